@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"maps"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/gorilla/websocket"
+)
+
+// The agent keeps a started connection warm for one-shot --ask runs: instead
+// of dialing, --agent runs send their question over a unix socket and the
+// agent answers it in a new session on its connection.
+
+var errAgentUnavailable = errors.New("agent unavailable")
+
+// agentStopSlack is how much longer than an answer "agent stop" waits for the
+// agent, which finishes the session in progress first.
+const agentStopSlack = 2 * time.Second
+
+// agentRequest is one JSON line sent to the agent.
+type agentRequest struct {
+	Command  string `json:"command"` // "ask" or "stop"
+	Question string `json:"question,omitempty"`
+}
+
+// agentResponse is the agent's JSON line answering an agentRequest.
+type agentResponse struct {
+	Text     string `json:"text,omitempty"`
+	Audio    []byte `json:"audio,omitempty"` // PCM S16LE
+	Stage    string `json:"stage,omitempty"`
+	ExitCode int    `json:"exit_code,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// defaultAgentSocket returns the socket path used when -agent-socket is empty.
+// The socket lives in a directory only the user can enter, so that no other
+// user can listen on it in place of the agent, or block the agent by creating
+// the socket first: $XDG_RUNTIME_DIR, or else a directory of the user's own in
+// the temp directory.
+func defaultAgentSocket() (string, error) {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "realtimedialog-agent.sock"), nil
+	}
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("realtimedialog-%d", os.Getuid()))
+	if err := os.Mkdir(dir, 0o700); err != nil && !errors.Is(err, fs.ErrExist) {
+		return "", fmt.Errorf("create agent directory: %w", err)
+	}
+	if err := checkPrivateDir(dir); err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "agent.sock"), nil
+}
+
+// checkPrivateDir returns an error unless dir is a directory, not a symlink,
+// that belongs to the user and that no one else may access.
+func checkPrivateDir(dir string) error {
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return fmt.Errorf("agent directory: %w", err)
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("agent directory %s is not a directory", dir)
+	}
+	if !privateToUser(fi) {
+		return fmt.Errorf("agent directory %s is not private to the user (mode %s)", dir, fi.Mode().Perm())
+	}
+	return nil
+}
+
+func agentSocketPath() (string, error) {
+	if *agentSocket != "" {
+		return *agentSocket, nil
+	}
+	return defaultAgentSocket()
+}
+
+// askAgent sends question to a running agent. It returns errAgentUnavailable
+// if no agent listens on the socket.
+func askAgent(ctx context.Context, question string) (*AskReply, error) {
+	resp, err := callAgent(ctx, agentRequest{Command: "ask", Question: question})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Error != "" {
+		return nil, &AskError{Stage: resp.Stage, ExitCode: resp.ExitCode, Err: errors.New(resp.Error)}
+	}
+	return &AskReply{Text: resp.Text, Audio: bytesToSamples(resp.Audio)}, nil
+}
+
+func callAgent(ctx context.Context, req agentRequest) (*agentResponse, error) {
+	path, err := agentSocketPath()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errAgentUnavailable, err)
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errAgentUnavailable, err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return nil, fmt.Errorf("send agent request: %w", err)
+	}
+	var resp agentResponse
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return nil, fmt.Errorf("read agent response: %w", err)
+	}
+	return &resp, nil
+}
+
+// startAgent launches "agent serve" in the background with the flags of this
+// run, so that later --agent runs find a warm connection.
+func startAgent() error {
+	path, err := agentSocketPath()
+	if err != nil {
+		return fmt.Errorf("start agent: %w", err)
+	}
+	cmd := exec.Command(os.Args[0], append(agentFlags(), "agent", "serve")...)
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("start agent: %w", err)
+	}
+	glog.Infof("Started agent (pid=%d) on %s", cmd.Process.Pid, path)
+	return cmd.Process.Release()
+}
+
+// agentFlags returns the flags set on this run that the agent inherits. A
+// repeatable flag is passed once per value.
+func agentFlags() []string {
+	var args []string
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "ask", "once", "ask-output", "agent", "dry-run", "validate":
+			return
+		}
+		if responses, ok := f.Value.(auditResponsesFlag); ok {
+			langs := slices.Sorted(maps.Keys(responses))
+			for _, lang := range langs {
+				args = append(args, fmt.Sprintf("-%s=%s=%s", f.Name, lang, responses[lang]))
+			}
+			return
+		}
+		args = append(args, fmt.Sprintf("-%s=%s", f.Name, f.Value))
+	})
+	return args
+}
+
+// runAgentCommand runs "agent serve" or "agent stop".
+func runAgentCommand(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: agent serve|stop")
+	}
+	switch args[0] {
+	case "serve":
+		return serveAgent(ctx)
+	case "stop":
+		ctx, cancel := context.WithTimeout(ctx, *askAnswerTimeout+agentStopSlack)
+		defer cancel()
+		resp, err := callAgent(ctx, agentRequest{Command: "stop"})
+		if err != nil {
+			return err
+		}
+		if resp.Error != "" {
+			return errors.New(resp.Error)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown agent command %q, want serve or stop", args[0])
+	}
+}
+
+// agent holds the warm connection. Questions are answered one at a time.
+type agent struct {
+	lock sync.Mutex
+	conn *websocket.Conn
+	idle *time.Timer
+	stop context.CancelFunc
+}
+
+// serveAgent answers questions on the agent socket until it is stopped, ctx is
+// done or no question arrived for -agent-idle.
+func serveAgent(ctx context.Context) error {
+	path, err := agentSocketPath()
+	if err != nil {
+		return err
+	}
+	// A socket file left by a crashed agent blocks Listen; a live agent
+	// answers the dial.
+	if c, err := net.Dial("unix", path); err == nil {
+		_ = c.Close()
+		return fmt.Errorf("an agent is already listening on %s", path)
+	}
+	_ = os.Remove(path)
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return fmt.Errorf("listen on agent socket: %w", err)
+	}
+	defer os.Remove(path)
+
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+	a := &agent{stop: stop, idle: time.AfterFunc(*agentIdle, stop)}
+	go func() {
+		<-ctx.Done()
+		_ = l.Close()
+	}()
+
+	a.lock.Lock()
+	if _, err := a.connect(ctx); err != nil {
+		// The next question retries; a bad configuration still fails there.
+		glog.Errorf("Agent failed to connect: %v", err)
+	}
+	a.lock.Unlock()
+	glog.Infof("Agent listening on %s, idle timeout %s", path, *agentIdle)
+
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			break
+		}
+		a.serve(ctx, c)
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.idle.Stop()
+	if a.conn != nil {
+		if err := finishConnection(a.conn); err != nil {
+			glog.Errorf("Failed to finish connection: %v", err)
+		}
+		_ = closeConn(a.conn)
+		a.conn = nil
+	}
+	glog.Info("Agent stopped.")
+	return nil
+}
+
+// connect returns the warm connection, dialing again if it was lost. The
+// caller holds a.lock.
+func (a *agent) connect(ctx context.Context) (*websocket.Conn, error) {
+	if a.conn != nil {
+		return a.conn, nil
+	}
+	conn, err := connectAsk(ctx)
+	if err != nil {
+		return nil, err
+	}
+	a.conn = conn
+	return conn, nil
+}
+
+// serve answers the single request on c. Requests are handled one after the
+// other, so a stop waits for the session in progress to finish. The idle timer
+// is held while a request is handled and starts again when it is answered.
+func (a *agent) serve(ctx context.Context, c net.Conn) {
+	defer c.Close()
+	var req agentRequest
+	if err := json.NewDecoder(c).Decode(&req); err != nil {
+		glog.Errorf("Read agent request: %v", err)
+		return
+	}
+
+	// 处理请求期间不计空闲，请求结束后重新计时
+	a.idle.Stop()
+	defer a.idle.Reset(*agentIdle)
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	var resp agentResponse
+	switch req.Command {
+	case "ask":
+		reply, err := a.ask(ctx, req.Question)
+		if err != nil {
+			resp.Error, resp.ExitCode = err.Error(), exitAskFailed
+			var askErr *AskError
+			if errors.As(err, &askErr) {
+				resp.Stage, resp.ExitCode = askErr.Stage, askErr.ExitCode
+			}
+		} else {
+			resp.Text, resp.Audio = reply.Text, samplesToBytes(reply.Audio)
+		}
+	case "stop":
+		a.stop()
+	default:
+		resp.Error = fmt.Sprintf("unknown agent command %q", req.Command)
+	}
+	if err := json.NewEncoder(c).Encode(resp); err != nil {
+		glog.Errorf("Write agent response: %v", err)
+	}
+}
+
+// ask answers question on the warm connection. A failed session drops the
+// connection so that the next question starts from a fresh one; if the warm
+// connection could not even start a session, e.g. because the server closed it
+// while idle, the question is retried once on a fresh connection.
+func (a *agent) ask(ctx context.Context, question string) (*AskReply, error) {
+	reused := a.conn != nil
+	conn, err := a.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := askSession(ctx, conn, question)
+	if err != nil {
+		_ = closeConn(conn)
+		a.conn = nil
+		var askErr *AskError
+		if reused && errors.As(err, &askErr) && askErr.ExitCode == exitAskSession {
+			glog.Warningf("Warm connection failed, retrying on a new one: %v", err)
+			return a.ask(ctx, question)
+		}
+	}
+	return reply, err
+}
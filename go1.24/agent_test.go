@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestAgentFlags checks that the agent inherits each -audit-response on its
+// own, and not the flags of the one-shot run.
+func TestAgentFlags(t *testing.T) {
+	t.Cleanup(func() { clear(auditResponses) })
+	for name, value := range map[string]string{"ask": "你好", "language": "en-US"} {
+		old := flag.Lookup(name).Value.String()
+		if err := flag.Set(name, value); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = flag.Set(name, old) })
+	}
+	for _, value := range []string{"en=Sorry, I can't answer that.", "ja=すみません"} {
+		if err := flag.Set("audit-response", value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	args := agentFlags()
+	for _, want := range []string{"-audit-response=en=Sorry, I can't answer that.", "-audit-response=ja=すみません", "-language=en-US"} {
+		if !slices.Contains(args, want) {
+			t.Errorf("agentFlags() = %q, missing %q", args, want)
+		}
+	}
+	for _, arg := range args {
+		if arg == "-ask=你好" {
+			t.Errorf("agentFlags() = %q, passes the question of the one-shot run", args)
+		}
+	}
+
+	// 代理按这些参数解析出的 -audit-response 与本次运行相同
+	parsed := auditResponsesFlag{}
+	fs := flag.NewFlagSet("agent", flag.ContinueOnError)
+	fs.Var(parsed, "audit-response", "")
+	var responses []string
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "-audit-response=") {
+			responses = append(responses, arg)
+		}
+	}
+	if err := fs.Parse(responses); err != nil {
+		t.Fatal(err)
+	}
+	if len(parsed) != 2 || parsed["en"] != "Sorry, I can't answer that." || parsed["ja"] != "すみません" {
+		t.Errorf("agent parses -audit-response as %v, want both entries", parsed)
+	}
+}
+
+// TestDefaultAgentSocket checks that the agent socket is placed in a directory
+// only the user can enter, and refused in one other users could get into.
+func TestDefaultAgentSocket(t *testing.T) {
+	runtimeDir := t.TempDir()
+	t.Setenv("XDG_RUNTIME_DIR", runtimeDir)
+	if path, err := defaultAgentSocket(); err != nil || filepath.Dir(path) != runtimeDir {
+		t.Errorf("defaultAgentSocket() = %q, %v, want a socket in $XDG_RUNTIME_DIR", path, err)
+	}
+
+	if runtime.GOOS == "windows" {
+		t.Skip("no file modes to check")
+	}
+	t.Setenv("XDG_RUNTIME_DIR", "")
+	t.Setenv("TMPDIR", t.TempDir())
+	path, err := defaultAgentSocket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0o700 {
+		t.Errorf("agent directory mode = %s, want -rwx------", fi.Mode().Perm())
+	}
+
+	// 其他用户可进入的目录里的 socket 可能被冒充
+	if err := os.Chmod(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if path, err := defaultAgentSocket(); err == nil {
+		t.Errorf("defaultAgentSocket() = %q in a directory of mode 0755, want an error", path)
+	}
+}
+
+// TestAgentIdleDuringAsk checks that the idle timer does not run while the
+// agent answers a question, and runs again once it has answered.
+func TestAgentIdleDuringAsk(t *testing.T) {
+	a := &agent{}
+	var idleDuringAsk atomic.Bool
+	s := newFakeServer(t, func(c *fakeConn) {
+		sid := c.handshake("dialog-1")
+		if c.expect(501) == nil {
+			return
+		}
+		// Stop 返回 true 说明计时器在回答期间仍在运行
+		idleDuringAsk.Store(a.idle.Stop())
+		c.answer(sid, "你好呀", 2400)
+		if c.expect(102) == nil {
+			return
+		}
+		c.send(serverFrame(152, sid, `{}`))
+	})
+	setupDialog(t, s)
+	ctx, stop := context.WithCancel(t.Context())
+	defer stop()
+	a.stop, a.idle = stop, time.AfterFunc(*agentIdle, stop)
+	t.Cleanup(func() {
+		a.idle.Stop()
+		if a.conn != nil {
+			_ = closeConn(a.conn)
+		}
+	})
+
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		a.serve(ctx, server)
+	}()
+	if err := json.NewEncoder(client).Encode(agentRequest{Command: "ask", Question: "你好"}); err != nil {
+		t.Fatal(err)
+	}
+	var resp agentResponse
+	if err := json.NewDecoder(client).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	if resp.Error != "" || resp.Text != "你好呀" {
+		t.Fatalf("agent answered %+v, want 你好呀", resp)
+	}
+	if idleDuringAsk.Load() {
+		t.Error("idle timer ran while the agent answered")
+	}
+	if !a.idle.Stop() {
+		t.Error("idle timer not running after the answer")
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+// Exit codes of a one-shot --ask --once run, one per stage so that scripts can
+// tell where it failed. They are apart from the exit codes of a dialog and
+// from 1 and 2, which glog.Exitf and invalid flags exit with.
+const (
+	exitAskConnect  = 20
+	exitAskSession  = 21
+	exitAskResponse = 22
+	exitAskAnswer   = 23
+	// exitAskFailed is any other failure of the question.
+	exitAskFailed = 24
+)
+
+// AskError reports the stage at which a one-shot question failed.
+type AskError struct {
+	Stage    string
+	ExitCode int
+	Err      error
+}
+
+func (e *AskError) Error() string {
+	if isTimeout(e.Err) {
+		return fmt.Sprintf("%s timed out: %v", e.Stage, e.Err)
+	}
+	return fmt.Sprintf("%s failed: %v", e.Stage, e.Err)
+}
+
+func (e *AskError) Unwrap() error {
+	return e.Err
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout())
+}
+
+// AskReply is the bot's complete answer to a one-shot question.
+type AskReply struct {
+	Text  string
+	Audio []int16
+	// Latency is the time from the end of the user turn, ASREnded or the
+	// start of receiving for a text query, to the first audio of the answer.
+	Latency time.Duration
+	// Turn holds the statistics of the answered turn; it is only set by
+	// AskTurn.
+	Turn Turn
+}
+
+// runAsk answers a single text question without touching any audio device: it
+// starts a session, sends the question as a text query, collects the spoken
+// answer until TTS ends and finishes the session again.
+func runAsk(ctx context.Context, question string) (*AskReply, error) {
+	conn, err := connectAsk(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = closeConn(conn)
+	}()
+
+	reply, err := askSession(ctx, conn, question)
+	if err != nil {
+		return nil, err
+	}
+	if err := finishConnection(conn); err != nil {
+		glog.Errorf("Failed to finish connection: %v", err)
+	}
+	return reply, nil
+}
+
+// connectAsk dials the service and performs StartConnection within
+// -ask-timeout.
+func connectAsk(ctx context.Context) (*websocket.Conn, error) {
+	dialCtx, cancel := context.WithTimeout(ctx, *askTimeout)
+	defer cancel()
+	conn, _, err := dial(dialCtx)
+	if err != nil {
+		return nil, &AskError{Stage: "connect", ExitCode: exitAskConnect, Err: err}
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(*askTimeout))
+	if err := startConnection(ctx, conn); err != nil {
+		_ = closeConn(conn)
+		return nil, &AskError{Stage: "connect", ExitCode: exitAskConnect, Err: err}
+	}
+	return conn, nil
+}
+
+// askSession answers question in a new session on the started connection
+// conn and finishes the session again, leaving the connection open.
+func askSession(ctx context.Context, conn *websocket.Conn, question string) (*AskReply, error) {
+	sessionID := uuid.New().String()
+	_ = conn.SetReadDeadline(time.Now().Add(*askTimeout))
+	if err := startSession(ctx, conn, sessionID, product.NewSessionPayload()); err != nil {
+		return nil, &AskError{Stage: "session", ExitCode: exitAskSession, Err: err}
+	}
+	if err := chatTextQuery(conn, sessionID, &ChatTextQueryPayload{Content: question}); err != nil {
+		return nil, &AskError{Stage: "session", ExitCode: exitAskSession, Err: err}
+	}
+
+	reply, err := receiveAnswer(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(*askTimeout))
+	if err := finishSession(conn, sessionID); err != nil {
+		glog.Errorf("Failed to finish session: %v", err)
+	} else if err := waitSessionFinished(conn); err != nil {
+		glog.Errorf("Failed to finish session: %v", err)
+	}
+	return reply, nil
+}
+
+// receiveAnswer reads the bot answer until TTS ends. The first response must
+// arrive within -ask-timeout, the complete answer within -ask-answer-timeout.
+func receiveAnswer(conn *websocket.Conn) (*AskReply, error) {
+	var (
+		reply    AskReply
+		started  bool
+		deadline = time.Now().Add(*askAnswerTimeout)
+		asked    = latencyClock()
+	)
+	_ = conn.SetReadDeadline(time.Now().Add(*askTimeout))
+	for {
+		msg, err := receiveMessage(conn)
+		if err != nil {
+			if !started {
+				return nil, &AskError{Stage: "waiting for the first response", ExitCode: exitAskResponse, Err: err}
+			}
+			return nil, &AskError{Stage: "waiting for the complete answer", ExitCode: exitAskAnswer, Err: err}
+		}
+		if !started {
+			started = true
+			_ = conn.SetReadDeadline(deadline)
+		}
+
+		switch msg.Type {
+		case MsgTypeError:
+			return nil, &AskError{Stage: "answer", ExitCode: exitAskAnswer, Err: handleServerError(msg)}
+		case MsgTypeAudioOnlyServer:
+			if reply.Audio == nil {
+				reply.Latency = latencyClock().Sub(asked)
+			}
+			reply.Audio = append(reply.Audio, pcmFloat32ToSamples(msg.Payload)...)
+		case MsgTypeFullServer:
+			switch msg.Event {
+			case 459: // ASREnded
+				asked = latencyClock()
+			case 550: // ChatResponse
+				var jsonData map[string]interface{}
+				_ = json.Unmarshal(msg.Payload, &jsonData)
+				if content, ok := jsonData["content"].(string); ok {
+					reply.Text += content
+				}
+			case 152, 153: // SessionFinished, SessionFailed
+				return nil, &AskError{Stage: "answer", ExitCode: exitAskAnswer, Err: fmt.Errorf("session ended early: %s", msg.Payload)}
+			}
+		}
+		if turnDetector.TurnComplete(msg) {
+			return &reply, nil
+		}
+	}
+}
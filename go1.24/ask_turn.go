@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/golang/glog"
+	"github.com/gorilla/websocket"
+)
+
+// ErrAskBusy is returned by AskTurn, AskAudioTurn and SendScriptedPrompts
+// while another of them is in progress, after WithRejectConcurrentAsk(true).
+var ErrAskBusy = errors.New("another AskTurn is in progress")
+
+// rejectConcurrentAsk makes AskTurn fail with ErrAskBusy instead of waiting
+// for the turn in progress.
+var rejectConcurrentAsk bool
+
+// WithRejectConcurrentAsk selects whether concurrent AskTurn calls queue up,
+// the default, or fail with ErrAskBusy.
+func WithRejectConcurrentAsk(reject bool) {
+	rejectConcurrentAsk = reject
+}
+
+// askSlot admits one AskTurn at a time.
+var askSlot = make(chan struct{}, 1)
+
+// askWaiter collects the answer to a pending AskTurn from the receive loop.
+type askWaiter struct {
+	// turnID is the turn the ask started; only its audio and its end are
+	// taken, not those of a turn still ending when the ask began.
+	turnID int
+	lock   sync.Mutex
+	audio  []int16
+	done   chan Turn
+	turn   Turn // set once done delivered it
+}
+
+var pendingAsk atomic.Pointer[askWaiter]
+
+func (w *askWaiter) addAudio(samples []int16) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.audio = append(w.audio, samples...)
+}
+
+// answerTurnFinished hands a finished turn to the pending AskTurn if the ask
+// started it. It is called from the receive loop when a turn ends, including
+// on barge-in.
+func answerTurnFinished(turn Turn) {
+	w := pendingAsk.Load()
+	if w == nil || w.turnID != turn.ID {
+		return
+	}
+	if pendingAsk.CompareAndSwap(w, nil) {
+		w.done <- turn
+	}
+}
+
+// answerAudio adds received TTS audio to the answer of the pending AskTurn
+// once the bot started answering its turn, so that audio of an answer still
+// arriving when the ask began is left out.
+func answerAudio(samples []int16) {
+	if w := pendingAsk.Load(); w != nil && turns.answeringTurn() == w.turnID {
+		w.addAudio(samples)
+	}
+}
+
+// AskTurn runs one full turn of a running dialog: it sends question as a text
+// query and blocks until the bot finished answering. The reply holds the bot
+// text, the spoken answer and the turn statistics. If ctx is done first the
+// bot answer is interrupted and ctx.Err() returned. The dialog's receive loop
+// (realtimeAPIOutputAudio) must be running. Concurrent calls are serialized,
+// or rejected with ErrAskBusy after WithRejectConcurrentAsk(true).
+func AskTurn(ctx context.Context, conn *websocket.Conn, sessionID, question string) (*AskReply, error) {
+	if err := acquireAskSlot(ctx); err != nil {
+		return nil, err
+	}
+	defer func() { <-askSlot }()
+
+	w, err := runTurn(ctx, conn, sessionID, question, func() error {
+		return chatTextQuery(conn, sessionID, &ChatTextQueryPayload{Content: question})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return w.reply(), nil
+}
+
+// AskAudioTurn is AskTurn for a spoken question: src is played as the user
+// with PlaySource, the dialog's input resuming at its end, and the call blocks
+// until the bot finished answering. The dialog must read its input through a
+// switchable source, as with -commands. If ctx is done first the bot answer
+// is interrupted; the rest of src is still played.
+func AskAudioTurn(ctx context.Context, conn *websocket.Conn, sessionID string, src AudioSource, name string) (*AskReply, error) {
+	if err := acquireAskSlot(ctx); err != nil {
+		return nil, err
+	}
+	defer func() { <-askSlot }()
+
+	w, err := runTurn(ctx, conn, sessionID, "", func() error {
+		return PlaySource(src, name)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return w.reply(), nil
+}
+
+func (w *askWaiter) reply() *AskReply {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return &AskReply{Text: w.turn.BotText, Audio: w.audio, Turn: w.turn}
+}
+
+// SendScriptedPrompts has the bot speak prompts one after the other, e.g. a
+// scripted intro: each prompt is sent as SayHello once the bot finished the
+// previous one, so the server never replaces a prompt still being spoken. If
+// ctx is done first the prompt being spoken is interrupted, the remaining
+// ones are skipped and ctx.Err() returned. Prompts are spaced at least by the
+// SayHello rate limit. Like AskTurn, it needs the receive loop and is
+// serialized with AskTurn calls.
+func SendScriptedPrompts(ctx context.Context, conn *websocket.Conn, sessionID string, prompts []string) error {
+	if err := acquireAskSlot(ctx); err != nil {
+		return err
+	}
+	defer func() { <-askSlot }()
+
+	for _, prompt := range prompts {
+		// 短提示可能早于 SayHello 限速间隔播完
+		if err := sayHelloLimiter.wait(ctx); err != nil {
+			return err
+		}
+		if _, err := runTurn(ctx, conn, sessionID, "", func() error {
+			return sayHello(conn, sessionID, &SayHelloPayload{Content: prompt})
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// acquireAskSlot waits for the turn in progress of another AskTurn, or fails
+// with ErrAskBusy after WithRejectConcurrentAsk(true).
+func acquireAskSlot(ctx context.Context) error {
+	if rejectConcurrentAsk {
+		select {
+		case askSlot <- struct{}{}:
+			return nil
+		default:
+			return ErrAskBusy
+		}
+	}
+	select {
+	case askSlot <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// runTurn starts a turn of userText with send and waits until the bot
+// finished it. A turn in progress is finished first, so that its end is not
+// taken for the answer. If ctx is done first the bot answer is interrupted.
+// The caller holds askSlot.
+func runTurn(ctx context.Context, conn *websocket.Conn, sessionID, userText string, send func() error) (*askWaiter, error) {
+	previous, finished, turnID := turns.begin(userText)
+	if finished {
+		logTurn(previous)
+	}
+	w := &askWaiter{turnID: turnID, done: make(chan Turn, 1)}
+	pendingAsk.Store(w)
+	if err := send(); err != nil {
+		pendingAsk.CompareAndSwap(w, nil)
+		return nil, err
+	}
+
+	select {
+	case turn := <-w.done:
+		w.turn = turn
+		return w, nil
+	case <-ctx.Done():
+		if pendingAsk.CompareAndSwap(w, nil) {
+			if err := clientInterrupt(conn, sessionID); err != nil {
+				glog.Errorf("Failed to interrupt answer of cancelled turn: %v", err)
+			}
+		}
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// startFakeDialog runs a dialog of session-1 against the server set up with
+// setupDialog in the background and waits until the session started. wait
+// waits for the dialog to end and returns what realTimeDialog returned.
+func startFakeDialog(t *testing.T) (conn *websocket.Conn, wait func() error) {
+	t.Helper()
+	conn = dialFake(t)
+	ended := make(chan error, 1)
+	go func() {
+		_, err := realTimeDialog(context.Background(), conn, "session-1")
+		ended <- err
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := sessionState.WaitReady(ctx); err != nil {
+		t.Fatalf("WaitReady() = %v", err)
+	}
+	return conn, func() error {
+		err := <-ended
+		if err := shutdownManager.GracefulShutdown(time.Second); err != nil {
+			t.Error(err)
+		}
+		return err
+	}
+}
+
+// waitFor polls cond until it holds, failing the test after 5s.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+// TestAskTurn asks a question while the greeting is still being answered and
+// checks that the reply is the answer to the question alone.
+func TestAskTurn(t *testing.T) {
+	s := newFakeServer(t, scriptedDialog(func(c *fakeConn, sid string) {
+		c.send(serverFrame(350, sid, `{"tts_type":"default"}`))
+		c.send(serverFrame(550, sid, `{"content":"你好"}`))
+		c.send(serverAudio(sid, make([]float32, 1200)))
+		if c.expect(501) == nil {
+			return
+		}
+		// 问候语的尾音在新问题之后才到达
+		c.send(serverAudio(sid, make([]float32, 600)))
+		c.answer(sid, "明天晴", 2400)
+	}))
+	_, speaker := setupDialog(t, s)
+	conn, wait := startFakeDialog(t)
+	waitFor(t, "the greeting", func() bool { return speaker.played() == 1200 })
+
+	reply, err := AskTurn(context.Background(), conn, "session-1", "明天天气怎么样")
+	if err != nil {
+		t.Fatalf("AskTurn() = %v", err)
+	}
+	if reply.Text != "明天晴" || len(reply.Audio) != 2400 {
+		t.Errorf("reply = %q with %d samples, want 明天晴 with 2400", reply.Text, len(reply.Audio))
+	}
+	if reply.Turn.UserText != "明天天气怎么样" || reply.Turn.ID != 2 {
+		t.Errorf("reply.Turn = %+v, want turn 2 of the question", reply.Turn)
+	}
+	if err := wait(); err == nil {
+		t.Error("realTimeDialog() = nil, want the server ending the session")
+	}
+	if got := turns.Transcript(); len(got) != 2 || got[0].BotText != "你好" {
+		t.Errorf("transcript = %+v, want the greeting and the question", got)
+	}
+}
+
+// TestAskAudioTurn speaks the question through the switchable input.
+func TestAskAudioTurn(t *testing.T) {
+	s := newFakeServer(t, scriptedDialog(func(c *fakeConn, sid string) {
+		c.answer(sid, "你好", 1200)
+		for {
+			msg := c.read()
+			if msg == nil {
+				c.t.Error("fake server: client hung up before speaking")
+				return
+			}
+			if msg.Type == MsgTypeAudioOnlyClient && len(msg.Payload) >= 2 && binary.LittleEndian.Uint16(msg.Payload) == 7 {
+				break
+			}
+		}
+		c.userTurn(sid, "你是谁")
+		c.answer(sid, "我是豆包", 2400)
+	}))
+	mic, _ := setupDialog(t, s)
+	audioSource = newSwitchSource(mic, "mic")
+	conn, wait := startFakeDialog(t)
+	waitFor(t, "the greeting", func() bool { return len(turns.Transcript()) == 1 })
+
+	question := make([]int16, inputFramesPerBuffer)
+	for i := range question {
+		question[i] = 7
+	}
+	reply, err := AskAudioTurn(context.Background(), conn, "session-1", &MemorySource{Frames: [][]int16{question}}, "question.wav")
+	if err != nil {
+		t.Fatalf("AskAudioTurn() = %v", err)
+	}
+	if reply.Text != "我是豆包" || len(reply.Audio) != 2400 || reply.Turn.UserText != "你是谁" {
+		t.Errorf("reply = %q with %d samples to %q, want 我是豆包 with 2400 to 你是谁", reply.Text, len(reply.Audio), reply.Turn.UserText)
+	}
+	_ = wait()
+}
+
+func TestAskTurnBusy(t *testing.T) {
+	setupDialog(t, nil)
+	WithRejectConcurrentAsk(true)
+	t.Cleanup(func() { WithRejectConcurrentAsk(false) })
+	askSlot <- struct{}{}
+	defer func() { <-askSlot }()
+	if _, err := AskTurn(context.Background(), nil, "session-1", "你好"); !errors.Is(err, ErrAskBusy) {
+		t.Errorf("AskTurn() during another = %v, want ErrAskBusy", err)
+	}
+	if _, err := AskAudioTurn(context.Background(), nil, "session-1", &MemorySource{}, "q.wav"); !errors.Is(err, ErrAskBusy) {
+		t.Errorf("AskAudioTurn() during another = %v, want ErrAskBusy", err)
+	}
+}
+
+// TestAnswerTurnFinishedOtherTurn checks that a pending ask ignores the end
+// of a turn it did not start, e.g. the one the user barged in on.
+func TestAnswerTurnFinishedOtherTurn(t *testing.T) {
+	w := &askWaiter{turnID: 2, done: make(chan Turn, 1)}
+	pendingAsk.Store(w)
+	t.Cleanup(func() { pendingAsk.Store(nil) })
+	answerTurnFinished(Turn{ID: 1})
+	if pendingAsk.Load() != w || len(w.done) != 0 {
+		t.Fatal("the end of turn 1 resolved the ask of turn 2")
+	}
+	answerTurnFinished(Turn{ID: 2, BotText: "好的"})
+	if got := <-w.done; got.BotText != "好的" || pendingAsk.Load() != nil {
+		t.Errorf("ask resolved with %+v, want turn 2", got)
+	}
+}
+
+// sayHelloContent returns the content of a SayHello request.
+func sayHelloContent(c *fakeConn, msg *Message) string {
+	var payload SayHelloPayload
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+		c.t.Errorf("fake server: decode SayHello: %v", err)
+	}
+	return payload.Content
+}
+
+// TestSendScriptedPrompts checks that the prompts are sent in order, each
+// once the bot finished speaking the previous one.
+func TestSendScriptedPrompts(t *testing.T) {
+	prompts := []string{"欢迎光临", "今天有优惠", "请问需要什么"}
+	received := make(chan string, len(prompts))
+	s := newFakeServer(t, scriptedDialog(func(c *fakeConn, sid string) {
+		c.answer(sid, "你好", 1200)
+		for range prompts {
+			msg := c.expect(300)
+			if msg == nil {
+				return
+			}
+			content := sayHelloContent(c, msg)
+			received <- content
+			c.answer(sid, content, 240)
+		}
+	}))
+	setupDialog(t, s)
+	conn, wait := startFakeDialog(t)
+	waitFor(t, "the greeting", func() bool { return len(turns.Transcript()) == 1 })
+
+	if err := SendScriptedPrompts(context.Background(), conn, "session-1", prompts); err != nil {
+		t.Fatalf("SendScriptedPrompts() = %v", err)
+	}
+	_ = wait()
+	close(received)
+	if got := drain(received); !slices.Equal(got, prompts) {
+		t.Errorf("server got prompts %q, want %q", got, prompts)
+	}
+	var spoken []string
+	for _, turn := range turns.Transcript()[1:] {
+		spoken = append(spoken, turn.BotText)
+	}
+	if !slices.Equal(spoken, prompts) {
+		t.Errorf("turns spoke %q, want %q", spoken, prompts)
+	}
+}
+
+// TestSendScriptedPromptsCanceled cancels the prompts while the second one is
+// spoken and checks that the third is never sent.
+func TestSendScriptedPromptsCanceled(t *testing.T) {
+	received := make(chan string, 3)
+	s := newFakeServer(t, func(c *fakeConn) {
+		sid := c.handshake("dialog-1")
+		if c.expect(300) == nil {
+			return
+		}
+		c.answer(sid, "你好", 1200)
+		for msg := c.read(); msg != nil; msg = c.read() {
+			switch msg.Event {
+			case 300:
+				content := sayHelloContent(c, msg)
+				received <- content
+				if content == "第一句" {
+					c.answer(sid, content, 240)
+				} else {
+					// 第二句一直说不完
+					c.send(serverFrame(350, sid, `{"tts_type":"default"}`))
+					c.send(serverFrame(550, sid, `{"content":"`+content+`"}`))
+				}
+			case 102:
+				c.send(serverFrame(152, sid, `{}`))
+			case 2:
+				c.send(serverFrame(52, "conn-1", `{}`))
+				return
+			}
+		}
+	})
+	setupDialog(t, s)
+	conn, wait := startFakeDialog(t)
+	waitFor(t, "the greeting", func() bool { return len(turns.Transcript()) == 1 })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sent := make(chan error, 1)
+	go func() {
+		sent <- SendScriptedPrompts(ctx, conn, "session-1", []string{"第一句", "第二句", "第三句"})
+	}()
+	waitFor(t, "the second prompt", func() bool { return len(received) == 2 })
+	cancel()
+	if err := <-sent; !errors.Is(err, context.Canceled) {
+		t.Errorf("SendScriptedPrompts() = %v, want context.Canceled", err)
+	}
+	if err := shutdownManager.GracefulShutdown(time.Second); err != nil {
+		t.Error(err)
+	}
+	_ = wait()
+	close(received)
+	if got := drain(received); !slices.Equal(got, []string{"第一句", "第二句"}) {
+		t.Errorf("server got prompts %q, want the first two", got)
+	}
+}
+
+// drain returns the values left in ch, which must be closed.
+func drain(ch <-chan string) []string {
+	var values []string
+	for v := range ch {
+		values = append(values, v)
+	}
+	return values
+}
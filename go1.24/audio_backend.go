@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var errNoAudioBackend = errors.New("no audio device backend in this build, it needs cgo")
+
+// AudioBackend opens the audio devices used for the "mic" input and the
+// "speaker" output. Open is called once before the first device is opened and
+// Close once all of them are closed.
+type AudioBackend interface {
+	Open() error
+	NewSource() (AudioSource, error)
+	NewSink() (AudioSink, error)
+	Close() error
+}
+
+// OutputDeviceBackend is implemented by an AudioBackend that can play on an
+// output device other than the default one.
+type OutputDeviceBackend interface {
+	NewSinkOn(device string) (AudioSink, error)
+}
+
+// audioBackend opens the audio devices. Builds without cgo have none, which
+// leaves file and pipe input and output, so that they cross-compile.
+var audioBackend = defaultAudioBackend
+
+// WithAudioBackend makes b open the audio devices instead of PortAudio.
+func WithAudioBackend(b AudioBackend) {
+	audioBackend = b
+}
+
+// AudioDevice describes an opened audio device stream as reported by the
+// backend, which may differ from what was requested.
+type AudioDevice struct {
+	Name       string
+	SampleRate float64
+	Channels   int
+	Latency    time.Duration
+}
+
+// AudioDevices holds the devices in use. A zero AudioDevice means the
+// direction does not use a device, e.g. with file input or output.
+type AudioDevices struct {
+	Input  AudioDevice
+	Output AudioDevice
+}
+
+var (
+	audioDevicesLock sync.Mutex
+	audioDevices     AudioDevices
+)
+
+// AudioDeviceInfo returns the audio devices opened for the dialog.
+func AudioDeviceInfo() AudioDevices {
+	audioDevicesLock.Lock()
+	defer audioDevicesLock.Unlock()
+	return audioDevices
+}
+
+// AudioDeviceReporter is implemented by the sources and sinks of an
+// AudioBackend other than PortAudio to report the device they opened, which
+// AudioDeviceInfo then returns. PortAudio streams register themselves.
+type AudioDeviceReporter interface {
+	AudioDevice() AudioDevice
+}
+
+// reportDevice registers the device of src or sink, whichever is not nil,
+// if it reports one.
+func reportDevice(src AudioSource, sink AudioSink) {
+	if r, ok := src.(AudioDeviceReporter); ok {
+		input := r.AudioDevice()
+		updateAudioDevices(func(d *AudioDevices) { d.Input = input })
+	}
+	if r, ok := sink.(AudioDeviceReporter); ok {
+		output := r.AudioDevice()
+		updateAudioDevices(func(d *AudioDevices) { d.Output = output })
+	}
+}
+
+// updateAudioDevices applies update to the devices in use.
+func updateAudioDevices(update func(*AudioDevices)) {
+	audioDevicesLock.Lock()
+	defer audioDevicesLock.Unlock()
+	update(&audioDevices)
+}
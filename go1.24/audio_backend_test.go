@@ -0,0 +1,53 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestAudioDeviceInfo opens the mic and the speaker of a fake backend and
+// checks that AudioDeviceInfo returns what the devices reported, and nothing
+// with file input and output.
+func TestAudioDeviceInfo(t *testing.T) {
+	resetDevices := func() { updateAudioDevices(func(d *AudioDevices) { *d = AudioDevices{} }) }
+	t.Cleanup(func() {
+		WithAudioBackend(defaultAudioBackend)
+		resetDevices()
+	})
+	want := AudioDevices{
+		Input:  AudioDevice{Name: "Fake Mic", SampleRate: 16000, Channels: 2, Latency: 5 * time.Millisecond},
+		Output: AudioDevice{Name: "Fake Speaker", SampleRate: 48000, Channels: 1, Latency: 20 * time.Millisecond},
+	}
+	WithAudioBackend(fakeBackend{input: want.Input, output: want.Output})
+
+	src, err := newAudioSource("mic")
+	if err != nil {
+		t.Fatalf(`newAudioSource("mic") = %v`, err)
+	}
+	defer src.Close()
+	sink, err := newAudioSink("speaker")
+	if err != nil {
+		t.Fatalf(`newAudioSink("speaker") = %v`, err)
+	}
+	defer sink.Close()
+	if got := AudioDeviceInfo(); got != want {
+		t.Errorf("AudioDeviceInfo() = %+v, want %+v", got, want)
+	}
+
+	resetDevices()
+	path := filepath.Join(t.TempDir(), "out.pcm")
+	fileSink, err := newAudioSink(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fileSink.Close()
+	fileSource, err := newAudioSource(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fileSource.Close()
+	if got := AudioDeviceInfo(); got != (AudioDevices{}) {
+		t.Errorf("AudioDeviceInfo() with files = %+v, want no devices", got)
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	inputSampleRate      = 16000
+	inputFramesPerBuffer = 160
+)
+
+// AudioSource provides uplink audio as frames of 16-bit mono PCM sampled at
+// inputSampleRate. ReadFrame blocks until a frame is available and returns
+// io.EOF once the source is exhausted.
+type AudioSource interface {
+	ReadFrame(ctx context.Context) ([]int16, error)
+	Close() error
+}
+
+// AudioSink consumes downlink audio as 16-bit mono PCM sampled at sampleRate.
+type AudioSink interface {
+	WriteFrame(samples []int16) error
+	// Flush ends the audio written so far: playback sinks drop whatever is
+	// still queued (e.g. when the user barges in), writer sinks push buffered
+	// bytes to the underlying writer.
+	Flush() error
+	Close() error
+}
+
+var (
+	audioSource AudioSource
+	audioSink   AudioSink
+)
+
+// WithAudioSource makes the dialog send the audio read from src, e.g. an RTP
+// or WebRTC receiver. The dialog closes src when it stops sending.
+func WithAudioSource(src AudioSource) {
+	audioSource = src
+}
+
+// WithAudioSink makes the dialog play the bot audio on sink. All processing,
+// e.g. the silence trimming of recordings, happens before the audio reaches
+// sink, so that it works with any sink.
+func WithAudioSink(sink AudioSink) {
+	audioSink = sink
+}
+
+// newAudioSource returns the source described by spec: "mic" for the default
+// input device, "-" for raw PCM on stdin, anything else is a file path.
+func newAudioSource(spec string) (AudioSource, error) {
+	switch spec {
+	case "mic":
+		if audioBackend == nil {
+			return nil, errNoAudioBackend
+		}
+		src, err := audioBackend.NewSource()
+		if err == nil {
+			reportDevice(src, nil)
+		}
+		return src, err
+	case "-":
+		return NewPipeSource(os.Stdin), nil
+	default:
+		return NewFileSource(spec)
+	}
+}
+
+// newAudioSink returns the sink described by spec: "speaker" for the default
+// output device, "-" for raw PCM on stdout, anything else is a file path. A
+// playback command set with WithPlaybackCommand takes precedence.
+func newAudioSink(spec string) (AudioSink, error) {
+	if len(playbackCommand) > 0 {
+		return NewCommandSink(playbackCommand)
+	}
+	switch spec {
+	case "speaker":
+		if audioBackend == nil {
+			return nil, errNoAudioBackend
+		}
+		sink, err := audioBackend.NewSink()
+		if err == nil {
+			reportDevice(nil, sink)
+		}
+		return sink, err
+	case "-":
+		return NewPipeSink(os.Stdout), nil
+	default:
+		return NewFileSink(spec)
+	}
+}
+
+// readerSource reads raw PCM S16LE frames from an io.Reader.
+type readerSource struct {
+	r      *bufio.Reader
+	closer io.Closer
+}
+
+// NewFileSource returns a source reading raw PCM S16LE from the file at path,
+// or a WAV file, which must be 16-bit PCM mono at inputSampleRate.
+func NewFileSource(path string) (AudioSource, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open audio input file: %w", err)
+	}
+	r := bufio.NewReader(f)
+	if header, err := r.Peek(4); err == nil && string(header) == "RIFF" {
+		if err := readWAVHeader(r, inputSampleRate, 1); err != nil {
+			_ = f.Close()
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return &readerSource{r: r, closer: f}, nil
+}
+
+// NewPipeSource returns a source reading raw PCM S16LE from r, e.g. stdin.
+func NewPipeSource(r io.Reader) AudioSource {
+	return &readerSource{r: bufio.NewReader(r)}
+}
+
+func (s *readerSource) ReadFrame(ctx context.Context) ([]int16, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, inputFramesPerBuffer*2)
+	n, err := io.ReadFull(s.r, buf)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		err = nil
+	}
+	if n == 0 && err == nil {
+		err = io.EOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	return bytesToSamples(buf[:n-n%2]), nil
+}
+
+func (s *readerSource) Close() error {
+	if s.closer == nil {
+		return nil
+	}
+	return s.closer.Close()
+}
+
+// writerSink writes raw PCM S16LE frames to an io.Writer.
+type writerSink struct {
+	w      *bufio.Writer
+	closer io.Closer
+	// trim holds back silence until louder audio follows, so that Flush
+	// and Close can trim the trailing silence of an answer.
+	trim    bool
+	pending []int16
+}
+
+// NewFileSink returns a sink writing raw PCM S16LE to the file at path.
+func NewFileSink(path string) (AudioSink, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("create audio output file: %w", err)
+	}
+	return &writerSink{w: bufio.NewWriter(f), closer: f, trim: recordTrimThreshold > 0}, nil
+}
+
+// NewPipeSink returns a sink writing raw PCM S16LE to w, e.g. stdout.
+func NewPipeSink(w io.Writer) AudioSink {
+	return &writerSink{w: bufio.NewWriter(w)}
+}
+
+func (s *writerSink) WriteFrame(samples []int16) error {
+	if !s.trim {
+		_, err := s.w.Write(samplesToBytes(samples))
+		return err
+	}
+	end := loudEnd(samples, recordTrimThreshold)
+	if end == 0 {
+		s.pending = append(s.pending, samples...)
+		return nil
+	}
+	if _, err := s.w.Write(samplesToBytes(append(s.pending, samples[:end]...))); err != nil {
+		return err
+	}
+	s.pending = append(s.pending[:0], samples[end:]...)
+	return nil
+}
+
+// writeTrimmed writes the silence held back, trimmed, as the end of an answer.
+func (s *writerSink) writeTrimmed() error {
+	if len(s.pending) == 0 {
+		return nil
+	}
+	_, err := s.w.Write(samplesToBytes(trimTrailingSilence(s.pending, recordTrimThreshold)))
+	s.pending = s.pending[:0]
+	return err
+}
+
+func (s *writerSink) Flush() error {
+	if err := s.writeTrimmed(); err != nil {
+		return err
+	}
+	return s.w.Flush()
+}
+
+func (s *writerSink) Close() error {
+	err := s.writeTrimmed()
+	if ferr := s.w.Flush(); err == nil {
+		err = ferr
+	}
+	if s.closer != nil {
+		if cerr := s.closer.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// MemorySource replays a fixed list of frames and then reports io.EOF.
+type MemorySource struct {
+	mu     sync.Mutex
+	Frames [][]int16
+}
+
+func (s *MemorySource) ReadFrame(ctx context.Context) ([]int16, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.Frames) == 0 {
+		return nil, io.EOF
+	}
+	frame := s.Frames[0]
+	s.Frames = s.Frames[1:]
+	return frame, nil
+}
+
+func (s *MemorySource) Close() error {
+	return nil
+}
+
+// silenceSource produces silent frames in real time, standing in for an input
+// that ended while the dialog goes on.
+type silenceSource struct{}
+
+func (silenceSource) ReadFrame(ctx context.Context) ([]int16, error) {
+	t := time.NewTimer(time.Duration(inputFramesPerBuffer) * time.Second / inputSampleRate)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-t.C:
+		return make([]int16, inputFramesPerBuffer), nil
+	}
+}
+
+func (silenceSource) Close() error {
+	return nil
+}
+
+// MemorySink collects every frame written to it.
+type MemorySink struct {
+	mu     sync.Mutex
+	frames [][]int16
+}
+
+func (s *MemorySink) WriteFrame(samples []int16) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.frames = append(s.frames, append([]int16(nil), samples...))
+	return nil
+}
+
+func (s *MemorySink) Flush() error {
+	return nil
+}
+
+func (s *MemorySink) Close() error {
+	return nil
+}
+
+// Frames returns a copy of the frames written so far.
+func (s *MemorySink) Frames() [][]int16 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([][]int16(nil), s.frames...)
+}
+
+// bytesToSamples decodes PCM S16LE bytes.
+func bytesToSamples(data []byte) []int16 {
+	samples := make([]int16, len(data)/2)
+	for i := range samples {
+		samples[i] = int16(binary.LittleEndian.Uint16(data[i*2:]))
+	}
+	return samples
+}
+
+// samplesToBytes encodes samples as PCM S16LE.
+func samplesToBytes(samples []int16) []byte {
+	data := make([]byte, len(samples)*2)
+	for i, sample := range samples {
+		binary.LittleEndian.PutUint16(data[i*2:], uint16(sample))
+	}
+	return data
+}
+
+// pcmFloat32ToSamples converts PCM float32 little endian bytes in [-1, 1] to
+// int16 samples. It runs for every downlink audio frame, so it decodes in a
+// single pass and allocates only the result.
+func pcmFloat32ToSamples(data []byte) []int16 {
+	samples := make([]int16, len(data)/4)
+	for i := range samples {
+		v := math.Float32frombits(binary.LittleEndian.Uint32(data[i*4:]))
+		if v > 1 {
+			v = 1
+		} else if v < -1 || v != v { // NaN
+			v = -1
+		}
+		samples[i] = int16(float64(v) * math.MaxInt16)
+	}
+	return samples
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"slices"
+	"testing"
+)
+
+// float32Bytes encodes samples as PCM float32 little endian.
+func float32Bytes(samples ...float32) []byte {
+	data := make([]byte, 0, len(samples)*4)
+	for _, s := range samples {
+		data = binary.LittleEndian.AppendUint32(data, math.Float32bits(s))
+	}
+	return data
+}
+
+func TestPCMFloat32ToSamples(t *testing.T) {
+	nan := float32(math.NaN())
+	got := pcmFloat32ToSamples(float32Bytes(0, 1, -1, 0.5, 2, -2, nan))
+	want := []int16{0, math.MaxInt16, -math.MaxInt16, math.MaxInt16 / 2, math.MaxInt16, -math.MaxInt16, -math.MaxInt16}
+	if !slices.Equal(got, want) {
+		t.Errorf("pcmFloat32ToSamples() = %v, want %v", got, want)
+	}
+	if got := pcmFloat32ToSamples([]byte{1, 2, 3}); len(got) != 0 {
+		t.Errorf("pcmFloat32ToSamples(3 bytes) = %v, want no samples", got)
+	}
+}
+
+// BenchmarkPCMFloat32ToSamples converts a typical TTS chunk of 40ms.
+func BenchmarkPCMFloat32ToSamples(b *testing.B) {
+	data := float32Bytes(make([]float32, sampleRate/25)...)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for b.Loop() {
+		pcmFloat32ToSamples(data)
+	}
+}
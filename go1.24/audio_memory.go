@@ -0,0 +1,104 @@
+package main
+
+import (
+	"os"
+	"sync/atomic"
+
+	"github.com/golang/glog"
+)
+
+// recordingFile is where the bot audio of the last turn is saved on exit.
+const recordingFile = "output.pcm"
+
+var (
+	audioMemoryLimit int64
+	// audioMemoryUsed counts the bytes of audio held by the buffers under the
+	// cap: the recording, the playback buffer and the memory queue of a
+	// spool sink.
+	audioMemoryUsed atomic.Int64
+	// recordingSpill is recordingFile while the recording of the current
+	// turn spills to disk, nil otherwise. Only the receive loop uses it.
+	recordingSpill *os.File
+)
+
+// WithAudioMemoryLimit caps the audio held in memory, i.e. the recording of
+// the bot answer, the playback buffer and the memory queue of a spool sink,
+// at bytes. At the cap the recording spills to its file on disk, the spool
+// sink queues in its spool file and the playback buffer drops its oldest
+// audio; 0 disables the cap.
+func WithAudioMemoryLimit(bytes int64) {
+	audioMemoryLimit = bytes
+}
+
+// AudioMemoryUsage returns how many bytes of audio are held in memory.
+func AudioMemoryUsage() int64 {
+	return audioMemoryUsed.Load()
+}
+
+// reserveAudioMemory counts n more bytes of audio held in memory. It fails,
+// counting nothing, if that would exceed the audio memory limit.
+func reserveAudioMemory(n int64) bool {
+	for {
+		used := audioMemoryUsed.Load()
+		if audioMemoryLimit > 0 && used+n > audioMemoryLimit {
+			return false
+		}
+		if audioMemoryUsed.CompareAndSwap(used, used+n) {
+			return true
+		}
+	}
+}
+
+// releaseAudioMemory uncounts n bytes of audio no longer held in memory.
+func releaseAudioMemory(n int64) {
+	audioMemoryUsed.Add(-n)
+}
+
+// recordAudio appends received bot audio to the recording, spilling the
+// recording to disk first if it would exceed the audio memory limit.
+func recordAudio(data []byte) {
+	n := int64(len(data))
+	if !reserveAudioMemory(n) {
+		if len(audio) > 0 {
+			spillRecording()
+		}
+		// 落盘后新到的音频仍先放在内存里，下次超限时一起写入文件
+		audioMemoryUsed.Add(n)
+	}
+	audio = append(audio, data...)
+}
+
+// resetRecording drops the recording, e.g. when a new turn starts, including
+// the part of it spilled to recordingFile.
+func resetRecording() {
+	releaseAudioMemory(int64(len(audio)))
+	audio = audio[:0]
+	if recordingSpill != nil {
+		_ = recordingSpill.Close()
+		recordingSpill = nil
+		// 否则本轮没有音频时，文件里留下的是上一轮的录音
+		if err := os.Remove(recordingFile); err != nil {
+			glog.Errorf("Failed to remove spilled recording: %v", err)
+		}
+	}
+}
+
+// spillRecording moves the recording in memory to recordingFile. On failure
+// the recording stays in memory.
+func spillRecording() {
+	if recordingSpill == nil {
+		f, err := os.Create(recordingFile)
+		if err != nil {
+			glog.Errorf("Failed to spill recording: %v", err)
+			return
+		}
+		glog.Infof("Audio memory limit of %d bytes reached, spilling recording to %s", audioMemoryLimit, recordingFile)
+		recordingSpill = f
+	}
+	if _, err := recordingSpill.Write(audio); err != nil {
+		glog.Errorf("Failed to spill recording: %v", err)
+		return
+	}
+	releaseAudioMemory(int64(len(audio)))
+	audio = nil
+}
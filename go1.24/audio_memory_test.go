@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+// setAudioMemoryLimit sets the audio memory limit for the test, starting
+// from no audio held.
+func setAudioMemoryLimit(t *testing.T, bytes int64) {
+	audioMemoryUsed.Store(0)
+	WithAudioMemoryLimit(bytes)
+	t.Cleanup(func() {
+		WithAudioMemoryLimit(0)
+		audioMemoryUsed.Store(0)
+	})
+}
+
+// TestRecordingSpills records more than the limit and checks that the
+// recording spills to disk instead of holding more than the limit.
+func TestRecordingSpills(t *testing.T) {
+	t.Chdir(t.TempDir())
+	setAudioMemoryLimit(t, 1000)
+	audio = nil
+	t.Cleanup(resetRecording)
+
+	for range 10 {
+		recordAudio(make([]byte, 400))
+		if used := AudioMemoryUsage(); used > 1000 {
+			t.Fatalf("AudioMemoryUsage() = %d, over the limit of 1000", used)
+		}
+	}
+	if used := AudioMemoryUsage(); used != int64(len(audio)) {
+		t.Errorf("AudioMemoryUsage() = %d, want the %d bytes of the recording", used, len(audio))
+	}
+	info, err := os.Stat(recordingFile)
+	if err != nil || info.Size()+int64(len(audio)) != 4000 {
+		t.Errorf("spilled %v bytes (%v) and kept %d, want 4000 in all", info, err, len(audio))
+	}
+	resetRecording()
+	if used := AudioMemoryUsage(); used != 0 {
+		t.Errorf("AudioMemoryUsage() after reset = %d, want 0", used)
+	}
+}
+
+// TestSpilledRecordingReset spills a turn to disk, resets the recording for
+// a turn without audio and checks that no audio of the earlier turn is saved.
+func TestSpilledRecordingReset(t *testing.T) {
+	t.Chdir(t.TempDir())
+	setAudioMemoryLimit(t, 1000)
+	audio = nil
+	t.Cleanup(resetRecording)
+
+	for range 5 {
+		recordAudio(make([]byte, 400))
+	}
+	if _, err := os.Stat(recordingFile); err != nil {
+		t.Fatalf("recording not spilled: %v", err)
+	}
+	resetRecording()
+	saveAudioToPCMFile(recordingFile)
+	if info, err := os.Stat(recordingFile); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("%s of the earlier turn left behind: %v, %v", recordingFile, info, err)
+	}
+}
+
+// downSink is an AudioSink whose consumer is away.
+type downSink struct{}
+
+func (downSink) WriteFrame([]int16) error { return errors.New("consumer away") }
+func (downSink) Flush() error             { return nil }
+func (downSink) Close() error             { return nil }
+
+// TestSpoolMemoryCapped checks that the memory queue of a spool sink stops
+// at the audio memory limit and queues the rest in its spool file.
+func TestSpoolMemoryCapped(t *testing.T) {
+	setAudioMemoryLimit(t, 1000)
+	sink := NewSpoolSink(downSink{}, SpoolConfig{Dir: t.TempDir()}).(*spoolSink)
+	defer sink.Close()
+
+	for range 10 {
+		if err := sink.WriteFrame(make([]int16, 200)); err != nil {
+			t.Fatal(err)
+		}
+		if used := AudioMemoryUsage(); used > 1000 {
+			t.Fatalf("AudioMemoryUsage() = %d, over the limit of 1000", used)
+		}
+	}
+	sink.lock.Lock()
+	memory, spooled := sink.memorySamples, sink.fileSamples
+	sink.lock.Unlock()
+	if memory != 400 || spooled != 1600 {
+		t.Errorf("queued %d samples in memory and %d in the spool file, want 400 and 1600", memory, spooled)
+	}
+	if err := sink.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if used := AudioMemoryUsage(); used != 0 {
+		t.Errorf("AudioMemoryUsage() after Flush = %d, want 0", used)
+	}
+}
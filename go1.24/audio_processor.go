@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"math"
+	"sync"
+	"sync/atomic"
+)
+
+// AudioProcessor transforms a frame of 16-bit PCM microphone samples before it
+// is sent to the server. Implementations may modify samples in place and
+// return it. Returning an empty frame drops it.
+type AudioProcessor interface {
+	Process(samples []int16) []int16
+}
+
+// inputProcessors is the chain applied, in order, to every captured frame.
+var inputProcessors []AudioProcessor
+
+// WithInputProcessor appends p to the chain of processors applied to the
+// microphone input.
+func WithInputProcessor(p AudioProcessor) {
+	inputProcessors = append(inputProcessors, p)
+}
+
+func processInput(samples []int16) []int16 {
+	for _, p := range inputProcessors {
+		if len(samples) == 0 {
+			break
+		}
+		samples = p.Process(samples)
+	}
+	return samples
+}
+
+// GainStage applies a linear gain of GainDB decibels to every sample, clipping
+// at ±32767. Positive values amplify (6dB roughly doubles the amplitude),
+// negative values attenuate.
+type GainStage struct {
+	GainDB float64
+}
+
+// Process implements AudioProcessor.
+func (g GainStage) Process(samples []int16) []int16 {
+	gain := math.Pow(10, g.GainDB/20)
+	for i, sample := range samples {
+		v := math.Round(float64(sample) * gain)
+		if v > math.MaxInt16 {
+			v = math.MaxInt16
+		} else if v < -math.MaxInt16 {
+			v = -math.MaxInt16
+		}
+		samples[i] = int16(v)
+	}
+	return samples
+}
+
+// DeduplicationFilter drops frames identical to one of the last WindowSize
+// frames, e.g. a buffer queued twice after a retry, which would confuse ASR.
+// Frames are compared by their FNV-1a hash. Digital silence is never dropped,
+// as consecutive silent frames are legitimately identical.
+type DeduplicationFilter struct {
+	WindowSize int
+
+	lock    sync.Mutex
+	hashes  []uint64 // ring buffer of the recent frame hashes
+	next    int
+	dropped atomic.Uint64
+}
+
+// Process implements AudioProcessor.
+func (f *DeduplicationFilter) Process(samples []int16) []int16 {
+	if f.WindowSize <= 0 || isSilent(samples) {
+		return samples
+	}
+	h := fnv.New64a()
+	_ = binary.Write(h, binary.LittleEndian, samples)
+	sum := h.Sum64()
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for _, seen := range f.hashes {
+		if seen == sum {
+			f.dropped.Add(1)
+			return nil
+		}
+	}
+	if len(f.hashes) < f.WindowSize {
+		f.hashes = append(f.hashes, sum)
+	} else {
+		f.hashes[f.next] = sum
+		f.next = (f.next + 1) % f.WindowSize
+	}
+	return samples
+}
+
+// DuplicatesDropped returns the number of frames dropped as duplicates.
+func (f *DeduplicationFilter) DuplicatesDropped() uint64 {
+	return f.dropped.Load()
+}
+
+func isSilent(samples []int16) bool {
+	for _, s := range samples {
+		if s != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/golang/glog"
+	"github.com/gorilla/websocket"
+)
+
+// ErrInvalidAuditTemplate is returned for an audit response template that
+// does not parse or execute.
+var ErrInvalidAuditTemplate = errors.New("invalid audit response template")
+
+// AuditTemplateContext holds the variables available to
+// DialogPayload.AuditResponseTemplate, e.g. {{.UserName}} or {{.SessionID}}.
+type AuditTemplateContext struct {
+	UserName  string
+	SessionID string
+	BotName   string
+}
+
+// renderAuditResponse executes the audit response template text with ctx.
+func renderAuditResponse(text string, ctx AuditTemplateContext) (string, error) {
+	tmpl, err := template.New("audit_response").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidAuditTemplate, err)
+	}
+	var sb strings.Builder
+	if err := tmpl.Execute(&sb, ctx); err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidAuditTemplate, err)
+	}
+	return sb.String(), nil
+}
+
+// localizedAuditResponse returns the audit response for language: an exact
+// match first, then its base language ("en" for "en-US"), then the response
+// under the empty key. ok is false if none applies.
+func localizedAuditResponse(responses map[string]string, language string) (text string, ok bool) {
+	if text, ok := responses[language]; ok {
+		return text, true
+	}
+	if base, _, found := strings.Cut(language, "-"); found {
+		if text, ok := responses[base]; ok {
+			return text, true
+		}
+	}
+	text, ok = responses[""]
+	return text, ok
+}
+
+// applyAuditResponseTemplate stores the audit response localized for the
+// dialog's language, then renders its audit response template, if any, into a
+// copy of its extra parameters as "audit_response". Without a localized
+// response for the language the existing "audit_response" is kept.
+func applyAuditResponseTemplate(dialog *DialogPayload, sessionID string) error {
+	localized, ok := localizedAuditResponse(dialog.AuditResponses, dialog.Language)
+	if !ok && dialog.AuditResponseTemplate == "" {
+		return nil
+	}
+	text := localized
+	if dialog.AuditResponseTemplate != "" {
+		var err error
+		text, err = renderAuditResponse(dialog.AuditResponseTemplate, AuditTemplateContext{
+			UserName:  *userName,
+			SessionID: sessionID,
+			BotName:   dialog.BotName,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	extra := make(map[string]interface{}, len(dialog.Extra)+1)
+	for k, v := range dialog.Extra {
+		extra[k] = v
+	}
+	extra["audit_response"] = text
+	dialog.Extra = extra
+	return nil
+}
+
+// auditResponsesFlag collects repeated -audit-response lang=text flags.
+type auditResponsesFlag map[string]string
+
+func (f auditResponsesFlag) String() string {
+	pairs := make([]string, 0, len(f))
+	for lang, text := range f {
+		pairs = append(pairs, lang+"="+text)
+	}
+	return strings.Join(pairs, ", ")
+}
+
+func (f auditResponsesFlag) Set(value string) error {
+	lang, text, ok := strings.Cut(value, "=")
+	if !ok {
+		return fmt.Errorf("want lang=text, got %q", value)
+	}
+	f[lang] = text
+	return nil
+}
+
+// AuditFailMode selects what happens when the server rejects a user query in
+// its audit and answers with the audit response.
+type AuditFailMode int
+
+// Values that an AuditFailMode variable can take.
+const (
+	// AuditFailOff plays the audit response like any answer.
+	AuditFailOff AuditFailMode = iota
+	// AuditFailTurn abandons the turn: the audit response is dropped and the
+	// dialog waits for the user again.
+	AuditFailTurn
+	// AuditFailSession ends the dialog with ShutdownAuditRejected.
+	AuditFailSession
+)
+
+func (m AuditFailMode) String() string {
+	switch m {
+	case AuditFailOff:
+		return "off"
+	case AuditFailTurn:
+		return "turn"
+	case AuditFailSession:
+		return "session"
+	default:
+		return fmt.Sprintf("AuditFailMode(%d)", int(m))
+	}
+}
+
+// parseAuditFailMode parses the names returned by AuditFailMode.String.
+func parseAuditFailMode(s string) (AuditFailMode, error) {
+	for _, m := range []AuditFailMode{AuditFailOff, AuditFailTurn, AuditFailSession} {
+		if m.String() == s {
+			return m, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown audit fail mode %q, want off, turn or session", s)
+}
+
+// auditRiskyTTSType is the tts_type of a TTSSentenceStart event whose
+// sentence is the audit response to a rejected query.
+const auditRiskyTTSType = "audit_content_risky"
+
+var (
+	errAuditRejected = errors.New("user query rejected by the audit")
+	auditFailMode    = AuditFailOff
+)
+
+// WithFailOnAudit makes an audit rejection end the turn or the session
+// instead of playing the audit response, for applications that must handle
+// disallowed content themselves. EventHandlers.OnAuditRejected is called
+// either way.
+func WithFailOnAudit(mode AuditFailMode) {
+	auditFailMode = mode
+}
+
+// handleAuditRejected applies the audit fail mode to a rejected query. It
+// returns the reason to end the dialog with, or nil to go on.
+func handleAuditRejected(conn *websocket.Conn, sessionID string) *ShutdownReason {
+	userText := turns.currentUserText()
+	glog.Warningf("User query rejected by the audit: %q", userText)
+	counters.auditRejections.Add(1)
+	journal.Record(JournalCommand, 0, sessionID, "audit rejected: "+userText)
+	if eventHandlers.OnAuditRejected != nil {
+		eventHandlers.OnAuditRejected(userText)
+	}
+	switch auditFailMode {
+	case AuditFailTurn:
+		AbandonTurn(conn, sessionID, errAuditRejected.Error())
+	case AuditFailSession:
+		flushAudioSink()
+		return &ShutdownReason{Kind: ShutdownAuditRejected, Err: fmt.Errorf("%w: %q", errAuditRejected, userText)}
+	}
+	return nil
+}
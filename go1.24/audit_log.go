@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// auditLogKeyEnv names the environment variable holding the HMAC key of
+// -audit-log, which is kept off the command line.
+const auditLogKeyEnv = "REALTIMEDIALOG_AUDIT_KEY"
+
+var (
+	errAuditLogSignature = errors.New("audit log line signature mismatch")
+	errAuditLogSequence  = errors.New("audit log line out of sequence")
+)
+
+// auditLogHMACField is how the HMAC is appended as the last field of a line.
+const auditLogHMACField = `,"hmac":"`
+
+// AuditLogger writes a tamper-evident trail of the websocket traffic: one JSON
+// line per message sent or received, signed with HMAC-SHA256 under SecretKey.
+// Only metadata is logged, never the payload. A failing Output is reported
+// once and then left alone, so the trail can never break the dialog.
+//
+// Each line carries a sequence number and its HMAC covers the exact bytes of
+// the line without the hmac field, chained to the HMAC of the line before, so
+// that editing, deleting, reordering or replaying lines breaks the chain.
+type AuditLogger struct {
+	SecretKey []byte
+	Output    io.Writer
+
+	lock   sync.Mutex
+	failed bool
+	// seq and prev are the sequence number and the HMAC of the last line
+	// written or verified.
+	seq  uint64
+	prev string
+}
+
+// auditLogRecord is one line of the audit log, without its HMAC.
+type auditLogRecord struct {
+	Seq           uint64    `json:"seq"`
+	Timestamp     string    `json:"timestamp"` // RFC 3339 with nanoseconds
+	Direction     Direction `json:"direction"`
+	SessionID     string    `json:"session_id,omitempty"`
+	MessageType   string    `json:"message_type"`
+	Event         int32     `json:"event,omitempty"`
+	PayloadLength int       `json:"payload_length"`
+}
+
+// auditLog signs the traffic if WithAuditLogger is set.
+var auditLog *AuditLogger
+
+// WithAuditLogger writes the audit trail of every message to l.
+func WithAuditLogger(l *AuditLogger) {
+	auditLog = l
+}
+
+// log writes the line for msg.
+func (l *AuditLogger) log(direction Direction, msg *Message) {
+	if l == nil {
+		return
+	}
+	rec := auditLogRecord{
+		Timestamp:     time.Now().Format(time.RFC3339Nano),
+		Direction:     direction,
+		SessionID:     msg.SessionID,
+		MessageType:   msg.Type.String(),
+		Event:         msg.Event,
+		PayloadLength: len(msg.Payload),
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.failed {
+		return
+	}
+	// 签名链要求按写入顺序签名，因此在锁内编号和签名
+	rec.Seq = l.seq + 1
+	unsigned, err := json.Marshal(rec)
+	if err != nil {
+		glog.Errorf("Sign audit log line: %v", err)
+		return
+	}
+	mac := l.mac(unsigned)
+	line := append(unsigned[:len(unsigned)-1], auditLogHMACField+mac+"\"}\n"...)
+	if _, err := l.Output.Write(line); err != nil {
+		glog.Errorf("Audit log write failed, audit log disabled: %v", err)
+		l.failed = true
+		return
+	}
+	l.seq, l.prev = rec.Seq, mac
+}
+
+// mac returns the HMAC of the unsigned line chained to the line before.
+func (l *AuditLogger) mac(unsigned []byte) string {
+	h := hmac.New(sha256.New, l.SecretKey)
+	h.Write([]byte(l.prev))
+	h.Write(unsigned)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Verify checks the next line of the audit log, with or without its trailing
+// newline: its sequence number and its HMAC, chained to the lines verified
+// before. Lines must be verified in order from the first. After a line fails,
+// the chain resumes from it, so that one deleted or edited line does not fail
+// every line after it.
+func (l *AuditLogger) Verify(line []byte) error {
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	i := bytes.LastIndex(line, []byte(auditLogHMACField))
+	if i < 0 || !bytes.HasSuffix(line, []byte(`"}`)) {
+		return fmt.Errorf("%w: no hmac field", errAuditLogSignature)
+	}
+	got := string(line[i+len(auditLogHMACField) : len(line)-2])
+	unsigned := append(bytes.Clone(line[:i]), '}')
+	var rec auditLogRecord
+	if err := json.Unmarshal(unsigned, &rec); err != nil {
+		return fmt.Errorf("parse audit log line: %w", err)
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	want := l.mac(unsigned)
+	expected := l.seq + 1
+	l.seq, l.prev = rec.Seq, got
+	if rec.Seq != expected {
+		return fmt.Errorf("%w: seq %d, want %d", errAuditLogSequence, rec.Seq, expected)
+	}
+	if !hmac.Equal([]byte(got), []byte(want)) {
+		return errAuditLogSignature
+	}
+	return nil
+}
+
+// auditLogKey returns the HMAC key of -audit-log and -audit-verify.
+func auditLogKey() []byte {
+	key := os.Getenv(auditLogKeyEnv)
+	if key == "" {
+		glog.Exitf("-audit-log and -audit-verify need the HMAC key in $%s", auditLogKeyEnv)
+	}
+	return []byte(key)
+}
+
+// scanAuditLog verifies the lines of the audit log at path in order with l,
+// calling fn with the number and the verification error of each.
+func scanAuditLog(path string, l *AuditLogger, fn func(n int, err error)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		fn(n, l.Verify(sc.Bytes()))
+	}
+	return sc.Err()
+}
+
+// verifyAuditLogFile checks every line of the audit log at path and reports
+// the lines whose signature or sequence number does not match. Lines deleted
+// from the end of the log cannot be detected.
+func verifyAuditLogFile(path string, l *AuditLogger) error {
+	var lines, bad int
+	err := scanAuditLog(path, l, func(n int, err error) {
+		lines++
+		if err != nil {
+			fmt.Printf("line %d: %v\n", n, err)
+			bad++
+		}
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d lines, %d failed verification\n", lines, bad)
+	if bad > 0 {
+		return fmt.Errorf("%d of %d lines: %w", bad, lines, errAuditLogSignature)
+	}
+	return nil
+}
+
+// resumeAuditLog verifies the audit log already at path, if any, so that l
+// appends to it continuing its chain. A log failing verification is not
+// appended to.
+func resumeAuditLog(path string, l *AuditLogger) error {
+	var first error
+	err := scanAuditLog(path, l, func(n int, err error) {
+		if err != nil && first == nil {
+			first = fmt.Errorf("line %d: %w", n, err)
+		}
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return first
+}
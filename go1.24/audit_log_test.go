@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// auditLines writes n signed lines and returns them.
+func auditLines(t *testing.T, n int) []string {
+	t.Helper()
+	var out bytes.Buffer
+	l := &AuditLogger{SecretKey: []byte("key"), Output: &out}
+	for i := 0; i < n; i++ {
+		l.log(DirectionOutbound, &Message{Type: MsgTypeFullClient, Event: 100 + int32(i), SessionID: "s", Payload: []byte("{}")})
+	}
+	lines := strings.SplitAfter(out.String(), "\n")
+	return lines[:len(lines)-1]
+}
+
+// verifyAuditLines verifies lines in order and returns the error of each.
+func verifyAuditLines(lines []string) []error {
+	l := &AuditLogger{SecretKey: []byte("key")}
+	var errs []error
+	for _, line := range lines {
+		errs = append(errs, l.Verify([]byte(line)))
+	}
+	return errs
+}
+
+// TestAuditLogVerify checks that an intact log verifies and that editing,
+// deleting, reordering and replaying lines is detected.
+func TestAuditLogVerify(t *testing.T) {
+	lines := auditLines(t, 3)
+	tests := []struct {
+		name  string
+		edit  func([]string) []string
+		want  error // of the first failing line
+		fails int   // index of the first failing line, -1 for none
+	}{
+		{"intact", func(l []string) []string { return l }, nil, -1},
+		{"unknown field", func(l []string) []string {
+			l[1] = strings.Replace(l[1], `{"seq"`, `{"extra":1,"seq"`, 1)
+			return l
+		}, errAuditLogSignature, 1},
+		{"reordered keys", func(l []string) []string {
+			l[1] = strings.Replace(l[1], `"session_id":"s","message_type":"FullClient"`, `"message_type":"FullClient","session_id":"s"`, 1)
+			return l
+		}, errAuditLogSignature, 1},
+		{"edited", func(l []string) []string {
+			l[0] = strings.Replace(l[0], `"payload_length":2`, `"payload_length":3`, 1)
+			return l
+		}, errAuditLogSignature, 0},
+		{"deleted", func(l []string) []string { return []string{l[0], l[2]} }, errAuditLogSequence, 1},
+		{"reordered", func(l []string) []string { return []string{l[0], l[2], l[1]} }, errAuditLogSequence, 1},
+		{"replayed", func(l []string) []string { return []string{l[0], l[1], l[1], l[2]} }, errAuditLogSequence, 2},
+		{"no hmac", func(l []string) []string {
+			l[2] = l[2][:strings.Index(l[2], `,"hmac"`)] + "}\n"
+			return l
+		}, errAuditLogSignature, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			edited := tt.edit(append([]string(nil), lines...))
+			if tt.fails >= 0 && strings.Join(edited, "") == strings.Join(lines, "") {
+				t.Fatal("the edit did not change the log")
+			}
+			for i, err := range verifyAuditLines(edited) {
+				switch {
+				case i < tt.fails || tt.fails < 0:
+					if err != nil {
+						t.Errorf("line %d: Verify() = %v, want nil", i, err)
+					}
+				case i == tt.fails:
+					if !errors.Is(err, tt.want) {
+						t.Errorf("line %d: Verify() = %v, want %v", i, err, tt.want)
+					}
+				}
+			}
+		})
+	}
+}
+
+// TestAuditLogResume checks that a logger appending to an existing log
+// continues its chain, and that a tampered log is not appended to.
+func TestAuditLogResume(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	if err := resumeAuditLog(path, &AuditLogger{SecretKey: []byte("key")}); err != nil {
+		t.Fatalf("resumeAuditLog() of a missing log = %v, want nil", err)
+	}
+	lines := auditLines(t, 2)
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "")), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &AuditLogger{SecretKey: []byte("key"), Output: f}
+	if err := resumeAuditLog(path, l); err != nil {
+		t.Fatalf("resumeAuditLog() = %v, want nil", err)
+	}
+	l.log(DirectionOutbound, &Message{Type: MsgTypeAudioOnlyClient, Payload: []byte{1, 2}})
+	f.Close()
+	if err := verifyAuditLogFile(path, &AuditLogger{SecretKey: []byte("key")}); err != nil {
+		t.Errorf("verifyAuditLogFile() after resuming = %v, want nil", err)
+	}
+
+	tampered := strings.Replace(lines[0], `"payload_length":2`, `"payload_length":3`, 1) + lines[1]
+	if err := os.WriteFile(path, []byte(tampered), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := resumeAuditLog(path, &AuditLogger{SecretKey: []byte("key")}); !errors.Is(err, errAuditLogSignature) {
+		t.Errorf("resumeAuditLog() of a tampered log = %v, want %v", err, errAuditLogSignature)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestRenderAuditResponse(t *testing.T) {
+	got, err := renderAuditResponse("抱歉{{.UserName}}，会话 {{.SessionID}}", AuditTemplateContext{UserName: "小明", SessionID: "s1"})
+	if err != nil || got != "抱歉小明，会话 s1" {
+		t.Errorf("renderAuditResponse() = %q, %v, want 抱歉小明，会话 s1", got, err)
+	}
+	for _, text := range []string{"{{.UserName", "{{.Unknown}}"} {
+		if _, err := renderAuditResponse(text, AuditTemplateContext{}); !errors.Is(err, ErrInvalidAuditTemplate) {
+			t.Errorf("renderAuditResponse(%q) = %v, want ErrInvalidAuditTemplate", text, err)
+		}
+	}
+}
+
+func TestApplyAuditResponseTemplate(t *testing.T) {
+	extra := map[string]interface{}{"strict_audit": false}
+	dialog := DialogPayload{BotName: "豆包", AuditResponseTemplate: "我是{{.BotName}}", Extra: extra}
+	if err := applyAuditResponseTemplate(&dialog, "s1"); err != nil {
+		t.Fatal(err)
+	}
+	if got := dialog.Extra["audit_response"]; got != "我是豆包" {
+		t.Errorf(`Extra["audit_response"] = %v, want 我是豆包`, got)
+	}
+	if _, ok := extra["audit_response"]; ok {
+		t.Error("applyAuditResponseTemplate changed the Extra map it was given")
+	}
+}
+
+func TestLocalizedAuditResponse(t *testing.T) {
+	responses := map[string]string{"": "抱歉", "en": "Sorry", "en-GB": "Sorry, old chap", "ja": "すみません"}
+	for _, tc := range []struct{ language, want string }{
+		{"en-GB", "Sorry, old chap"},
+		{"en-US", "Sorry"},
+		{"ja", "すみません"},
+		{"fr-FR", "抱歉"},
+		{"", "抱歉"},
+	} {
+		if got, ok := localizedAuditResponse(responses, tc.language); !ok || got != tc.want {
+			t.Errorf("localizedAuditResponse(%q) = %q, %v, want %q", tc.language, got, ok, tc.want)
+		}
+	}
+	if _, ok := localizedAuditResponse(map[string]string{"en": "Sorry"}, "fr"); ok {
+		t.Error("localizedAuditResponse() without a default found a response for fr")
+	}
+}
+
+// TestLocalizedAuditResponseMarshaled checks the audit response StartSession
+// sends for the configured language, and that the default is kept when no
+// localized response applies.
+func TestLocalizedAuditResponseMarshaled(t *testing.T) {
+	responses := auditResponsesFlag{}
+	for _, value := range []string{"en=Sorry, I can't answer that.", "ja=すみません"} {
+		if err := responses.Set(value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tc := range []struct{ language, want string }{
+		{"en-US", "Sorry, I can't answer that."},
+		{"ja", "すみません"},
+		{"de", "抱歉"},
+	} {
+		p := &StartSessionPayload{Dialog: DialogPayload{
+			Extra:          map[string]interface{}{"audit_response": "抱歉"},
+			AuditResponses: responses,
+			Language:       tc.language,
+		}}
+		data, err := p.MarshalStartSession("s1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got StartSessionPayload
+		if err := json.Unmarshal(data, &got); err != nil {
+			t.Fatal(err)
+		}
+		if got.Dialog.Extra["audit_response"] != tc.want {
+			t.Errorf("language %s: audit_response = %v, want %q", tc.language, got.Dialog.Extra["audit_response"], tc.want)
+		}
+	}
+	if err := responses.Set("no equals sign"); err == nil {
+		t.Error("Set(\"no equals sign\") = nil, want an error")
+	}
+}
+
+// auditRejectedTurn has the user ask something the audit rejects and the
+// server answer with the audit response.
+func auditRejectedTurn(c *fakeConn, sid string) {
+	c.userTurn(sid, "违规问题")
+	c.send(serverFrame(350, sid, `{"tts_type":"`+auditRiskyTTSType+`"}`))
+	c.send(serverFrame(550, sid, `{"content":"这个问题我无法回答"}`))
+	c.send(serverAudio(sid, make([]float32, 4800)))
+	c.send(serverFrame(359, sid, `{}`))
+}
+
+// setupAuditRejection sets the audit fail mode and records the user text
+// OnAuditRejected is called with.
+func setupAuditRejection(t *testing.T, mode AuditFailMode) *[]string {
+	var rejected []string
+	WithFailOnAudit(mode)
+	eventHandlers.OnAuditRejected = func(userText string) { rejected = append(rejected, userText) }
+	t.Cleanup(func() {
+		WithFailOnAudit(AuditFailOff)
+		eventHandlers.OnAuditRejected = nil
+	})
+	return &rejected
+}
+
+// TestFailOnAuditSession checks that an audit rejection ends the dialog with
+// AuditFailSession, without playing the audit response.
+func TestFailOnAuditSession(t *testing.T) {
+	s := newFakeServer(t, scriptedDialog(func(c *fakeConn, sid string) {
+		c.answer(sid, "你好", 1200)
+		auditRejectedTurn(c, sid)
+	}))
+	_, speaker := setupDialog(t, s)
+	rejected := setupAuditRejection(t, AuditFailSession)
+
+	_, err := runFakeDialog(t)
+	var reason *ShutdownReason
+	if !errors.As(err, &reason) || reason.Kind != ShutdownAuditRejected || !errors.Is(err, errAuditRejected) {
+		t.Fatalf("realTimeDialog() = %v, want ShutdownAuditRejected", err)
+	}
+	if len(*rejected) != 1 || (*rejected)[0] != "违规问题" {
+		t.Errorf("OnAuditRejected got %q, want the rejected query", *rejected)
+	}
+	if got := speaker.played(); got != 1200 {
+		t.Errorf("played %d samples, want only the 1200 of the greeting", got)
+	}
+}
+
+// TestFailOnAuditTurn checks that an audit rejection abandons the turn with
+// AuditFailTurn, dropping the audit response, and that the dialog goes on.
+func TestFailOnAuditTurn(t *testing.T) {
+	s := newFakeServer(t, scriptedDialog(func(c *fakeConn, sid string) {
+		c.answer(sid, "你好", 1200)
+		auditRejectedTurn(c, sid)
+		c.userTurn(sid, "今天天气")
+		c.answer(sid, "晴天", 2400)
+	}))
+	_, speaker := setupDialog(t, s)
+	rejected := setupAuditRejection(t, AuditFailTurn)
+
+	if _, err := runFakeDialog(t); err == nil {
+		t.Error("realTimeDialog() = nil, want the server ending the session")
+	}
+	if len(*rejected) != 1 || (*rejected)[0] != "违规问题" {
+		t.Errorf("OnAuditRejected got %q, want the rejected query", *rejected)
+	}
+	transcript := turns.Transcript()
+	if len(transcript) != 3 || transcript[1].Abandoned != errAuditRejected.Error() || transcript[2].BotText != "晴天" {
+		t.Fatalf("transcript = %+v, want the rejected turn abandoned and the next one answered", transcript)
+	}
+	if got := speaker.played(); got != 1200+2400 {
+		t.Errorf("played %d samples, want the greeting and the next answer without the audit response", got)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"text/tabwriter"
+)
+
+// BandwidthStats counts the bytes of one message type in one direction.
+// Overhead is everything in the frame but the payload: header, event, session
+// ID and length fields. RawPayloadBytes is the payload size before compression
+// and equals PayloadBytes when the payload was not compressed.
+type BandwidthStats struct {
+	Direction       Direction `json:"direction"`
+	Type            string    `json:"type"`
+	Frames          uint64    `json:"frames"`
+	Bytes           uint64    `json:"bytes"`
+	PayloadBytes    uint64    `json:"payload_bytes"`
+	RawPayloadBytes uint64    `json:"raw_payload_bytes"`
+}
+
+// Overhead returns the bytes spent outside the payload.
+func (s BandwidthStats) Overhead() uint64 {
+	return s.Bytes - s.PayloadBytes
+}
+
+// CompressionSaved returns the bytes saved by payload compression.
+func (s BandwidthStats) CompressionSaved() uint64 {
+	if s.RawPayloadBytes < s.PayloadBytes {
+		return 0
+	}
+	return s.RawPayloadBytes - s.PayloadBytes
+}
+
+// BandwidthMetrics can be implemented by a Metrics to also receive the byte
+// breakdown of every websocket message.
+type BandwidthMetrics interface {
+	ObserveBandwidth(direction Direction, msgType MsgType, frameBytes, payloadBytes, rawPayloadBytes int)
+}
+
+type bandwidthKey struct {
+	direction Direction
+	msgType   MsgType
+}
+
+// bandwidthTracker attributes the websocket traffic to message types. It is
+// safe for concurrent use.
+type bandwidthTracker struct {
+	lock  sync.Mutex
+	stats map[bandwidthKey]*BandwidthStats
+}
+
+var bandwidth = &bandwidthTracker{stats: map[bandwidthKey]*BandwidthStats{}}
+
+// observe records a marshaled or unmarshaled message and its frame size.
+func (t *bandwidthTracker) observe(direction Direction, msg *Message, frameBytes int) {
+	payloadBytes := len(msg.Payload)
+	rawPayloadBytes := msg.rawPayloadSize
+	if rawPayloadBytes == 0 {
+		// Incoming payloads are observed before they are decompressed.
+		rawPayloadBytes = payloadBytes
+	}
+
+	t.lock.Lock()
+	key := bandwidthKey{direction: direction, msgType: msg.Type}
+	s, ok := t.stats[key]
+	if !ok {
+		s = &BandwidthStats{Direction: direction, Type: msg.Type.String()}
+		t.stats[key] = s
+	}
+	s.Frames++
+	s.Bytes += uint64(frameBytes)
+	s.PayloadBytes += uint64(payloadBytes)
+	s.RawPayloadBytes += uint64(rawPayloadBytes)
+	t.lock.Unlock()
+
+	if m, ok := metrics.(BandwidthMetrics); ok {
+		m.ObserveBandwidth(direction, msg.Type, frameBytes, payloadBytes, rawPayloadBytes)
+	}
+}
+
+// Snapshot returns the statistics ordered by direction and message type.
+func (t *bandwidthTracker) Snapshot() []BandwidthStats {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	snapshot := make([]BandwidthStats, 0, len(t.stats))
+	for _, s := range t.stats {
+		snapshot = append(snapshot, *s)
+	}
+	sort.Slice(snapshot, func(i, j int) bool {
+		if snapshot[i].Direction != snapshot[j].Direction {
+			return snapshot[i].Direction > snapshot[j].Direction
+		}
+		return snapshot[i].Type < snapshot[j].Type
+	})
+	return snapshot
+}
+
+// writeBandwidthReport prints the bandwidth breakdown as a table. The
+// compression columns are only shown when some payload was compressed.
+func writeBandwidthReport(w io.Writer, stats []BandwidthStats) error {
+	var total BandwidthStats
+	for _, s := range stats {
+		total.Frames += s.Frames
+		total.Bytes += s.Bytes
+		total.PayloadBytes += s.PayloadBytes
+		total.RawPayloadBytes += s.RawPayloadBytes
+	}
+	compressed := total.CompressionSaved() > 0
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprint(tw, "direction\ttype\tframes\tbytes\tavg frame\tshare\toverhead\t")
+	if compressed {
+		fmt.Fprint(tw, "uncompressed\tsaved\t")
+	}
+	fmt.Fprintln(tw)
+	row := func(direction, msgType string, s BandwidthStats) {
+		var avg, share float64
+		if s.Frames > 0 {
+			avg = float64(s.Bytes) / float64(s.Frames)
+		}
+		if total.Bytes > 0 {
+			share = 100 * float64(s.Bytes) / float64(total.Bytes)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%.1f\t%.1f%%\t%d\t", direction, msgType, s.Frames, s.Bytes, avg, share, s.Overhead())
+		if compressed {
+			fmt.Fprintf(tw, "%d\t%d\t", s.RawPayloadBytes, s.CompressionSaved())
+		}
+		fmt.Fprintln(tw)
+	}
+	for _, s := range stats {
+		row(string(s.Direction), s.Type, s)
+	}
+	row("total", "", total)
+	return tw.Flush()
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestBandwidthReport(t *testing.T) {
+	b := &bandwidthTracker{stats: map[bandwidthKey]*BandwidthStats{}}
+	audio := &Message{Type: MsgTypeAudioOnlyClient, Payload: make([]byte, 320)}
+	b.observe(DirectionOutbound, audio, 340)
+	b.observe(DirectionOutbound, audio, 340)
+	control := &Message{Type: MsgTypeFullClient, Payload: make([]byte, 30), rawPayloadSize: 100}
+	b.observe(DirectionOutbound, control, 50)
+
+	stats := b.Snapshot()
+	if len(stats) != 2 {
+		t.Fatalf("Snapshot() = %+v, want audio and control", stats)
+	}
+	for _, s := range stats {
+		switch s.Type {
+		case MsgTypeAudioOnlyClient.String():
+			if s.Frames != 2 || s.Bytes != 680 || s.Overhead() != 40 {
+				t.Errorf("audio stats %+v, want 2 frames of 680 bytes with 40 overhead", s)
+			}
+		case MsgTypeFullClient.String():
+			if s.CompressionSaved() != 70 {
+				t.Errorf("control stats %+v, want 70 bytes saved", s)
+			}
+		}
+	}
+	var out bytes.Buffer
+	if err := writeBandwidthReport(&out, stats); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), MsgTypeAudioOnlyClient.String()) || !strings.Contains(out.String(), "total") {
+		t.Errorf("report lacks the audio or total row:\n%s", out.String())
+	}
+}
+
+func TestReportOutput(t *testing.T) {
+	defer func(spec string) { *outputSpec = spec }(*outputSpec)
+	*outputSpec = "-"
+	if reportOutput() != os.Stderr {
+		t.Error("reportOutput() with -output - is not stderr")
+	}
+	*outputSpec = "speaker"
+	if reportOutput() != os.Stdout {
+		t.Error("reportOutput() with -output speaker is not stdout")
+	}
+}
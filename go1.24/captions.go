@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// captionQueueSize bounds the captions waiting for their audio to play.
+const captionQueueSize = 256
+
+// caption is one caption update, written at the time its audio plays.
+type caption struct {
+	at      time.Time
+	speaker string
+	text    string
+	final   bool
+}
+
+// captioner writes "[user] …" and "[bot] …" caption lines. Interim text is
+// written without a line break and overwritten by the next update of the same
+// line. Bot captions are delayed until the audio received before them has
+// played, assuming playback in real time from the moment audio arrives. A nil
+// captioner writes nothing.
+type captioner struct {
+	w     io.Writer
+	queue chan caption
+
+	lock     sync.Mutex
+	playhead time.Time // when the audio received so far will have played
+	bot      string    // bot text of the answer in progress
+
+	partial string // speaker of the unfinished line, used by run only
+}
+
+// captions is set by WithCaptions.
+var captions *captioner
+
+// WithCaptions writes captions of the recognized user text and of the bot
+// answer, in sync with playback, to w.
+func WithCaptions(w io.Writer) {
+	captions = &captioner{w: w, queue: make(chan caption, captionQueueSize)}
+	go captions.run()
+}
+
+// userText captions recognized user text; final is false for interim results.
+func (c *captioner) userText(text string, final bool) {
+	if c == nil || text == "" {
+		return
+	}
+	c.send(caption{at: time.Now(), speaker: "user", text: text, final: final})
+}
+
+// botText adds a chunk of bot text to the caption of the answer.
+func (c *captioner) botText(chunk string) {
+	if c == nil || chunk == "" {
+		return
+	}
+	c.lock.Lock()
+	c.bot += chunk
+	capt := caption{at: c.playhead, speaker: "bot", text: c.bot}
+	c.lock.Unlock()
+	c.send(capt)
+}
+
+// botEnded finishes the caption of the answer once its audio has played.
+func (c *captioner) botEnded() {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	if c.bot == "" {
+		c.lock.Unlock()
+		return
+	}
+	capt := caption{at: c.playhead, speaker: "bot", text: c.bot, final: true}
+	c.bot = ""
+	c.lock.Unlock()
+	c.send(capt)
+}
+
+// send queues capt for run. It never blocks the receive loop: when the
+// captions fall captionQueueSize behind, the caption is dropped.
+func (c *captioner) send(capt caption) {
+	select {
+	case c.queue <- capt:
+	default:
+		glog.Warningf("Caption queue full, dropping %s caption", capt.speaker)
+	}
+}
+
+// audioQueued advances the playhead by d of audio handed to the sink.
+func (c *captioner) audioQueued(d time.Duration) {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if now := time.Now(); c.playhead.Before(now) {
+		c.playhead = now
+	}
+	c.playhead = c.playhead.Add(d)
+}
+
+// flush follows the sink dropping its queued audio.
+func (c *captioner) flush() {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.playhead = time.Now()
+}
+
+// run writes the captions in order, each once its time has come.
+func (c *captioner) run() {
+	for capt := range c.queue {
+		if d := time.Until(capt.at); d > 0 {
+			time.Sleep(d)
+		}
+		c.write(capt)
+	}
+}
+
+func (c *captioner) write(capt caption) {
+	switch c.partial {
+	case "":
+	case capt.speaker:
+		// 回到行首并清除该行，用新的内容覆盖未完成的字幕
+		fmt.Fprint(c.w, "\r\x1b[K")
+	default:
+		fmt.Fprintln(c.w)
+	}
+	line := fmt.Sprintf("[%s] %s", capt.speaker, capt.text)
+	if capt.final {
+		fmt.Fprintln(c.w, line)
+		c.partial = ""
+	} else {
+		fmt.Fprint(c.w, line)
+		c.partial = capt.speaker
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+)
+
+// captionBuffer collects the captions written by the captioner goroutine.
+type captionBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *captionBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *captionBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.String()
+}
+
+// TestCaptions plays a scripted turn with an interim ASR result and checks
+// the order of the captions, the interim line being overwritten.
+func TestCaptions(t *testing.T) {
+	s := newFakeServer(t, scriptedDialog(func(c *fakeConn, sid string) {
+		c.send(serverFrame(450, sid, `{}`))
+		c.send(serverFrame(451, sid, `{"results":[{"text":"今天","is_interim":true}]}`))
+		c.send(serverFrame(451, sid, `{"results":[{"text":"今天天气","is_interim":false}]}`))
+		c.send(serverFrame(459, sid, `{}`))
+		c.answer(sid, "晴天", 2400)
+	}))
+	setupDialog(t, s)
+	var out captionBuffer
+	WithCaptions(&out)
+	t.Cleanup(func() { captions = nil })
+
+	if _, err := runFakeDialog(t); err == nil {
+		t.Error("realTimeDialog() = nil, want the server ending the session")
+	}
+	want := "[user] 今天\r\x1b[K[user] 今天天气\n[bot] 晴天\r\x1b[K[bot] 晴天\n"
+	waitFor(t, "the captions", func() bool { return len(out.String()) >= len(want) })
+	if got := out.String(); got != want {
+		t.Errorf("captions = %q, want %q", got, want)
+	}
+}
+
+// TestCaptionsQueueFull checks that captions are dropped rather than blocking
+// the receive loop once the writer falls behind.
+func TestCaptionsQueueFull(t *testing.T) {
+	c := &captioner{queue: make(chan caption, 1)}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.userText("你好", true)
+		c.botText("一")
+		c.botText("二")
+		c.botEnded()
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("captions blocked on a full queue")
+	}
+	if capt := <-c.queue; capt.speaker != "user" || capt.text != "你好" {
+		t.Errorf("queued caption = %+v, want the first one", capt)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var errInvalidChannelMap = errors.New("invalid input channel map")
+
+// inputChannelMap holds the indices of the microphone channels sent to the
+// server, nil for a mono input stream.
+var inputChannelMap []int
+
+// WithInputChannelMap makes the microphone capture a multi-channel stream and
+// send the channels at indices, 0 being the first, mixed down to mono, e.g.
+// []int{2} for the third input of an audio interface or []int{0, 1} for both
+// sides of a stereo input. The indices are checked against the channel count
+// of the input device when it opens. nil restores the mono input. The map only
+// applies to microphone inputs opened afterwards.
+func WithInputChannelMap(indices []int) error {
+	seen := map[int]bool{}
+	for _, i := range indices {
+		if i < 0 {
+			return fmt.Errorf("%w: negative channel index %d", errInvalidChannelMap, i)
+		}
+		if seen[i] {
+			return fmt.Errorf("%w: channel %d selected twice", errInvalidChannelMap, i)
+		}
+		seen[i] = true
+	}
+	inputChannelMap = slices.Clone(indices)
+	return nil
+}
+
+// parseChannelMap parses a comma separated list of channel indices such as
+// "0,1".
+func parseChannelMap(s string) ([]int, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var indices []int
+	for _, field := range strings.Split(s, ",") {
+		i, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %q is not a channel index", errInvalidChannelMap, field)
+		}
+		indices = append(indices, i)
+	}
+	return indices, nil
+}
+
+// inputStreamChannels returns how many channels the input stream must capture
+// for inputChannelMap.
+func inputStreamChannels() int {
+	if len(inputChannelMap) == 0 {
+		return 1
+	}
+	return slices.Max(inputChannelMap) + 1
+}
+
+// checkChannelMap fails if inputChannelMap selects a channel a device with
+// maxChannels input channels does not have.
+func checkChannelMap(device string, maxChannels int) error {
+	if n := inputStreamChannels(); n > maxChannels {
+		return fmt.Errorf("%w: channel %d selected, but %s has %d input channels", errInvalidChannelMap, n-1, device, maxChannels)
+	}
+	return nil
+}
+
+// mixChannels extracts the channels at indices from the interleaved samples of
+// a stream with the given number of channels and averages them into mono.
+func mixChannels(interleaved []int16, channels int, indices []int) []int16 {
+	mono := make([]int16, len(interleaved)/channels)
+	for i := range mono {
+		frame := interleaved[i*channels : (i+1)*channels]
+		var sum int32
+		for _, c := range indices {
+			sum += int32(frame[c])
+		}
+		mono[i] = int16(sum / int32(len(indices)))
+	}
+	return mono
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+// TestMixChannels extracts and mixes channels of a synthetic four channel
+// buffer whose channel c of frame i holds 100*c + i.
+func TestMixChannels(t *testing.T) {
+	const channels, frames = 4, 3
+	var interleaved []int16
+	for i := range frames {
+		for c := range channels {
+			interleaved = append(interleaved, int16(100*c+i))
+		}
+	}
+	tests := []struct {
+		indices []int
+		want    []int16
+	}{
+		{[]int{0}, []int16{0, 1, 2}},
+		{[]int{2}, []int16{200, 201, 202}},
+		{[]int{3, 1}, []int16{200, 201, 202}},
+		{[]int{1, 2, 3}, []int16{200, 201, 202}},
+	}
+	for _, tt := range tests {
+		if got := mixChannels(interleaved, channels, tt.indices); !slices.Equal(got, tt.want) {
+			t.Errorf("mixChannels(%v) = %v, want %v", tt.indices, got, tt.want)
+		}
+	}
+	// 满幅的同相声道相加不能溢出
+	loud := []int16{32767, 32767, -32768, -32768}
+	if got, want := mixChannels(loud, 2, []int{0, 1}), []int16{32767, -32768}; !slices.Equal(got, want) {
+		t.Errorf("mixChannels() of full scale channels = %v, want %v", got, want)
+	}
+}
+
+func TestChannelMap(t *testing.T) {
+	t.Cleanup(func() { _ = WithInputChannelMap(nil) })
+	for _, s := range []string{"a", "0,,1", "1.5"} {
+		if _, err := parseChannelMap(s); !errors.Is(err, errInvalidChannelMap) {
+			t.Errorf("parseChannelMap(%q) = %v, want errInvalidChannelMap", s, err)
+		}
+	}
+	for _, indices := range [][]int{{-1}, {1, 1}} {
+		if err := WithInputChannelMap(indices); !errors.Is(err, errInvalidChannelMap) {
+			t.Errorf("WithInputChannelMap(%v) = %v, want errInvalidChannelMap", indices, err)
+		}
+	}
+
+	indices, err := parseChannelMap(" 3, 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := WithInputChannelMap(indices); err != nil {
+		t.Fatal(err)
+	}
+	if got := inputStreamChannels(); got != 4 {
+		t.Errorf("inputStreamChannels() = %d, want 4 for channel 3", got)
+	}
+	if err := checkChannelMap("mic", 4); err != nil {
+		t.Errorf("checkChannelMap() of a 4 channel device = %v, want nil", err)
+	}
+	if err := checkChannelMap("mic", 2); !errors.Is(err, errInvalidChannelMap) {
+		t.Errorf("checkChannelMap() of a 2 channel device = %v, want errInvalidChannelMap", err)
+	}
+	_ = WithInputChannelMap(nil)
+	if got := inputStreamChannels(); got != 1 {
+		t.Errorf("inputStreamChannels() without a map = %d, want 1", got)
+	}
+}
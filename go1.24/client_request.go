@@ -2,11 +2,18 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"runtime"
+	"slices"
+	"strings"
+	"time"
+	"weak"
 
 	"github.com/golang/glog"
-	"github.com/gordonklaus/portaudio"
 	"github.com/gorilla/websocket"
 )
 
@@ -25,9 +32,64 @@ type ChatTTSTextPayload struct {
 	Content string `json:"content"`
 }
 
+type ChatTextQueryPayload struct {
+	Content string `json:"content"`
+}
+
 type TTSPayload struct {
 	//Speaker     string      `json:"speaker"`
 	AudioConfig AudioConfig `json:"audio_config"`
+	// SpeakingRate multiplies the bot's normal speaking speed, within
+	// [minSpeakingRate, maxSpeakingRate]; 0 leaves the server default.
+	SpeakingRate float64 `json:"speech_rate,omitempty"`
+	// EmotionStyle is the emotional tone the bot speaks in, one of
+	// SupportedEmotionStyles; "" leaves the server default.
+	EmotionStyle string `json:"emotion_style,omitempty"`
+}
+
+const (
+	minSpeakingRate = 0.5
+	maxSpeakingRate = 2.0
+)
+
+var errInvalidSpeakingRate = errors.New("invalid speaking rate")
+
+// speakingRate is sent as TTSPayload.SpeakingRate when the session starts.
+var speakingRate float64
+
+// WithSpeakingRate sets how fast the bot speaks relative to its normal speed,
+// e.g. 0.8 to slow it down for accessibility. 0 restores the server default.
+// The rate only applies to sessions started afterwards.
+func WithSpeakingRate(rate float64) error {
+	if rate != 0 && (rate < minSpeakingRate || rate > maxSpeakingRate) {
+		return fmt.Errorf("%w: %v is outside [%v, %v]", errInvalidSpeakingRate, rate, minSpeakingRate, maxSpeakingRate)
+	}
+	speakingRate = rate
+	return nil
+}
+
+// supportedEmotionStyles lists the values of TTSPayload.EmotionStyle.
+var supportedEmotionStyles = []string{"neutral", "happy", "sad", "excited", "calm"}
+
+// SupportedEmotionStyles returns the emotional tones the bot can speak in.
+func SupportedEmotionStyles() []string {
+	return slices.Clone(supportedEmotionStyles)
+}
+
+var errInvalidEmotionStyle = errors.New("invalid emotion style")
+
+// emotionStyle is sent as TTSPayload.EmotionStyle when the session starts.
+var emotionStyle string
+
+// WithEmotionStyle sets the emotional tone the bot speaks in, e.g. "calm" for
+// a support line. "" restores the server default. The style only applies to
+// sessions started afterwards.
+func WithEmotionStyle(style string) error {
+	if style != "" && !slices.Contains(supportedEmotionStyles, style) {
+		return fmt.Errorf("%w: %q, want one of %s", errInvalidEmotionStyle, style, strings.Join(supportedEmotionStyles, ", "))
+	}
+	emotionStyle = style
+	return nil
 }
 
 type AudioConfig struct {
@@ -42,9 +104,193 @@ type DialogPayload struct {
 	SystemRole    string                 `json:"system_role"`
 	SpeakingStyle string                 `json:"speaking_style"`
 	Extra         map[string]interface{} `json:"extra"`
+	// AuditResponses maps a language such as "en" or "en-US" to the audit
+	// response for it; the empty key is the fallback. At StartSession time the
+	// one matching Language replaces Extra["audit_response"].
+	AuditResponses map[string]string `json:"-"`
+	Language       string            `json:"-"`
+	// AuditResponseTemplate, if set, is rendered with text/template at
+	// StartSession time and replaces Extra["audit_response"].
+	AuditResponseTemplate string `json:"-"`
 }
 
-func startConnection(conn *websocket.Conn) error {
+// The request functions in this file may be called concurrently, e.g. the idle
+// SayHello from its own goroutine while audio is being sent: every message is
+// marshaled with its own copy of the protocol and frames are written under
+// wsWriteLock. After closeConn they return ErrClientClosed.
+
+// ErrClientClosed is returned by the request functions for a connection
+// closed with closeConn.
+var ErrClientClosed = errors.New("websocket connection closed by client")
+
+// closedConns holds the connections closed by closeConn, guarded by
+// wsWriteLock. The keys are weak so that they do not keep the connections
+// alive; an entry is deleted once its connection is garbage collected, when
+// nothing can write to it anymore.
+var closedConns = map[weak.Pointer[websocket.Conn]]bool{}
+
+// closeConn closes conn once no frame is being written. Later writes fail with
+// ErrClientClosed instead of a write error on the closed socket.
+func closeConn(conn *websocket.Conn) error {
+	wsWriteLock.Lock()
+	defer wsWriteLock.Unlock()
+	key := weak.Make(conn)
+	if closedConns[key] {
+		return nil
+	}
+	closedConns[key] = true
+	delete(startedConns, key)
+	runtime.AddCleanup(conn, forgetClosedConn, key)
+	sessionManager.forget(conn)
+	return conn.Close()
+}
+
+// forgetClosedConn deletes the closedConns entry of a collected connection.
+func forgetClosedConn(key weak.Pointer[websocket.Conn]) {
+	wsWriteLock.Lock()
+	defer wsWriteLock.Unlock()
+	delete(closedConns, key)
+}
+
+// startedConns holds the connections on which StartConnection succeeded and
+// FinishConnection was not sent yet, e.g. one warmed up with Warmup, guarded
+// by wsWriteLock. The keys are weak like those of closedConns.
+var startedConns = map[weak.Pointer[websocket.Conn]]bool{}
+
+// setConnStarted records whether conn is between StartConnection and
+// FinishConnection.
+func setConnStarted(conn *websocket.Conn, started bool) {
+	wsWriteLock.Lock()
+	defer wsWriteLock.Unlock()
+	key := weak.Make(conn)
+	switch {
+	case !started:
+		delete(startedConns, key)
+	case !startedConns[key]:
+		startedConns[key] = true
+		runtime.AddCleanup(conn, forgetStartedConn, key)
+	}
+}
+
+// connStarted reports whether StartConnection succeeded on conn.
+func connStarted(conn *websocket.Conn) bool {
+	wsWriteLock.Lock()
+	defer wsWriteLock.Unlock()
+	return startedConns[weak.Make(conn)]
+}
+
+// forgetStartedConn deletes the startedConns entry of a collected connection.
+func forgetStartedConn(key weak.Pointer[websocket.Conn]) {
+	wsWriteLock.Lock()
+	defer wsWriteLock.Unlock()
+	delete(startedConns, key)
+}
+
+// PayloadInterceptor rewrites the JSON payload of a control request before it
+// is framed, e.g. to inject fields for an A/B test. An error aborts the send.
+type PayloadInterceptor func(msgType MsgType, payload []byte) ([]byte, error)
+
+var payloadInterceptor PayloadInterceptor
+
+// WithPayloadInterceptor applies f to the JSON payload of every request other
+// than audio. It is an escape hatch below the typed payloads: the payload f
+// returns is sent as is.
+func WithPayloadInterceptor(f PayloadInterceptor) {
+	payloadInterceptor = f
+}
+
+// marshalMessage serializes msg with a copy of the global protocol, so that
+// concurrent requests do not race on its serialization method: audio is sent
+// raw, everything else as JSON, passed through the payload interceptor.
+func marshalMessage(msg *Message) ([]byte, error) {
+	p, err := messageProtocol(msg)
+	if err != nil {
+		return nil, err
+	}
+	return p.Marshal(msg)
+}
+
+// messageProtocol returns the copy of the global protocol msg is marshaled
+// with, by value so that the audio hot path does not allocate it.
+func messageProtocol(msg *Message) (BinaryProtocol, error) {
+	p := *protocol
+	if msg.Type == MsgTypeAudioOnlyClient {
+		p.SetSerialization(SerializationRaw)
+	} else {
+		p.SetSerialization(SerializationJSON)
+		if payloadInterceptor != nil {
+			payload, err := payloadInterceptor(msg.Type, msg.Payload)
+			if err != nil {
+				return p, fmt.Errorf("payload interceptor: %w", err)
+			}
+			msg.Payload = payload
+		}
+	}
+	return p, nil
+}
+
+// wsMessageType is the websocket message type frames are sent as. Text
+// messages carry the frame base64 encoded.
+var wsMessageType = websocket.BinaryMessage
+
+// WithWebSocketMessageType sends frames as websocket.BinaryMessage, the
+// default, or base64 encoded as websocket.TextMessage for networks filtering
+// binary websocket messages. Text messages received in text mode are decoded
+// the same way.
+func WithWebSocketMessageType(mt int) error {
+	if mt != websocket.BinaryMessage && mt != websocket.TextMessage {
+		return fmt.Errorf("unsupported websocket message type %d", mt)
+	}
+	wsMessageType = mt
+	return nil
+}
+
+// writeFrame sends the marshaled frame of msg over conn. It is safe to call from
+// multiple goroutines.
+func writeFrame(conn *websocket.Conn, msg *Message, frame []byte) error {
+	wsWriteLock.Lock()
+	defer wsWriteLock.Unlock()
+	if closedConns[weak.Make(conn)] {
+		return ErrClientClosed
+	}
+	data := frame
+	if wsMessageType == websocket.TextMessage {
+		data = []byte(base64.StdEncoding.EncodeToString(frame))
+	}
+	if err := conn.WriteMessage(wsMessageType, data); err != nil {
+		return err
+	}
+	writeTap.tap(frame)
+	auditLog.log(DirectionOutbound, msg)
+	counters.framesSent.Add(1)
+	counters.bytesSent.Add(uint64(len(data)))
+	metrics.ObserveMessageSize(DirectionOutbound, len(data))
+	bandwidth.observe(DirectionOutbound, msg, len(data))
+	journal.Record(JournalFrameSent, msg.Event, msg.SessionID, fmt.Sprintf("%s, %d bytes", msg.Type, len(data)))
+	debugFrame("sent", msg)
+	return nil
+}
+
+// receiveAck reads the response to a StartConnection or StartSession request.
+// If ctx is done first the read is aborted and the context error returned;
+// the connection is then unusable.
+func receiveAck(ctx context.Context, conn *websocket.Conn) (*Message, error) {
+	// 阻塞的读取无法直接取消，通过把读超时设为当前时间使其立即返回
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetReadDeadline(time.Now())
+	})
+	msg, err := receiveMessage(conn)
+	if !stop() && ctx.Err() != nil {
+		return nil, context.Cause(ctx)
+	}
+	return msg, err
+}
+
+func startConnection(ctx context.Context, conn *websocket.Conn) error {
+	return withNegotiationFallback(func() error { return doStartConnection(ctx, conn) })
+}
+
+func doStartConnection(ctx context.Context, conn *websocket.Conn) error {
 	msg, err := NewMessage(MsgTypeFullClient, MsgTypeFlagWithEvent)
 	if err != nil {
 		return fmt.Errorf("create StartSession request message: %w", err)
@@ -52,29 +298,23 @@ func startConnection(conn *websocket.Conn) error {
 	msg.Event = 1
 	msg.Payload = []byte("{}")
 
-	frame, err := protocol.Marshal(msg)
+	frame, err := marshalMessage(msg)
 	glog.Infof("StartConnection frame: %v", frame)
 	if err != nil {
 		return fmt.Errorf("marshal StartConnection request message: %w", err)
 	}
 
-	if err := conn.WriteMessage(websocket.BinaryMessage, frame); err != nil {
+	if err := writeFrame(conn, msg, frame); err != nil {
 		return fmt.Errorf("send StartConnection request: %w", err)
 	}
 
 	// Read ConnectionStarted message.
-	mt, frame, err := conn.ReadMessage()
+	msg, err = receiveAck(ctx, conn)
 	if err != nil {
 		return fmt.Errorf("read ConnectionStarted response: %w", err)
 	}
-	if mt != websocket.BinaryMessage && mt != websocket.TextMessage {
-		return fmt.Errorf("unexpected Websocket message type: %d", mt)
-	}
-
-	msg, _, err = Unmarshal(frame, protocol.containsSequence)
-	if err != nil {
-		glog.Infof("StartConnection response: %s", frame)
-		return fmt.Errorf("unmarshal ConnectionStarted response message: %w", err)
+	if msg.Type == MsgTypeError {
+		return handleServerError(msg)
 	}
 	if msg.Type != MsgTypeFullServer {
 		return fmt.Errorf("unexpected ConnectionStarted message type: %s", msg.Type)
@@ -83,12 +323,29 @@ func startConnection(conn *websocket.Conn) error {
 		return fmt.Errorf("unexpected response event (%d) for StartConnection request", msg.Event)
 	}
 	glog.Infof("Connection started (event=%d) connectID: %s, payload: %s", msg.Event, msg.ConnectID, msg.Payload)
+	glog.Infof("Protocol version: sent %d, server answered with %d", protocol.Version(), serverVersion.Load())
+	setConnStarted(conn, true)
+	sessionState.Set(StateConnected, nil)
+	return nil
+}
 
+func startSession(ctx context.Context, conn *websocket.Conn, sessionID string, req SessionPayload) error {
+	if err := sessionManager.acquire(conn, sessionID); err != nil {
+		return err
+	}
+	err := withNegotiationFallback(func() error { return doStartSession(ctx, conn, sessionID, req) })
+	if err != nil {
+		sessionManager.release(conn, sessionID)
+		sessionState.Set(StateFailed, err)
+		return err
+	}
+	resetAudioSequence()
+	sessionState.Set(StateSessionStarted, nil)
 	return nil
 }
 
-func startSession(conn *websocket.Conn, sessionID string, req *StartSessionPayload) error {
-	payload, err := json.Marshal(req)
+func doStartSession(ctx context.Context, conn *websocket.Conn, sessionID string, req SessionPayload) error {
+	payload, err := req.MarshalStartSession(sessionID)
 	if err != nil {
 		return fmt.Errorf("marshal StartSession request payload: %w", err)
 	}
@@ -101,30 +358,23 @@ func startSession(conn *websocket.Conn, sessionID string, req *StartSessionPaylo
 	msg.SessionID = sessionID
 	msg.Payload = payload
 
-	frame, err := protocol.Marshal(msg)
+	frame, err := marshalMessage(msg)
 	glog.Infof("StartSession request frame: %v", frame)
 	if err != nil {
 		return fmt.Errorf("marshal StartSession request message: %w", err)
 	}
 
-	if err := conn.WriteMessage(websocket.BinaryMessage, frame); err != nil {
+	if err := writeFrame(conn, msg, frame); err != nil {
 		return fmt.Errorf("send StartSession request: %w", err)
 	}
 
 	// Read SessionStarted message.
-	mt, frame, err := conn.ReadMessage()
+	msg, err = receiveAck(ctx, conn)
 	if err != nil {
 		return fmt.Errorf("read SessionStarted response: %w", err)
 	}
-	if mt != websocket.BinaryMessage && mt != websocket.TextMessage {
-		return fmt.Errorf("unexpected Websocket message type: %d", mt)
-	}
-
-	// Validate SessionStarted message.
-	msg, _, err = Unmarshal(frame, protocol.containsSequence)
-	if err != nil {
-		glog.Infof("StartSession response: %s", frame)
-		return fmt.Errorf("unmarshal SessionStarted response message: %w", err)
+	if msg.Type == MsgTypeError {
+		return handleServerError(msg)
 	}
 	if msg.Type != MsgTypeFullServer {
 		return fmt.Errorf("unexpected SessionStarted message type: %s", msg.Type)
@@ -137,11 +387,16 @@ func startSession(conn *websocket.Conn, sessionID string, req *StartSessionPaylo
 	if err := json.Unmarshal(msg.Payload, &jsonData); err != nil {
 		return fmt.Errorf("unmarshal SessionStarted response payload: %w", err)
 	}
-	dialogID = jsonData["dialog_id"].(string)
+	dialogID, _ = jsonData["dialog_id"].(string)
+	dialogIDs.record(sessionID, dialogID)
 	return nil
 }
 
 func sayHello(conn *websocket.Conn, sessionID string, req *SayHelloPayload) error {
+	if wait := sayHelloLimiter.take(time.Now()); wait > 0 {
+		glog.Warningf("SayHello request rate limited, next one allowed in %s.", wait.Round(time.Millisecond))
+		return fmt.Errorf("%w: next one allowed in %s", ErrSayHelloRateLimited, wait.Round(time.Millisecond))
+	}
 	payload, err := json.Marshal(req)
 	glog.Infof("SayHello request payload: %s", string(payload))
 	if err != nil {
@@ -156,13 +411,13 @@ func sayHello(conn *websocket.Conn, sessionID string, req *SayHelloPayload) erro
 	msg.SessionID = sessionID
 	msg.Payload = payload
 
-	frame, err := protocol.Marshal(msg)
+	frame, err := marshalMessage(msg)
 	glog.Infof("SayHello frame: %v", frame)
 	if err != nil {
 		return fmt.Errorf("marshal SayHello request message: %w", err)
 	}
 
-	if err := conn.WriteMessage(websocket.BinaryMessage, frame); err != nil {
+	if err := writeFrame(conn, msg, frame); err != nil {
 		return fmt.Errorf("send SayHello request: %w", err)
 	}
 	return nil
@@ -179,7 +434,6 @@ func chatTTSText(conn *websocket.Conn, sessionID string, req *ChatTTSTextPayload
 		return fmt.Errorf("marshal ChatTTSText request payload: %w", err)
 	}
 
-	protocol.SetSerialization(SerializationJSON)
 	msg, err := NewMessage(MsgTypeFullClient, MsgTypeFlagWithEvent)
 	if err != nil {
 		return fmt.Errorf("create ChatTTSText request message: %w", err)
@@ -188,108 +442,228 @@ func chatTTSText(conn *websocket.Conn, sessionID string, req *ChatTTSTextPayload
 	msg.SessionID = sessionID
 	msg.Payload = payload
 
-	frame, err := protocol.Marshal(msg)
+	frame, err := marshalMessage(msg)
 	glog.Infof("ChatTTSText frame: %v", frame)
 	if err != nil {
 		return fmt.Errorf("marshal ChatTTSText request message: %w", err)
 	}
 
-	wsWriteLock.Lock()
-	defer wsWriteLock.Unlock()
-	if err := conn.WriteMessage(websocket.BinaryMessage, frame); err != nil {
+	if err := writeFrame(conn, msg, frame); err != nil {
 		return fmt.Errorf("send ChatTTSText request: %w", err)
 	}
 	return nil
 }
 
-func sendAudio(ctx context.Context, c *websocket.Conn, sessionID string) {
-	go func() {
+// chatTextQuery sends a user query as text instead of audio.
+func chatTextQuery(conn *websocket.Conn, sessionID string, req *ChatTextQueryPayload) error {
+	payload, err := json.Marshal(req)
+	glog.Infof("ChatTextQuery request payload: %s", string(payload))
+	if err != nil {
+		return fmt.Errorf("marshal ChatTextQuery request payload: %w", err)
+	}
+
+	msg, err := NewMessage(MsgTypeFullClient, MsgTypeFlagWithEvent)
+	if err != nil {
+		return fmt.Errorf("create ChatTextQuery request message: %w", err)
+	}
+	msg.Event = 501
+	msg.SessionID = sessionID
+	msg.Payload = payload
+
+	frame, err := marshalMessage(msg)
+	if err != nil {
+		return fmt.Errorf("marshal ChatTextQuery request message: %w", err)
+	}
+
+	if err := writeFrame(conn, msg, frame); err != nil {
+		return fmt.Errorf("send ChatTextQuery request: %w", err)
+	}
+	return nil
+}
+
+// clientInterrupt asks the server to stop the bot answer in progress.
+func clientInterrupt(conn *websocket.Conn, sessionID string) error {
+	msg, err := NewMessage(MsgTypeFullClient, MsgTypeFlagWithEvent)
+	if err != nil {
+		return fmt.Errorf("create ClientInterrupt request message: %w", err)
+	}
+	msg.Event = 515
+	msg.SessionID = sessionID
+	msg.Payload = []byte("{}")
+
+	frame, err := marshalMessage(msg)
+	if err != nil {
+		return fmt.Errorf("marshal ClientInterrupt request message: %w", err)
+	}
+
+	if err := writeFrame(conn, msg, frame); err != nil {
+		return fmt.Errorf("send ClientInterrupt request: %w", err)
+	}
+	glog.Info("ClientInterrupt request is sent.")
+	return nil
+}
+
+// sendAudio streams the audio input until ctx is done, then finishes the
+// session. A failing audio input ends the dialog through stop, an exhausted
+// one once the bot answered it.
+func sendAudio(ctx context.Context, stop context.CancelCauseFunc, c *websocket.Conn, sessionID string) {
+	// 音频输入关闭之前不能释放音频设备，退出时由 shutdownManager 等待
+	shutdownManager.Go(func() {
 		defer func() {
 			if err := recover(); err != nil {
 				glog.Errorf("panic: %v", err)
 			}
 		}()
-		defaultInputDevice, err := portaudio.DefaultInputDevice()
-		if err != nil {
-			glog.Errorf("Failed to get default input device: %v", err)
+		// 会话就绪之前发送的音频会被服务端丢弃
+		if err := sessionState.WaitReady(ctx); err != nil {
+			glog.Errorf("Session not ready, audio input not started: %v", err)
 			return
 		}
-		glog.Infof("Using default input device: %s", defaultInputDevice.Name)
-		streamParameters := portaudio.StreamParameters{
-			Input: portaudio.StreamDeviceParameters{
-				Device:   defaultInputDevice,
-				Channels: 1,
-				Latency:  defaultInputDevice.DefaultLowInputLatency,
-			},
-			SampleRate:      16000,
-			FramesPerBuffer: 160,
-		}
-
-		stream, err := portaudio.OpenStream(streamParameters, func(in []int16) {
-			//glog.Infof("Sending audio: %v", in)
-			// 1. 将 int16 音频数据转换为 []byte (PCM S16LE)
-			audioBytes := make([]byte, len(in)*2)
-			for i, sample := range in {
-				audioBytes[i*2] = byte(sample & 0xff)
-				audioBytes[i*2+1] = byte((sample >> 8) & 0xff)
-			}
-
-			// 2. 设置序列化方式为原始数据
-			// 你提供的 sendAudioData 示例中在此处设置。确保这对你的协议是正确的。
-			protocol.SetSerialization(SerializationRaw)
-
-			// 3. 创建并发送消息
-			msg, err := NewMessage(MsgTypeAudioOnlyClient, MsgTypeFlagWithEvent)
+		glog.Info("Audio input started. please speak...")
+		p := newPacer(sendRateMultiplier)
+		utterances := newUtteranceGate(minUtteranceDuration)
+		for {
+			samples, err := audioSource.ReadFrame(ctx)
 			if err != nil {
-				glog.Errorf("Error creating audio message: %v", err)
-				return // 从回调中退出
+				if errors.Is(err, io.EOF) {
+					glog.Info("Audio input exhausted.")
+					for _, frame := range utterances.flush() {
+						if err := sendAudioFrame(c, sessionID, frame, MsgTypeFlagWithEvent); err != nil {
+							glog.Errorf("Error sending audio message: %v", err)
+						}
+					}
+					// 用一帧静音标记输入音频的最后一包
+					last := make([]int16, inputFramesPerBuffer)
+					if err := sendAudioFrame(c, sessionID, last, MsgTypeFlagLastNoSeq|MsgTypeFlagWithEvent); err != nil {
+						glog.Errorf("Error sending last audio message: %v", err)
+					}
+					// 等机器人回答完最后的输入再结束对话
+					go endAfterLastAnswer(ctx, stop)
+				} else if ctx.Err() == nil {
+					glog.Errorf("Failed to read audio input: %v", err)
+					stop(&ShutdownReason{Kind: ShutdownAudioFatal, Err: err})
+				}
+				break
 			}
-
-			msg.Event = 200
-			msg.SessionID = sessionID
-			msg.Payload = audioBytes
-
-			frame, err := protocol.Marshal(msg)
-			if err != nil {
-				glog.Errorf("Error marshalling audio message: %v", err)
-				return // 从回调中退出
+			if *inputSpec == "mic" {
+				formatCheck.checkUplink(len(samples))
 			}
-
-			wsWriteLock.Lock()
-			defer wsWriteLock.Unlock()
-			//glog.Infof("Sent %d bytes of audio data for frame %v", len(audioBytes), frame)
-			if err := c.WriteMessage(websocket.BinaryMessage, frame); err != nil {
-				glog.Errorf("Error sending audio message: %v", err)
-				// 持续发送失败可能需要停止音频流，目前仅记录日志。
-				return
+			// 按实时速率发送，避免文件输入瞬间把音频全部推给服务端
+			if err := p.wait(ctx, len(samples)); err != nil {
+				break
+			}
+			// 处理链可以丢弃整帧（如重复帧）
+			if samples = processInput(samples); len(samples) == 0 {
+				continue
+			}
+			// 过短的"语音"（按键声、咳嗽）以静音代替，避免触发多余的轮次
+			for _, frame := range utterances.push(gateInput(samples)) {
+				if err := sendAudioFrame(c, sessionID, frame, MsgTypeFlagWithEvent); err != nil {
+					glog.Errorf("Error sending audio message: %v", err)
+					// 持续发送失败可能需要停止音频流，目前仅记录日志。
+					continue
+				}
+				duplex.userAudio(frame)
+				sessionExport.userAudio(frame)
 			}
-		})
-		if err != nil {
-			glog.Errorf("Failed to open microphone input stream: %v", err)
-			return
 		}
-		defer stream.Close()
 
-		if err := stream.Start(); err != nil {
-			glog.Errorf("Failed to start microphone input stream: %v", err)
-			return
+		<-ctx.Done()
+		journal.Record(JournalCommand, 0, sessionID, "stop requested")
+		glog.Info("Stopping audio input due to context cancellation...")
+		if err := audioSource.Close(); err != nil {
+			glog.Errorf("Failed to close audio input: %v", err)
 		}
-		glog.Info("Microphone input stream started. please speak...")
+		err := finishSession(c, sessionID)
+		if err != nil {
+			glog.Errorf("Failed to finish session: %v", err)
+		}
+		// 服务端在 FinishSession 之后仍可能下发尾部音频，接收循环最多再等待 -finish-grace
+		_ = c.SetReadDeadline(time.Now().Add(finishGracePeriod))
+		glog.Info("Audio input stopped.")
+	})
+}
+
+var errInputExhausted = errors.New("audio input ended")
 
-		// 保持 goroutine 运行以允许回调处理音频
+// inputEndWait is how long after the input ended the server may take to
+// start a turn for its last words.
+const inputEndWait = 5 * time.Second
+
+// endAfterLastAnswer ends the dialog through stop once the bot answered the
+// input, which ended: when the user turn in progress finishes or, without
+// one, when a user turn recognized within inputEndWait does.
+func endAfterLastAnswer(ctx context.Context, stop context.CancelCauseFunc) {
+	finished, inProgress := turns.nextAnswer()
+	if !inProgress {
+		timer := time.NewTimer(inputEndWait)
+		defer timer.Stop()
 		select {
 		case <-ctx.Done():
-			glog.Info("Stopping microphone input stream due to context cancellation...")
-			if err := stream.Stop(); err != nil {
-				glog.Errorf("Failed to stop microphone input stream: %v", err)
-			}
-			err = finishSession(c, sessionID)
-			if err != nil {
-				glog.Errorf("Failed to finish session: %v", err)
+			return
+		case <-finished:
+		case <-timer.C:
+			finished, inProgress = turns.nextAnswer()
+			if inProgress {
+				break
 			}
+			glog.Info("Audio input ended without a turn to answer, ending the dialog.")
+			stop(&ShutdownReason{Kind: ShutdownUserRequested, Err: errInputExhausted})
+			return
+		}
+	}
+	select {
+	case <-ctx.Done():
+	case <-finished:
+		glog.Info("Bot answered the last input, ending the dialog.")
+		stop(&ShutdownReason{Kind: ShutdownUserRequested, Err: errInputExhausted})
+	}
+}
+
+// sendAudioFrame sends one frame of input audio with the given message type
+// specific flag, which must include MsgTypeFlagWithEvent; the frame is
+// numbered if WithAudioSequence is set.
+func sendAudioFrame(c *websocket.Conn, sessionID string, samples []int16, flag MsgTypeFlagBits) error {
+	msg, err := NewMessage(MsgTypeAudioOnlyClient, flag)
+	if err != nil {
+		return fmt.Errorf("create audio message: %w", err)
+	}
+	msg.Event = 200
+	msg.SessionID = sessionID
+	msg.Payload = samplesToBytes(samples)
+	sequenceAudioFrame(msg)
+
+	p, err := messageProtocol(msg)
+	if err != nil {
+		return fmt.Errorf("marshal audio message: %w", err)
+	}
+	// 音频帧发送频繁，直接发送池中缓冲区里的帧，省去一次拷贝
+	var sendErr error
+	err = p.MarshalTo(msg, func(frame []byte) error {
+		if sendErr = writeFrame(c, msg, frame); sendErr == nil {
+			audioFrameSizes.observe(len(frame))
+			counters.userSamples.Add(uint64(len(samples)))
 		}
-		glog.Info("Microphone input stream stopped.")
-	}()
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("marshal audio message: %w", err)
+	}
+	if sendErr != nil {
+		return fmt.Errorf("send audio message: %w", sendErr)
+	}
+	return nil
+}
+
+// finishGracePeriod bounds how long the receive loop keeps playing late audio
+// after FinishSession while waiting for SessionFinished.
+var finishGracePeriod = 3 * time.Second
+
+// WithFinishGrace sets how long audio still arriving after FinishSession is
+// played before the connection is closed regardless of SessionFinished. Zero
+// or less gives no grace: the receive loop stops right after FinishSession.
+func WithFinishGrace(d time.Duration) {
+	finishGracePeriod = max(d, 0)
 }
 
 func finishSession(conn *websocket.Conn, sessionID string) error {
@@ -301,12 +675,12 @@ func finishSession(conn *websocket.Conn, sessionID string) error {
 	msg.SessionID = sessionID
 	msg.Payload = []byte("{}")
 
-	frame, err := protocol.Marshal(msg)
+	frame, err := marshalMessage(msg)
 	if err != nil {
 		return fmt.Errorf("marshal FinishSession request message: %w", err)
 	}
 
-	if err := conn.WriteMessage(websocket.BinaryMessage, frame); err != nil {
+	if err := writeFrame(conn, msg, frame); err != nil {
 		return fmt.Errorf("send FinishSession request: %w", err)
 	}
 
@@ -314,6 +688,30 @@ func finishSession(conn *websocket.Conn, sessionID string) error {
 	return nil
 }
 
+// waitSessionFinished reads server frames until the session is reported as
+// finished (event=152) or failed (event=153).
+func waitSessionFinished(conn *websocket.Conn) error {
+	for {
+		msg, err := receiveMessage(conn)
+		if err != nil {
+			return fmt.Errorf("read SessionFinished response: %w", err)
+		}
+		if msg.Type == MsgTypeError {
+			return handleServerError(msg)
+		}
+		switch msg.Event {
+		case 152:
+			glog.Infof("Session finished (event=%d).", msg.Event)
+			sessionState.Set(StateSessionFinished, nil)
+			return nil
+		case 153:
+			err := fmt.Errorf("session failed (event=%d): %s", msg.Event, msg.Payload)
+			sessionState.Set(StateFailed, err)
+			return err
+		}
+	}
+}
+
 func finishConnection(conn *websocket.Conn) error {
 	msg, err := NewMessage(MsgTypeFullClient, MsgTypeFlagWithEvent)
 	if err != nil {
@@ -322,28 +720,23 @@ func finishConnection(conn *websocket.Conn) error {
 	msg.Event = 2
 	msg.Payload = []byte("{}")
 
-	frame, err := protocol.Marshal(msg)
+	frame, err := marshalMessage(msg)
 	if err != nil {
 		return fmt.Errorf("marshal FinishConnection request message: %w", err)
 	}
 
-	if err := conn.WriteMessage(websocket.BinaryMessage, frame); err != nil {
+	if err := writeFrame(conn, msg, frame); err != nil {
 		return fmt.Errorf("send FinishConnection request: %w", err)
 	}
+	setConnStarted(conn, false)
 
-	// Read ConnectionStarted message.
-	mt, frame, err := conn.ReadMessage()
+	// Read ConnectionFinished message.
+	msg, err = receiveMessage(conn)
 	if err != nil {
 		return fmt.Errorf("read ConnectionFinished response: %w", err)
 	}
-	if mt != websocket.BinaryMessage && mt != websocket.TextMessage {
-		return fmt.Errorf("unexpected Websocket message type: %d", mt)
-	}
-
-	msg, _, err = Unmarshal(frame, protocol.containsSequence)
-	if err != nil {
-		glog.Infof("FinishConnection response: %s", frame)
-		return fmt.Errorf("unmarshal ConnectionFinished response message: %w", err)
+	if msg.Type == MsgTypeError {
+		return handleServerError(msg)
 	}
 	if msg.Type != MsgTypeFullServer {
 		return fmt.Errorf("unexpected ConnectionFinished message type: %s", msg.Type)
@@ -353,5 +746,6 @@ func finishConnection(conn *websocket.Conn) error {
 	}
 
 	glog.Infof("Connection finished (event=%d).", msg.Event)
+	sessionState.Set(StateIdle, nil)
 	return nil
 }
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// TestInputEndEndsDialog checks that a dialog on a file input ends once the
+// bot answered what the file said.
+func TestInputEndEndsDialog(t *testing.T) {
+	const frames = 3
+	s := newFakeServer(t, func(c *fakeConn) {
+		sid := c.handshake("dialog-1")
+		if c.expect(300) == nil {
+			return
+		}
+		c.answer(sid, "你好", 2400)
+		for c.audioFrames < frames {
+			if c.read() == nil {
+				c.t.Errorf("fake server: client hung up after %d audio frames, want %d", c.audioFrames, frames)
+				return
+			}
+		}
+		c.userTurn(sid, "今天天气怎么样")
+		c.answer(sid, "晴天", 4800)
+		c.finish(sid)
+	})
+	setupDialog(t, s)
+	src := &MemorySource{}
+	for range frames {
+		src.Frames = append(src.Frames, make([]int16, inputFramesPerBuffer))
+	}
+	WithAudioSource(src)
+
+	summary, err := runFakeDialog(t)
+	if err != nil {
+		t.Fatalf("realTimeDialog() = %v, want nil once the input ended", err)
+	}
+	if !strings.HasPrefix(summary.DisconnectReason, ShutdownUserRequested.String()) || !strings.Contains(summary.DisconnectReason, errInputExhausted.Error()) {
+		t.Errorf("summary.DisconnectReason = %q, want the user quitting as the input ended", summary.DisconnectReason)
+	}
+	if got := turns.Transcript(); len(got) != 2 || got[1].BotText != "晴天" {
+		t.Errorf("transcript = %+v, want the greeting and the answer to the input", got)
+	}
+}
+
+func TestSwitchSourceContinuesAfterEOF(t *testing.T) {
+	setupDialog(t, nil)
+	s := newSwitchSource(&MemorySource{Frames: [][]int16{{1}}}, "file.wav")
+	ctx := t.Context()
+	if got, err := s.ReadFrame(ctx); err != nil || len(got) != 1 {
+		t.Fatalf("ReadFrame() = %v, %v, want the frame of the file", got, err)
+	}
+	if got, err := s.ReadFrame(ctx); err != nil || len(got) != inputFramesPerBuffer {
+		t.Fatalf("ReadFrame() after EOF = %d samples, %v, want a frame of silence", len(got), err)
+	}
+	audioSource = s
+	if err := PlaySource(&MemorySource{Frames: [][]int16{{2}}}, "play.wav"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s.ReadFrame(ctx); err != nil || len(got) != 1 || got[0] != 2 {
+		t.Errorf("ReadFrame() after /play = %v, %v, want the played frame", got, err)
+	}
+	if err := s.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestConcurrentRequests hammers the request functions from several
+// goroutines, then checks that every frame arrived whole and that requests
+// after closeConn fail with ErrClientClosed. Run it with -race.
+func TestConcurrentRequests(t *testing.T) {
+	const perGoroutine = 50
+	received := make(chan int, 1)
+	s := newFakeServer(t, func(c *fakeConn) {
+		c.handshake("dialog-1")
+		for c.read() != nil {
+		}
+		received <- len(c.events) + c.audioFrames
+	})
+	setupDialog(t, s)
+	conn := dialFake(t)
+	if err := startConnection(t.Context(), conn); err != nil {
+		t.Fatal(err)
+	}
+	if err := startSession(t.Context(), conn, "session-1", product.NewSessionPayload()); err != nil {
+		t.Fatal(err)
+	}
+
+	requests := []func() error{
+		func() error { return sayHello(conn, "session-1", &SayHelloPayload{Content: "你好"}) },
+		func() error { return chatTextQuery(conn, "session-1", &ChatTextQueryPayload{Content: "天气"}) },
+		func() error { return clientInterrupt(conn, "session-1") },
+		func() error {
+			return sendAudioFrame(conn, "session-1", make([]int16, inputFramesPerBuffer), MsgTypeFlagWithEvent)
+		},
+	}
+	var wg sync.WaitGroup
+	for _, request := range requests {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range perGoroutine {
+				if err := request(); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if err := closeConn(conn); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := <-received, 2+len(requests)*perGoroutine; got != want {
+		t.Errorf("server received %d frames, want %d", got, want)
+	}
+	for i, request := range requests {
+		if err := request(); !errors.Is(err, ErrClientClosed) {
+			t.Errorf("request %d after closeConn = %v, want ErrClientClosed", i, err)
+		}
+	}
+}
+
+// finishGraceDialog runs a dialog the user quits, against a server sending
+// late audio delay after FinishSession, and returns the samples played.
+func finishGraceDialog(t *testing.T, grace, delay time.Duration) int {
+	t.Helper()
+	s := newFakeServer(t, func(c *fakeConn) {
+		sid := c.handshake("dialog-1")
+		// 用户马上退出，问候语可能来不及发出；没有宽限期时客户端可能已经断开
+		for msg := c.read(); msg == nil || msg.Event != 102; msg = c.read() {
+			if msg == nil {
+				return
+			}
+		}
+		time.Sleep(delay)
+		c.send(serverAudio(sid, make([]float32, 2400)))
+		c.send(serverFrame(152, sid, `{}`))
+		for msg := c.read(); msg != nil; msg = c.read() {
+			if msg.Event == 2 {
+				c.send(serverFrame(52, "conn-1", `{}`))
+			}
+		}
+	})
+	_, speaker := setupDialog(t, s)
+	WithFinishGrace(grace)
+	conn := dialFake(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, err := realTimeDialog(ctx, conn, "session-1")
+		done <- err
+	}()
+	if err := sessionState.WaitReady(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(grace + 5*time.Second):
+		t.Fatal("dialog did not end within the finish grace period")
+	}
+	if err := shutdownManager.GracefulShutdown(time.Second); err != nil {
+		t.Error(err)
+	}
+	return speaker.played()
+}
+
+func TestFinishGrace(t *testing.T) {
+	if got := finishGraceDialog(t, time.Second, 50*time.Millisecond); got != 2400 {
+		t.Errorf("played %d samples, want the 2400 arriving within the grace period", got)
+	}
+}
+
+func TestFinishGraceZero(t *testing.T) {
+	start := time.Now()
+	if got := finishGraceDialog(t, 0, 200*time.Millisecond); got != 0 {
+		t.Errorf("played %d samples without grace, want none", got)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("dialog without grace took %v to end", d)
+	}
+	WithFinishGrace(-time.Second)
+	if finishGracePeriod != 0 {
+		t.Errorf("WithFinishGrace(-1s) set %v, want no grace", finishGracePeriod)
+	}
+}
+
+func TestSpeakingRate(t *testing.T) {
+	t.Cleanup(func() { _ = WithSpeakingRate(0) })
+	for _, rate := range []float64{0.49, 2.01, -1} {
+		if err := WithSpeakingRate(rate); !errors.Is(err, errInvalidSpeakingRate) {
+			t.Errorf("WithSpeakingRate(%v) = %v, want errInvalidSpeakingRate", rate, err)
+		}
+	}
+	if err := WithSpeakingRate(0.8); err != nil {
+		t.Fatal(err)
+	}
+	data, err := newStartSessionPayload().MarshalStartSession("s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"speech_rate":0.8`) {
+		t.Errorf("StartSession payload %s lacks \"speech_rate\":0.8", data)
+	}
+	_ = WithSpeakingRate(0)
+	if data, _ := newStartSessionPayload().MarshalStartSession("s1"); strings.Contains(string(data), "speech_rate") {
+		t.Errorf("StartSession payload %s sends a speech_rate without WithSpeakingRate", data)
+	}
+}
+
+func TestEmotionStyle(t *testing.T) {
+	t.Cleanup(func() { _ = WithEmotionStyle("") })
+	for _, style := range []string{"angry", "Calm", " "} {
+		if err := WithEmotionStyle(style); !errors.Is(err, errInvalidEmotionStyle) {
+			t.Errorf("WithEmotionStyle(%q) = %v, want errInvalidEmotionStyle", style, err)
+		}
+	}
+	for _, style := range SupportedEmotionStyles() {
+		if err := WithEmotionStyle(style); err != nil {
+			t.Errorf("WithEmotionStyle(%q) = %v, want nil", style, err)
+		}
+	}
+	if err := WithEmotionStyle("calm"); err != nil {
+		t.Fatal(err)
+	}
+	data, err := newStartSessionPayload().MarshalStartSession("s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"emotion_style":"calm"`) {
+		t.Errorf("StartSession payload %s lacks \"emotion_style\":\"calm\"", data)
+	}
+	_ = WithEmotionStyle("")
+	if data, _ := newStartSessionPayload().MarshalStartSession("s1"); strings.Contains(string(data), "emotion_style") {
+		t.Errorf("StartSession payload %s sends an emotion_style without WithEmotionStyle", data)
+	}
+}
+
+// TestClosedConnForgotten checks that closeConn does not keep an entry per
+// connection once the connection is gone.
+func TestClosedConnForgotten(t *testing.T) {
+	s := newFakeServer(t, func(c *fakeConn) {
+		for c.read() != nil {
+		}
+	})
+	setupDialog(t, s)
+	for range 10 {
+		conn, _, err := dial(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := closeConn(conn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		runtime.GC()
+		wsWriteLock.Lock()
+		n := len(closedConns)
+		wsWriteLock.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d closed connections still tracked", n)
+		}
+	}
+}
+
+// TestHandshakeCanceled cancels the context while StartConnection and
+// StartSession wait for a server that never answers and checks that they
+// return promptly with the context error.
+func TestHandshakeCanceled(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		start func(ctx context.Context, conn *websocket.Conn) error
+	}{
+		{"StartConnection", startConnection},
+		{"StartSession", func(ctx context.Context, conn *websocket.Conn) error {
+			return startSession(ctx, conn, "session-1", newStartSessionPayload())
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newFakeServer(t, func(c *fakeConn) {
+				for c.read() != nil {
+				}
+			})
+			setupDialog(t, s)
+			conn := dialFake(t)
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(100*time.Millisecond, cancel)
+
+			done := make(chan error, 1)
+			go func() { done <- tc.start(ctx, conn) }()
+			select {
+			case err := <-done:
+				if !errors.Is(err, context.Canceled) {
+					t.Errorf("%s() = %v, want context.Canceled", tc.name, err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("%s() still waiting for the ack after the context was canceled", tc.name)
+			}
+		})
+	}
+}
+
+// TestPayloadInterceptor checks that the payloads rewritten by the
+// interceptor are what the server receives, and that an interceptor error
+// aborts the send.
+func TestPayloadInterceptor(t *testing.T) {
+	payloads := make(chan string, 4)
+	s := newFakeServer(t, func(c *fakeConn) {
+		c.handshake("dialog-1")
+		for msg := c.read(); msg != nil; msg = c.read() {
+			payloads <- string(msg.Payload)
+		}
+	})
+	setupDialog(t, s)
+	errRejected := errors.New("rejected by the test")
+	var types []MsgType
+	WithPayloadInterceptor(func(msgType MsgType, payload []byte) ([]byte, error) {
+		types = append(types, msgType)
+		if strings.Contains(string(payload), "blocked") {
+			return nil, errRejected
+		}
+		var fields map[string]any
+		if err := json.Unmarshal(payload, &fields); err != nil {
+			return nil, err
+		}
+		fields["ab_group"] = "B"
+		return json.Marshal(fields)
+	})
+	t.Cleanup(func() { WithPayloadInterceptor(nil) })
+
+	conn := dialFake(t)
+	if err := startConnection(t.Context(), conn); err != nil {
+		t.Fatal(err)
+	}
+	if err := startSession(t.Context(), conn, "session-1", newStartSessionPayload()); err != nil {
+		t.Fatal(err)
+	}
+	if err := chatTextQuery(conn, "session-1", &ChatTextQueryPayload{Content: "blocked"}); !errors.Is(err, errRejected) {
+		t.Errorf("chatTextQuery() = %v, want the interceptor error", err)
+	}
+	if err := chatTextQuery(conn, "session-1", &ChatTextQueryPayload{Content: "你好"}); err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]any
+	if err := json.Unmarshal([]byte(<-payloads), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got["content"] != "你好" || got["ab_group"] != "B" {
+		t.Errorf("server got ChatTextQuery payload %v, want 你好 with the injected ab_group", got)
+	}
+	for _, mt := range types {
+		if mt != MsgTypeFullClient {
+			t.Errorf("interceptor called with %s, want only %s", mt, MsgTypeFullClient)
+		}
+	}
+	if len(types) != 4 {
+		t.Errorf("interceptor called %d times, want 4", len(types))
+	}
+}
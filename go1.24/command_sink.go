@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// commandWaitTimeout bounds how long Close waits for the playback command to
+// drain its input before killing it.
+const commandWaitTimeout = 5 * time.Second
+
+var errPlaybackExited = errors.New("playback command exited")
+
+// playbackCommand, if set, replaces the -output sink with a subprocess reading
+// the received PCM on its stdin.
+var playbackCommand []string
+
+// WithPlaybackCommand plays the received audio by piping raw PCM S16LE 24kHz
+// mono to the stdin of the command argv, e.g.
+// []string{"ffplay", "-nodisp", "-f", "s16le", "-ar", "24000", "-ac", "1", "-"}.
+func WithPlaybackCommand(argv []string) {
+	playbackCommand = argv
+}
+
+// commandSink writes raw PCM S16LE frames to the stdin of a subprocess.
+type commandSink struct {
+	lock   sync.Mutex
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	w      *bufio.Writer
+	exited chan struct{}
+	err    error // set once the process exited
+	// reported is set once a write returned err.
+	reported bool
+	closed   bool
+}
+
+// NewCommandSink starts argv and returns a sink writing to its stdin. The
+// command's own output goes to stderr, next to the log. If the command dies,
+// the next write reports errPlaybackExited and later audio is dropped.
+func NewCommandSink(argv []string) (AudioSink, error) {
+	if len(argv) == 0 {
+		return nil, errors.New("empty playback command")
+	}
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("create playback command stdin: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("start playback command: %w", err)
+	}
+	s := &commandSink{
+		cmd:    cmd,
+		stdin:  stdin,
+		w:      bufio.NewWriter(stdin),
+		exited: make(chan struct{}),
+	}
+	go s.wait()
+	glog.Infof("Playback command started (pid=%d): %v", cmd.Process.Pid, argv)
+	return s, nil
+}
+
+// wait reaps the process and records why it exited.
+func (s *commandSink) wait() {
+	err := s.cmd.Wait()
+	s.lock.Lock()
+	if !s.closed {
+		if err == nil {
+			err = errors.New("exit status 0")
+		}
+		glog.Errorf("Playback command exited unexpectedly: %v, dropping audio", err)
+	}
+	s.err = fmt.Errorf("%w: %v", errPlaybackExited, err)
+	s.lock.Unlock()
+	close(s.exited)
+}
+
+func (s *commandSink) WriteFrame(samples []int16) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.err != nil && !s.reported {
+		s.reported = true
+		return s.err
+	}
+	if s.err != nil || s.closed {
+		return nil
+	}
+	if _, err := s.w.Write(samplesToBytes(samples)); err != nil {
+		return fmt.Errorf("%w: %v", errPlaybackExited, err)
+	}
+	return nil
+}
+
+// Flush pushes the buffered audio to the command. Audio the command has
+// already read cannot be taken back.
+func (s *commandSink) Flush() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.err != nil || s.closed {
+		return nil
+	}
+	if err := s.w.Flush(); err != nil {
+		return fmt.Errorf("%w: %v", errPlaybackExited, err)
+	}
+	return nil
+}
+
+// Close closes the command's stdin and waits for it to exit, killing it after
+// commandWaitTimeout.
+func (s *commandSink) Close() error {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return nil
+	}
+	s.closed = true
+	var err error
+	if s.err == nil {
+		err = s.w.Flush()
+	}
+	if cerr := s.stdin.Close(); err == nil && s.err == nil {
+		err = cerr
+	}
+	s.lock.Unlock()
+
+	select {
+	case <-s.exited:
+	case <-time.After(commandWaitTimeout):
+		glog.Warningf("Playback command did not exit within %s, killing it.", commandWaitTimeout)
+		_ = s.cmd.Process.Kill()
+		<-s.exited
+	}
+	return err
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestCommandSink(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out.pcm")
+	sink, err := NewCommandSink([]string{"sh", "-c", "cat > " + out})
+	if err != nil {
+		t.Skipf("no shell: %v", err)
+	}
+	samples := []int16{1, -2, 300}
+	if err := sink.WriteFrame(samples); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	cs := sink.(*commandSink)
+	if cs.cmd.ProcessState == nil {
+		t.Error("playback command not reaped after Close")
+	}
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := bytesToSamples(data); !slices.Equal(got, samples) {
+		t.Errorf("command read %v, want %v", got, samples)
+	}
+}
+
+func TestCommandSinkExited(t *testing.T) {
+	sink, err := NewCommandSink([]string{"sh", "-c", "exit 3"})
+	if err != nil {
+		t.Skipf("no shell: %v", err)
+	}
+	select {
+	case <-sink.(*commandSink).exited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("playback command did not exit")
+	}
+	if err := sink.WriteFrame([]int16{1}); !errors.Is(err, errPlaybackExited) {
+		t.Errorf("WriteFrame() after the command died = %v, want errPlaybackExited", err)
+	}
+	if err := sink.WriteFrame([]int16{1}); err != nil {
+		t.Errorf("second WriteFrame() = %v, want the audio dropped", err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Error(err)
+	}
+}
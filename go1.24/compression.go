@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var errUnsupportedCompression = errors.New("unsupported compression")
+
+// parseCompression parses the -compression flag. zstd is recognized but
+// rejected: the protocol header has no compression bits for it.
+func parseCompression(s string) (CompressionBits, error) {
+	switch s {
+	case "none":
+		return CompressionNone, nil
+	case "gzip":
+		return CompressionGzip, nil
+	case "zstd":
+		return CompressionNone, fmt.Errorf("%w: zstd, the protocol only defines gzip", errUnsupportedCompression)
+	default:
+		return CompressionNone, fmt.Errorf("%w: %q, want none or gzip", errUnsupportedCompression, s)
+	}
+}
+
+// WithCompression compresses the payload of every request with c at level,
+// which for gzip ranges from gzip.HuffmanOnly to gzip.BestCompression, with
+// gzip.DefaultCompression the default. Compressed responses are decompressed
+// whatever the setting.
+func WithCompression(c CompressionBits, level int) error {
+	switch c {
+	case CompressionNone:
+		protocol.SetCompression(CompressionNone, nil)
+	case CompressionGzip:
+		if _, err := gzip.NewWriterLevel(io.Discard, level); err != nil {
+			return fmt.Errorf("gzip level %d: %w", level, err)
+		}
+		protocol.SetCompression(CompressionGzip, gzipCompressor(level))
+	default:
+		return fmt.Errorf("%w: %s", errUnsupportedCompression, c)
+	}
+	return nil
+}
+
+// gzipCompressor returns a CompressFunc gzipping at level.
+func gzipCompressor(level int) CompressFunc {
+	return func(payload []byte) ([]byte, error) {
+		var buf bytes.Buffer
+		w, err := gzip.NewWriterLevel(&buf, level)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(payload); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+}
+
+// decompressPayload returns payload, received with compression c, as sent
+// before compression. Like the fields of a frame, the decompressed payload is
+// limited to maxDecodedFieldSize, so that a small corrupt or malicious payload
+// cannot inflate to gigabytes.
+func decompressPayload(c CompressionBits, payload []byte) ([]byte, error) {
+	switch c {
+	case CompressionNone:
+		return payload, nil
+	case CompressionGzip:
+		r, err := gzip.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		data, err := io.ReadAll(io.LimitReader(r, maxDecodedFieldSize+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(data) > maxDecodedFieldSize {
+			return nil, fmt.Errorf("decompress payload: %w: over %d bytes", errFieldTooLarge, maxDecodedFieldSize)
+		}
+		return data, nil
+	default:
+		return nil, fmt.Errorf("%w: %s", errUnsupportedCompression, c)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"testing"
+)
+
+func TestParseCompression(t *testing.T) {
+	for s, want := range map[string]CompressionBits{"none": CompressionNone, "gzip": CompressionGzip} {
+		if got, err := parseCompression(s); err != nil || got != want {
+			t.Errorf("parseCompression(%q) = %v, %v, want %v", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"zstd", "", "GZIP"} {
+		if _, err := parseCompression(s); !errors.Is(err, errUnsupportedCompression) {
+			t.Errorf("parseCompression(%q) = %v, want errUnsupportedCompression", s, err)
+		}
+	}
+}
+
+func TestDecompressPayload(t *testing.T) {
+	payload := []byte(`{"content":"你好"}`)
+	compressed, err := gzipCompressor(gzip.BestSpeed)(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := decompressPayload(CompressionGzip, compressed)
+	if err != nil || !bytes.Equal(got, payload) {
+		t.Errorf("decompressPayload() = %q, %v, want %q", got, err, payload)
+	}
+	if _, err := decompressPayload(CompressionGzip, payload); err == nil {
+		t.Error("decompressPayload() of a payload that is not gzip = nil, want an error")
+	}
+}
+
+// TestDecompressPayloadTooLarge checks that a payload inflating past
+// maxDecodedFieldSize is rejected.
+func TestDecompressPayloadTooLarge(t *testing.T) {
+	var bomb bytes.Buffer
+	w, err := gzip.NewWriterLevel(&bomb, gzip.BestSpeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zeros := make([]byte, 1<<20)
+	for range maxDecodedFieldSize >> 20 {
+		_, _ = w.Write(zeros)
+	}
+	_, _ = w.Write([]byte{0})
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := decompressPayload(CompressionGzip, bomb.Bytes()); !errors.Is(err, errFieldTooLarge) {
+		t.Errorf("decompressPayload() of %d compressed bytes over the limit = %v, want errFieldTooLarge", bomb.Len(), err)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// A config file sets flags, one per line, by their name without the dash:
+//
+//	# comment
+//	idle-timeout = 45s
+//	idle-behavior = notify
+//	v = 1
+//
+// Flags given on the command line take precedence over the file. On SIGHUP the
+// file is read again and the settings in reloadableFlags are applied to the
+// running dialog. Any other setting, e.g. the credentials or -tls-sni, needs a
+// restart: a reload changing it only logs a warning. Removing a line keeps the
+// current value.
+
+var errInvalidConfig = errors.New("invalid config")
+
+// reloadableFlags maps the flags a reload applies to their group in
+// reloadGroups; "" for flags that take effect when set, like the glog level.
+var reloadableFlags = map[string]string{
+	"idle-timeout":   "idle",
+	"idle-behavior":  "idle",
+	"v":              "",
+	"stats-interval": "stats",
+}
+
+// reloadGroups puts each group of reloaded flags into effect.
+var reloadGroups = map[string]func() error{
+	"idle":  applyIdleFlags,
+	"stats": applyStatsInterval,
+}
+
+// configFile is a loaded config file.
+type configFile struct {
+	path string
+	// cmdline holds the flags set on the command line, which the file does
+	// not override.
+	cmdline map[string]bool
+	values  map[string]string
+}
+
+// loadConfig reads the config file at path and sets the flags it contains
+// that are not in cmdline, the names of the flags given on the command line.
+// cmdline is taken once after flag.Parse: the flags the file sets count as set
+// too, so they cannot be told apart from the command line later.
+func loadConfig(path string, cmdline map[string]bool) (*configFile, error) {
+	values, err := readConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &configFile{path: path, cmdline: cmdline, values: values}
+	for _, name := range sortedKeys(values) {
+		if c.cmdline[name] {
+			continue
+		}
+		if err := flag.Set(name, values[name]); err != nil {
+			return nil, fmt.Errorf("%w: %s: %s: %v", errInvalidConfig, path, name, err)
+		}
+	}
+	return c, nil
+}
+
+// readConfig parses the config file at path into flag values by name.
+func readConfig(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	values := map[string]string{}
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(line, "=")
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("%w: %s line %d: want name = value", errInvalidConfig, path, n)
+		}
+		if flag.Lookup(name) == nil || name == "config" {
+			return nil, fmt.Errorf("%w: %s line %d: unknown flag %q", errInvalidConfig, path, n, name)
+		}
+		values[name] = value
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// reload reads the config file again and applies the reloadable settings that
+// changed, except those given on the command line. If the file is invalid
+// nothing changes.
+func (c *configFile) reload() error {
+	values, err := readConfig(c.path)
+	if err != nil {
+		return err
+	}
+	groups := map[string]bool{}
+	for _, name := range sortedKeys(values) {
+		value := values[name]
+		if old, ok := c.values[name]; ok && old == value {
+			continue
+		}
+		group, ok := reloadableFlags[name]
+		switch {
+		case c.cmdline[name]:
+			glog.Warningf("Config %s: %s is set on the command line, ignoring %s = %s", c.path, name, name, value)
+			continue
+		case !ok:
+			glog.Warningf("Config %s: %s changed to %s, restart to apply it", c.path, name, value)
+			continue
+		}
+		// 先校验再设置，避免 flag 的值与正在生效的设置不一致
+		if err := checkReloadValue(name, value); err != nil {
+			glog.Errorf("Config %s: %s: %v", c.path, name, err)
+			continue
+		}
+		if err := flag.Set(name, value); err != nil {
+			glog.Errorf("Config %s: %s: %v", c.path, name, err)
+			continue
+		}
+		glog.Infof("Config %s: %s = %s", c.path, name, value)
+		if group != "" {
+			groups[group] = true
+		}
+	}
+	c.values = values
+	// 同一组设置（如 idle-timeout 与 idle-behavior）一起生效
+	for _, group := range sortedKeys(groups) {
+		if err := reloadGroups[group](); err != nil {
+			glog.Errorf("Config %s: %v", c.path, err)
+		}
+	}
+	return nil
+}
+
+// checkReloadValue rejects a value of a reloadable flag that the flag itself
+// would accept but its group could not apply, before the flag is set, so that
+// the flag keeps the value in effect.
+func checkReloadValue(name, value string) error {
+	switch name {
+	case "idle-behavior":
+		_, err := parseTimeoutBehavior(value)
+		return err
+	case "stats-interval":
+		d, err := time.ParseDuration(value)
+		if err == nil && d > 0 && len(registeredReporters()) == 0 {
+			return errors.New("statistics were off at startup, restart to turn them on")
+		}
+	}
+	return nil
+}
+
+// applyIdleFlags applies -idle-timeout and -idle-behavior.
+func applyIdleFlags() error {
+	behavior, err := parseTimeoutBehavior(*idleBehavior)
+	if err != nil {
+		return fmt.Errorf("idle-behavior: %w", err)
+	}
+	WithBotResponseTimeout(*idleTimeout, behavior)
+	return nil
+}
+
+// applyStatsInterval applies -stats-interval. Reports that were off at
+// startup stay off, checkReloadValue refuses to turn them on: their reporters
+// were never registered.
+func applyStatsInterval() error {
+	SetStatsInterval(*statsInterval)
+	return nil
+}
+
+// sortedKeys returns the keys of m in order, so that settings apply
+// deterministically.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
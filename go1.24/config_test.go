@@ -0,0 +1,69 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestConfigReload loads a config file, then reloads it after changing it
+// and checks which settings take effect: the idle settings, except an invalid
+// idle-behavior, which leaves both the flag and the running setting alone,
+// and not a setting that needs a restart.
+func TestConfigReload(t *testing.T) {
+	for _, name := range []string{"idle-timeout", "idle-behavior", "wrap-up-text"} {
+		old := flag.Lookup(name).Value.String()
+		t.Cleanup(func() { _ = flag.Set(name, old) })
+	}
+	timeout, behavior := idleSettings()
+	t.Cleanup(func() { WithBotResponseTimeout(timeout, behavior) })
+	path := filepath.Join(t.TempDir(), "dialog.conf")
+	write := func(config string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(what string, timeout time.Duration, behavior TimeoutBehavior) {
+		t.Helper()
+		if *idleTimeout != timeout || *idleBehavior != behavior.String() {
+			t.Errorf("%s: flags = %v, %s, want %v, %v", what, *idleTimeout, *idleBehavior, timeout, behavior)
+		}
+		if gotTimeout, gotBehavior := idleSettings(); gotTimeout != timeout || gotBehavior != behavior {
+			t.Errorf("%s: idle settings = %v, %v, want %v, %v", what, gotTimeout, gotBehavior, timeout, behavior)
+		}
+	}
+
+	write("# idle\nidle-timeout = 45s\nidle-behavior = notify\nwrap-up-text = 好的\n")
+	c, err := loadConfig(path, map[string]bool{})
+	if err != nil {
+		t.Fatalf("loadConfig() = %v", err)
+	}
+	if err := applyIdleFlags(); err != nil {
+		t.Fatal(err)
+	}
+	check("loaded", 45*time.Second, TimeoutBehaviorNotify)
+
+	write("idle-timeout = 1m\nidle-behavior = bogus\nwrap-up-text = 再见\n")
+	if err := c.reload(); err != nil {
+		t.Fatalf("reload() = %v", err)
+	}
+	check("invalid idle-behavior", time.Minute, TimeoutBehaviorNotify)
+	if *wrapUpText != "好的" {
+		t.Errorf("wrap-up-text = %q after a reload, want it to need a restart", *wrapUpText)
+	}
+
+	write("idle-timeout = 1m\nidle-behavior = terminate\n")
+	if err := c.reload(); err != nil {
+		t.Fatalf("reload() = %v", err)
+	}
+	check("valid idle-behavior", time.Minute, TimeoutBehaviorTerminate)
+
+	write("idle-timeout = 2m\nidle-behavior\n")
+	if err := c.reload(); err == nil {
+		t.Error("reload() of an invalid file = nil, want an error")
+	}
+	check("invalid file", time.Minute, TimeoutBehaviorTerminate)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Kinds of CredentialError, to test with errors.Is.
+var (
+	// ErrCredentialsRejected means the service rejected the credentials
+	// without telling which one is wrong.
+	ErrCredentialsRejected = errors.New("credentials rejected")
+	ErrBadAppID            = errors.New("invalid app id")
+	ErrBadAccessToken      = errors.New("invalid access token")
+	ErrBadResourceID       = errors.New("invalid resource id")
+)
+
+// handshakeCredentialErrors maps the HTTP status of a rejected handshake to
+// the credential at fault: the gateway answers a malformed request, e.g. an
+// unknown app id, with 400, an access token it does not accept with 401 and a
+// resource the app is not granted with 403.
+var handshakeCredentialErrors = map[int]error{
+	http.StatusBadRequest:   ErrBadAppID,
+	http.StatusUnauthorized: ErrBadAccessToken,
+	http.StatusForbidden:    ErrBadResourceID,
+	http.StatusNotFound:     ErrCredentialsRejected,
+}
+
+// Credentials identify the client to the service.
+type Credentials struct {
+	AppID       string // sent as X-Api-App-ID
+	AccessToken string // sent as X-Api-Access-Key
+	ResourceID  string // sent as X-Api-Resource-Id
+	AppKey      string // sent as X-Api-App-Key
+}
+
+// currentCredentials returns the credentials the dialog connects with.
+func currentCredentials() Credentials {
+	return Credentials{AppID: appid, AccessToken: accessToken, ResourceID: product.ResourceID, AppKey: product.AppKey}
+}
+
+// CredentialError reports credentials rejected by the service. It unwraps to
+// ErrBadAppID, ErrBadAccessToken or ErrBadResourceID when the status of the
+// rejected handshake tells which one is wrong, to ErrCredentialsRejected
+// otherwise.
+type CredentialError struct {
+	// Code is the HTTP status of the rejected handshake or the code of the
+	// Error frame answering StartConnection.
+	Code    int
+	Message string
+	LogID   string
+	kind    error
+}
+
+func (e *CredentialError) Error() string {
+	return fmt.Sprintf("%v (code=%d, logid=%s): %s", e.Unwrap(), e.Code, e.LogID, e.Message)
+}
+
+func (e *CredentialError) Unwrap() error {
+	if e.kind == nil {
+		return ErrCredentialsRejected
+	}
+	return e.kind
+}
+
+// ValidateCredentials checks cfg with the cheapest possible exchange: it dials
+// the service, performs StartConnection and closes the connection again.
+// Rejected credentials are reported as a *CredentialError.
+func ValidateCredentials(ctx context.Context, cfg Credentials) error {
+	conn, resp, err := dialWith(ctx, cfg)
+	var logID string
+	if resp != nil {
+		logID = resp.Header.Get("X-Tt-Logid")
+	}
+	if err != nil {
+		if errors.Is(err, websocket.ErrBadHandshake) && resp != nil {
+			return handshakeCredentialError(resp, logID)
+		}
+		return &DryRunError{Stage: "dial", LogID: logID, Err: err}
+	}
+	defer func() {
+		_ = closeConn(conn)
+	}()
+	_ = conn.SetReadDeadline(time.Now().Add(dryRunTimeout))
+
+	if err := startConnection(ctx, conn); err != nil {
+		var serverErr ServerError
+		if errors.As(err, &serverErr) && !errors.Is(serverErr, ErrInternalServer) {
+			return &CredentialError{Code: serverErr.Code, Message: serverErr.Message, LogID: logID, kind: ErrCredentialsRejected}
+		}
+		return &DryRunError{Stage: "StartConnection", LogID: logID, Err: err}
+	}
+	if err := finishConnection(conn); err != nil {
+		return &DryRunError{Stage: "FinishConnection", LogID: logID, Err: err}
+	}
+	return nil
+}
+
+// handshakeCredentialError turns a failed websocket upgrade into a
+// CredentialError. The websocket dialer keeps the start of the response body.
+func handshakeCredentialError(resp *http.Response, logID string) error {
+	body, _ := io.ReadAll(resp.Body)
+	msg := strings.TrimSpace(string(body))
+	if msg == "" {
+		msg = resp.Status
+	}
+	if kind, ok := handshakeCredentialErrors[resp.StatusCode]; ok {
+		return &CredentialError{Code: resp.StatusCode, Message: msg, LogID: logID, kind: kind}
+	}
+	return &DryRunError{Stage: "dial", LogID: logID, Err: fmt.Errorf("%w: %s", websocket.ErrBadHandshake, msg)}
+}
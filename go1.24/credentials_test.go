@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+var testCredentials = Credentials{AppID: "app", AccessToken: "token", ResourceID: "volc.speech.dialog", AppKey: "key"}
+
+func TestValidateCredentials(t *testing.T) {
+	s := newFakeServer(t, func(c *fakeConn) {
+		if c.expect(1) == nil {
+			return
+		}
+		c.send(serverFrame(50, "conn-1", `{}`))
+		if c.expect(2) == nil {
+			return
+		}
+		c.send(serverFrame(52, "conn-1", `{}`))
+	})
+	setupDialog(t, s)
+	if err := ValidateCredentials(t.Context(), testCredentials); err != nil {
+		t.Fatalf("ValidateCredentials() = %v", err)
+	}
+	if got := s.Header().Get("X-Api-Access-Key"); got != testCredentials.AccessToken {
+		t.Errorf("X-Api-Access-Key = %q, want the token of cfg", got)
+	}
+}
+
+// TestValidateCredentialsRejected checks that the status of a rejected
+// handshake tells which credential is wrong.
+func TestValidateCredentialsRejected(t *testing.T) {
+	for status, want := range map[int]error{
+		http.StatusBadRequest:   ErrBadAppID,
+		http.StatusUnauthorized: ErrBadAccessToken,
+		http.StatusForbidden:    ErrBadResourceID,
+		http.StatusNotFound:     ErrCredentialsRejected,
+	} {
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, `{"error":"rejected"}`, status)
+		}))
+		setupDialog(t, nil)
+		WithDialer(&MockWebSocketDialer{URL: "ws" + strings.TrimPrefix(s.URL, "http")})
+		err := ValidateCredentials(t.Context(), testCredentials)
+		var credErr *CredentialError
+		if !errors.Is(err, want) || !errors.As(err, &credErr) || credErr.Code != status {
+			t.Errorf("status %d: ValidateCredentials() = %v, want a CredentialError with %v", status, err, want)
+		}
+		s.Close()
+	}
+	WithDialer(nil)
+}
+
+func TestValidateCredentialsErrorFrame(t *testing.T) {
+	s := newFakeServer(t, func(c *fakeConn) {
+		if c.expect(1) == nil {
+			return
+		}
+		c.send(serverError(codeInvalidRequest, `{"error":"bad app"}`))
+	})
+	setupDialog(t, s)
+	err := ValidateCredentials(t.Context(), testCredentials)
+	if !errors.Is(err, ErrCredentialsRejected) {
+		t.Errorf("ValidateCredentials() = %v, want ErrCredentialsRejected", err)
+	}
+}
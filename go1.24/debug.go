@@ -0,0 +1,40 @@
+package main
+
+import (
+	"encoding/hex"
+	"sync/atomic"
+
+	"github.com/golang/glog"
+)
+
+// debugPayloadPrefix is how much of the payload a debug frame log shows.
+const debugPayloadPrefix = 64
+
+var debugMode atomic.Bool
+
+// WithDebugMode logs every frame sent and received when enabled: its type,
+// sequence, payload length and the start of its payload in hex.
+func WithDebugMode(enabled bool) {
+	debugMode.Store(enabled)
+}
+
+// SetDebugMode turns the frame logging of WithDebugMode on or off while the
+// dialog runs.
+func SetDebugMode(enabled bool) {
+	if debugMode.Swap(enabled) != enabled {
+		glog.Infof("Debug mode enabled=%v", enabled)
+	}
+}
+
+// debugFrame logs msg if debug mode is on. direction is "sent" or "received".
+func debugFrame(direction string, msg *Message) {
+	if !debugMode.Load() {
+		return
+	}
+	prefix := msg.Payload
+	if len(prefix) > debugPayloadPrefix {
+		prefix = prefix[:debugPayloadPrefix]
+	}
+	glog.Infof("[debug] %s %s event=%d seq=%d payload=%d bytes: %s",
+		direction, msg.Type, msg.Event, msg.Sequence, len(msg.Payload), hex.EncodeToString(prefix))
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+// sessionAffinityKey is sent as X-Session-Affinity on every dial, so that a load
+// balancer routes all connections of the session to the same backend.
+var sessionAffinityKey string
+
+// WithAffinityKey sets the session affinity key sent on every dial, including
+// reconnects. An empty key, the default, sends no affinity header.
+func WithAffinityKey(key string) {
+	sessionAffinityKey = key
+}
+
+// AffinityKey returns the session affinity key, or an empty string if none is
+// set.
+func AffinityKey() string {
+	return sessionAffinityKey
+}
+
+// clientVersion identifies this build in the User-Agent and X-Client-Version
+// headers. Release builds stamp it with
+// -ldflags "-X main.clientVersion=v1.2.3".
+var clientVersion = "dev"
+
+// userAgent, if set, replaces the default User-Agent of the dial.
+var userAgent string
+
+// WithUserAgent sends ua as User-Agent on every dial instead of the default
+// RealtimeDialog/<version>. X-Client-Version is sent either way.
+func WithUserAgent(ua string) {
+	userAgent = ua
+}
+
+// UserAgent returns the User-Agent sent on every dial.
+func UserAgent() string {
+	if userAgent != "" {
+		return userAgent
+	}
+	return "RealtimeDialog/" + clientVersion
+}
+
+// WebSocketDialer opens the websocket connection to the service.
+// *websocket.Dialer implements it.
+type WebSocketDialer interface {
+	DialContext(ctx context.Context, urlStr string, requestHeader http.Header) (*websocket.Conn, *http.Response, error)
+}
+
+// customDialer, if set, replaces the default dialer, e.g. to connect to an
+// in-process httptest server.
+var customDialer WebSocketDialer
+
+// WithDialer makes every dial go through d. The -tls-sni override only applies
+// to the default dialer.
+func WithDialer(d WebSocketDialer) {
+	customDialer = d
+}
+
+// defaultDialer returns a copy of websocket.DefaultDialer configured by the
+// command line flags.
+func defaultDialer() WebSocketDialer {
+	dialer := *websocket.DefaultDialer
+	if *tlsSNI != "" {
+		// 仅覆盖 TLS 握手中的 SNI，Host 头仍然取自 wsURL
+		dialer.TLSClientConfig = &tls.Config{ServerName: *tlsSNI}
+	}
+	return &dialer
+}
+
+// dialTimeout bounds each dial, DNS lookup and handshake included, on top of
+// the caller's context. Zero leaves only the context.
+var dialTimeout time.Duration
+
+// WithDialTimeout bounds every dial by d without affecting the context the
+// dial was started with: a timed out dial fails, the dialog's context lives
+// on.
+func WithDialTimeout(d time.Duration) {
+	dialTimeout = d
+}
+
+// dial 用当前的鉴权信息建立到实时对话服务的 websocket 连接
+func dial(ctx context.Context) (*websocket.Conn, *http.Response, error) {
+	return dialWith(ctx, currentCredentials())
+}
+
+// dialWith 用 cfg 中的鉴权信息建立 websocket 连接
+func dialWith(ctx context.Context, cfg Credentials) (*websocket.Conn, *http.Response, error) {
+	dialCtx := ctx
+	if dialTimeout > 0 {
+		// 超时只作用于本次拨号，不影响上层 context
+		var cancel context.CancelFunc
+		dialCtx, cancel = context.WithTimeout(ctx, dialTimeout)
+		defer cancel()
+	}
+	dialer := customDialer
+	if dialer == nil {
+		dialer = defaultDialer()
+	}
+	header := http.Header{
+		"X-Api-Resource-Id": []string{cfg.ResourceID},
+		"X-Api-Access-Key":  []string{cfg.AccessToken},
+		"X-Api-App-Key":     []string{cfg.AppKey},
+		"X-Api-App-ID":      []string{cfg.AppID},
+		"X-Api-Connect-Id":  []string{uuid.New().String()},
+		"User-Agent":        []string{UserAgent()},
+		"X-Client-Version":  []string{clientVersion},
+	}
+	if sessionAffinityKey != "" {
+		header.Set("X-Session-Affinity", sessionAffinityKey)
+	}
+	conn, resp, err := dialer.DialContext(dialCtx, wsURL.String(), header)
+	if err != nil && dialCtx.Err() != nil && ctx.Err() == nil {
+		err = fmt.Errorf("dial timed out after %s: %w", dialTimeout, err)
+	}
+	return conn, resp, err
+}
+
+// validateHostname reports whether name is a valid DNS hostname usable as TLS
+// server name.
+func validateHostname(name string) error {
+	if len(name) > 253 {
+		return fmt.Errorf("hostname %q is longer than 253 characters", name)
+	}
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" || len(label) > 63 {
+			return fmt.Errorf("hostname %q has an empty or too long label", name)
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return fmt.Errorf("hostname %q has a label starting or ending with '-'", name)
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return fmt.Errorf("hostname %q contains invalid character %q", name, c)
+			}
+		}
+	}
+	return nil
+}
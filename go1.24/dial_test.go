@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// TestWithDialer checks that dials go through the dialer set with WithDialer,
+// with the authentication and client headers.
+func TestWithDialer(t *testing.T) {
+	s := newFakeServer(t, func(c *fakeConn) {
+		for c.read() != nil {
+		}
+	})
+	setupDialog(t, nil)
+	d := s.Dialer()
+	WithDialer(d)
+	WithAffinityKey("user-42")
+	t.Cleanup(func() {
+		WithDialer(nil)
+		WithAffinityKey("")
+	})
+
+	cfg := Credentials{AppID: "app", AccessToken: "token", ResourceID: "volc.speech.dialog", AppKey: "key"}
+	conn, _, err := dialWith(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("dialWith() = %v", err)
+	}
+	_ = closeConn(conn)
+	if got := d.Dials.Load(); got != 1 {
+		t.Errorf("mock dialer dialed %d times, want 1", got)
+	}
+	header := s.Header()
+	for name, want := range map[string]string{
+		"X-Api-App-ID":       "app",
+		"X-Api-Access-Key":   "token",
+		"X-Api-Resource-Id":  "volc.speech.dialog",
+		"X-Api-App-Key":      "key",
+		"X-Session-Affinity": "user-42",
+		"User-Agent":         UserAgent(),
+	} {
+		if got := header.Get(name); got != want {
+			t.Errorf("header %s = %q, want %q", name, got, want)
+		}
+	}
+	if header.Get("X-Api-Connect-Id") == "" {
+		t.Error("no X-Api-Connect-Id sent")
+	}
+}
+
+// TestDefaultDialer checks that the default dialer applies -tls-sni without
+// touching websocket.DefaultDialer.
+func TestDefaultDialer(t *testing.T) {
+	old := *tlsSNI
+	*tlsSNI = "dialog.example.com"
+	t.Cleanup(func() { *tlsSNI = old })
+	d, ok := defaultDialer().(*websocket.Dialer)
+	if !ok {
+		t.Fatalf("defaultDialer() = %T, want a *websocket.Dialer", defaultDialer())
+	}
+	if d.TLSClientConfig == nil || d.TLSClientConfig.ServerName != "dialog.example.com" {
+		t.Errorf("TLSClientConfig = %+v, want the -tls-sni server name", d.TLSClientConfig)
+	}
+	if websocket.DefaultDialer.TLSClientConfig != nil {
+		t.Error("websocket.DefaultDialer was modified")
+	}
+}
+
+// TestUserAgent checks the client headers of a dial, with the default and a
+// custom User-Agent.
+func TestUserAgent(t *testing.T) {
+	oldVersion := clientVersion
+	clientVersion = "v1.2.3"
+	t.Cleanup(func() {
+		clientVersion = oldVersion
+		WithUserAgent("")
+		WithDialer(nil)
+	})
+	for _, tc := range []struct {
+		userAgent string
+		want      string
+	}{
+		{"", "RealtimeDialog/v1.2.3"},
+		{"kiosk/7", "kiosk/7"},
+	} {
+		s := newFakeServer(t, func(c *fakeConn) {
+			for c.read() != nil {
+			}
+		})
+		setupDialog(t, nil)
+		WithDialer(s.Dialer())
+		WithUserAgent(tc.userAgent)
+		conn, _, err := dialWith(context.Background(), Credentials{AppID: "app", AccessToken: "token"})
+		if err != nil {
+			t.Fatalf("dialWith() = %v", err)
+		}
+		_ = closeConn(conn)
+		header := s.Header()
+		if got := header.Get("User-Agent"); got != tc.want {
+			t.Errorf("WithUserAgent(%q): User-Agent = %q, want %q", tc.userAgent, got, tc.want)
+		}
+		if got := header.Get("X-Client-Version"); got != "v1.2.3" {
+			t.Errorf("WithUserAgent(%q): X-Client-Version = %q, want v1.2.3", tc.userAgent, got)
+		}
+	}
+}
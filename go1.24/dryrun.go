@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/google/uuid"
+)
+
+// dryRunTimeout bounds every handshake read of a dry run so an unresponsive
+// server fails the check instead of hanging it.
+const dryRunTimeout = 10 * time.Second
+
+// DryRunError reports the stage at which a dry run failed together with the
+// logid returned by the server, so the failure can be traced on its side.
+type DryRunError struct {
+	Stage string
+	LogID string
+	Err   error
+}
+
+func (e *DryRunError) Error() string {
+	return fmt.Sprintf("%s failed (logid=%s): %v", e.Stage, e.LogID, e.Err)
+}
+
+func (e *DryRunError) Unwrap() error {
+	return e.Err
+}
+
+// runDryRun dials the service, performs StartConnection and StartSession with
+// the real session payload and tears both down again. No audio device is
+// touched, so it can run on machines without portaudio.
+func runDryRun(ctx context.Context) error {
+	conn, resp, err := dial(ctx)
+	var logID string
+	if resp != nil {
+		logID = resp.Header.Get("X-Tt-Logid")
+	}
+	if err != nil {
+		return &DryRunError{Stage: "dial", LogID: logID, Err: err}
+	}
+	defer func() {
+		_ = closeConn(conn)
+	}()
+	_ = conn.SetReadDeadline(time.Now().Add(dryRunTimeout))
+
+	if err := startConnection(ctx, conn); err != nil {
+		return &DryRunError{Stage: "StartConnection", LogID: logID, Err: err}
+	}
+	sessionID := uuid.New().String()
+	if err := startSession(ctx, conn, sessionID, product.NewSessionPayload()); err != nil {
+		return &DryRunError{Stage: "StartSession", LogID: logID, Err: err}
+	}
+	glog.Infof("Dry-run session started, dialogID: %s, logid: %s", dialogID, logID)
+
+	if err := finishSession(conn, sessionID); err != nil {
+		return &DryRunError{Stage: "FinishSession", LogID: logID, Err: err}
+	}
+	if err := waitSessionFinished(conn); err != nil {
+		return &DryRunError{Stage: "FinishSession", LogID: logID, Err: err}
+	}
+	if err := finishConnection(conn); err != nil {
+		return &DryRunError{Stage: "FinishConnection", LogID: logID, Err: err}
+	}
+	return nil
+}
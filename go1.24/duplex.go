@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// duplexBlock is how many stereo frames the recording is interleaved by when
+// it is saved, one second.
+const duplexBlock = sampleRate
+
+// duplexRecorder records both sides of the dialog on a common timeline: each
+// chunk of audio is placed at the time it was sent or received, after the
+// audio before it on its side. A side whose audio runs behind the clock, e.g.
+// while nobody speaks, is padded with silence, so that the two sides do not
+// drift apart. The sides are streamed to temporary files, so that a long
+// dialog is not held in memory.
+type duplexRecorder struct {
+	path string
+
+	lock   sync.Mutex
+	start  time.Time    // of the first audio on either side
+	user   *duplexTrack // at inputSampleRate
+	bot    *duplexTrack // at sampleRate
+	failed bool
+}
+
+// duplex records the dialog if WithDuplexRecording is set.
+var duplex *duplexRecorder
+
+// WithDuplexRecording records the dialog to path as a stereo WAV file at the
+// output sample rate, with the user audio sent on the left channel and the
+// bot audio on the right, time-aligned. The file is written when the dialog
+// ends; until then the audio is kept in temporary files.
+func WithDuplexRecording(path string) {
+	duplex = &duplexRecorder{path: path}
+}
+
+// open creates the temporary files of the tracks, and reports false if the
+// recording failed. d.lock must be held.
+func (d *duplexRecorder) open() bool {
+	if d.failed || d.user != nil {
+		return !d.failed
+	}
+	user, err := newDuplexTrack()
+	if err != nil {
+		d.fail(err)
+		return false
+	}
+	bot, err := newDuplexTrack()
+	if err != nil {
+		user.remove()
+		d.fail(err)
+		return false
+	}
+	d.user, d.bot = user, bot
+	return true
+}
+
+// fail stops the recording after err. d.lock must be held.
+func (d *duplexRecorder) fail(err error) {
+	glog.Errorf("Duplex recording failed, stopping it: %v", err)
+	d.failed = true
+}
+
+// position returns the sample index at rate of the current time. d.lock must
+// be held.
+func (d *duplexRecorder) position(rate int) int {
+	now := time.Now()
+	if d.start.IsZero() {
+		d.start = now
+	}
+	return int(now.Sub(d.start) * time.Duration(rate) / time.Second)
+}
+
+// userAudio records samples just sent, which were captured over the time up
+// to now.
+func (d *duplexRecorder) userAudio(samples []int16) {
+	if d == nil {
+		return
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if !d.open() {
+		return
+	}
+	if err := d.user.appendAligned(samples, d.position(inputSampleRate)-len(samples)); err != nil {
+		d.fail(err)
+	}
+}
+
+// botAudio records samples just received, which start playing about now.
+func (d *duplexRecorder) botAudio(samples []int16) {
+	if d == nil {
+		return
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if !d.open() {
+		return
+	}
+	if err := d.bot.appendAligned(samples, d.position(sampleRate)); err != nil {
+		d.fail(err)
+	}
+}
+
+// botFlushed drops the bot audio not played yet, which the playback dropped
+// too, e.g. on barge-in.
+func (d *duplexRecorder) botFlushed() {
+	if d == nil {
+		return
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.failed || d.bot == nil {
+		return
+	}
+	if at := d.position(sampleRate); at < d.bot.n {
+		if err := d.bot.truncate(at); err != nil {
+			d.fail(err)
+		}
+	}
+}
+
+// save writes the recording to d.path and removes the temporary files.
+func (d *duplexRecorder) save() {
+	if d == nil {
+		return
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.user == nil {
+		return
+	}
+	defer d.user.remove()
+	defer d.bot.remove()
+	if d.failed {
+		return
+	}
+	n, err := d.write()
+	if err != nil {
+		glog.Errorf("Failed to save duplex recording: %v", err)
+		return
+	}
+	glog.Infof("Duplex recording of %s saved to %s", samplesDuration(n), d.path)
+}
+
+// write interleaves the tracks into the WAV file at d.path, duplexBlock
+// frames at a time, and returns the number of frames. d.lock must be held.
+func (d *duplexRecorder) write() (int, error) {
+	n := max(d.user.n*sampleRate/inputSampleRate, d.bot.n)
+	f, err := os.Create(d.path)
+	if err != nil {
+		return 0, fmt.Errorf("create WAV file: %w", err)
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	if err := writeWAVHeader(w, 2*n, sampleRate, 2); err != nil {
+		return 0, err
+	}
+	for start := 0; start < n; start += duplexBlock {
+		end := min(n, start+duplexBlock)
+		left, err := d.user.resampled(start, end, inputSampleRate, sampleRate)
+		if err != nil {
+			return 0, err
+		}
+		right, err := d.bot.read(start, end)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := w.Write(samplesToBytes(interleave(left, right, end-start))); err != nil {
+			return 0, fmt.Errorf("write WAV data: %w", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return 0, fmt.Errorf("write WAV data: %w", err)
+	}
+	return n, f.Close()
+}
+
+// duplexTrack is one side of a duplex recording, as PCM S16LE in a temporary
+// file.
+type duplexTrack struct {
+	file *os.File
+	n    int // samples in file
+}
+
+func newDuplexTrack() (*duplexTrack, error) {
+	f, err := os.CreateTemp("", "duplex-*.pcm")
+	if err != nil {
+		return nil, fmt.Errorf("create duplex track: %w", err)
+	}
+	return &duplexTrack{file: f}, nil
+}
+
+// appendAligned appends samples to the track, padding it with silence up to
+// at first if it ends before.
+func (t *duplexTrack) appendAligned(samples []int16, at int) error {
+	for t.n < at {
+		// 长时间静音分块补齐，避免一次分配整段静音
+		if err := t.write(make([]int16, min(at-t.n, duplexBlock))); err != nil {
+			return err
+		}
+	}
+	return t.write(samples)
+}
+
+func (t *duplexTrack) write(samples []int16) error {
+	if _, err := t.file.WriteAt(samplesToBytes(samples), int64(2*t.n)); err != nil {
+		return fmt.Errorf("write duplex track: %w", err)
+	}
+	t.n += len(samples)
+	return nil
+}
+
+// truncate drops the samples from at on.
+func (t *duplexTrack) truncate(at int) error {
+	if err := t.file.Truncate(int64(2 * at)); err != nil {
+		return fmt.Errorf("truncate duplex track: %w", err)
+	}
+	t.n = at
+	return nil
+}
+
+// read returns the samples from start to end, fewer if the track ends before.
+func (t *duplexTrack) read(start, end int) ([]int16, error) {
+	end = min(end, t.n)
+	if start >= end {
+		return nil, nil
+	}
+	data := make([]byte, 2*(end-start))
+	if _, err := t.file.ReadAt(data, int64(2*start)); err != nil {
+		return nil, fmt.Errorf("read duplex track: %w", err)
+	}
+	return bytesToSamples(data), nil
+}
+
+// resampled returns the samples from start to end of the track converted
+// from one rate to another like resampleLinear, fewer if the track ends
+// before.
+func (t *duplexTrack) resampled(start, end, from, to int) ([]int16, error) {
+	if from == to {
+		return t.read(start, end)
+	}
+	end = min(end, t.n*to/from)
+	if start >= end {
+		return nil, nil
+	}
+	first := start * from / to
+	src, err := t.read(first, (end-1)*from/to+2)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]int16, end-start)
+	for i := range out {
+		pos := (start + i) * from
+		j := pos/to - first
+		if j+1 >= len(src) {
+			out[i] = src[len(src)-1]
+			continue
+		}
+		frac := float64(pos%to) / float64(to)
+		out[i] = int16(float64(src[j])*(1-frac) + float64(src[j+1])*frac)
+	}
+	return out, nil
+}
+
+// remove closes and deletes the temporary file of the track.
+func (t *duplexTrack) remove() {
+	_ = t.file.Close()
+	_ = os.Remove(t.file.Name())
+}
+
+// interleave returns n stereo frames of left and right, padded with silence.
+func interleave(left, right []int16, n int) []int16 {
+	stereo := make([]int16, 2*n)
+	for i := 0; i < n; i++ {
+		if i < len(left) {
+			stereo[2*i] = left[i]
+		}
+		if i < len(right) {
+			stereo[2*i+1] = right[i]
+		}
+	}
+	return stereo
+}
+
+// resampleLinear converts samples from one rate to another by linear
+// interpolation, which is good enough for a speech recording.
+func resampleLinear(samples []int16, from, to int) []int16 {
+	if from == to || len(samples) == 0 {
+		return samples
+	}
+	n := len(samples) * to / from
+	out := make([]int16, n)
+	for i := range out {
+		pos := float64(i) * float64(from) / float64(to)
+		j := int(pos)
+		if j+1 >= len(samples) {
+			out[i] = samples[len(samples)-1]
+			continue
+		}
+		frac := pos - float64(j)
+		out[i] = int16(float64(samples[j])*(1-frac) + float64(samples[j+1])*frac)
+	}
+	return out
+}
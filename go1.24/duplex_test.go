@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// readDuplexWAV returns the left and right channels of the duplex recording
+// at path.
+func readDuplexWAV(t *testing.T, path string) (left, right []int16) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := bytes.NewReader(data)
+	if err := readWAVHeader(r, sampleRate, 2); err != nil {
+		t.Fatal(err)
+	}
+	stereo := bytesToSamples(data[len(data)-r.Len():])
+	for i := 0; i+1 < len(stereo); i += 2 {
+		left = append(left, stereo[i])
+		right = append(right, stereo[i+1])
+	}
+	return left, right
+}
+
+// loudSpan returns the first and last index of samples louder than 100, or
+// -1, -1.
+func loudSpan(samples []int16) (first, last int) {
+	first, last = -1, -1
+	for i, s := range samples {
+		if s > 100 || s < -100 {
+			if first < 0 {
+				first = i
+			}
+			last = i
+		}
+	}
+	return first, last
+}
+
+// TestDuplexRecording sends 100ms of user audio, receives 100ms of bot audio
+// 300ms later and checks where each lands in the recording, and that the
+// temporary files are gone.
+func TestDuplexRecording(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "call.wav")
+	WithDuplexRecording(path)
+	d := duplex
+	t.Cleanup(func() { duplex = nil })
+
+	d.userAudio(toneSamples(inputSampleRate/10, 1000))
+	time.Sleep(300 * time.Millisecond)
+	d.botAudio(toneSamples(sampleRate/10, 2000))
+	tracks := []string{d.user.file.Name(), d.bot.file.Name()}
+	d.save()
+
+	left, right := readDuplexWAV(t, path)
+	if first, last := loudSpan(left); first != 0 || last < sampleRate/10-2 || last > sampleRate/10 {
+		t.Errorf("user audio at frames %d to %d, want 0 to %d", first, last, sampleRate/10)
+	}
+	first, last := loudSpan(right)
+	if at := 300 * sampleRate / 1000; first < at || first > at+sampleRate/2 {
+		t.Errorf("bot audio starts at frame %d, want about %d", first, at)
+	}
+	if last-first+1 != sampleRate/10 {
+		t.Errorf("bot audio is %d frames long, want %d", last-first+1, sampleRate/10)
+	}
+	if len(right) != last+1 || len(left) != len(right) {
+		t.Errorf("recording has %d left and %d right frames, want %d", len(left), len(right), last+1)
+	}
+	for _, name := range tracks {
+		if _, err := os.Stat(name); !os.IsNotExist(err) {
+			t.Errorf("temporary track %s left behind: %v", name, err)
+		}
+	}
+}
+
+// TestDuplexBotFlushed checks that bot audio dropped on barge-in is dropped
+// from the recording too.
+func TestDuplexBotFlushed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "call.wav")
+	WithDuplexRecording(path)
+	d := duplex
+	t.Cleanup(func() { duplex = nil })
+
+	d.botAudio(toneSamples(sampleRate, 2000))
+	time.Sleep(100 * time.Millisecond)
+	d.botFlushed()
+	d.save()
+
+	_, right := readDuplexWAV(t, path)
+	if n := len(right); n < sampleRate/10 || n > sampleRate/2 {
+		t.Errorf("recording has %d bot frames after the flush, want about %d", n, sampleRate/10)
+	}
+}
+
+// TestDuplexTrackResampled checks that resampling a track block by block
+// matches resampleLinear over the whole track.
+func TestDuplexTrackResampled(t *testing.T) {
+	track, err := newDuplexTrack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer track.remove()
+	r := rand.New(rand.NewPCG(1, 2))
+	samples := make([]int16, 3*inputSampleRate+123)
+	for i := range samples {
+		samples[i] = int16(r.IntN(20000) - 10000)
+	}
+	if err := track.appendAligned(samples, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	want := resampleLinear(samples, inputSampleRate, sampleRate)
+	var got []int16
+	for start := 0; start < len(want)+duplexBlock; start += duplexBlock {
+		block, err := track.resampled(start, start+duplexBlock, inputSampleRate, sampleRate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, block...)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("resampled %d samples, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if d := int(got[i]) - int(want[i]); d < -1 || d > 1 {
+			t.Fatalf("sample %d = %d, want %d", i, got[i], want[i])
+		}
+	}
+}
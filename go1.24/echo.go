@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// echoFrame is captured audio waiting out the echo delay.
+type echoFrame struct {
+	at      time.Time
+	samples []int16
+}
+
+// runEchoTest plays the audio captured from src back on sink after delay,
+// without contacting the server, until src ends or ctx is done. It exercises
+// the input and output devices and their capture and playback code before a
+// real dialog. The input is resampled to the output rate.
+func runEchoTest(ctx context.Context, src AudioSource, sink AudioSink, delay time.Duration) error {
+	glog.Infof("Echo test: speak, your voice plays back after %s. Ctrl-C ends the test.", delay)
+	var queue []echoFrame
+	// release plays the queued audio captured before cutoff.
+	release := func(cutoff time.Time) error {
+		for len(queue) > 0 && !queue[0].at.After(cutoff) {
+			if err := sink.WriteFrame(resampleLinear(queue[0].samples, inputSampleRate, sampleRate)); err != nil {
+				return fmt.Errorf("write audio output: %w", err)
+			}
+			queue = queue[1:]
+		}
+		return nil
+	}
+	var frames int
+	for {
+		samples, err := src.ReadFrame(ctx)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			return fmt.Errorf("read audio input: %w", err)
+		}
+		frames++
+		now := time.Now()
+		queue = append(queue, echoFrame{at: now, samples: samples})
+		if err := release(now.Add(-delay)); err != nil {
+			return err
+		}
+	}
+	// 输入结束后把仍在延迟中的音频按时放完
+	for len(queue) > 0 && ctx.Err() == nil {
+		time.Sleep(time.Until(queue[0].at.Add(delay)))
+		if err := release(time.Now().Add(-delay)); err != nil {
+			return err
+		}
+	}
+	glog.Infof("Echo test finished, %s of audio looped back.", time.Duration(frames*inputFramesPerBuffer)*time.Second/inputSampleRate)
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+)
+
+// timedSpeaker is a fakeSpeaker noting when the first frame was played.
+type timedSpeaker struct {
+	fakeSpeaker
+	first time.Time
+}
+
+func (s *timedSpeaker) WriteFrame(samples []int16) error {
+	if s.first.IsZero() {
+		s.first = time.Now()
+	}
+	return s.fakeSpeaker.WriteFrame(samples)
+}
+
+// TestEchoTest loops two captured frames back and checks that they play
+// resampled to the output rate, in order, after the delay.
+func TestEchoTest(t *testing.T) {
+	const delay = 200 * time.Millisecond
+	frames := [][]int16{toneSamples(inputFramesPerBuffer, 8000), toneSamples(inputFramesPerBuffer, 100)}
+	src := &MemorySource{Frames: slices.Clone(frames)}
+	sink := &timedSpeaker{}
+
+	start := time.Now()
+	if err := runEchoTest(context.Background(), src, sink, delay); err != nil {
+		t.Fatalf("runEchoTest() = %v", err)
+	}
+	if d := sink.first.Sub(start); d < delay {
+		t.Errorf("first frame played after %s, want the %s delay", d, delay)
+	}
+	var want []int16
+	for _, f := range frames {
+		want = append(want, resampleLinear(f, inputSampleRate, sampleRate)...)
+	}
+	if !slices.Equal(sink.samples, want) {
+		t.Errorf("played %d samples, want the %d captured ones at %dHz", len(sink.samples), len(want), sampleRate)
+	}
+}
+
+// TestEchoTestCanceled checks that the echo test of a microphone, which
+// never ends by itself, stops with its context.
+func TestEchoTestCanceled(t *testing.T) {
+	mic := newFakeMic()
+	mic.say(toneSamples(inputFramesPerBuffer, 8000))
+	sink := &fakeSpeaker{}
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() { done <- runEchoTest(ctx, mic, sink, 50*time.Millisecond) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("runEchoTest() = %v, want nil once canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("runEchoTest() still running after its context was done")
+	}
+	if sink.played() == 0 {
+		t.Error("nothing looped back from the microphone")
+	}
+}
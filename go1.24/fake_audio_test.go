@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// fakeMic is an AudioSource standing in for a microphone: it returns the
+// frames queued with say and silence in between, a frame per
+// inputFramesPerBuffer of real time, until it is closed.
+type fakeMic struct {
+	frames chan []int16
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newFakeMic() *fakeMic {
+	return &fakeMic{frames: make(chan []int16, 64), closed: make(chan struct{})}
+}
+
+// say queues frames to be read.
+func (m *fakeMic) say(frames ...[]int16) {
+	for _, f := range frames {
+		m.frames <- f
+	}
+}
+
+func (m *fakeMic) ReadFrame(ctx context.Context) ([]int16, error) {
+	select {
+	case f := <-m.frames:
+		return f, nil
+	default:
+	}
+	t := time.NewTimer(time.Duration(inputFramesPerBuffer) * time.Second / inputSampleRate)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-m.closed:
+		return nil, io.EOF
+	case f := <-m.frames:
+		return f, nil
+	case <-t.C:
+		return make([]int16, inputFramesPerBuffer), nil
+	}
+}
+
+func (m *fakeMic) Close() error {
+	m.once.Do(func() { close(m.closed) })
+	return nil
+}
+
+// fakeSpeaker is an AudioSink standing in for a speaker: it keeps the samples
+// played and counts the flushes.
+type fakeSpeaker struct {
+	lock    sync.Mutex
+	samples []int16
+	flushes int
+	closed  bool
+}
+
+func (s *fakeSpeaker) WriteFrame(samples []int16) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.samples = append(s.samples, samples...)
+	return nil
+}
+
+func (s *fakeSpeaker) Flush() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.flushes++
+	return nil
+}
+
+func (s *fakeSpeaker) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.closed = true
+	return nil
+}
+
+// played returns the number of samples played.
+func (s *fakeSpeaker) played() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.samples)
+}
+
+// fakeBackend is an AudioBackend opening a fakeMic and a fakeSpeaker, which
+// report the devices input and output.
+type fakeBackend struct {
+	input, output AudioDevice
+}
+
+func (fakeBackend) Open() error  { return nil }
+func (fakeBackend) Close() error { return nil }
+
+func (b fakeBackend) NewSource() (AudioSource, error) {
+	return &fakeDeviceMic{fakeMic: newFakeMic(), device: b.input}, nil
+}
+
+func (b fakeBackend) NewSink() (AudioSink, error) {
+	return &fakeDeviceSpeaker{device: b.output}, nil
+}
+
+type fakeDeviceMic struct {
+	*fakeMic
+	device AudioDevice
+}
+
+func (m *fakeDeviceMic) AudioDevice() AudioDevice { return m.device }
+
+type fakeDeviceSpeaker struct {
+	fakeSpeaker
+	device AudioDevice
+}
+
+func (s *fakeDeviceSpeaker) AudioDevice() AudioDevice { return s.device }
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// fakeServer is an in-process realtime dialog server. Every connection the
+// client opens is handed to the handler, which plays the service with the
+// helpers of fakeConn.
+type fakeServer struct {
+	*httptest.Server
+	t     *testing.T
+	lock  sync.Mutex
+	conns []*websocket.Conn
+	wg    sync.WaitGroup
+	// header and path hold the headers and the URL path of the last dial.
+	header http.Header
+	path   string
+}
+
+// newFakeServer starts a server running handle for every connection. It is
+// stopped when the test ends, after the handlers returned.
+func newFakeServer(t *testing.T, handle func(c *fakeConn)) *fakeServer {
+	t.Helper()
+	s := &fakeServer{t: t}
+	upgrader := websocket.Upgrader{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Recorded before the upgrade, which the dial of the client returns on.
+		s.lock.Lock()
+		s.header = r.Header.Clone()
+		s.path = r.URL.Path
+		s.lock.Unlock()
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("fake server: upgrade: %v", err)
+			return
+		}
+		s.lock.Lock()
+		s.conns = append(s.conns, conn)
+		s.wg.Add(1)
+		s.lock.Unlock()
+		defer s.wg.Done()
+		defer conn.Close()
+		handle(&fakeConn{t: t, conn: conn})
+	}))
+	t.Cleanup(func() {
+		s.lock.Lock()
+		for _, conn := range s.conns {
+			_ = conn.Close()
+		}
+		s.lock.Unlock()
+		s.wg.Wait()
+		s.Close()
+	})
+	return s
+}
+
+// Header returns the headers the client sent with its last dial.
+func (s *fakeServer) Header() http.Header {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.header
+}
+
+// Path returns the URL path of the last dial.
+func (s *fakeServer) Path() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.path
+}
+
+// Dialer returns a dialer connecting to the server whatever the URL.
+func (s *fakeServer) Dialer() *MockWebSocketDialer {
+	return &MockWebSocketDialer{URL: "ws" + strings.TrimPrefix(s.URL, "http")}
+}
+
+// MockWebSocketDialer dials the host of URL instead of the host of the URL it
+// is given, keeping the path, so that an httptest server can stand in for the
+// service with WithDialer.
+type MockWebSocketDialer struct {
+	URL string
+	// Dials counts the dials.
+	Dials atomic.Int32
+}
+
+func (d *MockWebSocketDialer) DialContext(ctx context.Context, urlStr string, header http.Header) (*websocket.Conn, *http.Response, error) {
+	d.Dials.Add(1)
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		return nil, nil, err
+	}
+	return websocket.DefaultDialer.DialContext(ctx, d.URL+u.Path, header)
+}
+
+// fakeConn is the server end of a client connection.
+type fakeConn struct {
+	t    *testing.T
+	conn *websocket.Conn
+	// events lists the events of the frames read other than audio, and
+	// audioFrames counts the audio frames.
+	events      []int32
+	audioFrames int
+	// compression is the compression of the last frame read.
+	compression CompressionBits
+}
+
+// read returns the next frame the client sent, decoded, or nil once the
+// client hung up.
+func (c *fakeConn) read() *Message {
+	mt, data, err := c.conn.ReadMessage()
+	if err != nil {
+		return nil
+	}
+	if mt == websocket.TextMessage {
+		if data, err = base64.StdEncoding.DecodeString(string(data)); err != nil {
+			c.t.Errorf("fake server: decode text message: %v", err)
+			return nil
+		}
+	}
+	msg, prot, err := Unmarshal(data, ContainsSequence)
+	if err != nil {
+		c.t.Errorf("fake server: unmarshal % x: %v", data, err)
+		return nil
+	}
+	if msg.Payload, err = decompressPayload(prot.Compression(), msg.Payload); err != nil {
+		c.t.Errorf("fake server: decompress event %d: %v", msg.Event, err)
+		return nil
+	}
+	c.compression = prot.Compression()
+	if msg.Type == MsgTypeAudioOnlyClient {
+		c.audioFrames++
+	} else {
+		c.events = append(c.events, msg.Event)
+	}
+	return msg
+}
+
+// expect reads frames, skipping audio, until one of event arrives. It fails
+// the test and returns nil if the client hangs up first.
+func (c *fakeConn) expect(event int32) *Message {
+	for {
+		msg := c.read()
+		if msg == nil {
+			c.t.Errorf("fake server: client hung up waiting for event %d", event)
+			return nil
+		}
+		if msg.Event == event {
+			return msg
+		}
+		if msg.Type != MsgTypeAudioOnlyClient {
+			c.t.Errorf("fake server: got event %d, want %d", msg.Event, event)
+		}
+	}
+}
+
+// send writes frame to the client.
+func (c *fakeConn) send(frame []byte) {
+	if err := c.conn.WriteMessage(websocket.BinaryMessage, frame); err != nil {
+		c.t.Logf("fake server: send: %v", err)
+	}
+}
+
+// handshake answers StartConnection and StartSession with dialogID and
+// returns the session ID.
+func (c *fakeConn) handshake(dialogID string) string {
+	if c.expect(1) == nil {
+		return ""
+	}
+	c.send(serverFrame(50, "conn-1", `{}`))
+	msg := c.expect(100)
+	if msg == nil {
+		return ""
+	}
+	c.send(serverFrame(150, msg.SessionID, `{"dialog_id":"`+dialogID+`"}`))
+	return msg.SessionID
+}
+
+// finish answers FinishSession and FinishConnection.
+func (c *fakeConn) finish(sessionID string) {
+	if c.expect(102) == nil {
+		return
+	}
+	c.send(serverFrame(152, sessionID, `{}`))
+	if c.expect(2) == nil {
+		return
+	}
+	c.send(serverFrame(52, "conn-1", `{}`))
+}
+
+// answer sends a bot answer of text with samples of audio, from
+// TTSSentenceStart to TTSEnded.
+func (c *fakeConn) answer(sessionID, text string, samples int) {
+	c.send(serverFrame(350, sessionID, `{"tts_type":"default"}`))
+	c.send(serverFrame(550, sessionID, `{"content":"`+text+`"}`))
+	c.send(serverAudio(sessionID, make([]float32, samples)))
+	c.send(serverFrame(359, sessionID, `{}`))
+}
+
+// userTurn sends the ASR events of the user saying text.
+func (c *fakeConn) userTurn(sessionID, text string) {
+	c.send(serverFrame(450, sessionID, `{}`))
+	c.send(serverFrame(451, sessionID, `{"results":[{"text":"`+text+`","is_interim":false}]}`))
+	c.send(serverFrame(459, sessionID, `{}`))
+}
+
+// serverFrame encodes a JSON server event the way the service does. The
+// connection events 50, 51 and 52 carry a connect ID in place of the session
+// ID.
+func serverFrame(event int32, sessionID, payload string) []byte {
+	frame := []byte{0x11, msgTypeToBits[MsgTypeFullServer] | uint8(MsgTypeFlagWithEvent), uint8(SerializationJSON), 0}
+	frame = binary.BigEndian.AppendUint32(frame, uint32(event))
+	frame = appendSized(frame, []byte(sessionID))
+	return appendSized(frame, []byte(payload))
+}
+
+// serverAudio encodes a TTSResponse carrying samples as PCM float32.
+func serverAudio(sessionID string, samples []float32) []byte {
+	frame := []byte{0x11, msgTypeToBits[MsgTypeAudioOnlyServer] | uint8(MsgTypeFlagWithEvent), uint8(SerializationRaw), 0}
+	frame = binary.BigEndian.AppendUint32(frame, 352)
+	frame = appendSized(frame, []byte(sessionID))
+	payload := make([]byte, 0, len(samples)*4)
+	for _, s := range samples {
+		payload = binary.LittleEndian.AppendUint32(payload, math.Float32bits(s))
+	}
+	return appendSized(frame, payload)
+}
+
+// serverError encodes an Error frame with code.
+func serverError(code uint32, payload string) []byte {
+	frame := []byte{0x11, msgTypeToBits[MsgTypeError], uint8(SerializationJSON), 0}
+	frame = binary.BigEndian.AppendUint32(frame, code)
+	return appendSized(frame, []byte(payload))
+}
+
+// appendSized appends data to frame with its big endian uint32 size before.
+func appendSized(frame, data []byte) []byte {
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(data)))
+	return append(frame, data...)
+}
+
+// setupDialog resets the state a dialog leaves behind in the package and
+// points the client at s, with mic as audio input and speaker as output. The
+// recording is saved in a temporary directory.
+func setupDialog(t *testing.T, s *fakeServer) (*fakeMic, *fakeSpeaker) {
+	t.Helper()
+	t.Chdir(t.TempDir())
+	if s != nil {
+		WithDialer(s.Dialer())
+		t.Cleanup(func() { WithDialer(nil) })
+	}
+	sessionState = newSessionStateMachine()
+	turns = &turnTracker{}
+	counters = &sessionCounters{start: time.Now()}
+	sessionManager = NewSessionManager()
+	dialogIDs = &dialogHistory{ids: map[string][]string{}}
+	shutdownManager = &ShutdownManager{sessions: map[string]context.CancelCauseFunc{}}
+	bandwidth = &bandwidthTracker{stats: map[bandwidthKey]*BandwidthStats{}}
+	journal = NewJournal(1024)
+	firstByte = newFirstByteProbe()
+	shutdownCounts = NewShutdownCounts()
+	audio = nil
+	audioMemoryUsed.Store(0)
+	dialogID = ""
+	isUserQuerying.Store(false)
+	isSendingChatTTSText.Store(false)
+	// 种子 1 的前两个 randIntn(2) 都是 1，前两轮不会触发随机的 ChatTTSText 请求
+	WithSeed(1)
+	WithSayHelloRateLimit(0)
+	WithBotResponseTimeout(0, TimeoutBehaviorSayHello)
+	WithFinishGrace(time.Second)
+	t.Cleanup(func() {
+		journal = nil
+		WithSayHelloRateLimit(5 * time.Second)
+		WithBotResponseTimeout(30*time.Second, TimeoutBehaviorSayHello)
+		WithFinishGrace(3 * time.Second)
+	})
+	mic, speaker := newFakeMic(), &fakeSpeaker{}
+	audioSource, audioSink = mic, speaker
+	return mic, speaker
+}
+
+// dialFake connects to the server set with setupDialog.
+func dialFake(t *testing.T) *websocket.Conn {
+	t.Helper()
+	conn, _, err := dial(context.Background())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { _ = closeConn(conn) })
+	return conn
+}
+
+// scriptedDialog returns a server handler answering the handshake and the
+// greeting, then playing script and ending the session as the server.
+func scriptedDialog(script func(c *fakeConn, sessionID string)) func(c *fakeConn) {
+	return func(c *fakeConn) {
+		sid := c.handshake("dialog-1")
+		if c.expect(300) == nil {
+			return
+		}
+		script(c, sid)
+		c.send(serverFrame(152, sid, `{}`))
+		for msg := c.read(); msg != nil; msg = c.read() {
+			if msg.Event == 2 {
+				c.send(serverFrame(52, "conn-1", `{}`))
+				return
+			}
+		}
+	}
+}
+
+// runFakeDialog runs a dialog against the server set up with setupDialog
+// until it ends and returns what realTimeDialog returned.
+func runFakeDialog(t *testing.T) (*DialogSummary, error) {
+	t.Helper()
+	conn := dialFake(t)
+	summary, err := realTimeDialog(context.Background(), conn, "session-1")
+	if err := shutdownManager.GracefulShutdown(time.Second); err != nil {
+		t.Error(err)
+	}
+	return summary, err
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// formatCheckWindow is how long after the first audio of a direction the
+	// sample format checks run; they are cheap but pointless later on.
+	formatCheckWindow = 5 * time.Second
+	// uplinkRateMinElapsed is how much capture is needed to estimate its rate.
+	uplinkRateMinElapsed = 2 * time.Second
+	// uplinkRateTolerance is the relative deviation of the measured capture
+	// rate tolerated before warning.
+	uplinkRateTolerance = 0.25
+	// outOfRangeRatio is the share of float32 samples outside [-1, 1] above
+	// which downlink audio is assumed not to be float32 at all.
+	outOfRangeRatio = 0.1
+	// sentenceMinDuration is the shortest TTS sentence whose duration is used
+	// to infer the downlink rate.
+	sentenceMinDuration = 200 * time.Millisecond
+	// downlinkRateTolerance is the relative deviation of the downlink byte
+	// rate from the configured format tolerated before warning.
+	downlinkRateTolerance = 0.1
+)
+
+// commonSampleRates are the rates the inferred downlink rate is rounded to.
+var commonSampleRates = []int{8000, 11025, 16000, 22050, 24000, 32000, 44100, 48000}
+
+// FormatWarning reports audio that does not match the configured format.
+type FormatWarning struct {
+	Direction  Direction
+	Configured string
+	Observed   string
+}
+
+func (w FormatWarning) String() string {
+	return fmt.Sprintf("%s audio format mismatch: configured %s, but observed %s", w.Direction, w.Configured, w.Observed)
+}
+
+// formatChecker runs the sample format sanity checks during the first seconds
+// of each audio direction. It is safe for concurrent use.
+type formatChecker struct {
+	lock sync.Mutex
+
+	downlinkStart time.Time
+	downlinkDone  bool
+	// sentenceBytes counts the audio bytes of the TTS sentence being received.
+	sentenceBytes int
+
+	uplinkStart   time.Time
+	uplinkSamples int
+	uplinkDone    bool
+}
+
+var formatCheck = &formatChecker{}
+
+// reset starts the checks over for a new session.
+func (c *formatChecker) reset() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.downlinkStart, c.downlinkDone, c.sentenceBytes = time.Time{}, false, 0
+	c.uplinkStart, c.uplinkSamples, c.uplinkDone = time.Time{}, 0, false
+}
+
+// checkDownlink inspects a TTS audio payload, expected to be PCM float32 at
+// sampleRate. Integer PCM decoded as float32 shows up as a payload size not
+// divisible by 4 or as samples far outside [-1, 1].
+func (c *formatChecker) checkDownlink(payload []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.downlinkDone {
+		return
+	}
+	now := time.Now()
+	if c.downlinkStart.IsZero() {
+		c.downlinkStart = now
+	} else if now.Sub(c.downlinkStart) > formatCheckWindow {
+		c.downlinkDone = true
+		return
+	}
+
+	c.sentenceBytes += len(payload)
+	configured := downlinkFormat()
+	if len(payload)%4 != 0 {
+		c.downlinkDone = true
+		c.warn(FormatWarning{
+			Direction:  DirectionInbound,
+			Configured: configured,
+			Observed:   fmt.Sprintf("a chunk of %d bytes, not a whole number of float32 samples (16-bit PCM?)", len(payload)),
+		})
+		return
+	}
+	var outOfRange int
+	n := len(payload) / 4
+	for i := 0; i < n; i++ {
+		v := math.Float32frombits(binary.LittleEndian.Uint32(payload[i*4:]))
+		if math.IsNaN(float64(v)) || v > 1.01 || v < -1.01 {
+			outOfRange++
+		}
+	}
+	if n > 0 && float64(outOfRange)/float64(n) > outOfRangeRatio {
+		c.downlinkDone = true
+		c.warn(FormatWarning{
+			Direction:  DirectionInbound,
+			Configured: configured,
+			Observed:   fmt.Sprintf("%d of %d samples outside [-1, 1] (16-bit PCM?)", outOfRange, n),
+		})
+	}
+}
+
+// sentenceStarted starts counting the audio of a TTS sentence.
+func (c *formatChecker) sentenceStarted() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.sentenceBytes = 0
+}
+
+// sentenceEnded compares the audio received for a TTS sentence with the
+// sentence duration, if the TTSSentenceEnd payload reports it as "duration"
+// in milliseconds. Audio at another rate than configured, e.g. 16kHz played
+// as 24kHz, sounds like a chipmunk or drags, and shows up here as a byte
+// rate that does not match the configured format.
+func (c *formatChecker) sentenceEnded(payload []byte) {
+	var sentence struct {
+		Duration float64 `json:"duration"`
+	}
+	_ = json.Unmarshal(payload, &sentence)
+	duration := time.Duration(sentence.Duration * float64(time.Millisecond))
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	bytes := c.sentenceBytes
+	c.sentenceBytes = 0
+	if c.downlinkDone || c.downlinkStart.IsZero() || duration < sentenceMinDuration || bytes == 0 {
+		return
+	}
+	if observed, ok := inferDownlinkFormat(bytes, duration); !ok {
+		c.downlinkDone = true
+		c.warn(FormatWarning{
+			Direction:  DirectionInbound,
+			Configured: downlinkFormat(),
+			Observed:   fmt.Sprintf("%d bytes for %v of speech, i.e. %s", bytes, duration, observed),
+		})
+	}
+}
+
+// downlinkFormat describes the configured downlink format.
+func downlinkFormat() string {
+	return fmt.Sprintf("PCM float32 %dHz", sampleRate)
+}
+
+// inferDownlinkFormat names the format in which bytes of audio last d, and
+// reports whether it is the configured one.
+func inferDownlinkFormat(bytes int, d time.Duration) (string, bool) {
+	perSecond := float64(bytes) / d.Seconds()
+	near := func(want float64) bool { return math.Abs(perSecond-want)/want <= downlinkRateTolerance }
+	switch {
+	case near(sampleRate * 4):
+		return downlinkFormat(), true
+	case near(sampleRate * 2):
+		return fmt.Sprintf("16-bit PCM %dHz", sampleRate), false
+	}
+	rate := perSecond / 4
+	closest := commonSampleRates[0]
+	for _, r := range commonSampleRates {
+		if math.Abs(float64(r)-rate) < math.Abs(float64(closest)-rate) {
+			closest = r
+		}
+	}
+	if math.Abs(float64(closest)-rate)/rate > downlinkRateTolerance {
+		return fmt.Sprintf("PCM float32 at about %.0fHz", rate), false
+	}
+	return fmt.Sprintf("PCM float32 %dHz", closest), false
+}
+
+// checkUplink measures the rate at which the microphone delivers samples,
+// which should be inputSampleRate.
+func (c *formatChecker) checkUplink(samples int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.uplinkDone {
+		return
+	}
+	now := time.Now()
+	if c.uplinkStart.IsZero() {
+		// The first read may have waited for the device to start.
+		c.uplinkStart = now
+		return
+	}
+	c.uplinkSamples += samples
+	elapsed := now.Sub(c.uplinkStart)
+	if elapsed < uplinkRateMinElapsed {
+		return
+	}
+	c.uplinkDone = true
+	rate := float64(c.uplinkSamples) / elapsed.Seconds()
+	if math.Abs(rate-inputSampleRate)/inputSampleRate > uplinkRateTolerance {
+		c.warn(FormatWarning{
+			Direction:  DirectionOutbound,
+			Configured: fmt.Sprintf("%dHz capture", inputSampleRate),
+			Observed:   fmt.Sprintf("%.0f samples per second from the microphone", rate),
+		})
+	}
+}
+
+func (c *formatChecker) warn(w FormatWarning) {
+	glog.Warningf("!!! %v !!!", w)
+	journal.Record(JournalDiagnostic, 0, "", w.String())
+	if eventHandlers.OnFormatWarning != nil {
+		eventHandlers.OnFormatWarning(w)
+	}
+}
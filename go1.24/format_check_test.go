@@ -0,0 +1,88 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInferDownlinkFormat(t *testing.T) {
+	for _, tc := range []struct {
+		bytes    int
+		observed string
+		ok       bool
+	}{
+		{sampleRate * 4, "PCM float32 24000Hz", true},
+		{sampleRate * 4 * 105 / 100, "PCM float32 24000Hz", true},
+		{16000 * 4, "PCM float32 16000Hz", false},
+		{48000 * 4, "PCM float32 48000Hz", false},
+		{sampleRate * 2, "16-bit PCM 24000Hz", false},
+		{5000 * 4, "PCM float32 at about 5000Hz", false},
+	} {
+		observed, ok := inferDownlinkFormat(tc.bytes, time.Second)
+		if observed != tc.observed || ok != tc.ok {
+			t.Errorf("inferDownlinkFormat(%d bytes, 1s) = %q, %v, want %q, %v", tc.bytes, observed, ok, tc.observed, tc.ok)
+		}
+	}
+}
+
+// captureFormatWarnings resets the checks and collects their warnings.
+func captureFormatWarnings(t *testing.T) *[]FormatWarning {
+	t.Helper()
+	setupDialog(t, nil)
+	var warnings []FormatWarning
+	old := eventHandlers.OnFormatWarning
+	eventHandlers.OnFormatWarning = func(w FormatWarning) { warnings = append(warnings, w) }
+	t.Cleanup(func() { eventHandlers.OnFormatWarning = old })
+	formatCheck.reset()
+	return &warnings
+}
+
+// TestChipmunkDownlink feeds a sentence of 16kHz audio while 24kHz is
+// configured and checks the warning names both rates.
+func TestChipmunkDownlink(t *testing.T) {
+	warnings := captureFormatWarnings(t)
+	formatCheck.sentenceStarted()
+	for range 10 {
+		formatCheck.checkDownlink(make([]byte, 1600*4)) // 100ms at 16kHz
+	}
+	formatCheck.sentenceEnded([]byte(`{"duration":1000}`))
+	if len(*warnings) != 1 {
+		t.Fatalf("got %d warnings, want 1", len(*warnings))
+	}
+	w := (*warnings)[0]
+	if w.Configured != "PCM float32 24000Hz" || !strings.Contains(w.Observed, "PCM float32 16000Hz") {
+		t.Errorf("warning = %v, want 24kHz configured and 16kHz observed", w)
+	}
+	entries := journal.Entries()
+	if len(entries) == 0 || entries[len(entries)-1].Kind != JournalDiagnostic {
+		t.Errorf("journal = %+v, want the warning recorded as a diagnostic", entries)
+	}
+
+	// 下一个会话重新检查
+	formatCheck.reset()
+	formatCheck.sentenceStarted()
+	formatCheck.checkDownlink(make([]byte, sampleRate*4/2))
+	formatCheck.sentenceEnded([]byte(`{"duration":500}`))
+	if len(*warnings) != 1 {
+		t.Errorf("matching audio in the next session warned: %v", (*warnings)[1:])
+	}
+}
+
+func TestSentenceWithoutDuration(t *testing.T) {
+	warnings := captureFormatWarnings(t)
+	formatCheck.sentenceStarted()
+	formatCheck.checkDownlink(make([]byte, 1600*4))
+	formatCheck.sentenceEnded([]byte(`{}`))
+	if len(*warnings) != 0 {
+		t.Errorf("a sentence of unknown duration warned: %v", *warnings)
+	}
+}
+
+func TestInt16Downlink(t *testing.T) {
+	warnings := captureFormatWarnings(t)
+	formatCheck.checkDownlink(make([]byte, 4802))
+	if len(*warnings) != 1 || !strings.Contains((*warnings)[0].Observed, "16-bit PCM?") {
+		t.Errorf("warnings = %v, want one about 16-bit PCM", *warnings)
+	}
+}
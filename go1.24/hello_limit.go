@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// ErrSayHelloRateLimited is returned for a SayHello request sent sooner than
+// WithSayHelloRateLimit allows.
+var ErrSayHelloRateLimited = errors.New("SayHello rate limited")
+
+// helloLimiter lets at most one SayHello request through per interval, so
+// that a runaway caller, e.g. a buggy idle loop, cannot flood the server. It
+// is safe for concurrent use.
+type helloLimiter struct {
+	limiter *rate.Limiter
+}
+
+var sayHelloLimiter = &helloLimiter{limiter: rate.NewLimiter(helloRate(5*time.Second), 1)}
+
+// WithSayHelloRateLimit allows one SayHello request per interval; requests in
+// between fail with ErrSayHelloRateLimited. The default is one per 5s, 0
+// disables the limit.
+func WithSayHelloRateLimit(interval time.Duration) {
+	sayHelloLimiter.limiter.SetLimit(helloRate(interval))
+}
+
+// helloRate returns the rate of one request per interval, unlimited for an
+// interval of 0.
+func helloRate(interval time.Duration) rate.Limit {
+	if interval <= 0 {
+		return rate.Inf
+	}
+	return rate.Every(interval)
+}
+
+// take reserves a request at now. It returns 0 if the request may be sent, or
+// how long until the next one may.
+func (l *helloLimiter) take(now time.Time) time.Duration {
+	r := l.limiter.ReserveN(now, 1)
+	if d := r.DelayFrom(now); d > 0 {
+		r.CancelAt(now)
+		return d
+	}
+	return 0
+}
+
+// wait blocks until a request may be sent, without reserving it, or ctx is
+// done.
+func (l *helloLimiter) wait(ctx context.Context) error {
+	now := time.Now()
+	r := l.limiter.ReserveN(now, 1)
+	d := r.DelayFrom(now)
+	r.CancelAt(now)
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// TestSayHelloRateLimit checks that a second SayHello within the interval
+// fails with ErrSayHelloRateLimited before anything is sent, and that the
+// limit can be lifted.
+func TestSayHelloRateLimit(t *testing.T) {
+	useHelloLimiter(t, time.Hour)
+	if wait := sayHelloLimiter.take(time.Now()); wait != 0 {
+		t.Fatalf("first take() = %s, want 0", wait)
+	}
+	if wait := sayHelloLimiter.take(time.Now()); wait <= 59*time.Minute {
+		t.Errorf("second take() = %s, want about an hour", wait)
+	}
+	// 被限速的请求在发送前就失败，不会用到连接
+	if err := sayHello(nil, "session-1", &SayHelloPayload{Content: "你好"}); !errors.Is(err, ErrSayHelloRateLimited) {
+		t.Errorf("sayHello() = %v, want ErrSayHelloRateLimited", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := sayHelloLimiter.wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("wait() = %v, want the context to expire first", err)
+	}
+
+	WithSayHelloRateLimit(0)
+	for range 3 {
+		if wait := sayHelloLimiter.take(time.Now()); wait != 0 {
+			t.Errorf("take() without a limit = %s, want 0", wait)
+		}
+	}
+	if err := sayHelloLimiter.wait(context.Background()); err != nil {
+		t.Errorf("wait() without a limit = %v", err)
+	}
+}
+
+// TestSayHelloWaitDoesNotReserve checks that wait leaves the request to take.
+func TestSayHelloWaitDoesNotReserve(t *testing.T) {
+	useHelloLimiter(t, time.Hour)
+	if err := sayHelloLimiter.wait(context.Background()); err != nil {
+		t.Fatalf("wait() = %v", err)
+	}
+	if wait := sayHelloLimiter.take(time.Now()); wait != 0 {
+		t.Errorf("take() after wait() = %s, want 0", wait)
+	}
+}
+
+// useHelloLimiter replaces the SayHello limiter for the test with a new one
+// allowing a request per interval.
+func useHelloLimiter(t *testing.T, interval time.Duration) {
+	saved := sayHelloLimiter
+	sayHelloLimiter = &helloLimiter{limiter: rate.NewLimiter(helloRate(interval), 1)}
+	t.Cleanup(func() { sayHelloLimiter = saved })
+}
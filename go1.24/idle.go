@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/gorilla/websocket"
+)
+
+// TimeoutBehavior selects what happens when neither the user nor the bot said
+// anything for the bot response timeout.
+type TimeoutBehavior int
+
+// Values that a TimeoutBehavior variable can take.
+const (
+	// TimeoutBehaviorSayHello prompts the user with a SayHello request.
+	TimeoutBehaviorSayHello TimeoutBehavior = iota
+	// TimeoutBehaviorTerminate ends the session.
+	TimeoutBehaviorTerminate
+	// TimeoutBehaviorNotify only calls EventHandlers.OnIdleTimeout.
+	TimeoutBehaviorNotify
+)
+
+func (b TimeoutBehavior) String() string {
+	switch b {
+	case TimeoutBehaviorSayHello:
+		return "say-hello"
+	case TimeoutBehaviorTerminate:
+		return "terminate"
+	case TimeoutBehaviorNotify:
+		return "notify"
+	default:
+		return fmt.Sprintf("TimeoutBehavior(%d)", int(b))
+	}
+}
+
+// parseTimeoutBehavior parses the names returned by TimeoutBehavior.String.
+func parseTimeoutBehavior(s string) (TimeoutBehavior, error) {
+	for _, b := range []TimeoutBehavior{TimeoutBehaviorSayHello, TimeoutBehaviorTerminate, TimeoutBehaviorNotify} {
+		if b.String() == s {
+			return b, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown idle timeout behavior %q, want say-hello, terminate or notify", s)
+}
+
+var (
+	idleLock           sync.Mutex
+	botResponseTimeout = 30 * time.Second
+	timeoutBehavior    = TimeoutBehaviorSayHello
+	// idleChanged wakes the running idle timer after WithBotResponseTimeout.
+	idleChanged = make(chan struct{}, 1)
+)
+
+// WithBotResponseTimeout sets how long the dialog may stay silent before
+// behavior applies. The timer restarts after every user utterance and every bot
+// answer; a timeout of 0 disables it. A running dialog picks up the change,
+// measuring the silence anew.
+func WithBotResponseTimeout(timeout time.Duration, behavior TimeoutBehavior) {
+	idleLock.Lock()
+	botResponseTimeout = timeout
+	timeoutBehavior = behavior
+	idleLock.Unlock()
+	select {
+	case idleChanged <- struct{}{}:
+	default:
+	}
+}
+
+// idleSettings returns the bot response timeout and its behavior.
+func idleSettings() (time.Duration, TimeoutBehavior) {
+	idleLock.Lock()
+	defer idleLock.Unlock()
+	return botResponseTimeout, timeoutBehavior
+}
+
+// resetIdleTicker makes ticker tick idleTicksPerTimeout times per timeout, or
+// stops it if the timeout is disabled.
+func resetIdleTicker(ticker *time.Ticker, timeout time.Duration) {
+	if timeout <= 0 {
+		ticker.Stop()
+		return
+	}
+	ticker.Reset(timeout / idleTicksPerTimeout)
+}
+
+// signalActivity restarts the idle timer. It never blocks the receive loop,
+// even after the idle timer stopped.
+func signalActivity() {
+	queryChan.Signal()
+}
+
+// idleTicksPerTimeout is how often per bot response timeout the idle timer
+// checks the silence, bounding how late it fires.
+const idleTicksPerTimeout = 4
+
+// runIdleTimer applies the timeout behavior whenever the dialog stays silent
+// for the bot response timeout, until ctx is done. stop ends the session.
+//
+// The silence is measured against the wall clock on every tick rather than
+// waited out with one timer, so that a timer delayed by a loaded scheduler
+// does not push the timeout back further.
+func runIdleTimer(ctx context.Context, stop context.CancelFunc, c *websocket.Conn, sessionID string) {
+	// 启动前的设置已经生效，无需再处理变更通知
+	select {
+	case <-idleChanged:
+	default:
+	}
+	timeout, behavior := idleSettings()
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	resetIdleTicker(ticker, timeout)
+	last := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-idleChanged:
+			timeout, behavior = idleSettings()
+			resetIdleTicker(ticker, timeout)
+			last = time.Now()
+			glog.Infof("Idle timeout changed to %s, behavior: %s", timeout, behavior)
+		case <-queryChan.C:
+			last = time.Now()
+			glog.Info("Received user query or bot answer, idle timer restarted.")
+		case now := <-ticker.C:
+			elapsed := now.Sub(last)
+			if elapsed < timeout {
+				continue
+			}
+			last = now
+			if elapsed > 2*timeout {
+				glog.Warningf("Idle timer fired late: %s elapsed for a timeout of %s", elapsed.Round(time.Millisecond), timeout)
+			}
+			glog.Infof("No speech for %s, idle timeout behavior: %s", elapsed.Round(time.Millisecond), behavior)
+			journal.Record(JournalCommand, 0, sessionID, "idle timeout: "+behavior.String())
+			if eventHandlers.OnIdleTimeout != nil {
+				eventHandlers.OnIdleTimeout()
+			}
+			switch behavior {
+			case TimeoutBehaviorSayHello:
+				if err := sayHello(c, sessionID, &SayHelloPayload{
+					Content: "你还在吗？还想聊点什么吗？我超乐意继续陪你。",
+				}); err != nil {
+					glog.Errorf("Idle sayHello error: %v", err)
+				}
+			case TimeoutBehaviorTerminate:
+				stop()
+				return
+			}
+		}
+	}
+}
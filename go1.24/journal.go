@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// JournalKind classifies a journal entry.
+type JournalKind string
+
+// Values that a JournalKind variable can take.
+const (
+	JournalFrameSent     JournalKind = "sent"
+	JournalEventReceived JournalKind = "received"
+	JournalStateChange   JournalKind = "state"
+	JournalCommand       JournalKind = "command"
+	// JournalDiagnostic records a problem the client noticed, e.g. a sample
+	// format mismatch, as opposed to an action it took.
+	JournalDiagnostic JournalKind = "diagnostic"
+)
+
+// JournalEntry records one local action or server event. Consecutive entries
+// of the same kind, event and session (e.g. a stream of audio frames) are
+// folded into one entry whose Count is incremented.
+type JournalEntry struct {
+	Seq       uint64        `json:"seq"`
+	Elapsed   time.Duration `json:"elapsed"`
+	Last      time.Duration `json:"last,omitempty"`
+	Count     int           `json:"count"`
+	Kind      JournalKind   `json:"kind"`
+	Event     int32         `json:"event"`
+	SessionID string        `json:"session_id,omitempty"`
+	Detail    string        `json:"detail,omitempty"`
+}
+
+// Journal is a bounded in-memory log of everything that happened in a session,
+// ordered by a sequence number and timestamped with the monotonic clock. It is
+// safe for concurrent use; a nil Journal records nothing.
+type Journal struct {
+	lock    sync.Mutex
+	start   time.Time
+	seq     uint64
+	entries []JournalEntry
+	next    int
+	full    bool
+}
+
+// NewJournal returns a journal keeping the last size entries; a size of 0 or
+// less keeps none.
+func NewJournal(size int) *Journal {
+	return &Journal{start: time.Now(), entries: make([]JournalEntry, max(size, 0))}
+}
+
+var journal *Journal
+
+// Record appends an entry to the journal.
+func (j *Journal) Record(kind JournalKind, event int32, sessionID, detail string) {
+	if j == nil || len(j.entries) == 0 {
+		return
+	}
+	elapsed := time.Since(j.start)
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if j.next > 0 || j.full {
+		last := &j.entries[(j.next+len(j.entries)-1)%len(j.entries)]
+		if last.Kind == kind && last.Event == event && last.SessionID == sessionID {
+			last.Count++
+			last.Last = elapsed
+			return
+		}
+	}
+	j.seq++
+	j.entries[j.next] = JournalEntry{
+		Seq:       j.seq,
+		Elapsed:   elapsed,
+		Count:     1,
+		Kind:      kind,
+		Event:     event,
+		SessionID: sessionID,
+		Detail:    detail,
+	}
+	j.next = (j.next + 1) % len(j.entries)
+	if j.next == 0 {
+		j.full = true
+	}
+}
+
+// Entries returns the journal entries, oldest first.
+func (j *Journal) Entries() []JournalEntry {
+	if j == nil {
+		return nil
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if !j.full {
+		return append([]JournalEntry(nil), j.entries[:j.next]...)
+	}
+	return append(append([]JournalEntry(nil), j.entries[j.next:]...), j.entries[:j.next]...)
+}
+
+// Dump writes the journal entries to w as JSON lines, the format read back by
+// ReadJournal.
+func (j *Journal) Dump(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	for _, e := range j.Entries() {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadJournal reads journal entries written by Journal.Dump.
+func ReadJournal(r io.Reader) ([]JournalEntry, error) {
+	var entries []JournalEntry
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		var e JournalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("decode journal entry %d: %w", len(entries)+1, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
+
+// AnalyzeJournal flags suspicious orderings in the journal entries:
+//   - frames sent for a session after its FinishSession request,
+//   - events received for a session after it finished or failed,
+//   - bot replies received while the user is still speaking, which shows up
+//     as "the bot answered the previous question".
+func AnalyzeJournal(entries []JournalEntry) []string {
+	var (
+		findings       []string
+		finishSent     = map[string]uint64{}
+		finished       = map[string]uint64{}
+		userSpeakingAt uint64
+	)
+	for _, e := range entries {
+		switch e.Kind {
+		case JournalFrameSent:
+			if seq, ok := finishSent[e.SessionID]; ok && e.SessionID != "" {
+				findings = append(findings, fmt.Sprintf("#%d: event %d sent for session %s after FinishSession (#%d)", e.Seq, e.Event, e.SessionID, seq))
+			}
+			if e.Event == 102 {
+				finishSent[e.SessionID] = e.Seq
+			}
+		case JournalEventReceived:
+			if seq, ok := finished[e.SessionID]; ok && e.SessionID != "" {
+				findings = append(findings, fmt.Sprintf("#%d: event %d received for session %s after it finished (#%d)", e.Seq, e.Event, e.SessionID, seq))
+			}
+			switch e.Event {
+			case 152, 153: // SessionFinished, SessionFailed
+				finished[e.SessionID] = e.Seq
+			case 450: // ASRInfo: the user started speaking
+				userSpeakingAt = e.Seq
+			case 459: // ASREnded
+				userSpeakingAt = 0
+			case 550: // ChatResponse
+				if userSpeakingAt != 0 {
+					findings = append(findings, fmt.Sprintf("#%d: bot reply received while the user is still speaking (since #%d)", e.Seq, userSpeakingAt))
+				}
+			}
+		}
+	}
+	return findings
+}
+
+// dumpJournal writes the journal and its analysis to path, or to stderr if
+// path is empty.
+func dumpJournal(path string) error {
+	w := io.Writer(os.Stderr)
+	if path != "" {
+		f, err := os.Create(path)
+		if err != nil {
+			return fmt.Errorf("create journal file: %w", err)
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := journal.Dump(w); err != nil {
+		return fmt.Errorf("dump journal: %w", err)
+	}
+	for _, finding := range AnalyzeJournal(journal.Entries()) {
+		fmt.Fprintf(os.Stderr, "journal: %s\n", finding)
+	}
+	return nil
+}
+
+// analyzeJournalFile prints the findings of AnalyzeJournal for a dumped journal.
+func analyzeJournalFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("open journal file: %w", err)
+	}
+	defer f.Close()
+	entries, err := ReadJournal(f)
+	if err != nil {
+		return err
+	}
+	findings := AnalyzeJournal(entries)
+	for _, finding := range findings {
+		fmt.Println(finding)
+	}
+	fmt.Printf("%d entries analyzed, %d suspicious orderings found.\n", len(entries), len(findings))
+	return nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestJournalBounded(t *testing.T) {
+	j := NewJournal(2)
+	j.Record(JournalFrameSent, 100, "s1", "")
+	j.Record(JournalEventReceived, 150, "s1", "")
+	j.Record(JournalFrameSent, 200, "s1", "")
+	j.Record(JournalFrameSent, 200, "s1", "") // folded into the previous entry
+	entries := j.Entries()
+	if len(entries) != 2 || entries[0].Event != 150 || entries[1].Event != 200 || entries[1].Count != 2 {
+		t.Fatalf("Entries() = %+v, want 150 and twice 200", entries)
+	}
+	if entries[0].Seq >= entries[1].Seq {
+		t.Errorf("sequence numbers %d, %d are not increasing", entries[0].Seq, entries[1].Seq)
+	}
+
+	var b bytes.Buffer
+	if err := j.Dump(&b); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadJournal(&b)
+	if err != nil || !reflect.DeepEqual(read, entries) {
+		t.Errorf("ReadJournal() = %+v, %v, want the dumped %+v", read, err, entries)
+	}
+
+	NewJournal(-1).Record(JournalCommand, 0, "", "dropped")
+}
+
+func TestAnalyzeJournal(t *testing.T) {
+	j := NewJournal(16)
+	j.Record(JournalEventReceived, 450, "s1", "")
+	j.Record(JournalEventReceived, 550, "s1", "") // bot reply while the user speaks
+	j.Record(JournalEventReceived, 459, "s1", "")
+	j.Record(JournalFrameSent, 102, "s1", "")
+	j.Record(JournalFrameSent, 200, "s1", "") // audio after FinishSession
+	j.Record(JournalEventReceived, 152, "s1", "")
+	j.Record(JournalEventReceived, 352, "s1", "") // event after the session finished
+	if got := AnalyzeJournal(j.Entries()); len(got) != 3 {
+		t.Errorf("AnalyzeJournal() = %q, want 3 findings", got)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// firstByteProbe measures the first byte latency of each turn: the time from
+// the end of the user's speech, ASREnded, to the first bot audio received
+// after it. The timestamps are handed over channels of capacity one, which
+// hold the last end of speech and the first audio after it, and are drained
+// when the turn ends.
+type firstByteProbe struct {
+	ended    chan time.Time
+	received chan time.Time
+	once     sync.Once
+	measured chan struct{} // closed once first is set
+	first    time.Duration
+}
+
+func newFirstByteProbe() *firstByteProbe {
+	return &firstByteProbe{
+		ended:    make(chan time.Time, 1),
+		received: make(chan time.Time, 1),
+		measured: make(chan struct{}),
+	}
+}
+
+var firstByte = newFirstByteProbe()
+
+// latencyClock tells the time of the events first byte latencies are measured
+// between, time.Now but for tests, which measure in steps of a fake clock.
+var latencyClock = time.Now
+
+// userEnded records that the user stopped speaking at t. A later end of
+// speech in the same turn replaces an earlier one still waiting for audio.
+func (p *firstByteProbe) userEnded(t time.Time) {
+	select {
+	case <-p.received:
+	default:
+	}
+	select {
+	case <-p.ended:
+	default:
+	}
+	p.ended <- t
+}
+
+// audioReceived records that bot audio was received at t. Only the first
+// audio after the end of speech counts.
+func (p *firstByteProbe) audioReceived(t time.Time) {
+	if len(p.ended) == 0 {
+		return
+	}
+	select {
+	case p.received <- t:
+	default:
+	}
+}
+
+// endTurn returns the first byte latency of the turn that ended and starts
+// measuring the next one. It reports false if the user did not finish
+// speaking in the turn or got no audio back after.
+func (p *firstByteProbe) endTurn() (time.Duration, bool) {
+	var ended, received time.Time
+	select {
+	case ended = <-p.ended:
+	default:
+	}
+	select {
+	case received = <-p.received:
+	default:
+	}
+	if ended.IsZero() || received.IsZero() {
+		return 0, false
+	}
+	latency := received.Sub(ended)
+	p.once.Do(func() {
+		p.first = latency
+		close(p.measured)
+	})
+	return latency, true
+}
+
+// FirstByteLatency blocks until the first turn of the session measured its
+// first byte latency, the time from the end of the user's speech (ASREnded)
+// to the first audio received by realtimeAPIOutputAudio, and returns it. The
+// latency of every turn is logged when the turn ends.
+func FirstByteLatency(ctx context.Context) (time.Duration, error) {
+	select {
+	case <-firstByte.measured:
+		return firstByte.first, nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// latencyTick is how far the clock of useTickingClock advances per reading.
+const latencyTick = 100 * time.Millisecond
+
+// useTickingClock replaces latencyClock with a clock advancing latencyTick
+// every time it is read, so that a latency counts the readings from its start
+// to its end rather than the time that passed, whatever the load of the
+// machine.
+func useTickingClock(t *testing.T) {
+	var reads atomic.Int64
+	start := time.Now()
+	latencyClock = func() time.Time { return start.Add(time.Duration(reads.Add(1)) * latencyTick) }
+	t.Cleanup(func() { latencyClock = time.Now })
+}
+
+func TestFirstByteProbe(t *testing.T) {
+	p := newFirstByteProbe()
+	t0 := time.Now()
+	p.audioReceived(t0) // 上一轮回答的音频，用户还没说完
+	p.userEnded(t0.Add(time.Second))
+	p.userEnded(t0.Add(2 * time.Second))
+	p.audioReceived(t0.Add(2300 * time.Millisecond))
+	p.audioReceived(t0.Add(2400 * time.Millisecond))
+	if got, ok := p.endTurn(); !ok || got != 300*time.Millisecond {
+		t.Errorf("endTurn() = %v, %v, want 300ms from the last end of speech", got, ok)
+	}
+	p.audioReceived(t0.Add(3 * time.Second))
+	if got, ok := p.endTurn(); ok {
+		t.Errorf("endTurn() of a turn without speech = %v, want no latency", got)
+	}
+}
+
+// TestFirstByteLatency checks the latency of a dialog turn is taken from
+// ASREnded, not from the audio sent or received before: on a ticking clock,
+// read at ASREnded and at every audio received, it is one tick.
+func TestFirstByteLatency(t *testing.T) {
+	s := newFakeServer(t, scriptedDialog(func(c *fakeConn, sid string) {
+		c.answer(sid, "你好", 1200)
+		c.userTurn(sid, "今天天气怎么样")
+		c.answer(sid, "晴天", 2400)
+	}))
+	setupDialog(t, s)
+	useTickingClock(t)
+	if _, err := runFakeDialog(t); err == nil {
+		t.Fatal("realTimeDialog() = nil, want the server closing the session")
+	}
+	transcript := turns.Transcript()
+	if len(transcript) != 2 {
+		t.Fatalf("transcript = %+v, want the greeting and one turn", transcript)
+	}
+	if got := transcript[0].FirstByteLatency; got != 0 {
+		t.Errorf("greeting latency = %v, want none without user speech", got)
+	}
+	if got := transcript[1].FirstByteLatency; got != latencyTick {
+		t.Errorf("turn latency = %v, want the %v from ASREnded to the answer", got, latencyTick)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if got, err := FirstByteLatency(ctx); err != nil || got != transcript[1].FirstByteLatency {
+		t.Errorf("FirstByteLatency() = %v, %v, want %v", got, err, transcript[1].FirstByteLatency)
+	}
+}
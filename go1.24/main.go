@@ -1,20 +1,23 @@
 package main
 
 import (
+	"compress/gzip"
 	"context"
+	"errors"
 	"flag"
-	"math/rand"
-	"net/http"
+	"fmt"
+	"io"
+	"math"
 	"net/url"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
 	"github.com/golang/glog"
 	"github.com/google/uuid"
-	"github.com/gordonklaus/portaudio"
 	"github.com/gorilla/websocket"
 )
 
@@ -24,79 +27,244 @@ var (
 	accessToken = ""
 
 	// 无需修改的参数
-	wsURL       = url.URL{Scheme: "wss", Host: "openspeech.bytedance.com", Path: "/api/v3/realtime/dialogue"}
+	wsURL       = url.URL{Scheme: "wss", Host: "openspeech.bytedance.com", Path: dialogueProfile.Path}
 	protocol    = NewBinaryProtocol()
 	dialogID    = ""
 	wsWriteLock sync.Mutex
-	queryChan   = make(chan struct{}, 10)
+	queryChan   = NewThrottledQueryChan(10, 200*time.Millisecond)
+
+	configPath = flag.String("config", "", `read flags from this file, one "name = value" per line, the command line taking precedence; SIGHUP reloads -idle-timeout, -idle-behavior, -v and -stats-interval from it`)
+
+	dryRun   = flag.Bool("dry-run", false, "only validate credentials, network and StartSession payload, then exit without audio")
+	echoTest = flag.Bool("echo-test", false, "without contacting the server, play the -input audio back on the -output after -echo-delay to check the audio devices")
+	echoWait = flag.Duration("echo-delay", time.Second, "with -echo-test: how long after capture the audio plays back")
+	validate = flag.Bool("validate", false, "check the credentials with a StartConnection before initializing audio and exit if they are rejected")
+
+	tlsSNI      = flag.String("tls-sni", "", "TLS server name (SNI) to send instead of the URL hostname")
+	productName = flag.String("product", dialogueProfile.Name, "product profile selecting the endpoint path, resource id and app key")
+	sessionJSON = flag.String("session-payload", "", "send the JSON in this file as StartSession payload instead of the product's default")
+	wsText      = flag.Bool("ws-text", false, "send frames base64 encoded as websocket text messages, for networks filtering binary messages")
+	affinityKey = flag.String("affinity-key", "", "send this key as X-Session-Affinity so the load balancer keeps the session on one backend")
+
+	connectTimeout = flag.Duration("dial-timeout", 15*time.Second, "give up connecting, DNS lookup and handshake included, after this long; 0 disables")
+	userAgentFlag  = flag.String("user-agent", "", "User-Agent sent when connecting, default RealtimeDialog/<version>")
+
+	protocolVersion  = flag.Int("protocol-version", 1, "protocol version written in the frame headers, 1 to 4, to test other server versions")
+	serialization    = flag.String("serialization", "json", `serialization of the request payloads; only "json" is supported`)
+	compression      = flag.String("compression", "none", `compression of the request payloads: "none" or "gzip"; compressed responses are always accepted`)
+	compressionLevel = flag.Int("compression-level", gzip.DefaultCompression, "with -compression gzip: level from 1 (fastest) to 9 (smallest), -1 for the default")
+
+	warmupConn = flag.Bool("warmup", false, "connect and perform StartConnection while the audio devices open, so the session starts on a ready connection")
+
+	inputGainDB = flag.Float64("input-gain-db", 0, "gain in dB applied to the microphone input, negative values attenuate")
+	inputSpec   = flag.String("input", "mic", `audio input: "mic", "-" for PCM S16LE 16kHz on stdin, or a PCM/WAV file path`)
+	outputSpec  = flag.String("output", "speaker", `audio output: "speaker", "-" for PCM S16LE 24kHz on stdout, or a file path`)
+	trimSilence = flag.Int("trim-silence", 0, "trim the trailing silence of answers written to an -output file or -ask-output beyond 300ms; samples up to this amplitude (0-32767) count as silence, 0 disables")
+	spoolMaxMB  = flag.Int("spool-max-mb", 0, "queue the audio output on disk, up to this many MiB, while writing it fails and replay it once it works again; 0 disables")
+	spoolMaxAge = flag.Duration("spool-max-age", 2*time.Minute, "with -spool-max-mb: discard queued audio older than this")
+	audioMemMB  = flag.Int("audio-memory-mb", 0, "cap the audio held in memory at this many MiB: beyond it the recording spills to output.pcm, the -spool-max-mb queue to its file and the playback buffer drops its oldest audio; 0 disables")
+	playbackCmd = flag.String("playback-cmd", "", `play the audio by piping PCM S16LE 24kHz mono to this command instead of -output, e.g. "ffplay -nodisp -f s16le -ar 24000 -ac 1 -"`)
+	dedupWindow = flag.Int("dedup-window", 0, "drop input frames identical to one of this many previous frames, 0 disables")
+	sendRate    = flag.Float64("send-rate", 1, "rate multiplier of real time at which input audio is sent, 0 disables pacing")
+
+	inputChannels = flag.String("input-channels", "", `comma separated indices of the microphone channels to send mixed down to mono, 0 being the first, e.g. "2" or "0,1"; empty captures a mono stream`)
+
+	inputCommands = flag.Bool("commands", false, `read input commands from stdin while the dialog runs: "/play <file>" speaks a PCM/WAV file, then goes back to the current input, "/mic" switches to the microphone, "/debug on|off" toggles -debug`)
+
+	halfDuplex       = flag.Bool("half-duplex", false, "mute the microphone input while the bot is speaking")
+	postTurnMicDelay = flag.Duration("post-turn-mic-delay", 0, "with -half-duplex: keep the microphone muted this long after the bot finished speaking")
+	minUtterance     = flag.Duration("min-utterance", 0, "send silence instead of speech shorter than this, e.g. key clicks or coughs, 0 disables")
+
+	showCaptions = flag.Bool("captions", false, "print the recognized user text and the bot text as captions to stdout (stderr with -output -), in sync with playback")
+
+	recordDuplex  = flag.String("record-duplex", "", "record the dialog to this stereo WAV file, the user audio sent on the left and the bot audio on the right, time-aligned")
+	exportSession = flag.String("export-session", "", "when the dialog ends, write its transcript and the user audio of each turn to this directory, for the scriptgen subcommand")
+
+	userName      = flag.String("user-name", "", "user name available to the audit response template as {{.UserName}}")
+	language      = flag.String("language", "", "language of the user, e.g. en-US, selecting the -audit-response to use")
+	auditTemplate = flag.String("audit-template", "", "text/template for the audit response, e.g. \"抱歉{{.UserName}}，这个问题我无法回答。\"")
+
+	errorMidTurn = flag.String("error-mid-turn", "abort-turn", `what an Error frame does while the bot is answering: "abort-turn" drops the answer and waits for the user, "continue" plays the rest, "end-dialog" ends the dialog`)
+
+	failOnAudit = flag.String("fail-on-audit", "off", `when the server rejects a query in its audit: "off" plays the audit response, "turn" drops it and waits for the user, "session" ends the dialog`)
+
+	finishGrace = flag.Duration("finish-grace", 3*time.Second, "keep playing audio arriving after FinishSession for at most this long before closing, 0 closes right away")
+
+	helloInterval = flag.Duration("say-hello-interval", 5*time.Second, "send at most one SayHello request per this interval, 0 disables the limit")
+
+	idleTimeout  = flag.Duration("idle-timeout", 30*time.Second, "apply -idle-behavior after this long without user or bot speech, 0 disables")
+	idleBehavior = flag.String("idle-behavior", "say-hello", `what to do on -idle-timeout: "say-hello", "terminate" the session or "notify" only`)
+
+	responseTimeout = flag.Duration("response-timeout", 0, "apply -response-timeout-action when the bot does not start answering this long after the user stopped speaking, 0 disables")
+	responseAction  = flag.String("response-timeout-action", "notify", `what to do on -response-timeout: "notify" only or "resend" the recognized user text once as a text query`)
+
+	qualityThreshold = flag.Float64("quality-threshold", 0.5, "warn when the network quality score, from 0 (poor) to 1 (excellent), drops below this, 0 disables")
+	qualityInterval  = flag.Duration("quality-probe-interval", defaultQualityProbeInterval, "ping the connection this often to measure the network quality, 0 disables the pings and the score")
+
+	botSpeakingRate = flag.Float64("speaking-rate", 0, "bot speaking speed relative to normal, from 0.5 to 2, 0 keeps the server default")
+	maxBotSpeech    = flag.Duration("max-bot-speech", 0, "interrupt bot answers longer than this much audio, 0 disables the limit")
+	maxBotSentences = flag.Int("max-bot-sentences", 0, "interrupt bot answers with more sentences than this, 0 disables the limit")
+	wrapUpText      = flag.String("wrap-up-text", "", "line spoken after an answer is interrupted by -max-bot-speech or -max-bot-sentences")
+
+	botEmotion = flag.String("emotion-style", "", `emotional tone of the bot voice: "neutral", "happy", "sad", "excited" or "calm", empty keeps the server default`)
+
+	ask              = flag.String("ask", "", "send this text as the first user query instead of the greeting")
+	once             = flag.Bool("once", false, "with -ask: print the text answer, save the spoken answer and exit without audio devices (see the exit codes of -ask -once below)")
+	askOutput        = flag.String("ask-output", "answer.wav", "with -ask -once: WAV file the spoken answer is saved to")
+	askTimeout       = flag.Duration("ask-timeout", 10*time.Second, "with -ask -once: timeout of the connect and session stages and of the first response")
+	askAnswerTimeout = flag.Duration("ask-answer-timeout", time.Minute, "with -ask -once: timeout of the complete answer")
+
+	useAgent    = flag.Bool("agent", false, "with -ask -once: ask through the background agent keeping a warm connection, starting it if needed")
+	agentSocket = flag.String("agent-socket", "", "unix socket of the agent, default in $XDG_RUNTIME_DIR or a private directory in the temp directory")
+	agentIdle   = flag.Duration("agent-idle", 5*time.Minute, "the agent exits after this long without a question")
+
+	script = flag.String("script", "", "run the conversation script in this file without audio devices and report which turns met their expectations")
+
+	statsInterval   = flag.Duration("stats-interval", 0, "log session statistics on this interval, 0 disables")
+	statsJSON       = flag.String("stats-json", "", "also append session statistics as JSON lines to this file every -stats-interval")
+	bandwidthReport = flag.Bool("bandwidth-report", false, "print the bytes sent and received per message type on exit")
+	sessionSummary  = flag.Bool("summary", false, "print a summary of the session on exit: duration, turns, bytes, audio, dialog ID changes, errors and audit rejections")
+	metricsAddr     = flag.String("metrics-addr", "", "serve the session statistics as Prometheus metrics at /metrics on this address, e.g. :9090")
+
+	journalSize    = flag.Int("journal-size", 2048, "number of entries kept in the in-memory session journal")
+	journalFile    = flag.String("journal-file", "", "write the session journal to this file on exit and on SIGUSR1")
+	journalAnalyze = flag.String("journal-analyze", "", "analyze a journal file written by -journal-file and exit")
+
+	seed = flag.Int64("seed", 0, "seed of the client's randomness, to replay a run with the seed it logged; 0 picks a random seed")
+
+	debug = flag.Bool("debug", false, `log every frame sent and received with the start of its payload; toggled with "/debug on|off" with -commands`)
+
+	writeTapFile = flag.String("write-tap", "", "write a copy of every frame sent to the websocket to this file")
+	readTapFile  = flag.String("read-tap", "", "write a copy of every frame received from the websocket to this file")
+
+	audioSeqStart = flag.Int("audio-seq-start", 0, "number the audio frames of a session from this value, the last one negated, for servers expecting sequenced audio; 0 sends them without sequence numbers")
+
+	auditLogFile = flag.String("audit-log", "", "append an HMAC-SHA256 signed JSON line per message sent or received to this file, keyed by $"+auditLogKeyEnv)
+	auditVerify  = flag.String("audit-verify", "", "verify the signatures of an -audit-log file with the key in $"+auditLogKeyEnv+" and exit")
 )
 
+// auditResponses holds the localized audit responses set by -audit-response.
+var auditResponses = auditResponsesFlag{}
+
 func init() {
+	flag.Var(auditResponses, "audit-response", "audit response for a language as lang=text, repeatable; an empty lang is the fallback")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s:\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprint(flag.CommandLine.Output(), exitCodesHelp)
+	}
 	protocol.SetVersion(Version1)
 	protocol.SetHeaderSize(HeaderSize4)
 	protocol.SetSerialization(SerializationJSON)
 	protocol.SetCompression(CompressionNone, nil)
 	protocol.containsSequence = ContainsSequence
-	rand.New(rand.NewSource(time.Now().UnixNano()))
 }
 
-// 流式合成
-func realTimeDialog(ctx context.Context, c *websocket.Conn, sessionID string) {
-	err := startConnection(c)
-	if err != nil {
-		glog.Errorf("realTimeDialog startConnection error: %v", err)
-		return
-	}
-	err = startSession(c, sessionID, &StartSessionPayload{
+// newStartSessionPayload 返回 StartSession 请求使用的会话配置
+func newStartSessionPayload() *StartSessionPayload {
+	return &StartSessionPayload{
 		TTS: TTSPayload{
 			AudioConfig: AudioConfig{
 				Channel:    1,
 				Format:     "pcm",
 				SampleRate: 24000,
 			},
+			SpeakingRate: speakingRate,
+			EmotionStyle: emotionStyle,
 		},
 		Dialog: DialogPayload{
-			BotName:       "豆包",
-			SystemRole:    "你使用活泼灵动的女声，性格开朗，热爱生活。",
-			SpeakingStyle: "你的说话风格简洁明了，语速适中，语调自然。",
 			Extra: map[string]interface{}{
 				"strict_audit":   false,
 				"audit_response": "抱歉这个问题我无法回答，你可以换个其他话题，我会尽力为你提供帮助。",
 			},
-		},
-	})
+			AuditResponses:        auditResponses,
+			Language:              *language,
+			AuditResponseTemplate: *auditTemplate,
+		}.FromPreset(PersonaDoubao),
+	}
+}
+
+// realTimeDialog runs the dialog of sessionID on c and returns its summary,
+// e.g. for billing. The error is the *ShutdownReason the dialog ended with,
+// nil if the user quit. StartConnection is skipped if it already succeeded on
+// c, e.g. a connection warmed up with Warmup.
+func realTimeDialog(ctx context.Context, c *websocket.Conn, sessionID string) (*DialogSummary, error) {
+	reason := runDialog(ctx, c, sessionID)
+	if reason.Kind == ShutdownContextCanceled {
+		// 主流程的 context 只会被 SIGINT/SIGTERM 取消
+		reason.Kind = ShutdownUserRequested
+	}
+	summary := recordShutdown(sessionID, reason)
+	if reason.Kind == ShutdownUserRequested {
+		return &summary, nil
+	}
+	return &summary, reason
+}
+
+// 流式合成，返回对话结束的原因；预热过的连接已完成 StartConnection，不再发送
+func runDialog(ctx context.Context, c *websocket.Conn, sessionID string) *ShutdownReason {
+	glog.Infof("Binary protocol: %v", protocol)
+	// 每个会话重新检查音频格式
+	formatCheck.reset()
+	var err error
+	if !connStarted(c) {
+		err = startConnection(ctx, c)
+	}
 	if err != nil {
-		glog.Errorf("realTimeDialog startSession error: %v", err)
-		return
+		glog.Errorf("realTimeDialog startConnection error: %v", err)
+		if ctx.Err() != nil {
+			return shutdownCause(ctx)
+		}
+		// StartConnection 只校验鉴权信息，非服务端内部错误即视为鉴权失败
+		var serverErr ServerError
+		if errors.As(err, &serverErr) && !errors.Is(serverErr, ErrInternalServer) {
+			return &ShutdownReason{Kind: ShutdownAuthFailure, Code: serverErr.Code, Err: err}
+		}
+		return shutdownFor(err)
 	}
-	// 模拟发送问候语
-	err = sayHello(c, sessionID, &SayHelloPayload{
-		Content: "你好，我是豆包，有什么可以帮助你的吗？",
-	})
+	err = startSession(ctx, c, sessionID, product.NewSessionPayload())
 	if err != nil {
-		glog.Errorf("realTimeDialog sayHello error: %v", err)
-		return
+		glog.Errorf("realTimeDialog startSession error: %v", err)
+		if ctx.Err() != nil {
+			return shutdownCause(ctx)
+		}
+		return shutdownFor(err)
 	}
-	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case <-queryChan:
-				glog.Info("Received user query signal, starting real-time dialog...")
-			case <-time.After(30 * time.Second):
-				glog.Info("Timeout waiting for user query, start new SayHello request...")
-				err = sayHello(c, sessionID, &SayHelloPayload{
-					Content: "你还在吗？还想聊点什么吗？我超乐意继续陪你。",
-				})
-			}
+	if *ask != "" {
+		// 以文本提问代替问候语开始对话
+		err = chatTextQuery(c, sessionID, &ChatTextQueryPayload{Content: *ask})
+		if err != nil {
+			glog.Errorf("realTimeDialog chatTextQuery error: %v", err)
+			return shutdownFor(err)
 		}
-	}()
+	} else {
+		// 模拟发送问候语
+		err = sayHello(c, sessionID, &SayHelloPayload{
+			Content: "你好，我是豆包，有什么可以帮助你的吗？",
+		})
+		if err != nil {
+			glog.Errorf("realTimeDialog sayHello error: %v", err)
+			return shutdownFor(err)
+		}
+	}
+	// 取消原因记录了对话结束的原因（空闲超时、音频故障）
+	ctx, stop := context.WithCancelCause(ctx)
+	defer stop(nil)
+	defer shutdownManager.register(sessionID, stop)()
+	// 长时间无人说话时按 -idle-behavior 处理（默认再次发送问候语）
+	go runIdleTimer(ctx, func() { stop(&ShutdownReason{Kind: ShutdownIdleTimeout}) }, c, sessionID)
+	// 定时 ping 连接，估算网络质量
+	runQualityProbe(ctx, c)
+	runStatsReporters(ctx, sessionID)
+
 	// 模拟发送音频流到服务端
-	sendAudio(ctx, c, sessionID)
+	sendAudio(ctx, stop, c, sessionID)
 
 	// 接收服务端返回数据
-	realtimeAPIOutputAudio(ctx, c)
+	reason := realtimeAPIOutputAudio(ctx, c)
+	if reason == nil {
+		reason = shutdownCause(ctx)
+	}
 
 	// 结束对话，断开websocket连接
 	err = finishConnection(c)
@@ -104,44 +272,524 @@ func realTimeDialog(ctx context.Context, c *websocket.Conn, sessionID string) {
 		glog.Errorf("Failed to finish connection: %v", err)
 	}
 	glog.Info("realTimeDialog finished.")
+	return reason
+}
+
+// dumpJournalOnSignal 收到 SIGUSR1 时导出会话日志，用于排查事件时序问题
+func dumpJournalOnSignal(ctx context.Context) {
+	if journalDumpSignal == nil {
+		return
+	}
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, journalDumpSignal)
+	defer signal.Stop(sigChan)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sigChan:
+			if err := dumpJournal(*journalFile); err != nil {
+				glog.Errorf("Failed to dump journal: %v", err)
+			}
+		}
+	}
+}
+
+// reportOutput 返回退出时打印报告的位置：-output - 时 stdout 用于输出音频，报告改写到 stderr
+func reportOutput() io.Writer {
+	if *outputSpec == "-" {
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
+// reloadConfigOnSignal 收到 SIGHUP 时重新读取配置文件，应用可热更新的设置
+func reloadConfigOnSignal(ctx context.Context, config *configFile) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGHUP)
+	defer signal.Stop(sigChan)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sigChan:
+			glog.Infof("SIGHUP received, reloading %s.", config.path)
+			if err := config.reload(); err != nil {
+				glog.Errorf("Failed to reload config: %v", err)
+			}
+		}
+	}
 }
 
 func main() {
 	_ = flag.Set("logtostderr", "true")
 	flag.Parse()
+	// 配置文件中的设置不覆盖命令行参数
+	var config *configFile
+	if *configPath != "" {
+		cmdline := map[string]bool{}
+		flag.Visit(func(f *flag.Flag) { cmdline[f.Name] = true })
+		var err error
+		if config, err = loadConfig(*configPath, cmdline); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -config: %v\n", err)
+			flag.Usage()
+			os.Exit(2)
+		}
+	}
+
+	// 对话结束的原因决定退出码，在其余 defer 清理完成之后才退出
+	var shutdown *ShutdownReason
+	defer func() {
+		if shutdown == nil {
+			return
+		}
+		glog.Flush()
+		if code := shutdown.ExitCode(); code != 0 {
+			os.Exit(code)
+		}
+	}()
+
+	if *tlsSNI != "" {
+		if err := validateHostname(*tlsSNI); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -tls-sni: %v\n", err)
+			flag.Usage()
+			os.Exit(2)
+		}
+	}
+	WithAffinityKey(*affinityKey)
+	if *trimSilence < 0 || *trimSilence > math.MaxInt16 {
+		fmt.Fprintf(os.Stderr, "invalid -trim-silence: %d is outside [0, %d]\n", *trimSilence, math.MaxInt16)
+		flag.Usage()
+		os.Exit(2)
+	}
+	WithRecordTrimTrailingSilence(int16(*trimSilence))
+	if *finishGrace < 0 {
+		fmt.Fprintf(os.Stderr, "invalid -finish-grace: %v is negative, use 0 for no grace\n", *finishGrace)
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *journalSize < 0 {
+		fmt.Fprintf(os.Stderr, "invalid -journal-size: %d is negative\n", *journalSize)
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *audioSeqStart < 0 || *audioSeqStart > math.MaxInt32 {
+		fmt.Fprintf(os.Stderr, "invalid -audio-seq-start: %d is outside [0, %d]\n", *audioSeqStart, math.MaxInt32)
+		flag.Usage()
+		os.Exit(2)
+	}
+	_ = WithAudioSequence(int32(*audioSeqStart))
+	WithSayHelloRateLimit(*helloInterval)
+	WithAudioMemoryLimit(int64(*audioMemMB) << 20)
+	// 记录实际使用的种子，复现问题时通过 -seed 传回
+	if *seed == 0 {
+		*seed = randomSeed()
+	}
+	WithSeed(*seed)
+	glog.Infof("Random seed: %d", *seed)
+	WithDebugMode(*debug)
+	WithDialTimeout(*connectTimeout)
+	WithUserAgent(*userAgentFlag)
+	if err := WithSpeakingRate(*botSpeakingRate); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -speaking-rate: %v\n", err)
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err := WithQualityThreshold(*qualityThreshold); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -quality-threshold: %v\n", err)
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err := WithQualityProbeInterval(*qualityInterval); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -quality-probe-interval: %v\n", err)
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err := WithEmotionStyle(*botEmotion); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -emotion-style: %v\n", err)
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *wsText {
+		_ = WithWebSocketMessageType(websocket.TextMessage)
+	}
+	if err := WithProtocolVersion(*protocolVersion); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -protocol-version: %v\n", err)
+		flag.Usage()
+		os.Exit(2)
+	}
+	if s, err := parseSerialization(*serialization); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -serialization: %v\n", err)
+		flag.Usage()
+		os.Exit(2)
+	} else {
+		protocol.SetSerialization(s)
+	}
+	if c, err := parseCompression(*compression); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -compression: %v\n", err)
+		flag.Usage()
+		os.Exit(2)
+	} else if err := WithCompression(c, *compressionLevel); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -compression-level: %v\n", err)
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err := WithProductProfile(*productName); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -product: %v\n", err)
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *sessionJSON != "" {
+		data, err := os.ReadFile(*sessionJSON)
+		if err != nil {
+			glog.Exitf("Read StartSession payload: %v", err)
+		}
+		product.NewSessionPayload = func() SessionPayload { return RawSessionPayload(data) }
+	}
+	if indices, err := parseChannelMap(*inputChannels); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -input-channels: %v\n", err)
+		flag.Usage()
+		os.Exit(2)
+	} else if err := WithInputChannelMap(indices); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -input-channels: %v\n", err)
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *inputCommands && *inputSpec == "-" {
+		fmt.Fprintln(os.Stderr, "invalid -commands: stdin is the audio input")
+		flag.Usage()
+		os.Exit(2)
+	}
+	if policy, err := parseErrorMidTurnPolicy(*errorMidTurn); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -error-mid-turn: %v\n", err)
+		flag.Usage()
+		os.Exit(2)
+	} else {
+		WithErrorMidTurnPolicy(policy)
+	}
+	if mode, err := parseAuditFailMode(*failOnAudit); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -fail-on-audit: %v\n", err)
+		flag.Usage()
+		os.Exit(2)
+	} else {
+		WithFailOnAudit(mode)
+	}
+	if behavior, err := parseTimeoutBehavior(*idleBehavior); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -idle-behavior: %v\n", err)
+		flag.Usage()
+		os.Exit(2)
+	} else {
+		WithBotResponseTimeout(*idleTimeout, behavior)
+	}
+	if action, err := parseResponseTimeoutAction(*responseAction); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -response-timeout-action: %v\n", err)
+		flag.Usage()
+		os.Exit(2)
+	} else {
+		WithFirstResponseTimeout(*responseTimeout, action)
+	}
+
+	if *journalAnalyze != "" {
+		if err := analyzeJournalFile(*journalAnalyze); err != nil {
+			glog.Exitf("Analyze journal: %v", err)
+		}
+		return
+	}
 
-	if err := portaudio.Initialize(); err != nil {
-		glog.Fatalf("portaudio initialize error: %v", err)
+	if *auditVerify != "" {
+		if err := verifyAuditLogFile(*auditVerify, &AuditLogger{SecretKey: auditLogKey()}); err != nil {
+			glog.Exitf("Verify audit log: %v", err)
+		}
 		return
 	}
+
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	journal = NewJournal(*journalSize)
+	go dumpJournalOnSignal(ctx)
 	defer func() {
-		err := portaudio.Terminate()
+		if *journalFile == "" {
+			return
+		}
+		if err := dumpJournal(*journalFile); err != nil {
+			glog.Errorf("Failed to write journal: %v", err)
+		}
+	}()
+
+	if *writeTapFile != "" {
+		f := createTapFile(*writeTapFile)
+		defer f.Close()
+		WithWriteTap(f)
+	}
+	if *readTapFile != "" {
+		f := createTapFile(*readTapFile)
+		defer f.Close()
+		WithReadTap(f)
+	}
+	if *auditLogFile != "" {
+		key := auditLogKey()
+		f, err := os.OpenFile(*auditLogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
 		if err != nil {
-			glog.Errorf("Failed to terminate portaudio: %v", err)
+			glog.Exitf("Open audit log: %v", err)
+		}
+		defer f.Close()
+		l := &AuditLogger{SecretKey: key, Output: f}
+		if err := resumeAuditLog(*auditLogFile, l); err != nil {
+			glog.Exitf("Audit log %s fails verification, not appending to it: %v", *auditLogFile, err)
+		}
+		WithAuditLogger(l)
+	}
+	WithSendRate(*sendRate)
+
+	if *dryRun {
+		if err := runDryRun(ctx); err != nil {
+			glog.Exitf("Dry-run failed: %v", err)
+		}
+		glog.Info("Dry-run succeeded.")
+		return
+	}
+
+	if *validate {
+		if err := ValidateCredentials(ctx, currentCredentials()); err != nil {
+			glog.Exitf("Credential validation failed: %v", err)
+		}
+		glog.Info("Credentials are valid.")
+	}
+
+	if flag.Arg(0) == "scriptgen" {
+		if err := runScriptgenCommand(flag.Args()[1:]); err != nil {
+			glog.Exitf("Scriptgen: %v", err)
+		}
+		return
+	}
+
+	if flag.Arg(0) == "agent" {
+		if err := runAgentCommand(ctx, flag.Args()[1:]); err != nil {
+			glog.Exitf("Agent: %v", err)
+		}
+		return
+	}
+
+	if *script != "" {
+		report, err := runScript(ctx, *script)
+		if err != nil {
+			glog.Exitf("Script failed: %v", err)
+		}
+		report.Print(os.Stdout)
+		if !report.Passed() {
+			glog.Flush()
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *ask != "" && *once {
+		var reply *AskReply
+		var err error
+		if *useAgent {
+			// 代理未运行时本次直连，同时启动代理供后续调用复用连接
+			reply, err = askAgent(ctx, *ask)
+			if errors.Is(err, errAgentUnavailable) {
+				if err := startAgent(); err != nil {
+					glog.Errorf("Failed to start agent: %v", err)
+				}
+				reply, err = runAsk(ctx, *ask)
+			}
+		} else {
+			reply, err = runAsk(ctx, *ask)
+		}
+		if err != nil {
+			glog.Errorf("Ask failed: %v", err)
+			glog.Flush()
+			var askErr *AskError
+			if errors.As(err, &askErr) {
+				os.Exit(askErr.ExitCode)
+			}
+			os.Exit(exitAskFailed)
+		}
+		if recordTrimThreshold > 0 {
+			reply.Audio = trimTrailingSilence(reply.Audio, recordTrimThreshold)
+		}
+		if err := writeWAV(*askOutput, reply.Audio, sampleRate, channels); err != nil {
+			glog.Exitf("Save answer audio: %v", err)
+		}
+		fmt.Println(reply.Text)
+		return
+	}
+
+	if *statsInterval > 0 {
+		WithStatsReporter(LogStatsReporter{}, *statsInterval)
+		if *statsJSON != "" {
+			f, err := os.OpenFile(*statsJSON, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+			if err != nil {
+				glog.Exitf("Open stats file: %v", err)
+			}
+			defer f.Close()
+			WithStatsReporter(JSONStatsReporter(f), *statsInterval)
+		}
+	}
+	if config != nil {
+		go reloadConfigOnSignal(ctx, config)
+	}
+	if *bandwidthReport {
+		defer func() {
+			if err := writeBandwidthReport(reportOutput(), bandwidth.Snapshot()); err != nil {
+				glog.Errorf("Failed to write bandwidth report: %v", err)
+			}
+		}()
+	}
+
+	WithPostTurnMicDelay(*postTurnMicDelay)
+	WithFinishGrace(*finishGrace)
+	WithMinUtteranceDuration(*minUtterance)
+	if *showCaptions {
+		// 与报告一样，-output - 时字幕改写到 stderr，避免混入音频数据
+		WithCaptions(reportOutput())
+	}
+	if *recordDuplex != "" {
+		WithDuplexRecording(*recordDuplex)
+		defer duplex.save()
+	}
+	if *exportSession != "" {
+		WithSessionExport(*exportSession)
+		defer sessionExport.save()
+	}
+	if *playbackCmd != "" {
+		WithPlaybackCommand(strings.Fields(*playbackCmd))
+	}
+
+	if *inputGainDB != 0 {
+		WithInputProcessor(GainStage{GainDB: *inputGainDB})
+	}
+	if *dedupWindow > 0 {
+		dedup := &DeduplicationFilter{WindowSize: *dedupWindow}
+		WithInputProcessor(dedup)
+		defer func() {
+			glog.Infof("Duplicate input frames dropped: %d", dedup.DuplicatesDropped())
+		}()
+	}
+
+	// 与打开音频设备并行建立连接，节省首轮延迟
+	var warmed chan error
+	if *warmupConn && !*echoTest {
+		warmed = make(chan error, 1)
+		go func() { warmed <- Warmup(ctx) }()
+		defer closeWarmConn()
+	}
+
+	// -commands 的 /mic 需要音频设备，但没有设备后端时仍可切换文件输入
+	if *inputSpec == "mic" || *outputSpec == "speaker" && len(playbackCommand) == 0 || *inputCommands && audioBackend != nil {
+		if audioBackend == nil {
+			glog.Errorf("Audio device error: %v", errNoAudioBackend)
+			shutdown = &ShutdownReason{Kind: ShutdownAudioFatal, Err: errNoAudioBackend}
+			return
+		}
+		if err := audioBackend.Open(); err != nil {
+			glog.Errorf("Audio backend initialize error: %v", err)
+			shutdown = &ShutdownReason{Kind: ShutdownAudioFatal, Err: err}
+			return
+		}
+		defer func() {
+			err := audioBackend.Close()
+			if err != nil {
+				glog.Errorf("Failed to terminate audio backend: %v", err)
+			}
+		}()
+	}
+
+	source, err := newAudioSource(*inputSpec)
+	if err != nil {
+		glog.Errorf("Audio input error: %v", err)
+		shutdown = &ShutdownReason{Kind: ShutdownAudioFatal, Err: err}
+		return
+	}
+	if *inputCommands {
+		// 命令可以在帧边界切换输入，会话不中断
+		source = newSwitchSource(source, *inputSpec)
+	}
+	sink, err := newAudioSink(*outputSpec)
+	if err != nil {
+		glog.Errorf("Audio output error: %v", err)
+		_ = source.Close()
+		shutdown = &ShutdownReason{Kind: ShutdownAudioFatal, Err: err}
+		return
+	}
+	if len(playbackCommand) == 0 && *outputSpec == "speaker" {
+		// 对话中可以用 /output 把播放切到另一个输出设备
+		speakerOutput = newSwitchSink(sink)
+		sink = speakerOutput
+	}
+	if *spoolMaxMB > 0 {
+		sink = NewSpoolSink(sink, SpoolConfig{MaxBytes: int64(*spoolMaxMB) << 20, MaxAge: *spoolMaxAge})
+	}
+	WithAudioSource(source)
+	WithAudioSink(sink)
+	if *inputCommands {
+		go runCommands(ctx, os.Stdin)
+	}
+	defer func() {
+		if err := sink.Close(); err != nil {
+			glog.Errorf("Failed to close audio output: %v", err)
+		}
+	}()
+
+	if *echoTest {
+		defer source.Close()
+		if err := runEchoTest(ctx, source, sink, *echoWait); err != nil {
+			glog.Errorf("Echo test: %v", err)
+			shutdown = &ShutdownReason{Kind: ShutdownAudioFatal, Err: err}
+		}
+		return
+	}
+
+	// 先于音频输出与设备后端的清理执行：等待所有对话停止使用音频设备
+	defer func() {
+		if err := shutdownManager.GracefulShutdown(gracefulShutdownTimeout); err != nil {
+			glog.Errorf("Graceful shutdown: %v", err)
 		}
-		stop()
 	}()
 
-	conn, resp, err := websocket.DefaultDialer.DialContext(ctx, wsURL.String(), http.Header{
-		"X-Api-Resource-Id": []string{"volc.speech.dialog"},
-		"X-Api-Access-Key":  []string{accessToken},
-		"X-Api-App-Key":     []string{"PlgvMymc7f3tQnJ6"},
-		"X-Api-App-ID":      []string{appid},
-		"X-Api-Connect-Id":  []string{uuid.New().String()},
-	})
+	if warmed != nil {
+		if err := <-warmed; err != nil {
+			glog.Warningf("Connection warmup failed, dialing again: %v", err)
+		}
+	}
+	conn, resp, ok := takeWarmConn()
+	if !ok {
+		conn, resp, err = dial(ctx)
+	}
 	if err != nil {
 		glog.Errorf("Websocket dial error: %v", err)
+		if errors.Is(err, websocket.ErrBadHandshake) && resp != nil {
+			err = handshakeCredentialError(resp, resp.Header.Get("X-Tt-Logid"))
+		}
+		shutdown = shutdownFor(err)
 		return
 	}
+	if resp != nil {
+		connLogID = resp.Header.Get("X-Tt-Logid")
+	}
 	defer func() {
 		if resp != nil {
-			glog.Infof("Websocket dial response logid: %s", resp.Header.Get("X-Tt-Logid"))
+			glog.Infof("Websocket dial response logid: %s", connLogID)
 		}
-		close(queryChan)
-		glog.Infof("Websocket response dialogID: %s", dialogID)
-		_ = conn.Close()
+		glog.Infof("Websocket response dialogID: %s, affinity key: %q", dialogID, AffinityKey())
+		_ = closeConn(conn)
 	}()
 
-	realTimeDialog(ctx, conn, uuid.New().String())
+	sessionID := uuid.New().String()
+	if *metricsAddr != "" {
+		go serveMetrics(ctx, *metricsAddr, sessionID)
+	}
+	summary, err := realTimeDialog(ctx, conn, sessionID)
+	shutdown = &ShutdownReason{Kind: ShutdownUserRequested}
+	if err != nil {
+		shutdown = shutdownFor(err)
+	}
+	if *sessionSummary {
+		if err := writeSessionSummary(reportOutput(), *summary); err != nil {
+			glog.Errorf("Failed to write session summary: %v", err)
+		}
+	}
 }
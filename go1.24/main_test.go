@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestRealTimeDialog drives a dialog from the dial through the greeting, one
+// user turn and an idle prompt to the shutdown.
+func TestRealTimeDialog(t *testing.T) {
+	idled := make(chan struct{})
+	events := make(chan []int32, 1)
+	s := newFakeServer(t, func(c *fakeConn) {
+		defer func() { events <- c.events }()
+		sid := c.handshake("dialog-1")
+		if c.expect(300) == nil { // greeting
+			return
+		}
+		c.answer(sid, "你好", 2400)
+		c.userTurn(sid, "今天天气怎么样")
+		c.answer(sid, "晴天", 4800)
+		if c.expect(300) == nil { // idle prompt
+			return
+		}
+		close(idled)
+		c.finish(sid)
+	})
+	_, speaker := setupDialog(t, s)
+	WithBotResponseTimeout(200*time.Millisecond, TimeoutBehaviorSayHello)
+	var idleTimeouts atomic.Int32
+	eventHandlers.OnIdleTimeout = func() { idleTimeouts.Add(1) }
+	t.Cleanup(func() { eventHandlers = EventHandlers{} })
+
+	conn := dialFake(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-idled
+		cancel()
+	}()
+	summary, err := realTimeDialog(ctx, conn, "session-1")
+	if err != nil {
+		t.Fatalf("realTimeDialog() = %v, want nil for a user quit", err)
+	}
+	if err := shutdownManager.GracefulShutdown(time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []int32{1, 100, 300, 300, 102, 2}
+	if got := <-events; !slices.Equal(got, want) {
+		t.Errorf("client sent events %v, want %v", got, want)
+	}
+	transcript := turns.Transcript()
+	if len(transcript) != 2 {
+		t.Fatalf("transcript has %d turns, want 2: %+v", len(transcript), transcript)
+	}
+	if got := transcript[0]; got.UserText != "" || got.BotText != "你好" {
+		t.Errorf("greeting turn = %+v, want the bot saying 你好", got)
+	}
+	if got := transcript[1]; got.UserText != "今天天气怎么样" || got.BotText != "晴天" {
+		t.Errorf("user turn = %+v, want 今天天气怎么样 answered with 晴天", got)
+	}
+	if got := idleTimeouts.Load(); got != 1 {
+		t.Errorf("OnIdleTimeout called %d times, want 1", got)
+	}
+	if got := speaker.played(); got != 2400+4800 {
+		t.Errorf("played %d samples, want %d", got, 2400+4800)
+	}
+	if summary.DialogID != "dialog-1" || summary.TotalTurns != 2 || !strings.HasPrefix(summary.DisconnectReason, ShutdownUserRequested.String()) {
+		t.Errorf("summary = %+v, want dialog-1 with 2 turns ended by the user", summary)
+	}
+}
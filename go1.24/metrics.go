@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Direction tells whether a websocket message was sent or received.
+type Direction string
+
+// Values that a Direction variable can take.
+const (
+	DirectionInbound  Direction = "inbound"
+	DirectionOutbound Direction = "outbound"
+)
+
+// Metrics receives instrumentation of the websocket traffic.
+type Metrics interface {
+	ObserveMessageSize(direction Direction, bytes int)
+}
+
+// metrics is called on every websocket message written or read. It defaults to
+// the built-in histogram included in the session statistics.
+var metrics Metrics = messageSizes
+
+// WithMetrics sends the websocket instrumentation to m instead of the
+// built-in histogram, e.g. to export it to Prometheus.
+func WithMetrics(m Metrics) {
+	metrics = m
+}
+
+var (
+	// messageSizeBuckets are the upper bounds, in bytes, of the message size
+	// histogram.
+	messageSizeBuckets = []int{64, 128, 256, 512, 1024, 2048, 4096, 8192, 16384, 32768, 65536}
+	// frameSizeBuckets are the upper bounds, in bytes, of the audio frame size
+	// histogram.
+	frameSizeBuckets = []int{64, 128, 256, 512, 1024, 2048, 4096, 8192, 16384}
+)
+
+// HistogramSnapshot is the state of a size histogram. Counts[i] counts the
+// observations no larger than Buckets[i]; the last count holds larger ones.
+type HistogramSnapshot struct {
+	Buckets []int    `json:"buckets"`
+	Counts  []uint64 `json:"counts"`
+	Count   uint64   `json:"count"`
+	Sum     uint64   `json:"sum"`
+}
+
+func (s HistogramSnapshot) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "count=%d sum=%d", s.Count, s.Sum)
+	for i, n := range s.Counts {
+		if n == 0 {
+			continue
+		}
+		if i < len(s.Buckets) {
+			fmt.Fprintf(&sb, " <=%d:%d", s.Buckets[i], n)
+		} else {
+			fmt.Fprintf(&sb, " >%d:%d", s.Buckets[len(s.Buckets)-1], n)
+		}
+	}
+	return sb.String()
+}
+
+type sizeHistogram struct {
+	buckets []int
+	counts  []atomic.Uint64 // len(buckets)+1
+	count   atomic.Uint64
+	sum     atomic.Uint64
+}
+
+func newSizeHistogram(buckets []int) *sizeHistogram {
+	return &sizeHistogram{buckets: buckets, counts: make([]atomic.Uint64, len(buckets)+1)}
+}
+
+func (h *sizeHistogram) observe(bytes int) {
+	i := 0
+	for i < len(h.buckets) && bytes > h.buckets[i] {
+		i++
+	}
+	h.counts[i].Add(1)
+	h.count.Add(1)
+	h.sum.Add(uint64(bytes))
+}
+
+func (h *sizeHistogram) snapshot() HistogramSnapshot {
+	s := HistogramSnapshot{
+		Buckets: h.buckets,
+		Counts:  make([]uint64, len(h.counts)),
+		Count:   h.count.Load(),
+		Sum:     h.sum.Load(),
+	}
+	for i := range h.counts {
+		s.Counts[i] = h.counts[i].Load()
+	}
+	return s
+}
+
+// MessageSizeHistogram is a Metrics implementation keeping a histogram of the
+// message sizes per direction. It is safe for concurrent use.
+type MessageSizeHistogram struct {
+	inbound, outbound *sizeHistogram
+}
+
+// NewMessageSizeHistogram returns an empty MessageSizeHistogram.
+func NewMessageSizeHistogram() *MessageSizeHistogram {
+	return &MessageSizeHistogram{
+		inbound:  newSizeHistogram(messageSizeBuckets),
+		outbound: newSizeHistogram(messageSizeBuckets),
+	}
+}
+
+var messageSizes = NewMessageSizeHistogram()
+
+// audioFrameSizes is the histogram of the audio frames sent, which shows
+// whether the input chunking fits the network MTU and reveals the occasional
+// oversized frame left by a buffering bug.
+var audioFrameSizes = newSizeHistogram(frameSizeBuckets)
+
+// ObserveMessageSize implements Metrics.
+func (h *MessageSizeHistogram) ObserveMessageSize(direction Direction, bytes int) {
+	if direction == DirectionInbound {
+		h.inbound.observe(bytes)
+	} else {
+		h.outbound.observe(bytes)
+	}
+}
+
+// Snapshot returns the histogram of the given direction.
+func (h *MessageSizeHistogram) Snapshot(direction Direction) HistogramSnapshot {
+	if direction == DirectionInbound {
+		return h.inbound.snapshot()
+	}
+	return h.outbound.snapshot()
+}
+
+// ShutdownCounts is a ShutdownMetrics counting the dialogs that ended per
+// ShutdownKind. It is safe for concurrent use.
+type ShutdownCounts struct {
+	lock   sync.Mutex
+	counts map[ShutdownKind]uint64
+}
+
+// NewShutdownCounts returns an empty ShutdownCounts.
+func NewShutdownCounts() *ShutdownCounts {
+	return &ShutdownCounts{counts: map[ShutdownKind]uint64{}}
+}
+
+// shutdownCounts counts every dialog ended, whatever WithMetrics is set to,
+// for the session statistics.
+var shutdownCounts = NewShutdownCounts()
+
+// ObserveShutdown implements ShutdownMetrics.
+func (c *ShutdownCounts) ObserveShutdown(kind ShutdownKind) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.counts[kind]++
+}
+
+// Snapshot returns the number of dialogs ended per kind, by kind name.
+func (c *ShutdownCounts) Snapshot() map[string]uint64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	snapshot := make(map[string]uint64, len(c.counts))
+	for kind, n := range c.counts {
+		snapshot[kind.String()] = n
+	}
+	return snapshot
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// serveMetrics serves the statistics of the session at /metrics on addr in the
+// Prometheus text format until ctx is done.
+func serveMetrics(ctx context.Context, addr, sessionID string) {
+	srv := &http.Server{Addr: addr, Handler: metricsHandler(sessionID), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_ = srv.Shutdown(shutdownCtx)
+	}()
+	glog.Infof("Serving metrics on http://%s/metrics", addr)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		glog.Errorf("Metrics server failed: %v", err)
+	}
+}
+
+// metricsHandler serves the statistics of the session at /metrics.
+func metricsHandler(sessionID string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writePrometheusMetrics(w, collectStats(sessionID))
+	})
+	return mux
+}
+
+// writePrometheusMetrics writes stats in the Prometheus text exposition format.
+func writePrometheusMetrics(w io.Writer, stats SessionStats) {
+	metric := func(name, kind, help string, value any) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, kind, name, value)
+	}
+	metric("realtimedialog_uptime_seconds", "gauge", "Time since the client started.", stats.Uptime.Seconds())
+	metric("realtimedialog_frames_sent_total", "counter", "Websocket frames sent.", stats.FramesSent)
+	metric("realtimedialog_bytes_sent_total", "counter", "Websocket bytes sent.", stats.BytesSent)
+	metric("realtimedialog_frames_received_total", "counter", "Websocket frames received.", stats.FramesReceived)
+	metric("realtimedialog_bytes_received_total", "counter", "Websocket bytes received.", stats.BytesReceived)
+	metric("realtimedialog_server_errors_total", "counter", "Error frames received from the server.", stats.ServerErrors)
+	metric("realtimedialog_turns_total", "counter", "Finished turns.", stats.Turns)
+	metric("realtimedialog_truncated_turns_total", "counter", "Turns whose bot answer was cut short.", stats.TruncatedTurns)
+	metric("realtimedialog_abandoned_turns_total", "counter", "Abandoned turns.", stats.AbandonedTurns)
+	metric("realtimedialog_bot_audio_seconds_total", "counter", "Bot audio received in finished turns.", stats.BotAudio.Seconds())
+	metric("realtimedialog_audio_memory_bytes", "gauge", "Audio held in memory.", stats.AudioMemory)
+	metric("realtimedialog_network_quality_score", "gauge", "Network quality from 0 (poor) to 1 (excellent).", stats.NetworkQuality.Score)
+	metric("realtimedialog_rtt_milliseconds", "gauge", "Smoothed round trip time of the websocket pings.", stats.NetworkQuality.RTTMs)
+
+	const shutdowns = "realtimedialog_shutdowns_total"
+	fmt.Fprintf(w, "# HELP %s Dialogs ended, by reason.\n# TYPE %s counter\n", shutdowns, shutdowns)
+	for _, reason := range slices.Sorted(maps.Keys(stats.Shutdowns)) {
+		fmt.Fprintf(w, "%s{reason=%q} %d\n", shutdowns, reason, stats.Shutdowns[reason])
+	}
+
+	const sizes = "realtimedialog_message_size_bytes"
+	fmt.Fprintf(w, "# HELP %s Size of the websocket messages.\n# TYPE %s histogram\n", sizes, sizes)
+	writePrometheusHistogram(w, sizes, fmt.Sprintf("direction=%q,", DirectionInbound), stats.InboundSizes)
+	writePrometheusHistogram(w, sizes, fmt.Sprintf("direction=%q,", DirectionOutbound), stats.OutboundSizes)
+
+	const frames = "realtimedialog_audio_frame_size_bytes"
+	fmt.Fprintf(w, "# HELP %s Size of the audio frames sent.\n# TYPE %s histogram\n", frames, frames)
+	writePrometheusHistogram(w, frames, "", stats.FrameSizes)
+}
+
+// writePrometheusHistogram writes the series of the histogram name; labels is
+// empty or a list of labels ending with a comma.
+func writePrometheusHistogram(w io.Writer, name, labels string, h HistogramSnapshot) {
+	var cumulative uint64
+	for i, bound := range h.Buckets {
+		cumulative += h.Counts[i]
+		fmt.Fprintf(w, "%s_bucket{%sle=\"%d\"} %d\n", name, labels, bound, cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", name, labels, h.Count)
+	if labels != "" {
+		labels = "{" + strings.TrimSuffix(labels, ",") + "}"
+	}
+	fmt.Fprintf(w, "%s_sum%s %d\n", name, labels, h.Sum)
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labels, h.Count)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestMetricsEndpoint scrapes /metrics after a dialog and checks that the
+// registered metrics are served in the Prometheus text format.
+func TestMetricsEndpoint(t *testing.T) {
+	s := newFakeServer(t, scriptedDialog(func(c *fakeConn, sid string) {
+		c.answer(sid, "你好", 2400)
+	}))
+	setupDialog(t, s)
+	if _, err := runFakeDialog(t); err == nil {
+		t.Fatal("realTimeDialog() = nil, want the server ending the session")
+	}
+
+	srv := httptest.NewServer(metricsHandler("session-1"))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /metrics = %s", resp.Status)
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q, want the Prometheus text format", ct)
+	}
+	for _, want := range []string{
+		"# TYPE realtimedialog_frames_sent_total counter\n",
+		"# TYPE realtimedialog_message_size_bytes histogram\n",
+		"\nrealtimedialog_turns_total 1\n",
+		"\nrealtimedialog_shutdowns_total{reason=\"ServerClosed\"} 1\n",
+		"\nrealtimedialog_message_size_bytes_bucket{direction=\"inbound\",le=\"+Inf\"} ",
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("/metrics lacks %q:\n%s", want, body)
+		}
+	}
+	if strings.Contains(string(body), "\nrealtimedialog_frames_sent_total 0\n") {
+		t.Error("/metrics reports no frames sent")
+	}
+}
+
+// TestServeMetricsShutdown checks that the metrics server stops with its
+// context.
+func TestServeMetricsShutdown(t *testing.T) {
+	setupDialog(t, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		serveMetrics(ctx, "127.0.0.1:0", "session-1")
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("serveMetrics() still running after the context was canceled")
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"slices"
+	"sync"
+	"testing"
+)
+
+// recordingMetrics is a Metrics keeping every observation.
+type recordingMetrics struct {
+	lock  sync.Mutex
+	sizes map[Direction][]int
+}
+
+func (m *recordingMetrics) ObserveMessageSize(direction Direction, bytes int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.sizes[direction] = append(m.sizes[direction], bytes)
+}
+
+// TestObserveMessageSize checks that the sizes of the StartConnection
+// request and of its response are observed.
+func TestObserveMessageSize(t *testing.T) {
+	response := serverFrame(50, "conn-1", `{}`)
+	requestSize := make(chan int, 1)
+	s := newFakeServer(t, func(c *fakeConn) {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			t.Errorf("fake server: %v", err)
+			return
+		}
+		requestSize <- len(data)
+		c.send(response)
+	})
+	setupDialog(t, s)
+	m := &recordingMetrics{sizes: map[Direction][]int{}}
+	WithMetrics(m)
+	t.Cleanup(func() { WithMetrics(messageSizes) })
+
+	if err := startConnection(t.Context(), dialFake(t)); err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{<-requestSize}; !slices.Equal(m.sizes[DirectionOutbound], want) {
+		t.Errorf("outbound sizes %v, want %v", m.sizes[DirectionOutbound], want)
+	}
+	if want := []int{len(response)}; !slices.Equal(m.sizes[DirectionInbound], want) {
+		t.Errorf("inbound sizes %v, want %v", m.sizes[DirectionInbound], want)
+	}
+}
+
+func TestMessageSizeHistogram(t *testing.T) {
+	h := NewMessageSizeHistogram()
+	for _, n := range []int{10, 64, 65, 70000} {
+		h.ObserveMessageSize(DirectionOutbound, n)
+	}
+	s := h.Snapshot(DirectionOutbound)
+	if s.Count != 4 || s.Sum != 10+64+65+70000 {
+		t.Errorf("count=%d sum=%d, want 4 and %d", s.Count, s.Sum, 10+64+65+70000)
+	}
+	if s.Counts[0] != 2 || s.Counts[1] != 1 || s.Counts[len(s.Counts)-1] != 1 {
+		t.Errorf("counts %v, want 2 up to 64, 1 up to 128 and 1 above the last bucket", s.Counts)
+	}
+	if in := h.Snapshot(DirectionInbound); in.Count != 0 {
+		t.Errorf("inbound count %d, want 0", in.Count)
+	}
+}
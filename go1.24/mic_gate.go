@@ -0,0 +1,60 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// micGate mutes the microphone input in half-duplex mode while the bot is
+// speaking, so that the bot does not hear its own answer.
+type micGate struct {
+	lock     sync.Mutex
+	muted    bool
+	reopenAt time.Time
+	// delay is how long the input stays muted after the bot finished a turn,
+	// to skip trailing audio and echo still in the room.
+	delay time.Duration
+}
+
+var mic = &micGate{}
+
+// WithPostTurnMicDelay keeps the microphone muted for d after the bot finished
+// speaking in half-duplex mode.
+func WithPostTurnMicDelay(d time.Duration) {
+	mic.lock.Lock()
+	defer mic.lock.Unlock()
+	mic.delay = d
+}
+
+// mute mutes the input until the turn completes.
+func (g *micGate) mute() {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.muted = true
+}
+
+// turnComplete unmutes the input once the post-turn delay has passed.
+func (g *micGate) turnComplete(now time.Time) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.muted = false
+	g.reopenAt = now.Add(g.delay)
+}
+
+// isMuted reports whether input captured at now must not reach the server.
+func (g *micGate) isMuted(now time.Time) bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.muted || now.Before(g.reopenAt)
+}
+
+// gateInput replaces the samples with silence while the microphone is muted.
+// Silence rather than nothing is sent to keep the server's input stream
+// continuous.
+func gateInput(samples []int16) []int16 {
+	if !*halfDuplex || !mic.isMuted(time.Now()) {
+		return samples
+	}
+	clear(samples)
+	return samples
+}
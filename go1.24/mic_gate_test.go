@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPostTurnMicDelay(t *testing.T) {
+	g := &micGate{delay: 300 * time.Millisecond}
+	start := time.Unix(1000, 0)
+	if g.isMuted(start) {
+		t.Fatal("muted before the bot spoke")
+	}
+	g.mute()
+	if !g.isMuted(start.Add(time.Hour)) {
+		t.Error("unmuted while the bot is speaking")
+	}
+	g.turnComplete(start)
+	for _, tc := range []struct {
+		after time.Duration
+		muted bool
+	}{
+		{0, true},
+		{299 * time.Millisecond, true},
+		{300 * time.Millisecond, false},
+		{time.Second, false},
+	} {
+		if got := g.isMuted(start.Add(tc.after)); got != tc.muted {
+			t.Errorf("%v after the turn completed: muted %v, want %v", tc.after, got, tc.muted)
+		}
+	}
+}
+
+func TestGateInput(t *testing.T) {
+	defer func(v bool) { *halfDuplex = v; mic = &micGate{} }(*halfDuplex)
+	*halfDuplex = true
+	mic = &micGate{}
+	mic.mute()
+	if got := gateInput([]int16{1, 2}); got[0] != 0 || got[1] != 0 {
+		t.Errorf("gateInput() while muted = %v, want silence", got)
+	}
+	*halfDuplex = false
+	if got := gateInput([]int16{1, 2}); got[0] != 1 {
+		t.Errorf("gateInput() without -half-duplex = %v, want the input", got)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/golang/glog"
+)
+
+// isNegotiationRejection reports whether err is the Error frame the server
+// answers a request it cannot decode with, e.g. a gzip payload sent to an
+// endpoint without gzip support.
+func isNegotiationRejection(err error) bool {
+	var serverErr ServerError
+	return errors.As(err, &serverErr) && serverErr.Code == codeInvalidRequest
+}
+
+// withNegotiationFallback runs the setup step. If the server rejects its
+// compressed request as invalid, e.g. an older endpoint without gzip support,
+// the step is retried once without compression. If the retry succeeds the
+// protocol stays without compression and OnNegotiationFallback is called;
+// otherwise the rejection was not about compression, so the compression is
+// restored and the first error returned. Requests other than audio are always
+// JSON, so compression is the only setting to fall back from. A rejected
+// StartConnection or StartSession leaves the connection open, so the retry
+// uses the same connection.
+func withNegotiationFallback(step func() error) error {
+	err := step()
+	from, compress := protocol.Compression(), protocol.compress
+	if err == nil || from == CompressionNone || !isNegotiationRejection(err) {
+		return err
+	}
+	glog.Warningf("Server rejected the request, retrying without compression %s: %v", from, err)
+	protocol.SetCompression(CompressionNone, nil)
+	if retryErr := step(); retryErr != nil {
+		glog.Warningf("Request rejected without compression too, keeping %s: %v", from, retryErr)
+		protocol.SetCompression(from, compress)
+		return err
+	}
+	glog.Warningf("Server does not accept compression %s, falling back to %s.", from, CompressionNone)
+	if eventHandlers.OnNegotiationFallback != nil {
+		eventHandlers.OnNegotiationFallback(from, CompressionNone)
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"slices"
+	"testing"
+)
+
+// rejectingServer answers StartConnection and StartSession, rejecting the
+// steps in reject with code, and when gzipOnly is set only their gzipped
+// requests. It sends the events it read to events.
+func rejectingServer(code uint32, gzipOnly bool, reject ...int32) (func(c *fakeConn), chan []int32) {
+	events := make(chan []int32, 1)
+	return func(c *fakeConn) {
+		defer func() { events <- c.events }()
+		acks := map[int32]int32{1: 50, 100: 150}
+		for msg := c.read(); msg != nil; msg = c.read() {
+			ack, ok := acks[msg.Event]
+			if !ok {
+				continue
+			}
+			if slices.Contains(reject, msg.Event) && (!gzipOnly || c.compression == CompressionGzip) {
+				c.send(serverError(code, `{"error":"invalid request"}`))
+				continue
+			}
+			c.send(serverFrame(ack, msg.SessionID, `{"dialog_id":"dialog-1"}`))
+		}
+	}, events
+}
+
+// TestNegotiationFallback checks that a setup step rejected because of gzip
+// is retried once without compression, which then sticks, and that other
+// rejections leave the compression alone.
+func TestNegotiationFallback(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		code     uint32
+		gzipOnly bool
+		reject   int32
+		events   []int32
+		fallback bool
+	}{
+		{"StartConnection rejects gzip", codeInvalidRequest, true, 1, []int32{1, 1, 100}, true},
+		{"StartSession rejects gzip", codeInvalidRequest, true, 100, []int32{1, 100, 100}, true},
+		{"invalid either way", codeInvalidRequest, false, 100, []int32{1, 100, 100}, false},
+		{"other error", 55000001, true, 100, []int32{1, 100}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			handler, events := rejectingServer(tc.code, tc.gzipOnly, tc.reject)
+			s := newFakeServer(t, handler)
+			setupDialog(t, s)
+			if err := WithCompression(CompressionGzip, gzip.DefaultCompression); err != nil {
+				t.Fatal(err)
+			}
+			var fallbacks [][2]CompressionBits
+			eventHandlers.OnNegotiationFallback = func(from, to CompressionBits) {
+				fallbacks = append(fallbacks, [2]CompressionBits{from, to})
+			}
+			t.Cleanup(func() {
+				_ = WithCompression(CompressionNone, 0)
+				eventHandlers = EventHandlers{}
+			})
+
+			conn := dialFake(t)
+			err := startConnection(context.Background(), conn)
+			if err == nil {
+				err = startSession(context.Background(), conn, "session-1", newStartSessionPayload())
+			}
+			_ = closeConn(conn)
+			if got := <-events; !slices.Equal(got, tc.events) {
+				t.Errorf("server got events %v, want %v", got, tc.events)
+			}
+			if !tc.fallback {
+				var serverErr ServerError
+				if !errors.As(err, &serverErr) || serverErr.Code != int(tc.code) {
+					t.Errorf("setup = %v, want the code %d rejection", err, tc.code)
+				}
+				if len(fallbacks) != 0 || protocol.Compression() != CompressionGzip {
+					t.Errorf("fell back %v to %s, want gzip kept", fallbacks, protocol.Compression())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("setup = %v, want the retry without compression to succeed", err)
+			}
+			if want := [][2]CompressionBits{{CompressionGzip, CompressionNone}}; !slices.Equal(fallbacks, want) {
+				t.Errorf("OnNegotiationFallback got %v, want %v", fallbacks, want)
+			}
+			if got := protocol.Compression(); got != CompressionNone {
+				t.Errorf("compression after the fallback = %s, want %s", got, CompressionNone)
+			}
+		})
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// defaultQualityProbeInterval is how often the connection is pinged to
+	// measure its quality unless WithQualityProbeInterval says otherwise.
+	defaultQualityProbeInterval = 2 * time.Second
+	// qualityLogInterval is how often the network quality is logged.
+	qualityLogInterval = 10 * time.Second
+	// qualityLateWindow is how many of the last pings the late pong rate is
+	// taken over.
+	qualityLateWindow = 15
+)
+
+// NetworkQuality is the quality of the connection, measured with websocket
+// pings in the style of RTCP receiver reports: the share of pongs arriving
+// late, the jitter of the round trip time and the smoothed round trip time.
+//
+// The websocket runs over TCP, which does not lose pings but retransmits
+// them, so a pong counts as late when it did not arrive by the next ping.
+// LatePongRate stands in for the packet loss of the E-model: a stall that
+// long is heard as a gap all the same.
+type NetworkQuality struct {
+	LatePongRate float64 `json:"late_pong_rate"`
+	JitterMs     float64 `json:"jitter_ms"`
+	RTTMs        float64 `json:"rtt_ms"`
+	Score        float64 `json:"network_quality_score"`
+}
+
+// qualityScore rates q from 0 (poor) to 1 (excellent) with the E-model of ITU-T
+// G.107, as VoIP MOS estimates do: the effective latency and the late pongs
+// lower the R factor, which maps to a MOS, scaled so that a perfect network scores 1.
+func qualityScore(q NetworkQuality) float64 {
+	score := (mos(rFactor(q)) - 1) / (mos(rFactor(NetworkQuality{})) - 1)
+	return math.Max(0, math.Min(1, score))
+}
+
+// rFactor is the simplified E-model R factor of q.
+func rFactor(q NetworkQuality) float64 {
+	r := 93.2
+	latency := q.RTTMs/2 + 2*q.JitterMs + 10
+	if latency < 160 {
+		r -= latency / 40
+	} else {
+		r -= (latency - 120) / 10
+	}
+	return r - 2.5*q.LatePongRate*100
+}
+
+// mos maps an E-model R factor to a mean opinion score from 1 to 4.5.
+func mos(r float64) float64 {
+	switch {
+	case r <= 0:
+		return 1
+	case r >= 100:
+		return 4.5
+	default:
+		return 1 + 0.035*r + 7e-6*r*(r-60)*(100-r)
+	}
+}
+
+var (
+	errInvalidQualityThreshold     = errors.New("invalid network quality threshold")
+	errInvalidQualityProbeInterval = errors.New("invalid network quality probe interval")
+)
+
+// qualityProbe pings the connection of the dialog and keeps its quality.
+type qualityProbe struct {
+	lock sync.Mutex
+	// interval is how often the connection is pinged, 0 for never.
+	interval time.Duration
+	seq      uint64
+	// sent is when the unanswered ping seq was sent, zero once it is answered.
+	sent     time.Time
+	late     []bool
+	rtt      time.Duration
+	lastRTT  time.Duration
+	jitter   time.Duration
+	measured bool
+	// threshold is the score below which EventHandlers.OnQualityDegraded is
+	// called; degraded is set until the score recovers.
+	threshold float64
+	degraded  bool
+}
+
+var netQuality = &qualityProbe{interval: defaultQualityProbeInterval, threshold: 0.5}
+
+// WithQualityProbeInterval pings the connection every interval to measure the
+// network quality, 2s by default. 0 turns the pings off, and with them the
+// score, which stays 1, and OnQualityDegraded. The interval only applies to
+// dialogs started afterwards.
+func WithQualityProbeInterval(interval time.Duration) error {
+	if interval < 0 {
+		return fmt.Errorf("%w: %v is negative", errInvalidQualityProbeInterval, interval)
+	}
+	netQuality.lock.Lock()
+	defer netQuality.lock.Unlock()
+	netQuality.interval = interval
+	return nil
+}
+
+// WithQualityThreshold calls EventHandlers.OnQualityDegraded when the network
+// quality score drops below threshold, from 0 to 1. 0 never calls it.
+func WithQualityThreshold(threshold float64) error {
+	if threshold < 0 || threshold > 1 {
+		return fmt.Errorf("%w: %v is outside [0, 1]", errInvalidQualityThreshold, threshold)
+	}
+	netQuality.lock.Lock()
+	defer netQuality.lock.Unlock()
+	netQuality.threshold = threshold
+	return nil
+}
+
+// NetworkQualityScore returns the quality of the connection from 0.0 (poor) to
+// 1.0 (excellent). It is 1 until the first ping of the dialog was answered.
+func NetworkQualityScore() float64 {
+	return netQuality.snapshot().Score
+}
+
+// snapshot returns the quality measured so far.
+func (p *qualityProbe) snapshot() NetworkQuality {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if !p.measured {
+		return NetworkQuality{Score: 1}
+	}
+	q := NetworkQuality{
+		JitterMs: float64(p.jitter) / float64(time.Millisecond),
+		RTTMs:    float64(p.rtt) / float64(time.Millisecond),
+	}
+	var late int
+	for _, l := range p.late {
+		if l {
+			late++
+		}
+	}
+	if len(p.late) > 0 {
+		q.LatePongRate = float64(late) / float64(len(p.late))
+	}
+	q.Score = qualityScore(q)
+	return q
+}
+
+// reset forgets the quality measured on a previous connection.
+func (p *qualityProbe) reset() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.sent, p.late, p.measured, p.degraded = time.Time{}, nil, false, false
+	p.rtt, p.lastRTT, p.jitter = 0, 0, 0
+}
+
+// record notes whether the pong of the last ping was late.
+func (p *qualityProbe) record(late bool) {
+	p.late = append(p.late, late)
+	if len(p.late) > qualityLateWindow {
+		p.late = p.late[1:]
+	}
+}
+
+// ping counts the pong of the previous ping as late if it is still missing
+// and sends the next one.
+func (p *qualityProbe) ping(conn *websocket.Conn, now time.Time) error {
+	data, deadline := p.next(now)
+	return conn.WriteControl(websocket.PingMessage, data, deadline)
+}
+
+// next accounts for the ping sent at now and returns its data and its write
+// deadline.
+func (p *qualityProbe) next(now time.Time) ([]byte, time.Time) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if !p.sent.IsZero() {
+		p.record(true)
+		p.measured = true
+	}
+	p.seq++
+	p.sent = now
+	return binary.BigEndian.AppendUint64(nil, p.seq), now.Add(p.interval)
+}
+
+// pong takes the round trip time of the ping data answers. Pongs already
+// counted as late are ignored.
+func (p *qualityProbe) pong(data []byte, now time.Time) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if len(data) != 8 || binary.BigEndian.Uint64(data) != p.seq || p.sent.IsZero() {
+		return
+	}
+	rtt := now.Sub(p.sent)
+	p.sent = time.Time{}
+	p.record(false)
+	if !p.measured {
+		p.rtt, p.lastRTT, p.measured = rtt, rtt, true
+		return
+	}
+	// 与 RTCP 相同的平滑方式：RTT 取 1/8 加权，抖动取 1/16 加权
+	p.rtt += (rtt - p.rtt) / 8
+	d := rtt - p.lastRTT
+	if d < 0 {
+		d = -d
+	}
+	p.jitter += (d - p.jitter) / 16
+	p.lastRTT = rtt
+}
+
+// checkDegraded calls EventHandlers.OnQualityDegraded once when the score
+// drops below the threshold, and again only after it recovered.
+func (p *qualityProbe) checkDegraded(q NetworkQuality) {
+	p.lock.Lock()
+	below := q.Score < p.threshold
+	fire := below && !p.degraded
+	p.degraded = below
+	p.lock.Unlock()
+	if !fire {
+		return
+	}
+	glog.Warningf("Network quality degraded: score=%.2f rtt=%.0fms jitter=%.0fms late pongs=%.0f%%", q.Score, q.RTTMs, q.JitterMs, q.LatePongRate*100)
+	if eventHandlers.OnQualityDegraded != nil {
+		eventHandlers.OnQualityDegraded(q)
+	}
+}
+
+// runQualityProbe pings conn every probe interval until ctx is done and logs
+// the network quality every qualityLogInterval, unless the probe is turned
+// off. The pongs are handled by the receive loop, which reads conn, so it must
+// be called before the loop starts.
+func runQualityProbe(ctx context.Context, conn *websocket.Conn) {
+	netQuality.reset()
+	netQuality.lock.Lock()
+	interval := netQuality.interval
+	netQuality.lock.Unlock()
+	if interval == 0 {
+		return
+	}
+	conn.SetPongHandler(func(data string) error {
+		netQuality.pong([]byte(data), time.Now())
+		return nil
+	})
+	go func() {
+		probe := time.NewTicker(interval)
+		defer probe.Stop()
+		report := time.NewTicker(qualityLogInterval)
+		defer report.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-probe.C:
+				if err := netQuality.ping(conn, now); err != nil {
+					glog.V(1).Infof("Failed to ping for the network quality: %v", err)
+				}
+				netQuality.checkDegraded(netQuality.snapshot())
+			case <-report.C:
+				q := netQuality.snapshot()
+				glog.Infof("Network quality: score=%.2f rtt=%.0fms jitter=%.0fms late pongs=%.0f%%", q.Score, q.RTTMs, q.JitterMs, q.LatePongRate*100)
+			}
+		}
+	}()
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestQualityScore(t *testing.T) {
+	if got := qualityScore(NetworkQuality{}); got != 1 {
+		t.Errorf("qualityScore() of a perfect network = %v, want 1", got)
+	}
+	good := qualityScore(NetworkQuality{RTTMs: 60, JitterMs: 5})
+	bad := qualityScore(NetworkQuality{RTTMs: 600, JitterMs: 80, LatePongRate: 0.2})
+	if good < 0.9 || bad > 0.5 || bad < 0 {
+		t.Errorf("qualityScore() = %v for a good network, %v for a bad one", good, bad)
+	}
+}
+
+// TestQualityProbeLatePongs checks the accounting of pongs: the round trip
+// time of a pong in time, and a pong missing by the next ping counted late
+// and ignored when it arrives after all.
+func TestQualityProbeLatePongs(t *testing.T) {
+	p := &qualityProbe{interval: time.Second}
+	if q := p.snapshot(); q.Score != 1 {
+		t.Errorf("score before any pong = %v, want 1", q.Score)
+	}
+	start := time.Now()
+	data, _ := p.next(start)
+	p.pong(data, start.Add(100*time.Millisecond))
+	late, _ := p.next(start.Add(time.Second))
+	p.next(start.Add(2 * time.Second))
+	p.pong(late, start.Add(2500*time.Millisecond))
+
+	q := p.snapshot()
+	if q.RTTMs != 100 {
+		t.Errorf("RTT = %vms, want 100ms", q.RTTMs)
+	}
+	if q.LatePongRate != 0.5 {
+		t.Errorf("LatePongRate = %v, want 0.5 for one late pong of two", q.LatePongRate)
+	}
+	if seq := binary.BigEndian.Uint64(late); seq != 2 {
+		t.Errorf("second ping carries %d, want 2", seq)
+	}
+}
+
+// dialogPings runs a short dialog probing the network quality every interval
+// and returns how many pings the server received.
+func dialogPings(t *testing.T, interval time.Duration) int32 {
+	var pings atomic.Int32
+	script := scriptedDialog(func(c *fakeConn, sid string) { time.Sleep(200 * time.Millisecond) })
+	s := newFakeServer(t, func(c *fakeConn) {
+		c.conn.SetPingHandler(func(string) error {
+			pings.Add(1)
+			return nil
+		})
+		script(c)
+	})
+	setupDialog(t, s)
+	if err := WithQualityProbeInterval(interval); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = WithQualityProbeInterval(defaultQualityProbeInterval) })
+	if _, err := runFakeDialog(t); err == nil {
+		t.Fatal("realTimeDialog() = nil, want the server closing the session")
+	}
+	return pings.Load()
+}
+
+func TestQualityProbeInterval(t *testing.T) {
+	if err := WithQualityProbeInterval(-time.Second); !errors.Is(err, errInvalidQualityProbeInterval) {
+		t.Errorf("WithQualityProbeInterval(-1s) = %v, want errInvalidQualityProbeInterval", err)
+	}
+	if n := dialogPings(t, 20*time.Millisecond); n < 2 {
+		t.Errorf("server got %d pings every 20ms, want several", n)
+	}
+	if n := dialogPings(t, 0); n != 0 {
+		t.Errorf("server got %d pings with the probe off, want none", n)
+	}
+	if got := NetworkQualityScore(); got != 1 {
+		t.Errorf("NetworkQualityScore() with the probe off = %v, want 1", got)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// switchSink plays on the speaker and can move playback to another output
+// device mid-session.
+type switchSink struct {
+	lock    sync.Mutex
+	current AudioSink
+	device  string
+}
+
+// speakerOutput is the speaker output of the dialog, nil unless the output
+// is "speaker".
+var speakerOutput *switchSink
+
+// newSwitchSink returns a switchSink playing on sink, which plays on the
+// default output device.
+func newSwitchSink(sink AudioSink) *switchSink {
+	return &switchSink{current: sink, device: "default"}
+}
+
+// bufferTaker is implemented by an AudioSink that can hand over the audio it
+// has not played yet.
+type bufferTaker interface {
+	takeBuffered() []int16
+}
+
+// SwitchOutputDevice moves playback to the output device called name without
+// interrupting the session: the new device is opened, the audio not played
+// yet moves over and the old device is closed. If the new device fails to
+// open, playback stays on the old one.
+func SwitchOutputDevice(name string) error {
+	if speakerOutput == nil {
+		return errors.New("audio output is not the speaker")
+	}
+	b, ok := audioBackend.(OutputDeviceBackend)
+	if !ok {
+		return errors.New("audio backend cannot select an output device")
+	}
+	return speakerOutput.switchTo(b, name)
+}
+
+func (s *switchSink) switchTo(b OutputDeviceBackend, name string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	sink, err := b.NewSinkOn(name)
+	if err != nil {
+		return fmt.Errorf("open output device %q, staying on %s: %w", name, s.device, err)
+	}
+	reportDevice(nil, sink)
+	if t, ok := s.current.(bufferTaker); ok {
+		if pending := t.takeBuffered(); len(pending) > 0 {
+			if err := sink.WriteFrame(pending); err != nil {
+				glog.Warningf("Failed to move %s of audio to %s: %v", samplesDuration(len(pending)), name, err)
+			}
+		}
+	}
+	if err := s.current.Close(); err != nil {
+		glog.Errorf("Failed to close audio output %s: %v", s.device, err)
+	}
+	glog.Infof("Audio output switched from %s to %s.", s.device, name)
+	journal.Record(JournalCommand, 0, "", fmt.Sprintf("audio output switched from %s to %s", s.device, name))
+	s.current, s.device = sink, name
+	return nil
+}
+
+func (s *switchSink) WriteFrame(samples []int16) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.current.WriteFrame(samples)
+}
+
+func (s *switchSink) Flush() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.current.Flush()
+}
+
+func (s *switchSink) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.current.Close()
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// bufferingSpeaker is a fakeSpeaker holding audio not played yet, which a
+// switch moves to the new device.
+type bufferingSpeaker struct {
+	fakeSpeaker
+	buffered []int16
+}
+
+func (s *bufferingSpeaker) isClosed() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.closed
+}
+
+func (s *bufferingSpeaker) takeBuffered() []int16 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	buffered := s.buffered
+	s.buffered = nil
+	return buffered
+}
+
+// devicesBackend is a fakeBackend that also opens the named output devices
+// in speakers, and fails for any other name.
+type devicesBackend struct {
+	fakeBackend
+	speakers map[string]*fakeSpeaker
+}
+
+func (b devicesBackend) NewSinkOn(device string) (AudioSink, error) {
+	if s, ok := b.speakers[device]; ok {
+		return s, nil
+	}
+	return nil, errors.New("no such device")
+}
+
+// TestSwitchOutputDevice moves playback to other devices between two bot
+// answers and checks that the session goes on, the audio not played yet
+// moves over and a failed switch keeps the old device.
+func TestSwitchOutputDevice(t *testing.T) {
+	switched := make(chan struct{})
+	s := newFakeServer(t, scriptedDialog(func(c *fakeConn, sid string) {
+		c.answer(sid, "你好", 2400)
+		<-switched
+		c.userTurn(sid, "今天天气怎么样")
+		c.answer(sid, "晴天", 4800)
+	}))
+	setupDialog(t, s)
+	speaker := &bufferingSpeaker{buffered: make([]int16, 1200)}
+	headphones := &fakeSpeaker{}
+	WithAudioBackend(devicesBackend{speakers: map[string]*fakeSpeaker{"headphones": headphones}})
+	speakerOutput = newSwitchSink(speaker)
+	audioSink = speakerOutput
+	t.Cleanup(func() {
+		WithAudioBackend(defaultAudioBackend)
+		speakerOutput = nil
+	})
+
+	type result struct {
+		summary *DialogSummary
+		err     error
+	}
+	done := make(chan result, 1)
+	go func() {
+		summary, err := runFakeDialog(t)
+		done <- result{summary, err}
+	}()
+	waitFor(t, "the greeting", func() bool { return speaker.played() == 2400 })
+	if err := SwitchOutputDevice("usb"); err == nil || !strings.Contains(err.Error(), "staying on default") {
+		t.Errorf(`SwitchOutputDevice("usb") = %v, want staying on the default device`, err)
+	}
+	if speaker.isClosed() {
+		t.Fatal("failed switch closed the old device")
+	}
+	if err := SwitchOutputDevice("headphones"); err != nil {
+		t.Fatalf(`SwitchOutputDevice("headphones") = %v`, err)
+	}
+	close(switched)
+
+	r := <-done
+	var reason *ShutdownReason
+	if !errors.As(r.err, &reason) || reason.Kind != ShutdownServerClosed {
+		t.Errorf("realTimeDialog() = %v, want the server ending the session", r.err)
+	}
+	if r.summary.TotalTurns != 2 {
+		t.Errorf("dialog finished %d turns, want 2", r.summary.TotalTurns)
+	}
+	if !speaker.isClosed() {
+		t.Error("old device not closed")
+	}
+	if got := speaker.played(); got != 2400 {
+		t.Errorf("old device played %d samples, want the 2400 of the greeting", got)
+	}
+	if got := headphones.played(); got != 1200+4800 {
+		t.Errorf("headphones played %d samples, want the 1200 moved over and the 4800 of the answer", got)
+	}
+}
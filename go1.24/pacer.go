@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// pacerBurst is how much audio, in seconds, may be sent ahead of real time.
+// It absorbs the jitter of a live microphone without letting file input burst.
+const pacerBurst = 0.1
+
+// sendRateMultiplier is the multiple of real time at which input audio is
+// sent; 0 disables pacing.
+var sendRateMultiplier = 1.0
+
+// WithSendRate sends input audio at multiplier times real time instead of as
+// fast as it is read, so that file input does not overflow the server and
+// behaves like a live microphone. A multiplier of 0 disables pacing.
+func WithSendRate(multiplier float64) {
+	sendRateMultiplier = multiplier
+}
+
+// pacer is a token bucket that limits outbound audio to a multiple of real
+// time. A nil pacer does not limit at all.
+type pacer struct {
+	rate   float64 // samples per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newPacer returns a pacer sending audio at multiplier times real time, or nil
+// if multiplier is not positive.
+func newPacer(multiplier float64) *pacer {
+	if multiplier <= 0 {
+		return nil
+	}
+	rate := inputSampleRate * multiplier
+	return &pacer{rate: rate, burst: rate * pacerBurst, tokens: rate * pacerBurst}
+}
+
+// wait blocks until n more samples may be sent or ctx is done.
+func (p *pacer) wait(ctx context.Context, n int) error {
+	if p == nil {
+		return nil
+	}
+	now := time.Now()
+	if !p.last.IsZero() {
+		p.tokens = min(p.burst, p.tokens+now.Sub(p.last).Seconds()*p.rate)
+	}
+	p.last = now
+	p.tokens -= float64(n)
+	if p.tokens >= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(time.Duration(-p.tokens / p.rate * float64(time.Second)))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// TestPacerSpacing checks that frames are sent at the configured multiple of
+// real time once the burst is used up.
+func TestPacerSpacing(t *testing.T) {
+	for _, multiplier := range []float64{1, 2} {
+		p := newPacer(multiplier)
+		const frames = 40
+		burst := int(pacerBurst * inputSampleRate * multiplier / inputFramesPerBuffer)
+		start := time.Now()
+		for range frames {
+			if err := p.wait(context.Background(), inputFramesPerBuffer); err != nil {
+				t.Fatal(err)
+			}
+		}
+		elapsed := time.Since(start)
+		want := time.Duration(float64(frames-burst) * inputFramesPerBuffer / (inputSampleRate * multiplier) * float64(time.Second))
+		if elapsed < want-5*time.Millisecond || elapsed > want+50*time.Millisecond {
+			t.Errorf("%v times real time: %d frames took %v, want about %v", multiplier, frames, elapsed, want)
+		}
+	}
+}
+
+func TestPacerDisabled(t *testing.T) {
+	p := newPacer(0)
+	start := time.Now()
+	for range 100 {
+		if err := p.wait(context.Background(), inputFramesPerBuffer); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Millisecond {
+		t.Errorf("unpaced frames took %v, want no delay", elapsed)
+	}
+}
+
+func TestPacerCanceled(t *testing.T) {
+	p := newPacer(1)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := p.wait(ctx, inputSampleRate); err != context.Canceled {
+		t.Errorf("wait() = %v, want context.Canceled", err)
+	}
+}
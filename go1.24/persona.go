@@ -0,0 +1,25 @@
+package main
+
+// PersonaPreset is a bot persona: the name, role and speaking style that
+// always go together in a DialogPayload.
+type PersonaPreset struct {
+	BotName       string
+	SystemRole    string
+	SpeakingStyle string
+}
+
+// PersonaDoubao is the persona of the dialog started by the command.
+var PersonaDoubao = PersonaPreset{
+	BotName:       "豆包",
+	SystemRole:    "你使用活泼灵动的女声，性格开朗，热爱生活。",
+	SpeakingStyle: "你的说话风格简洁明了，语速适中，语调自然。",
+}
+
+// FromPreset returns a copy of p with all persona fields set from preset. The
+// copy shares Extra and AuditResponses with p.
+func (p DialogPayload) FromPreset(preset PersonaPreset) DialogPayload {
+	p.BotName = preset.BotName
+	p.SystemRole = preset.SystemRole
+	p.SpeakingStyle = preset.SpeakingStyle
+	return p
+}
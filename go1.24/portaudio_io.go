@@ -0,0 +1,244 @@
+//go:build cgo
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/gordonklaus/portaudio"
+)
+
+// PortAudioBackend opens the default input and output devices with PortAudio.
+// It is the default audio backend of cgo builds.
+type PortAudioBackend struct{}
+
+var defaultAudioBackend AudioBackend = PortAudioBackend{}
+
+// Open initializes PortAudio.
+func (PortAudioBackend) Open() error {
+	return portaudio.Initialize()
+}
+
+// NewSource implements AudioBackend.
+func (PortAudioBackend) NewSource() (AudioSource, error) {
+	return NewPortAudioSource()
+}
+
+// NewSink implements AudioBackend.
+func (PortAudioBackend) NewSink() (AudioSink, error) {
+	return NewPortAudioSink()
+}
+
+// NewSinkOn implements OutputDeviceBackend.
+func (PortAudioBackend) NewSinkOn(device string) (AudioSink, error) {
+	return NewPortAudioSinkOn(device)
+}
+
+// Close terminates PortAudio.
+func (PortAudioBackend) Close() error {
+	return portaudio.Terminate()
+}
+
+// portaudioSource captures frames from the default input device.
+type portaudioSource struct {
+	stream *portaudio.Stream
+	frame  []int16
+	// channels is the channel count of the stream; frames of more than one
+	// channel are mixed down to the channels of inputChannelMap.
+	channels   int
+	channelMap []int
+}
+
+// NewPortAudioSource opens and starts a blocking input stream on the default
+// input device, capturing the channels WithInputChannelMap selects.
+func NewPortAudioSource() (AudioSource, error) {
+	defaultInputDevice, err := portaudio.DefaultInputDevice()
+	if err != nil {
+		return nil, fmt.Errorf("get default input device: %w", err)
+	}
+	glog.Infof("Using default input device: %s", defaultInputDevice.Name)
+	if err := checkChannelMap(defaultInputDevice.Name, defaultInputDevice.MaxInputChannels); err != nil {
+		return nil, err
+	}
+	channels := inputStreamChannels()
+	streamParameters := portaudio.StreamParameters{
+		Input: portaudio.StreamDeviceParameters{
+			Device:   defaultInputDevice,
+			Channels: channels,
+			Latency:  defaultInputDevice.DefaultLowInputLatency,
+		},
+		SampleRate:      inputSampleRate,
+		FramesPerBuffer: inputFramesPerBuffer,
+	}
+	s := &portaudioSource{frame: make([]int16, inputFramesPerBuffer*channels), channels: channels, channelMap: inputChannelMap}
+	s.stream, err = portaudio.OpenStream(streamParameters, s.frame)
+	if err != nil {
+		return nil, fmt.Errorf("open microphone input stream: %w", err)
+	}
+	if err := s.stream.Start(); err != nil {
+		_ = s.stream.Close()
+		return nil, fmt.Errorf("start microphone input stream: %w", err)
+	}
+	info := s.stream.Info()
+	input := AudioDevice{Name: defaultInputDevice.Name, SampleRate: info.SampleRate, Channels: channels, Latency: info.InputLatency}
+	updateAudioDevices(func(d *AudioDevices) { d.Input = input })
+	glog.Infof("Microphone input stream started: %+v", input)
+	return s, nil
+}
+
+func (s *portaudioSource) ReadFrame(ctx context.Context) ([]int16, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	// 输入溢出只意味着丢了一部分采样，本帧数据仍然可用
+	if err := s.stream.Read(); err != nil && !errors.Is(err, portaudio.InputOverflowed) {
+		return nil, fmt.Errorf("read microphone input stream: %w", err)
+	}
+	if s.channels > 1 {
+		return mixChannels(s.frame, s.channels, s.channelMap), nil
+	}
+	return append([]int16(nil), s.frame...), nil
+}
+
+func (s *portaudioSource) Close() error {
+	updateAudioDevices(func(d *AudioDevices) { d.Input = AudioDevice{} })
+	if err := s.stream.Stop(); err != nil {
+		glog.Errorf("Failed to stop microphone input stream: %v", err)
+	}
+	return s.stream.Close()
+}
+
+// portaudioSink plays frames on the default output device.
+type portaudioSink struct {
+	stream *portaudio.Stream
+	output AudioDevice
+
+	lock   sync.Mutex
+	buffer []int16
+}
+
+// NewPortAudioSink opens and starts a callback output stream on the default
+// output device.
+func NewPortAudioSink() (AudioSink, error) {
+	outputDevice, err := portaudio.DefaultOutputDevice()
+	if err != nil {
+		return nil, fmt.Errorf("get default output device: %w", err)
+	}
+	return newPortAudioSink(outputDevice)
+}
+
+// NewPortAudioSinkOn is like NewPortAudioSink, but plays on the output device
+// called name.
+func NewPortAudioSinkOn(name string) (AudioSink, error) {
+	devices, err := portaudio.Devices()
+	if err != nil {
+		return nil, fmt.Errorf("list audio devices: %w", err)
+	}
+	for _, d := range devices {
+		if d.Name == name && d.MaxOutputChannels >= channels {
+			return newPortAudioSink(d)
+		}
+	}
+	return nil, fmt.Errorf("no output device %q", name)
+}
+
+func newPortAudioSink(outputDevice *portaudio.DeviceInfo) (AudioSink, error) {
+	var err error
+	outputParameters := portaudio.StreamParameters{
+		Output: portaudio.StreamDeviceParameters{
+			Device:   outputDevice,
+			Channels: channels,
+			Latency:  10 * time.Millisecond,
+		},
+		SampleRate:      float64(sampleRate),
+		FramesPerBuffer: framesPerBuffer,
+	}
+	s := &portaudioSink{buffer: make([]int16, 0, sampleRate*bufferSeconds)}
+	s.stream, err = portaudio.OpenStream(outputParameters, s.play)
+	if err != nil {
+		return nil, fmt.Errorf("open PortAudio output stream: %w", err)
+	}
+	if err := s.stream.Start(); err != nil {
+		_ = s.stream.Close()
+		return nil, fmt.Errorf("start PortAudio output stream: %w", err)
+	}
+	info := s.stream.Info()
+	s.output = AudioDevice{Name: outputDevice.Name, SampleRate: info.SampleRate, Channels: channels, Latency: info.OutputLatency}
+	updateAudioDevices(func(d *AudioDevices) { d.Output = s.output })
+	glog.Infof("PortAudio output stream started for playback: %+v", s.output)
+	return s, nil
+}
+
+func (s *portaudioSink) play(out []int16) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	n := copy(out, s.buffer)
+	for i := n; i < len(out); i++ {
+		out[i] = 0
+	}
+	s.drop(n)
+}
+
+func (s *portaudioSink) WriteFrame(samples []int16) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	n := int64(2 * len(samples))
+	if !reserveAudioMemory(n) {
+		// 达到音频内存上限时丢弃最早未播放的音频，腾出新音频的空间
+		over := int((audioMemoryUsed.Load() + n - audioMemoryLimit + 1) / 2)
+		dropped := min(over, len(s.buffer))
+		glog.Warningf("Audio memory limit of %d bytes reached, dropping %s of playback", audioMemoryLimit, samplesDuration(dropped))
+		s.drop(dropped)
+		audioMemoryUsed.Add(n)
+	}
+	s.buffer = append(s.buffer, samples...)
+	if len(s.buffer) > sampleRate*bufferSeconds {
+		s.drop(len(s.buffer) - sampleRate*bufferSeconds)
+	}
+	return nil
+}
+
+// drop removes the n oldest samples of the buffer. s.lock must be held.
+func (s *portaudioSink) drop(n int) {
+	s.buffer = s.buffer[n:]
+	releaseAudioMemory(int64(2 * n))
+}
+
+// takeBuffered removes the audio not played yet and returns it.
+func (s *portaudioSink) takeBuffered() []int16 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	samples := append([]int16(nil), s.buffer...)
+	s.drop(len(s.buffer))
+	return samples
+}
+
+func (s *portaudioSink) Flush() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.drop(len(s.buffer))
+	return nil
+}
+
+func (s *portaudioSink) Close() error {
+	updateAudioDevices(func(d *AudioDevices) {
+		// 切换输出设备时新设备已经登记，不能清掉
+		if d.Output == s.output {
+			d.Output = AudioDevice{}
+		}
+	})
+	if err := s.stream.Stop(); err != nil {
+		glog.Errorf("Failed to stop PortAudio output stream: %v", err)
+	}
+	err := s.stream.Close()
+	s.lock.Lock()
+	s.drop(len(s.buffer))
+	s.lock.Unlock()
+	glog.Info("PortAudio output stream stopped.")
+	return err
+}
@@ -0,0 +1,35 @@
+//go:build cgo
+
+package main
+
+import "testing"
+
+// TestPlaybackMemoryCapped checks that the playback buffer drops its oldest
+// audio rather than hold more than the audio memory limit.
+func TestPlaybackMemoryCapped(t *testing.T) {
+	setAudioMemoryLimit(t, 2000)
+	s := &portaudioSink{}
+	first := make([]int16, 600)
+	for i := range first {
+		first[i] = int16(i)
+	}
+	_ = s.WriteFrame(first)
+	_ = s.WriteFrame(make([]int16, 600))
+	if used := AudioMemoryUsage(); used != 2000 {
+		t.Errorf("AudioMemoryUsage() = %d, want the limit of 2000", used)
+	}
+	if len(s.buffer) != 1000 || s.buffer[0] != 200 {
+		t.Errorf("buffer holds %d samples from %d, want 1000 from 200", len(s.buffer), s.buffer[0])
+	}
+
+	s.play(make([]int16, 400))
+	if used := AudioMemoryUsage(); used != 1200 {
+		t.Errorf("AudioMemoryUsage() after playing 400 samples = %d, want 1200", used)
+	}
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if used := AudioMemoryUsage(); used != 0 {
+		t.Errorf("AudioMemoryUsage() after Flush = %d, want 0", used)
+	}
+}
@@ -0,0 +1,6 @@
+//go:build !cgo
+
+package main
+
+// PortAudio needs cgo; without it there is no default device backend.
+var defaultAudioBackend AudioBackend
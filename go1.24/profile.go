@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// SessionPayload produces the StartSession payload of a product, so that
+// products with a different payload shape can reuse the client.
+type SessionPayload interface {
+	MarshalStartSession(sessionID string) ([]byte, error)
+}
+
+// MarshalStartSession implements SessionPayload. The audit response template
+// is rendered into a copy, p is left as it is.
+func (p *StartSessionPayload) MarshalStartSession(sessionID string) ([]byte, error) {
+	session := *p
+	if err := applyAuditResponseTemplate(&session.Dialog, sessionID); err != nil {
+		return nil, err
+	}
+	return json.Marshal(&session)
+}
+
+// RawSessionPayload is a StartSession payload sent verbatim.
+type RawSessionPayload []byte
+
+// MarshalStartSession implements SessionPayload.
+func (p RawSessionPayload) MarshalStartSession(string) ([]byte, error) {
+	if !json.Valid(p) {
+		return nil, fmt.Errorf("raw StartSession payload is not valid JSON")
+	}
+	return p, nil
+}
+
+// ProductProfile describes a realtime speech product served over the binary
+// protocol: where to connect, how to authenticate and what StartSession sends.
+type ProductProfile struct {
+	Name       string
+	ResourceID string // sent as X-Api-Resource-Id
+	Path       string // websocket path on wsURL's host
+	AppKey     string // sent as X-Api-App-Key
+	// NewSessionPayload returns the StartSession payload of a new session.
+	NewSessionPayload func() SessionPayload
+}
+
+// dialogueProfile is the realtime dialogue product, the default.
+var dialogueProfile = ProductProfile{
+	Name:       "dialogue",
+	ResourceID: "volc.speech.dialog",
+	Path:       "/api/v3/realtime/dialogue",
+	AppKey:     "PlgvMymc7f3tQnJ6",
+	NewSessionPayload: func() SessionPayload {
+		return newStartSessionPayload()
+	},
+}
+
+var (
+	productProfiles = map[string]ProductProfile{dialogueProfile.Name: dialogueProfile}
+	// product is the profile the client connects with.
+	product = dialogueProfile
+)
+
+// RegisterProductProfile makes p selectable by name with WithProductProfile,
+// replacing a profile of the same name.
+func RegisterProductProfile(p ProductProfile) {
+	productProfiles[p.Name] = p
+}
+
+// WithProductProfile connects to the product registered under name.
+func WithProductProfile(name string) error {
+	p, ok := productProfiles[name]
+	if !ok {
+		names := make([]string, 0, len(productProfiles))
+		for n := range productProfiles {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown product profile %q, known: %s", name, strings.Join(names, ", "))
+	}
+	product = p
+	wsURL.Path = p.Path
+	return nil
+}
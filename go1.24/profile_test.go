@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+// translationPayload is the StartSession payload of the example product of
+// TestProductProfile, whose envelope differs from the dialogue product's.
+type translationPayload struct {
+	SourceLanguage string
+	TargetLanguage string
+}
+
+func (p translationPayload) MarshalStartSession(sessionID string) ([]byte, error) {
+	return json.Marshal(map[string]any{
+		"request": map[string]string{"session": sessionID, "source": p.SourceLanguage, "target": p.TargetLanguage},
+	})
+}
+
+// TestProductProfile starts a session of a second product with its own
+// endpoint, keys and payload envelope against the fake server.
+func TestProductProfile(t *testing.T) {
+	payloads := make(chan []byte, 1)
+	s := newFakeServer(t, func(c *fakeConn) {
+		if c.expect(1) == nil {
+			return
+		}
+		c.send(serverFrame(50, "conn-1", `{}`))
+		msg := c.expect(100)
+		if msg == nil {
+			return
+		}
+		payloads <- msg.Payload
+		c.send(serverFrame(150, msg.SessionID, `{}`))
+		for c.read() != nil {
+		}
+	})
+	setupDialog(t, s)
+	oldPath := wsURL.Path
+	t.Cleanup(func() {
+		product, wsURL.Path = dialogueProfile, oldPath
+		delete(productProfiles, "translation")
+	})
+	RegisterProductProfile(ProductProfile{
+		Name:       "translation",
+		ResourceID: "example.speech.translation",
+		Path:       "/api/v3/example/translation",
+		AppKey:     "example-key",
+		NewSessionPayload: func() SessionPayload {
+			return translationPayload{SourceLanguage: "zh", TargetLanguage: "en"}
+		},
+	})
+	if err := WithProductProfile("translation"); err != nil {
+		t.Fatal(err)
+	}
+
+	conn := dialFake(t)
+	if err := startConnection(context.Background(), conn); err != nil {
+		t.Fatal(err)
+	}
+	if err := startSession(context.Background(), conn, "session-1", product.NewSessionPayload()); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Path(); got != "/api/v3/example/translation" {
+		t.Errorf("dialed path %q, want the path of the profile", got)
+	}
+	if got := s.Header().Get("X-Api-Resource-Id"); got != "example.speech.translation" {
+		t.Errorf("X-Api-Resource-Id = %q, want the resource ID of the profile", got)
+	}
+	if got := s.Header().Get("X-Api-App-Key"); got != "example-key" {
+		t.Errorf("X-Api-App-Key = %q, want the app key of the profile", got)
+	}
+	want := `{"request":{"session":"session-1","source":"zh","target":"en"}}`
+	if got := string(<-payloads); got != want {
+		t.Errorf("StartSession payload = %s, want %s", got, want)
+	}
+}
+
+func TestWithProductProfileUnknown(t *testing.T) {
+	if err := WithProductProfile("nope"); err == nil {
+		t.Error("WithProductProfile(\"nope\") = nil, want an error")
+	}
+	if product.Name != dialogueProfile.Name {
+		t.Errorf("product = %q after a failed switch, want %q", product.Name, dialogueProfile.Name)
+	}
+}
+
+// TestMarshalStartSessionLeavesPayload checks that rendering the audit
+// response template does not change the payload, which is marshaled again
+// for every session.
+func TestMarshalStartSessionLeavesPayload(t *testing.T) {
+	extra := map[string]interface{}{"audit_response": "默认回复"}
+	p := &StartSessionPayload{Dialog: DialogPayload{
+		BotName:               "豆包",
+		Extra:                 extra,
+		AuditResponseTemplate: "{{.SessionID}}: 抱歉",
+	}}
+	for _, sessionID := range []string{"s1", "s2"} {
+		data, err := p.MarshalStartSession(sessionID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got StartSessionPayload
+		if err := json.Unmarshal(data, &got); err != nil {
+			t.Fatal(err)
+		}
+		if want := sessionID + ": 抱歉"; got.Dialog.Extra["audit_response"] != want {
+			t.Errorf("audit_response = %v, want %q", got.Dialog.Extra["audit_response"], want)
+		}
+	}
+	if extra["audit_response"] != "默认回复" || len(p.Dialog.Extra) != 1 {
+		t.Errorf("Extra = %v after marshaling, want it unchanged", p.Dialog.Extra)
+	}
+}
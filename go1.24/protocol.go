@@ -7,6 +7,9 @@ import (
 	"fmt"
 	"io"
 	"math"
+	"strings"
+	"sync"
+	"unicode/utf8"
 
 	"github.com/golang/glog"
 )
@@ -77,7 +80,51 @@ func (t MsgType) String() string {
 	case MsgTypeFrontEndResultServer:
 		return "TtsFrontEndResult"
 	default:
-		return fmt.Sprintf("invalid message type: %d", t)
+		return fmt.Sprintf("Unknown(0x%02X)", uint8(t))
+	}
+}
+
+// MsgTypeFromString returns the message type named s as by MsgType.String,
+// e.g. in a configuration filtering messages. AudioOnlyServer and ServerACK
+// name the same type.
+func MsgTypeFromString(s string) (MsgType, error) {
+	switch s {
+	case "AudioOnlyServer", "ServerACK":
+		return MsgTypeAudioOnlyServer, nil
+	}
+	for t := MsgTypeFullClient; t <= MsgTypeError; t++ {
+		if t.String() == s {
+			return t, nil
+		}
+	}
+	return MsgTypeInvalid, fmt.Errorf("%w: unknown message type %q", errInvalidMessageType, s)
+}
+
+func (s SerializationBits) String() string {
+	switch s {
+	case SerializationRaw:
+		return "Raw"
+	case SerializationJSON:
+		return "JSON"
+	case SerializationThrift:
+		return "Thrift"
+	case SerializationCustom:
+		return "Custom"
+	default:
+		return fmt.Sprintf("invalid serialization: %04b", s>>4)
+	}
+}
+
+func (c CompressionBits) String() string {
+	switch c {
+	case CompressionNone:
+		return "None"
+	case CompressionGzip:
+		return "Gzip"
+	case CompressionCustom:
+		return "Custom"
+	default:
+		return fmt.Sprintf("invalid compression: %04b", c)
 	}
 }
 
@@ -89,6 +136,11 @@ const (
 	MsgTypeFlagLastNoSeq   MsgTypeFlagBits = 0b10  // last packet with no sequence
 	MsgTypeFlagNegativeSeq MsgTypeFlagBits = 0b11  // last packet with sequence < 0
 	MsgTypeFlagWithEvent   MsgTypeFlagBits = 0b100 // Payload contains event number (int32)
+
+	// msgTypeFlagSequenceMask covers the two bits that tell whether a packet
+	// is the last one and whether it carries a sequence number. Unlike the
+	// event bit they form a single enumerated value, not independent flags.
+	msgTypeFlagSequenceMask MsgTypeFlagBits = 0b11
 )
 
 // Values that a VersionBits variable can take.
@@ -254,6 +306,10 @@ type Message struct {
 	// Raw payload (not Gzip compressed). BinaryProtocol.Marshal will do the
 	// compression for you.
 	Payload []byte
+
+	// rawPayloadSize is the payload size before compression, set by
+	// BinaryProtocol.Marshal.
+	rawPayloadSize int
 }
 
 // NewMessage returns a new Message instance of the given message type with the
@@ -288,7 +344,47 @@ func (m *Message) TypeFlag() MsgTypeFlagBits {
 	return MsgTypeFlagBits(m.typeAndFlagBits &^ 0b11110000)
 }
 
-func (m *Message) writers(compress CompressFunc) (writers []writeFunc, _ error) {
+// SetTypeFlag replaces the message type specific flag, e.g. to mark an
+// outgoing packet as the last one with MsgTypeFlagLastNoSeq|MsgTypeFlagWithEvent.
+// BinaryProtocol.Marshal encodes the optional fields the flag announces.
+func (m *Message) SetTypeFlag(flag MsgTypeFlagBits) {
+	m.typeAndFlagBits = m.typeAndFlagBits&0b11110000 | uint8(flag&0b1111)
+}
+
+// messageStringPayload is the number of payload bytes shown by Message.String.
+const messageStringPayload = 64
+
+// String returns a one-line summary of the message for debug output, with the
+// payload truncated to messageStringPayload bytes.
+func (m *Message) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s flag=%04b", m.Type, m.TypeFlag())
+	if ContainsSequence(m.TypeFlag()) {
+		fmt.Fprintf(&sb, " seq=%d", m.Sequence)
+	}
+	if containsEvent(m.TypeFlag()) {
+		fmt.Fprintf(&sb, " event=%d", m.Event)
+	}
+	if m.SessionID != "" {
+		fmt.Fprintf(&sb, " session_id=%s", m.SessionID)
+	}
+	if m.Type == MsgTypeError {
+		fmt.Fprintf(&sb, " error_code=%d", m.ErrorCode)
+	}
+	payload, suffix := m.Payload, ""
+	if len(payload) > messageStringPayload {
+		payload, suffix = payload[:messageStringPayload], "..."
+	}
+	if utf8.Valid(payload) && m.Type != MsgTypeAudioOnlyClient && m.Type != MsgTypeAudioOnlyServer {
+		fmt.Fprintf(&sb, " payload(%d)=%q%s", len(m.Payload), payload, suffix)
+	} else {
+		fmt.Fprintf(&sb, " payload(%d)=%x%s", len(m.Payload), payload, suffix)
+	}
+	return sb.String()
+}
+
+func (m *Message) writers(containsSequence ContainsSequenceFunc, compress CompressFunc) (writers []writeFunc, _ error) {
+	m.rawPayloadSize = len(m.Payload)
 	if compress != nil {
 		payload, err := compress(m.Payload)
 		if err != nil {
@@ -297,6 +393,9 @@ func (m *Message) writers(compress CompressFunc) (writers []writeFunc, _ error)
 		m.Payload = payload
 	}
 
+	if containsSequence == nil {
+		containsSequence = ContainsSequence
+	}
 	if containsSequence(m.TypeFlag()) {
 		writers = append(writers, m.writeSequence)
 		glog.Info("Add Sequence writer.")
@@ -327,7 +426,7 @@ func (m *Message) writeSessionID(buf *bytes.Buffer) error {
 	}
 
 	size := len(m.SessionID)
-	if size > math.MaxUint32 {
+	if uint64(size) > math.MaxUint32 {
 		return fmt.Errorf("payload size (%d) exceeds max(uint32)", size)
 	}
 	if err := binary.Write(buf, binary.BigEndian, uint32(size)); err != nil {
@@ -353,7 +452,7 @@ func (m *Message) writeErrorCode(buf *bytes.Buffer) error {
 
 func (m *Message) writePayload(buf *bytes.Buffer) error {
 	size := len(m.Payload)
-	if size > math.MaxUint32 {
+	if uint64(size) > math.MaxUint32 {
 		return fmt.Errorf("payload size (%d) exceeds max(uint32)", size)
 	}
 	if err := binary.Write(buf, binary.BigEndian, uint32(size)); err != nil {
@@ -367,6 +466,10 @@ func (m *Message) readers(containsSequence ContainsSequenceFunc) (readers []read
 
 	switch m.Type {
 	case MsgTypeFullClient, MsgTypeFullServer, MsgTypeFrontEndResultServer:
+		if containsSequence != nil && containsSequence(m.TypeFlag()) {
+			readers = append(readers, m.readSequence)
+			glog.V(1).Info("Full message: add Sequence reader.")
+		}
 
 	case MsgTypeAudioOnlyClient:
 		if containsSequence == nil || containsSequence(m.TypeFlag()) {
@@ -482,18 +585,16 @@ func (m *Message) readPayload(buf *bytes.Buffer) error {
 // ContainsSequence reports whether a message type specific flag indicates
 // messages with this kind of flag contain a sequence number in its serialized
 // value. This determiner function should be used for common binary protocol.
+// The event bit does not affect the result.
 func ContainsSequence(bits MsgTypeFlagBits) bool {
-	return bits&MsgTypeFlagPositiveSeq == MsgTypeFlagPositiveSeq || bits&MsgTypeFlagNegativeSeq == MsgTypeFlagNegativeSeq
+	seq := bits & msgTypeFlagSequenceMask
+	return seq == MsgTypeFlagPositiveSeq || seq == MsgTypeFlagNegativeSeq
 }
 
 func containsEvent(bits MsgTypeFlagBits) bool {
 	return bits&MsgTypeFlagWithEvent == MsgTypeFlagWithEvent
 }
 
-func containsSequence(bits MsgTypeFlagBits) bool {
-	return bits&MsgTypeFlagPositiveSeq == MsgTypeFlagPositiveSeq || bits&MsgTypeFlagNegativeSeq == MsgTypeFlagNegativeSeq
-}
-
 // BinaryProtocol implements the binary protocol serialization and deserialization
 // used in Lab-Speech MDD, TTS, ASR, etc. services. For more details, read:
 // https://bytedance.feishu.cn/docs/doccnT0t71J4LCQCS0cnB4Eca8D
@@ -503,11 +604,18 @@ type BinaryProtocol struct {
 
 	containsSequence ContainsSequenceFunc
 	compress         CompressFunc
+
+	// buffers holds the bytes.Buffers reused by Marshal and MarshalTo. It is
+	// shared with the copies of the protocol, which marshalMessage makes per
+	// message.
+	buffers *sync.Pool
 }
 
 // NewBinaryProtocol returns a new BinaryProtocol instance.
 func NewBinaryProtocol() *BinaryProtocol {
-	return new(BinaryProtocol)
+	return &BinaryProtocol{
+		buffers: &sync.Pool{New: func() any { return new(bytes.Buffer) }},
+	}
 }
 
 // Clone returns a clone of current BinaryProtocol
@@ -517,6 +625,7 @@ func (p *BinaryProtocol) Clone() *BinaryProtocol {
 	clonedBinaryProtocal.serializationAndCompression = p.serializationAndCompression
 	clonedBinaryProtocal.containsSequence = p.containsSequence
 	clonedBinaryProtocal.compress = p.compress
+	clonedBinaryProtocal.buffers = p.buffers
 	return clonedBinaryProtocal
 }
 
@@ -526,6 +635,14 @@ func (p *BinaryProtocol) SetVersion(v VersionBits) {
 	p.versionAndHeaderSize = (p.versionAndHeaderSize &^ 0b11110000) + uint8(v)
 }
 
+// String returns a summary of the protocol configuration for debug output,
+// e.g. "Version:1 HeaderSize:4 Serialization:JSON Compression:None
+// ContainsSequence:true".
+func (p *BinaryProtocol) String() string {
+	return fmt.Sprintf("Version:%d HeaderSize:%d Serialization:%s Compression:%s ContainsSequence:%t",
+		p.Version(), p.HeaderSize(), p.Serialization(), p.Compression(), p.containsSequence != nil)
+}
+
 // Version returns the integral version value.
 func (p *BinaryProtocol) Version() int {
 	return int(p.versionAndHeaderSize >> 4)
@@ -567,21 +684,41 @@ func (p *BinaryProtocol) Compression() CompressionBits {
 
 // Marshal serializes the message to a sequence of binary data.
 func (p *BinaryProtocol) Marshal(msg *Message) ([]byte, error) {
-	buf := new(bytes.Buffer)
+	var frame []byte
+	err := p.MarshalTo(msg, func(b []byte) error {
+		// The frame must not alias the buffer, which goes back to the pool.
+		frame = bytes.Clone(b)
+		return nil
+	})
+	return frame, err
+}
+
+// MarshalTo serializes the message into a pooled buffer and calls f with the
+// frame, returning the error of f. The frame is only valid until f returns,
+// which saves the copy Marshal makes for callers sending it right away.
+func (p *BinaryProtocol) MarshalTo(msg *Message, f func(frame []byte) error) error {
+	var buf *bytes.Buffer
+	if p.buffers != nil {
+		buf = p.buffers.Get().(*bytes.Buffer)
+		buf.Reset()
+		defer p.buffers.Put(buf)
+	} else {
+		buf = new(bytes.Buffer)
+	}
 	if err := p.writeHeader(buf, msg); err != nil {
-		return nil, fmt.Errorf("write header: %w", err)
+		return fmt.Errorf("write header: %w", err)
 	}
 
-	writers, err := msg.writers(p.compress)
+	writers, err := msg.writers(p.containsSequence, p.compress)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	for _, write := range writers {
 		if err := write(buf); err != nil {
-			return nil, err
+			return err
 		}
 	}
-	return buf.Bytes(), nil
+	return f(buf.Bytes())
 }
 
 func (p *BinaryProtocol) writeHeader(buf *bytes.Buffer, msg *Message) error {
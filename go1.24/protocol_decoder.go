@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// maxDecodedFieldSize bounds the size fields DecodeFrom allocates for and
+// IncrementalDecoder buffers, so that a corrupt length does not allocate
+// gigabytes before the read fails.
+const maxDecodedFieldSize = 64 << 20
+
+var errFieldTooLarge = errors.New("field size exceeds limit")
+
+// IncrementalDecoder decodes binary protocol frames from a byte stream that may
+// split or join frames arbitrarily, e.g. data read from an io.Reader instead of
+// one websocket message at a time. It is not safe for concurrent use.
+type IncrementalDecoder struct {
+	containsSequence ContainsSequenceFunc
+	buf              []byte
+	msgs             []*Message
+}
+
+// NewIncrementalDecoder returns a decoder using the sequence rules of p.
+func (p *BinaryProtocol) NewIncrementalDecoder() *IncrementalDecoder {
+	return &IncrementalDecoder{containsSequence: p.containsSequence}
+}
+
+// Write buffers data and decodes every frame completed by it. It always
+// consumes all of data; an error means the stream is corrupt and the decoder
+// must not be used any more.
+func (d *IncrementalDecoder) Write(data []byte) (int, error) {
+	d.buf = append(d.buf, data...)
+	for {
+		size, ok, err := frameSize(d.buf, d.containsSequence)
+		if err != nil {
+			return len(data), err
+		}
+		if !ok {
+			return len(data), nil
+		}
+		// Unmarshal keeps references into the frame, so hand it its own copy.
+		frame := append([]byte(nil), d.buf[:size]...)
+		msg, _, err := Unmarshal(frame, d.containsSequence)
+		if err != nil {
+			return len(data), err
+		}
+		d.msgs = append(d.msgs, msg)
+		d.buf = d.buf[size:]
+	}
+}
+
+// Next returns the next decoded message, or false if no complete frame has
+// been written yet.
+func (d *IncrementalDecoder) Next() (*Message, bool) {
+	if len(d.msgs) == 0 {
+		return nil, false
+	}
+	msg := d.msgs[0]
+	d.msgs[0] = nil
+	d.msgs = d.msgs[1:]
+	return msg, true
+}
+
+// Buffered returns the number of bytes of the incomplete frame held back.
+func (d *IncrementalDecoder) Buffered() int {
+	return len(d.buf)
+}
+
+// frameSize returns the length of the frame at the start of data, or false if
+// data does not hold the whole frame yet. The field layout mirrors
+// Message.readers.
+func frameSize(data []byte, containsSequence ContainsSequenceFunc) (int, bool, error) {
+	if len(data) < 2 {
+		return 0, false, nil
+	}
+	headerSize := 4 * int(data[0]&0b1111)
+	if headerSize < 4 {
+		return 0, false, fmt.Errorf("%w: header size %d", errNoEnoughHeaderBytes, headerSize)
+	}
+	msg, err := NewMessageFromByte(data[1])
+	if err != nil {
+		return 0, false, err
+	}
+	flag := msg.TypeFlag()
+
+	pos := headerSize
+	// uint32 returns the big endian value at pos and advances pos past it.
+	uint32At := func() (uint32, bool) {
+		if len(data) < pos+4 {
+			return 0, false
+		}
+		v := binary.BigEndian.Uint32(data[pos:])
+		pos += 4
+		return v, true
+	}
+	// skipSized skips a field prefixed with its uint32 length.
+	skipSized := func() (bool, error) {
+		size, ok := uint32At()
+		if !ok {
+			return false, nil
+		}
+		if size > maxDecodedFieldSize {
+			return false, fmt.Errorf("%w: %d bytes", errFieldTooLarge, size)
+		}
+		pos += int(size)
+		return true, nil
+	}
+
+	switch msg.Type {
+	case MsgTypeAudioOnlyClient:
+		if containsSequence == nil || containsSequence(flag) {
+			pos += 4
+		}
+	case MsgTypeError:
+		pos += 4
+	default:
+		if containsSequence != nil && containsSequence(flag) {
+			pos += 4
+		}
+	}
+
+	if containsEvent(flag) {
+		event, ok := uint32At()
+		if !ok {
+			return 0, false, nil
+		}
+		switch int32(event) {
+		case 1, 2, 50, 51, 52:
+		default:
+			if ok, err := skipSized(); !ok {
+				return 0, false, err
+			}
+		}
+		switch int32(event) {
+		case 50, 51, 52:
+			if ok, err := skipSized(); !ok {
+				return 0, false, err
+			}
+		}
+	}
+
+	if ok, err := skipSized(); !ok || len(data) < pos {
+		return 0, false, err
+	}
+	return pos, true, nil
+}
+
+// DecodeFrom reads exactly one frame from r and decodes it: the header first,
+// then each field with its length, reading the payload straight into the
+// message. Unlike Unmarshal it needs no buffer holding the whole frame, e.g.
+// reading from the io.Reader of websocket.Conn.NextReader. The field layout
+// mirrors Message.readers. Like the receive loop, and unlike Unmarshal, it
+// returns the payload decompressed. It returns io.EOF if r ends before a new
+// frame.
+func (p *BinaryProtocol) DecodeFrom(r io.Reader) (*Message, error) {
+	var fixed [3]byte
+	if _, err := io.ReadFull(r, fixed[:]); err != nil {
+		if err == io.EOF {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w: %v", errNoEnoughHeaderBytes, err)
+	}
+	prot := &BinaryProtocol{versionAndHeaderSize: fixed[0], serializationAndCompression: fixed[2]}
+	if prot.HeaderSize() < 4 {
+		return nil, fmt.Errorf("%w: header size %d", errNoEnoughHeaderBytes, prot.HeaderSize())
+	}
+	msg, err := NewMessageFromByte(fixed[1])
+	if err != nil {
+		return nil, err
+	}
+	if !serializations[prot.Serialization()] {
+		return nil, fmt.Errorf("%w: %b", errInvalidSerialization, prot.Serialization())
+	}
+	if !compressions[prot.Compression()] {
+		return nil, fmt.Errorf("%w: %b", errInvalidCompression, prot.Compression())
+	}
+	if _, err := io.CopyN(io.Discard, r, int64(prot.HeaderSize()-len(fixed))); err != nil {
+		return nil, fmt.Errorf("%w: %v", errNoEnoughHeaderBytes, err)
+	}
+
+	flag := msg.TypeFlag()
+	switch {
+	case msg.Type == MsgTypeError:
+		if err := binary.Read(r, binary.BigEndian, &msg.ErrorCode); err != nil {
+			return nil, fmt.Errorf("%w: %v", errReadErrorCode, err)
+		}
+	case msg.Type == MsgTypeAudioOnlyClient && p.containsSequence == nil,
+		p.containsSequence != nil && p.containsSequence(flag):
+		if err := binary.Read(r, binary.BigEndian, &msg.Sequence); err != nil {
+			return nil, fmt.Errorf("%w: %v", errReadSequence, err)
+		}
+	}
+
+	if containsEvent(flag) {
+		if err := binary.Read(r, binary.BigEndian, &msg.Event); err != nil {
+			return nil, fmt.Errorf("%w: %v", errReadEvent, err)
+		}
+		switch msg.Event {
+		case 1, 2, 50, 51, 52:
+		default:
+			id, err := readSized(r, errReadSessionIDSize)
+			if err != nil {
+				return nil, err
+			}
+			msg.SessionID = string(id)
+		}
+		switch msg.Event {
+		case 50, 51, 52:
+			id, err := readSized(r, errReadConnectIDSize)
+			if err != nil {
+				return nil, err
+			}
+			msg.ConnectID = string(id)
+		}
+	}
+
+	if msg.Payload, err = readSized(r, errReadPayloadSize); err != nil {
+		return nil, err
+	}
+	if msg.Payload, err = decompressPayload(prot.Compression(), msg.Payload); err != nil {
+		return nil, fmt.Errorf("decompress payload: %w", err)
+	}
+	return msg, nil
+}
+
+// readSized reads a field prefixed with its uint32 length; errSize tells which
+// field failed.
+func readSized(r io.Reader, errSize error) ([]byte, error) {
+	var size uint32
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return nil, fmt.Errorf("%w: %v", errSize, err)
+	}
+	if size > maxDecodedFieldSize {
+		return nil, fmt.Errorf("%w: %v: %d bytes", errSize, errFieldTooLarge, size)
+	}
+	if size == 0 {
+		return nil, nil
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, fmt.Errorf("%w: %v", errSize, err)
+	}
+	return data, nil
+}
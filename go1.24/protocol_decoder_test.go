@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"testing"
+)
+
+// TestIncrementalDecoder feeds frames split at every byte and joined together.
+func TestIncrementalDecoder(t *testing.T) {
+	frames := [][]byte{
+		serverFrame(50, "conn-1", `{}`),
+		serverFrame(150, "session-1", `{"dialog_id":"d"}`),
+		serverAudio("session-1", []float32{0.5, -0.5}),
+		serverError(codeQuotaExceeded, `{"error":"quota"}`),
+	}
+	var stream []byte
+	for _, f := range frames {
+		stream = append(stream, f...)
+	}
+	d := protocol.NewIncrementalDecoder()
+	for i := range stream {
+		if _, err := d.Write(stream[i : i+1]); err != nil {
+			t.Fatalf("Write() at byte %d = %v", i, err)
+		}
+	}
+	for _, want := range []int32{50, 150, 352} {
+		msg, ok := d.Next()
+		if !ok || msg.Event != want {
+			t.Fatalf("Next() = %v, %v, want event %d", msg, ok, want)
+		}
+	}
+	if msg, ok := d.Next(); !ok || msg.ErrorCode != codeQuotaExceeded {
+		t.Errorf("Next() = %v, %v, want the error frame", msg, ok)
+	}
+	if d.Buffered() != 0 {
+		t.Errorf("Buffered() = %d, want 0", d.Buffered())
+	}
+}
+
+// TestIncrementalDecoderFieldLimit checks that a corrupt length prefix fails
+// at once instead of buffering until the announced size arrives.
+func TestIncrementalDecoderFieldLimit(t *testing.T) {
+	frame := serverFrame(150, "session-1", `{}`)
+	binary.BigEndian.PutUint32(frame[8:], maxDecodedFieldSize+1) // session ID size
+	d := protocol.NewIncrementalDecoder()
+	if _, err := d.Write(frame); !errors.Is(err, errFieldTooLarge) {
+		t.Errorf("Write() = %v, want errFieldTooLarge", err)
+	}
+}
+
+// TestDecodeFrom decodes a stream of frames, one of them gzipped, through a
+// bufio.Reader until it ends.
+func TestDecodeFrom(t *testing.T) {
+	compressed, err := gzipCompressor(gzip.DefaultCompression)([]byte(`{"content":"晴天"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gzipped := serverFrame(550, "session-1", "")
+	gzipped[2] |= uint8(CompressionGzip)
+	gzipped = appendSized(gzipped[:len(gzipped)-4], compressed)
+
+	var stream bytes.Buffer
+	for _, f := range [][]byte{
+		serverFrame(50, "conn-1", `{}`),
+		serverFrame(150, "session-1", `{"dialog_id":"d"}`),
+		gzipped,
+		serverAudio("session-1", []float32{0.5, -0.5}),
+		serverError(codeQuotaExceeded, `{"error":"quota"}`),
+	} {
+		stream.Write(f)
+	}
+	r := bufio.NewReader(&stream)
+	p := NewBinaryProtocol()
+	p.containsSequence = ContainsSequence
+	var got []string
+	for {
+		msg, err := p.DecodeFrom(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("DecodeFrom() after %q = %v", got, err)
+		}
+		got = append(got, fmt.Sprintf("%d %s%s %s %d", msg.Event, msg.ConnectID, msg.SessionID, msg.Payload, msg.ErrorCode))
+	}
+	want := []string{
+		`50 conn-1 {} 0`,
+		`150 session-1 {"dialog_id":"d"} 0`,
+		`550 session-1 {"content":"晴天"} 0`,
+		"352 session-1 " + string(float32Bytes(0.5, -0.5)) + " 0",
+		`0  {"error":"quota"} 45000292`,
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("DecodeFrom() decoded %q, want %q", got, want)
+	}
+}
+
+// TestDecodeFromTruncated checks that a stream ending within a frame is an
+// error rather than io.EOF.
+func TestDecodeFromTruncated(t *testing.T) {
+	frame := serverFrame(150, "session-1", `{}`)
+	r := bufio.NewReader(bytes.NewReader(frame[:len(frame)-1]))
+	if _, err := NewBinaryProtocol().DecodeFrom(r); err == nil || err == io.EOF {
+		t.Errorf("DecodeFrom() of a truncated frame = %v, want an error", err)
+	}
+}
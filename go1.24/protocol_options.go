@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+var (
+	errInvalidVersion           = errors.New("invalid protocol version")
+	errUnsupportedSerialization = errors.New("unsupported serialization")
+)
+
+// serverVersion is the protocol version of the last frame received.
+var serverVersion atomic.Int32
+
+// WithProtocolVersion sets the protocol version written in the header of every
+// frame, from 1 to 4, e.g. to test a server version during its rollout. The
+// version the server answers with is logged once the connection started.
+func WithProtocolVersion(v int) error {
+	if v < 1 || v > 4 {
+		return fmt.Errorf("%w: %d, want 1 to 4", errInvalidVersion, v)
+	}
+	protocol.SetVersion(VersionBits(v << 4))
+	return nil
+}
+
+// parseSerialization parses the -serialization flag. Requests other than
+// audio are marshaled with encoding/json by marshalMessage, so JSON is the only
+// serialization; protobuf and msgpack are recognized but rejected, Thrift has
+// header bits but no encoder here.
+func parseSerialization(s string) (SerializationBits, error) {
+	switch s {
+	case "json":
+		return SerializationJSON, nil
+	case "protobuf", "msgpack":
+		return SerializationJSON, fmt.Errorf("%w: %s, the requests are encoded as JSON", errUnsupportedSerialization, s)
+	default:
+		return SerializationJSON, fmt.Errorf("%w: %q, want json", errUnsupportedSerialization, s)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// TestTypeFlagRoundTrip checks that every combination of the sequence and
+// event flags is encoded in the header and decoded back with its fields.
+func TestTypeFlagRoundTrip(t *testing.T) {
+	for _, seq := range []MsgTypeFlagBits{MsgTypeFlagNoSeq, MsgTypeFlagPositiveSeq, MsgTypeFlagLastNoSeq, MsgTypeFlagNegativeSeq} {
+		for _, event := range []MsgTypeFlagBits{0, MsgTypeFlagWithEvent} {
+			flag := seq | event
+			msg, err := NewMessage(MsgTypeAudioOnlyClient, flag)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ContainsSequence(flag) {
+				msg.Sequence = 7
+				if seq == MsgTypeFlagNegativeSeq {
+					msg.Sequence = -7
+				}
+			}
+			if containsEvent(flag) {
+				msg.Event = 200
+				msg.SessionID = "session-1"
+			}
+			msg.Payload = []byte{1, 2, 3}
+
+			frame, err := protocol.Marshal(msg)
+			if err != nil {
+				t.Fatalf("flag %04b: Marshal() = %v", flag, err)
+			}
+			if got := MsgTypeFlagBits(frame[1] & 0b1111); got != flag {
+				t.Errorf("flag %04b: header carries %04b", flag, got)
+			}
+			got, _, err := Unmarshal(frame, ContainsSequence)
+			if err != nil {
+				t.Fatalf("flag %04b: Unmarshal() = %v", flag, err)
+			}
+			if got.TypeFlag() != flag || got.Sequence != msg.Sequence || got.Event != msg.Event ||
+				got.SessionID != msg.SessionID || !bytes.Equal(got.Payload, msg.Payload) {
+				t.Errorf("flag %04b: decoded %v, want %v", flag, got, msg)
+			}
+		}
+	}
+}
+
+func TestContainsSequence(t *testing.T) {
+	for flag, want := range map[MsgTypeFlagBits]bool{
+		MsgTypeFlagNoSeq:                              false,
+		MsgTypeFlagPositiveSeq:                        true,
+		MsgTypeFlagLastNoSeq:                          false,
+		MsgTypeFlagNegativeSeq:                        true,
+		MsgTypeFlagWithEvent:                          false,
+		MsgTypeFlagPositiveSeq | MsgTypeFlagWithEvent: true,
+		MsgTypeFlagLastNoSeq | MsgTypeFlagWithEvent:   false,
+		MsgTypeFlagNegativeSeq | MsgTypeFlagWithEvent: true,
+	} {
+		if got := ContainsSequence(flag); got != want {
+			t.Errorf("ContainsSequence(%04b) = %v, want %v", flag, got, want)
+		}
+	}
+}
+
+// TestMarshalTo checks that MarshalTo hands f the frame Marshal returns.
+func TestMarshalTo(t *testing.T) {
+	msg := benchmarkAudioMessage(t)
+	want, err := protocol.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = protocol.MarshalTo(msg, func(frame []byte) error {
+		if !bytes.Equal(frame, want) {
+			t.Errorf("MarshalTo() frame = % x, want % x", frame, want)
+		}
+		return errors.New("sent")
+	})
+	if err == nil || err.Error() != "sent" {
+		t.Errorf("MarshalTo() = %v, want the error of f", err)
+	}
+}
+
+// BenchmarkMarshal marshals a 100ms audio frame without the buffer pool, as
+// before it was added, with the pool and with the pool through MarshalTo,
+// which the audio send path uses.
+func BenchmarkMarshal(b *testing.B) {
+	msg := benchmarkAudioMessage(b)
+	unpooled := *protocol
+	unpooled.buffers = nil
+	for _, bm := range []struct {
+		name    string
+		marshal func() error
+	}{
+		{"unpooled", func() error { _, err := unpooled.Marshal(msg); return err }},
+		{"pooled", func() error { _, err := protocol.Marshal(msg); return err }},
+		{"MarshalTo", func() error { return protocol.MarshalTo(msg, func([]byte) error { return nil }) }},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for b.Loop() {
+				if err := bm.marshal(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func benchmarkAudioMessage(tb testing.TB) *Message {
+	msg, err := NewMessage(MsgTypeAudioOnlyClient, MsgTypeFlagWithEvent)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	msg.Event = 200
+	msg.SessionID = "session-1"
+	msg.Payload = make([]byte, 3200)
+	return msg
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ThrottledQueryChan carries the activity signals restarting the idle timer.
+// Bursts of signals, e.g. a run of intermediate ASR results, are collapsed:
+// within MinSignalInterval of the last delivered signal further signals are
+// discarded, and only the most recent of them is delivered once the interval
+// has passed. Signal never blocks.
+type ThrottledQueryChan struct {
+	C                 chan struct{}
+	MinSignalInterval time.Duration
+
+	lock      sync.Mutex
+	last      time.Time
+	scheduled bool
+	dropped   atomic.Uint64
+}
+
+// NewThrottledQueryChan returns a ThrottledQueryChan buffering size signals.
+func NewThrottledQueryChan(size int, interval time.Duration) *ThrottledQueryChan {
+	return &ThrottledQueryChan{C: make(chan struct{}, size), MinSignalInterval: interval}
+}
+
+// Signal sends a signal on q.C, or defers it to the end of the interval.
+func (q *ThrottledQueryChan) Signal() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	wait := q.MinSignalInterval - time.Since(q.last)
+	switch {
+	case wait <= 0:
+		q.deliver()
+	case q.scheduled:
+		// 间隔内的信号只保留最新的一个，由已安排的发送代表
+		q.dropped.Add(1)
+	default:
+		q.scheduled = true
+		time.AfterFunc(wait, func() {
+			q.lock.Lock()
+			defer q.lock.Unlock()
+			q.scheduled = false
+			q.deliver()
+		})
+	}
+}
+
+// deliver sends a signal without blocking. q.lock must be held.
+func (q *ThrottledQueryChan) deliver() {
+	q.last = time.Now()
+	select {
+	case q.C <- struct{}{}:
+	default:
+		q.dropped.Add(1)
+	}
+}
+
+// Dropped returns how many signals were discarded.
+func (q *ThrottledQueryChan) Dropped() uint64 {
+	return q.dropped.Load()
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"math/rand"
+	"sync"
+)
+
+// All randomness of the client comes from rng, so that a run can be replayed
+// with the seed it logged at startup.
+var (
+	rngLock sync.Mutex
+	rng     = rand.New(rand.NewSource(randomSeed()))
+)
+
+// WithRand makes the client draw its randomness from r.
+func WithRand(r *rand.Rand) {
+	rngLock.Lock()
+	defer rngLock.Unlock()
+	rng = r
+}
+
+// WithSeed seeds the randomness of the client with seed.
+func WithSeed(seed int64) {
+	WithRand(rand.New(rand.NewSource(seed)))
+}
+
+// randomSeed returns a nonzero seed read from crypto/rand.
+func randomSeed() int64 {
+	var b [8]byte
+	if _, err := crand.Read(b[:]); err != nil {
+		panic(err) // crypto/rand does not fail on supported platforms
+	}
+	seed := int64(binary.LittleEndian.Uint64(b[:]) >> 1)
+	if seed == 0 {
+		seed = 1
+	}
+	return seed
+}
+
+// randIntn returns a random int in [0, n) from rng.
+func randIntn(n int) int {
+	rngLock.Lock()
+	defer rngLock.Unlock()
+	return rng.Intn(n)
+}
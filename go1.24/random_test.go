@@ -0,0 +1,64 @@
+package main
+
+import (
+	"math/rand"
+	"slices"
+	"testing"
+)
+
+// draws returns n draws of randIntn(1000).
+func draws(n int) []int {
+	values := make([]int, n)
+	for i := range values {
+		values[i] = randIntn(1000)
+	}
+	return values
+}
+
+// TestWithSeed checks that a run seeded with the seed it logged draws the
+// same numbers again, the ones of a rand.Rand with that seed.
+func TestWithSeed(t *testing.T) {
+	t.Cleanup(func() { WithSeed(randomSeed()) })
+	seed := randomSeed()
+	WithSeed(seed)
+	first := draws(50)
+	WithSeed(seed)
+	if replay := draws(50); !slices.Equal(replay, first) {
+		t.Errorf("seed %d drew %v, then %v", seed, first, replay)
+	}
+	r := rand.New(rand.NewSource(seed))
+	for i, got := range first {
+		if want := r.Intn(1000); got != want {
+			t.Fatalf("draw %d of seed %d = %d, want %d", i, seed, got, want)
+		}
+	}
+	WithSeed(seed + 1)
+	if other := draws(50); slices.Equal(other, first) {
+		t.Errorf("seeds %d and %d drew the same numbers", seed, seed+1)
+	}
+}
+
+// TestWithRand checks that WithRand replaces the source of randomness.
+func TestWithRand(t *testing.T) {
+	t.Cleanup(func() { WithSeed(randomSeed()) })
+	r := rand.New(rand.NewSource(3))
+	want := rand.New(rand.NewSource(3)).Intn(1000)
+	WithRand(r)
+	if got := randIntn(1000); got != want {
+		t.Errorf("randIntn() = %d, want %d from the rand.Rand set", got, want)
+	}
+}
+
+func TestRandomSeed(t *testing.T) {
+	seeds := map[int64]bool{}
+	for range 10 {
+		seed := randomSeed()
+		if seed <= 0 {
+			t.Errorf("randomSeed() = %d, want a positive seed", seed)
+		}
+		seeds[seed] = true
+	}
+	if len(seeds) < 10 {
+		t.Errorf("randomSeed() repeated itself in 10 calls: %v", seeds)
+	}
+}
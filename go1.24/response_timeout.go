@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/gorilla/websocket"
+)
+
+// ResponseTimeoutAction selects what happens when the bot does not start
+// answering a finished user query within the first response timeout.
+type ResponseTimeoutAction int
+
+// Values that a ResponseTimeoutAction variable can take.
+const (
+	// ResponseTimeoutNotify only calls EventHandlers.OnResponseTimeout.
+	ResponseTimeoutNotify ResponseTimeoutAction = iota
+	// ResponseTimeoutResend sends the recognized user text again as a text
+	// query, once per turn.
+	ResponseTimeoutResend
+)
+
+func (a ResponseTimeoutAction) String() string {
+	switch a {
+	case ResponseTimeoutNotify:
+		return "notify"
+	case ResponseTimeoutResend:
+		return "resend"
+	default:
+		return fmt.Sprintf("ResponseTimeoutAction(%d)", int(a))
+	}
+}
+
+// parseResponseTimeoutAction parses the names returned by
+// ResponseTimeoutAction.String.
+func parseResponseTimeoutAction(s string) (ResponseTimeoutAction, error) {
+	for _, a := range []ResponseTimeoutAction{ResponseTimeoutNotify, ResponseTimeoutResend} {
+		if a.String() == s {
+			return a, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown response timeout action %q, want notify or resend", s)
+}
+
+var (
+	firstResponseTimeout  time.Duration
+	responseTimeoutAction = ResponseTimeoutNotify
+)
+
+// WithFirstResponseTimeout applies action when the bot does not start its
+// answer within timeout of the end of a user query. Unlike the idle timeout it
+// catches a single stuck turn while the dialog is otherwise busy. A timeout of
+// 0, the default, disables it.
+func WithFirstResponseTimeout(timeout time.Duration, action ResponseTimeoutAction) {
+	firstResponseTimeout = timeout
+	responseTimeoutAction = action
+}
+
+// responseWatch times the bot response to the current user query.
+type responseWatch struct {
+	lock  sync.Mutex
+	timer *time.Timer
+	// gen counts the queries timed and the stops, so that a timer firing
+	// late or a resend finishing after stop does not act on a query already
+	// answered.
+	gen uint64
+}
+
+var responseWait = &responseWatch{}
+
+// queryEnded starts timing the response to the user query of the current
+// turn, which just ended.
+func (w *responseWatch) queryEnded(conn *websocket.Conn, sessionID string) {
+	if firstResponseTimeout <= 0 {
+		return
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+	w.gen++
+	gen := w.gen
+	turnID := turns.currentID()
+	resent := false
+	var fire func()
+	fire = func() {
+		if !w.current(gen) {
+			return
+		}
+		glog.Warningf("No response to turn %d within %s, response timeout action: %s", turnID, firstResponseTimeout, responseTimeoutAction)
+		journal.Record(JournalDiagnostic, 0, sessionID, fmt.Sprintf("response timeout of turn %d: %s", turnID, responseTimeoutAction))
+		if eventHandlers.OnResponseTimeout != nil {
+			eventHandlers.OnResponseTimeout(turnID)
+		}
+		text := turns.currentUserText()
+		if responseTimeoutAction != ResponseTimeoutResend || resent || text == "" {
+			return
+		}
+		resent = true
+		if err := chatTextQuery(conn, sessionID, &ChatTextQueryPayload{Content: text}); err != nil {
+			glog.Errorf("Resend user query error: %v", err)
+			return
+		}
+		w.lock.Lock()
+		defer w.lock.Unlock()
+		// 重发期间机器人可能已开始回答，stop 之后不再重新计时
+		if w.gen == gen {
+			w.timer = time.AfterFunc(firstResponseTimeout, fire)
+		}
+	}
+	w.timer = time.AfterFunc(firstResponseTimeout, fire)
+}
+
+// current reports whether gen is still the query being timed.
+func (w *responseWatch) current(gen uint64) bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.gen == gen
+}
+
+// stop ends the timing, because the bot started answering or the user spoke
+// again.
+func (w *responseWatch) stop() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.gen++
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestResponseTimeoutResend stalls the server after a user query and checks
+// that the timeout is reported once, recorded as a diagnostic and the query
+// resent, and that the answer to the resent query stops the timing.
+func TestResponseTimeoutResend(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+	resent := make(chan string, 1)
+	s := newFakeServer(t, scriptedDialog(func(c *fakeConn, sid string) {
+		c.answer(sid, "你好", 2400)
+		c.userTurn(sid, "今天天气怎么样")
+		// 不回答，等客户端超时后重发
+		msg := c.expect(501)
+		if msg == nil {
+			return
+		}
+		resent <- string(msg.Payload)
+		c.answer(sid, "晴天", 2400)
+		time.Sleep(5 * timeout)
+	}))
+	setupDialog(t, s)
+	WithFirstResponseTimeout(timeout, ResponseTimeoutResend)
+	var lock sync.Mutex
+	var timeouts []int
+	eventHandlers.OnResponseTimeout = func(turnID int) {
+		lock.Lock()
+		defer lock.Unlock()
+		timeouts = append(timeouts, turnID)
+	}
+	t.Cleanup(func() {
+		WithFirstResponseTimeout(0, ResponseTimeoutNotify)
+		eventHandlers = EventHandlers{}
+	})
+
+	if _, err := runFakeDialog(t); err == nil {
+		t.Error("realTimeDialog() = nil, want the server ending the session")
+	}
+	select {
+	case payload := <-resent:
+		if !strings.Contains(payload, "今天天气怎么样") {
+			t.Errorf("resent query %s, want the user text", payload)
+		}
+	default:
+		t.Fatal("the user query was not resent")
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if len(timeouts) != 1 || timeouts[0] != 2 {
+		t.Errorf("OnResponseTimeout got turns %v, want [2]", timeouts)
+	}
+	var diagnostics int
+	for _, e := range journal.Entries() {
+		if strings.HasPrefix(e.Detail, "response timeout") {
+			if e.Kind != JournalDiagnostic {
+				t.Errorf("response timeout journaled as %s, want %s", e.Kind, JournalDiagnostic)
+			}
+			diagnostics++
+		}
+	}
+	if diagnostics != 1 {
+		t.Errorf("journal has %d response timeouts, want 1", diagnostics)
+	}
+}
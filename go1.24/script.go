@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+// scriptTrailingSilence is the silence sent after the audio of a scripted
+// user turn so that the server detects the end of the utterance.
+const scriptTrailingSilence = 2 * time.Second
+
+// A conversation script has one user turn per line:
+//
+//	# comment
+//	text: 明天北京天气怎么样 => audio, contains=天气
+//	audio: whoareyou.wav => audio
+//	text: 不能回答的问题 => audit
+//
+// Left of "=>" is the turn, a text query or the path of a PCM S16LE or WAV
+// file spoken as the user. Right of it are the comma separated expectations
+// on the bot answer:
+//
+//	audio          the answer is spoken
+//	text           the answer has text
+//	audit          the answer is the audit response
+//	no-audit       the answer is not the audit response
+//	contains=s     the answer text contains s
+//	max-latency=d  the answer audio starts within the duration d, e.g. 1.5s,
+//	               after the user turn ended
+
+// ScriptStep is one scripted user turn.
+type ScriptStep struct {
+	Line   int
+	Text   string // text query, or
+	Audio  string // path of the audio spoken as the user turn
+	Expect []string
+}
+
+func (s ScriptStep) String() string {
+	if s.Audio != "" {
+		return "audio " + s.Audio
+	}
+	return fmt.Sprintf("text %q", s.Text)
+}
+
+// ScriptResult is the outcome of one step; Err is nil if it passed.
+type ScriptResult struct {
+	Step  ScriptStep
+	Reply *AskReply
+	Err   error
+}
+
+// ScriptReport holds the results of a script run in script order. Steps not
+// run because an earlier step broke the session are missing.
+type ScriptReport struct {
+	Steps   int
+	Results []ScriptResult
+}
+
+// Passed reports whether every step ran and passed.
+func (r *ScriptReport) Passed() bool {
+	if len(r.Results) != r.Steps {
+		return false
+	}
+	for _, res := range r.Results {
+		if res.Err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// Print writes one PASS or FAIL line per step and a summary.
+func (r *ScriptReport) Print(w io.Writer) {
+	var passed int
+	for _, res := range r.Results {
+		if res.Err != nil {
+			fmt.Fprintf(w, "FAIL line %d: %v: %v\n", res.Step.Line, res.Step, res.Err)
+			continue
+		}
+		passed++
+		fmt.Fprintf(w, "PASS line %d: %v\n", res.Step.Line, res.Step)
+	}
+	fmt.Fprintf(w, "%d of %d steps passed", passed, r.Steps)
+	if skipped := r.Steps - len(r.Results); skipped > 0 {
+		fmt.Fprintf(w, ", %d not run", skipped)
+	}
+	fmt.Fprintln(w)
+}
+
+// parseScript reads a conversation script.
+func parseScript(r io.Reader) ([]ScriptStep, error) {
+	var steps []ScriptStep
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		turn, expect, _ := strings.Cut(line, "=>")
+		kind, value, ok := strings.Cut(turn, ":")
+		value = strings.TrimSpace(value)
+		if !ok || value == "" {
+			return nil, fmt.Errorf("line %d: want \"text: <query>\" or \"audio: <file>\"", n)
+		}
+		step := ScriptStep{Line: n}
+		switch strings.TrimSpace(kind) {
+		case "text":
+			step.Text = value
+		case "audio":
+			step.Audio = value
+		default:
+			return nil, fmt.Errorf("line %d: unknown turn kind %q, want text or audio", n, strings.TrimSpace(kind))
+		}
+		for _, e := range strings.Split(expect, ",") {
+			e = strings.TrimSpace(e)
+			if e == "" {
+				continue
+			}
+			switch name, arg, _ := strings.Cut(e, "="); name {
+			case "audio", "text", "audit", "no-audit", "contains":
+			case "max-latency":
+				if d, err := time.ParseDuration(arg); err != nil || d <= 0 {
+					return nil, fmt.Errorf("line %d: want max-latency=<positive duration>, got %q", n, e)
+				}
+			default:
+				return nil, fmt.Errorf("line %d: unknown expectation %q", n, e)
+			}
+			step.Expect = append(step.Expect, e)
+		}
+		steps = append(steps, step)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return steps, nil
+}
+
+// runScript drives one session through the script at path, without touching
+// any audio device, and reports which steps met their expectations. Steps run
+// one after the other; a step whose answer could not be received ends the run.
+func runScript(ctx context.Context, path string) (*ScriptReport, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open script: %w", err)
+	}
+	steps, err := parseScript(f)
+	_ = f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("parse script: %w", err)
+	}
+
+	conn, err := connectAsk(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = closeConn(conn)
+	}()
+	sessionID := uuid.New().String()
+	payload := product.NewSessionPayload()
+	_ = conn.SetReadDeadline(time.Now().Add(*askTimeout))
+	if err := startSession(ctx, conn, sessionID, payload); err != nil {
+		return nil, &AskError{Stage: "session", ExitCode: exitAskSession, Err: err}
+	}
+	audit := auditResponseOf(payload, sessionID)
+
+	report := &ScriptReport{Steps: len(steps)}
+	for _, step := range steps {
+		glog.Infof("Script line %d: %v", step.Line, step)
+		reply, err := runScriptStep(ctx, conn, sessionID, step)
+		if err != nil {
+			report.Results = append(report.Results, ScriptResult{Step: step, Err: err})
+			break
+		}
+		report.Results = append(report.Results, ScriptResult{Step: step, Reply: reply, Err: checkExpectations(step.Expect, reply, audit)})
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(*askTimeout))
+	if err := finishSession(conn, sessionID); err != nil {
+		glog.Errorf("Failed to finish session: %v", err)
+	} else if err := waitSessionFinished(conn); err != nil {
+		glog.Errorf("Failed to finish session: %v", err)
+	}
+	if err := finishConnection(conn); err != nil {
+		glog.Errorf("Failed to finish connection: %v", err)
+	}
+	return report, nil
+}
+
+// runScriptStep sends the user turn of step and receives the bot answer.
+// Audio is received while it is sent, so that the answer latency is measured
+// when the answer arrives rather than after the trailing silence.
+func runScriptStep(ctx context.Context, conn *websocket.Conn, sessionID string, step ScriptStep) (*AskReply, error) {
+	if step.Audio == "" {
+		if err := chatTextQuery(conn, sessionID, &ChatTextQueryPayload{Content: step.Text}); err != nil {
+			return nil, err
+		}
+		return receiveAnswer(conn)
+	}
+	type answer struct {
+		reply *AskReply
+		err   error
+	}
+	answered := make(chan answer, 1)
+	go func() {
+		reply, err := receiveAnswer(conn)
+		answered <- answer{reply, err}
+	}()
+	if err := sendScriptAudio(ctx, conn, sessionID, step.Audio); err != nil {
+		// 中断仍在等待回复的读取
+		_ = conn.SetReadDeadline(time.Now())
+		<-answered
+		return nil, err
+	}
+	a := <-answered
+	return a.reply, a.err
+}
+
+// sendScriptAudio sends the audio file at path at -send-rate, followed by
+// scriptTrailingSilence of silence.
+func sendScriptAudio(ctx context.Context, conn *websocket.Conn, sessionID, path string) error {
+	src, err := NewFileSource(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	p := newPacer(sendRateMultiplier)
+	silence := make([]int16, inputFramesPerBuffer)
+	silent := 0
+	for {
+		samples, err := src.ReadFrame(ctx)
+		if errors.Is(err, io.EOF) {
+			if silent >= int(scriptTrailingSilence.Seconds()*inputSampleRate) {
+				return nil
+			}
+			samples, err = silence, nil
+			silent += len(silence)
+		}
+		if err != nil {
+			return fmt.Errorf("read %s: %w", path, err)
+		}
+		if err := p.wait(ctx, len(samples)); err != nil {
+			return err
+		}
+		if err := sendAudioFrame(conn, sessionID, samples, MsgTypeFlagWithEvent); err != nil {
+			return err
+		}
+	}
+}
+
+// auditResponseOf returns the audit response a StartSession payload sets for
+// sessionID, or "" if it is unknown.
+func auditResponseOf(payload SessionPayload, sessionID string) string {
+	p, ok := payload.(*StartSessionPayload)
+	if !ok {
+		return ""
+	}
+	dialog := p.Dialog
+	if err := applyAuditResponseTemplate(&dialog, sessionID); err != nil {
+		return ""
+	}
+	text, _ := dialog.Extra["audit_response"].(string)
+	return text
+}
+
+// checkExpectations returns an error describing the first expectation reply
+// does not meet.
+func checkExpectations(expect []string, reply *AskReply, audit string) error {
+	for _, e := range expect {
+		name, arg, _ := strings.Cut(e, "=")
+		var ok bool
+		switch name {
+		case "audio":
+			ok = len(reply.Audio) > 0
+		case "text":
+			ok = reply.Text != ""
+		case "audit", "no-audit":
+			if audit == "" {
+				return errors.New("audit response of the session unknown")
+			}
+			ok = strings.Contains(reply.Text, audit) == (name == "audit")
+		case "contains":
+			ok = strings.Contains(reply.Text, arg)
+		case "max-latency":
+			limit, _ := time.ParseDuration(arg)
+			if len(reply.Audio) > 0 && reply.Latency > limit {
+				return fmt.Errorf("expected %s, answer started after %v", e, reply.Latency.Round(time.Millisecond))
+			}
+			ok = true
+		}
+		if !ok {
+			return fmt.Errorf("expected %s, answer was %q with %.1fs of audio", e, reply.Text, float64(len(reply.Audio))/sampleRate)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseScriptMaxLatency(t *testing.T) {
+	steps, err := parseScript(strings.NewReader("text: 你好 => audio, max-latency=1.5s\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(steps) != 1 || len(steps[0].Expect) != 2 || steps[0].Expect[1] != "max-latency=1.5s" {
+		t.Errorf("steps = %+v, want one step expecting audio within 1.5s", steps)
+	}
+	for _, bad := range []string{"max-latency=", "max-latency=fast", "max-latency=0s", "max-latency=-1s"} {
+		if _, err := parseScript(strings.NewReader("text: 你好 => " + bad + "\n")); err == nil {
+			t.Errorf("parseScript(%q) = nil, want an error", bad)
+		}
+	}
+}
+
+func TestCheckMaxLatency(t *testing.T) {
+	expect := []string{"max-latency=1s"}
+	fast := &AskReply{Audio: []int16{1}, Latency: 500 * time.Millisecond}
+	if err := checkExpectations(expect, fast, ""); err != nil {
+		t.Errorf("answer after 500ms: %v, want nil", err)
+	}
+	slow := &AskReply{Audio: []int16{1}, Latency: 2 * time.Second}
+	if err := checkExpectations(expect, slow, ""); err == nil {
+		t.Error("answer after 2s: nil, want an error")
+	}
+}
+
+// TestRunScriptAudioLatency runs a spoken step against a server answering
+// while the trailing silence is still being sent, and checks the latency is
+// taken from ASREnded: on a ticking clock, read when the answer is awaited,
+// at ASREnded and at the first audio, it is one tick.
+func TestRunScriptAudioLatency(t *testing.T) {
+	s := newFakeServer(t, func(c *fakeConn) {
+		sid := c.handshake("dialog-1")
+		for c.audioFrames < 5 {
+			if c.read() == nil {
+				return
+			}
+		}
+		c.userTurn(sid, "你好")
+		c.answer(sid, "你好呀", 2400)
+		c.finish(sid)
+	})
+	setupDialog(t, s)
+	useTickingClock(t)
+	WithSendRate(0)
+	t.Cleanup(func() { WithSendRate(1) })
+	path := "hello.pcm"
+	if err := os.WriteFile(path, make([]byte, 5*inputFramesPerBuffer*2), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile("hello.script", []byte("audio: "+path+" => audio, contains=你好, max-latency=1s\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := runScript(t.Context(), "hello.script")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Passed() {
+		var out strings.Builder
+		report.Print(&out)
+		t.Fatalf("script failed:\n%s", out.String())
+	}
+	if got := report.Results[0].Reply.Latency; got != latencyTick {
+		t.Errorf("Latency = %v, want the %v from ASREnded to the answer", got, latencyTick)
+	}
+}
+
+// TestRunScript drives a text script against the fake server: a passing
+// step, an audit rejection and a step whose answer is not what it expects.
+func TestRunScript(t *testing.T) {
+	audit := newStartSessionPayload().Dialog.Extra["audit_response"].(string)
+	s := newFakeServer(t, func(c *fakeConn) {
+		sid := c.handshake("dialog-1")
+		for _, answer := range []string{"明天北京晴", audit, "好的"} {
+			if c.expect(501) == nil {
+				return
+			}
+			c.send(serverFrame(350, sid, `{"tts_type":"default"}`))
+			c.send(serverFrame(550, sid, `{"content":"`+answer+`"}`))
+			if answer != "好的" {
+				c.send(serverAudio(sid, make([]float32, 2400)))
+			}
+			c.send(serverFrame(359, sid, `{}`))
+		}
+		c.finish(sid)
+	})
+	setupDialog(t, s)
+	script := `# 回归脚本
+text: 明天北京天气怎么样 => audio, contains=晴, no-audit
+text: 不能回答的问题 => audit
+
+text: 说句话 => audio, text
+`
+	if err := os.WriteFile("dialog.script", []byte(script), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := runScript(t.Context(), "dialog.script")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	report.Print(&out)
+	if report.Passed() {
+		t.Errorf("report passed, want the last step failing:\n%s", out.String())
+	}
+	want := []string{
+		`PASS line 2: text "明天北京天气怎么样"`,
+		`PASS line 3: text "不能回答的问题"`,
+		`FAIL line 5: text "说句话": expected audio, answer was "好的" with 0.0s of audio`,
+		"2 of 3 steps passed",
+	}
+	if got := strings.Split(strings.TrimSpace(out.String()), "\n"); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("report:\n%s\nwant:\n%s", out.String(), strings.Join(want, "\n"))
+	}
+}
+
+func TestParseScriptErrors(t *testing.T) {
+	for _, script := range []string{
+		"明天天气怎么样 => audio",
+		"video: clip.mp4 => audio",
+		"text: 你好 => spoken",
+		"text: => audio",
+	} {
+		if _, err := parseScript(strings.NewReader(script)); err == nil {
+			t.Errorf("parseScript(%q) = nil, want an error", script)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// scriptgenPrefix is how many characters of the recorded answer the
+	// generated contains= expectation checks.
+	scriptgenPrefix = 4
+	// scriptgenLatencyFactor is the slack given to the recorded first byte
+	// latency in the generated max-latency= expectation.
+	scriptgenLatencyFactor = 1.5
+)
+
+// runScriptgen writes to w a conversation script replaying the session
+// exported to dir with WithSessionExport. Each user turn becomes a step
+// speaking its recorded audio, or sending its text if no audio was recorded,
+// and expects a spoken answer starting like the recorded one, no slower than
+// scriptgenLatencyFactor times the recorded latency. Turns without user
+// input, e.g. the greeting, are skipped.
+func runScriptgen(w io.Writer, dir string) error {
+	data, err := os.ReadFile(filepath.Join(dir, exportTranscript))
+	if err != nil {
+		return fmt.Errorf("read session export: %w", err)
+	}
+	var transcript []Turn
+	if err := json.Unmarshal(data, &transcript); err != nil {
+		return fmt.Errorf("decode %s: %w", exportTranscript, err)
+	}
+	fmt.Fprintf(w, "# generated by scriptgen from %s\n", dir)
+	for _, turn := range transcript {
+		var step string
+		switch audio := exportSegmentPath(dir, turn.ID); {
+		case fileExists(audio):
+			step = "audio: " + audio
+		case turn.UserText != "":
+			step = "text: " + scriptValue(turn.UserText)
+		default:
+			continue
+		}
+		expect := []string{"audio"}
+		if prefix := scriptValue(firstRunes(turn.BotText, scriptgenPrefix)); prefix != "" {
+			expect = append(expect, "contains="+prefix)
+		}
+		if turn.FirstByteLatency > 0 {
+			limit := time.Duration(float64(turn.FirstByteLatency) * scriptgenLatencyFactor)
+			expect = append(expect, "max-latency="+limit.Round(time.Millisecond).String())
+		}
+		if _, err := fmt.Fprintf(w, "%s => %s\n", step, strings.Join(expect, ", ")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runScriptgenCommand runs "scriptgen <export dir>", printing the script to
+// stdout.
+func runScriptgenCommand(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: scriptgen <session export directory>")
+	}
+	return runScriptgen(os.Stdout, args[0])
+}
+
+// scriptValue makes s safe to use in a script line, which splits
+// expectations on commas and the turn from them on "=>".
+func scriptValue(s string) string {
+	s = strings.NewReplacer("\n", " ", ",", " ", "=>", " ").Replace(s)
+	return strings.TrimSpace(s)
+}
+
+// firstRunes returns the first n characters of s.
+func firstRunes(s string, n int) string {
+	r := []rune(s)
+	return string(r[:min(n, len(r))])
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync/atomic"
+)
+
+// Audio frames are sent without sequence numbers by default, the last one of
+// a session flagged MsgTypeFlagLastNoSeq; control requests never carry one,
+// their event identifies them. For servers that expect numbered audio,
+// WithAudioSequence numbers the frames of each session from a base: every
+// frame is flagged MsgTypeFlagPositiveSeq, and the last one
+// MsgTypeFlagNegativeSeq with its number negated, as the protocol marks the
+// end of a sequenced stream. Numbers are int32 and must stay positive, so
+// after math.MaxInt32 they wrap around to 1, not to 0 or a negative number.
+
+var (
+	// audioSequenceStart is the number of the first audio frame of a session,
+	// 0 for frames without sequence numbers.
+	audioSequenceStart int32
+	audioSequence      atomic.Int32 // number of the next audio frame
+)
+
+// WithAudioSequence numbers the audio frames of every session from start,
+// which must be positive; 0 turns the numbering off.
+func WithAudioSequence(start int32) error {
+	if start < 0 {
+		return fmt.Errorf("audio sequence start %d is negative", start)
+	}
+	audioSequenceStart = start
+	audioSequence.Store(start)
+	return nil
+}
+
+// resetAudioSequence starts the numbering of a new session over.
+func resetAudioSequence() {
+	audioSequence.Store(audioSequenceStart)
+}
+
+// sequenceAudioFrame numbers msg, an audio frame flagged MsgTypeFlagNoSeq or
+// MsgTypeFlagLastNoSeq, if WithAudioSequence is set. Frames must be numbered
+// in the order they are sent.
+func sequenceAudioFrame(msg *Message) {
+	if audioSequenceStart == 0 {
+		return
+	}
+	flag := msg.TypeFlag()
+	seq := nextAudioSequence()
+	if flag&msgTypeFlagSequenceMask == MsgTypeFlagLastNoSeq {
+		msg.SetTypeFlag(flag&^msgTypeFlagSequenceMask | MsgTypeFlagNegativeSeq)
+		msg.Sequence = -seq
+		return
+	}
+	msg.SetTypeFlag(flag&^msgTypeFlagSequenceMask | MsgTypeFlagPositiveSeq)
+	msg.Sequence = seq
+}
+
+// nextAudioSequence returns the number of the next audio frame and advances
+// it, wrapping from math.MaxInt32 to 1.
+func nextAudioSequence() int32 {
+	for {
+		seq := audioSequence.Load()
+		next := seq + 1
+		if seq == math.MaxInt32 {
+			next = 1
+		}
+		if audioSequence.CompareAndSwap(seq, next) {
+			return seq
+		}
+	}
+}
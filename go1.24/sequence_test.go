@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"testing"
+)
+
+// TestAudioSequence runs a dialog on a file input with numbered audio and
+// checks the sequence flag and number of every frame the server receives:
+// none on the control requests, the audio numbered from the start and the
+// last audio frame negated.
+func TestAudioSequence(t *testing.T) {
+	const frames = 3
+	got := make(chan []string, 1)
+	s := newFakeServer(t, func(c *fakeConn) {
+		var seen []string
+		defer func() { got <- seen }()
+		// until reads and records frames up to the first one done reports,
+		// which it returns, or nil if the client hung up before.
+		until := func(done func(msg *Message) bool) *Message {
+			for {
+				msg := c.read()
+				if msg == nil {
+					return nil
+				}
+				seen = append(seen, fmt.Sprintf("%d %04b %d", msg.Event, msg.TypeFlag(), msg.Sequence))
+				if done(msg) {
+					return msg
+				}
+			}
+		}
+		event := func(event int32) func(*Message) bool {
+			return func(msg *Message) bool { return msg.Event == event }
+		}
+		if until(event(1)) == nil {
+			return
+		}
+		c.send(serverFrame(50, "conn-1", `{}`))
+		msg := until(event(100))
+		if msg == nil {
+			return
+		}
+		sid := msg.SessionID
+		c.send(serverFrame(150, sid, `{"dialog_id":"dialog-1"}`))
+		if until(event(300)) == nil {
+			return
+		}
+		c.answer(sid, "你好", 2400)
+		last := func(msg *Message) bool { return msg.TypeFlag()&msgTypeFlagSequenceMask == MsgTypeFlagNegativeSeq }
+		if until(last) == nil {
+			return
+		}
+		c.userTurn(sid, "今天天气怎么样")
+		c.answer(sid, "晴天", 4800)
+		if until(event(102)) == nil {
+			return
+		}
+		c.send(serverFrame(152, sid, `{}`))
+		if until(event(2)) == nil {
+			return
+		}
+		c.send(serverFrame(52, "conn-1", `{}`))
+	})
+	setupDialog(t, s)
+	if err := WithAudioSequence(5); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = WithAudioSequence(0) })
+	src := &MemorySource{}
+	for range frames {
+		src.Frames = append(src.Frames, make([]int16, inputFramesPerBuffer))
+	}
+	WithAudioSource(src)
+
+	if _, err := runFakeDialog(t); err != nil {
+		t.Fatalf("realTimeDialog() = %v, want nil once the input ended", err)
+	}
+	// event, type flag bits, sequence number
+	want := []string{
+		"1 0100 0",
+		"100 0100 0",
+		"300 0100 0",
+		"200 0101 5",
+		"200 0101 6",
+		"200 0101 7",
+		"200 0111 -8",
+		"102 0100 0",
+		"2 0100 0",
+	}
+	if seen := <-got; !slices.Equal(seen, want) {
+		t.Errorf("frames = %q, want %q", seen, want)
+	}
+}
+
+// TestAudioSequenceWrap numbers frames from near math.MaxInt32 and checks
+// that the numbers wrap around to 1, staying positive, and that the last
+// frame after the wrap is negated from its wrapped number.
+func TestAudioSequenceWrap(t *testing.T) {
+	if err := WithAudioSequence(math.MaxInt32 - 2); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = WithAudioSequence(0) })
+	var got []int32
+	for i := range 6 {
+		flag := MsgTypeFlagWithEvent
+		if i == 5 {
+			flag |= MsgTypeFlagLastNoSeq
+		}
+		msg, err := NewMessage(MsgTypeAudioOnlyClient, flag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sequenceAudioFrame(msg)
+		got = append(got, msg.Sequence)
+	}
+	want := []int32{math.MaxInt32 - 2, math.MaxInt32 - 1, math.MaxInt32, 1, 2, -3}
+	if !slices.Equal(got, want) {
+		t.Errorf("sequence numbers = %v, want %v", got, want)
+	}
+
+	// 新会话从起始值重新编号
+	resetAudioSequence()
+	if got := nextAudioSequence(); got != math.MaxInt32-2 {
+		t.Errorf("first number after resetAudioSequence() = %d, want %d", got, math.MaxInt32-2)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Known kinds of ServerError, to test with errors.Is.
+var (
+	// ErrInvalidSession means the server rejected the session or its request
+	// parameters.
+	ErrInvalidSession = errors.New("invalid session")
+	// ErrQuotaExceeded means the account ran out of quota or concurrency.
+	ErrQuotaExceeded = errors.New("quota exceeded")
+	// ErrInternalServer means the server failed; retrying may help.
+	ErrInternalServer = errors.New("internal server error")
+)
+
+// Error codes of the service. Codes 45xxxxxx are client errors and 55xxxxxx
+// server errors.
+const (
+	codeInvalidRequest = 45000001
+	codeQuotaExceeded  = 45000292
+)
+
+// serverErrorKinds maps the client error codes with a known kind.
+var serverErrorKinds = map[int]error{
+	codeInvalidRequest: ErrInvalidSession,
+	codeQuotaExceeded:  ErrQuotaExceeded,
+}
+
+// ServerError is the content of an Error frame sent by the server. Known
+// causes can be tested with errors.Is against ErrInvalidSession,
+// ErrQuotaExceeded and ErrInternalServer.
+type ServerError struct {
+	Code      int
+	Message   string
+	SessionID string
+}
+
+func (e ServerError) Error() string {
+	return fmt.Sprintf("server error (code=%d, session_id=%s): %s", e.Code, e.SessionID, e.Message)
+}
+
+// Unwrap returns the known error kind of e, or nil.
+func (e ServerError) Unwrap() error {
+	if e.Code/1000000 == 55 {
+		return ErrInternalServer
+	}
+	return serverErrorKinds[e.Code]
+}
+
+// parseServerError decodes an Error frame. The payload is usually a JSON
+// object with an "error" field, anything else is taken as the message itself.
+func parseServerError(msg *Message) ServerError {
+	serverErr := ServerError{
+		Code:      int(msg.ErrorCode),
+		Message:   string(msg.Payload),
+		SessionID: msg.SessionID,
+	}
+	var payload struct {
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(msg.Payload, &payload); err == nil && payload.Error != "" {
+		serverErr.Message = payload.Error
+	}
+	return serverErr
+}
+
+// WithErrorHandler calls fn with every Error frame received from the server,
+// for handling at the application level besides what the client does itself.
+func WithErrorHandler(fn func(ServerError)) {
+	eventHandlers.OnError = fn
+}
+
+// ErrorMidTurnPolicy selects what an Error frame does while the bot is
+// answering. Outside of a bot answer an Error frame always ends the dialog.
+type ErrorMidTurnPolicy int
+
+// Values that an ErrorMidTurnPolicy variable can take.
+const (
+	// ErrorMidTurnAbortTurn abandons the answer in progress and waits for
+	// the user again.
+	ErrorMidTurnAbortTurn ErrorMidTurnPolicy = iota
+	// ErrorMidTurnContinue logs the error and keeps playing the rest of the
+	// answer.
+	ErrorMidTurnContinue
+	// ErrorMidTurnEndDialog ends the dialog like an Error frame outside of a
+	// bot answer.
+	ErrorMidTurnEndDialog
+)
+
+func (p ErrorMidTurnPolicy) String() string {
+	switch p {
+	case ErrorMidTurnAbortTurn:
+		return "abort-turn"
+	case ErrorMidTurnContinue:
+		return "continue"
+	case ErrorMidTurnEndDialog:
+		return "end-dialog"
+	default:
+		return fmt.Sprintf("ErrorMidTurnPolicy(%d)", int(p))
+	}
+}
+
+// parseErrorMidTurnPolicy parses the names returned by
+// ErrorMidTurnPolicy.String.
+func parseErrorMidTurnPolicy(s string) (ErrorMidTurnPolicy, error) {
+	for _, p := range []ErrorMidTurnPolicy{ErrorMidTurnAbortTurn, ErrorMidTurnContinue, ErrorMidTurnEndDialog} {
+		if p.String() == s {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown error mid-turn policy %q, want abort-turn, continue or end-dialog", s)
+}
+
+var errorMidTurnPolicy = ErrorMidTurnAbortTurn
+
+// WithErrorMidTurnPolicy sets what an Error frame received while the bot is
+// answering does. EventHandlers.OnError is called with the error whatever the
+// policy.
+func WithErrorMidTurnPolicy(p ErrorMidTurnPolicy) {
+	errorMidTurnPolicy = p
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestServerErrorKind(t *testing.T) {
+	for _, tc := range []struct {
+		code    uint32
+		payload string
+		want    error
+	}{
+		{codeInvalidRequest, `{"error":"bad request"}`, ErrInvalidSession},
+		{codeQuotaExceeded, `{"error":"quota exceeded for types: concurrency"}`, ErrQuotaExceeded},
+		{55000031, `{"error":"server busy"}`, ErrInternalServer},
+		// the message alone does not classify an error
+		{45000002, `{"error":"session quota"}`, nil},
+	} {
+		msg, _, err := Unmarshal(serverError(tc.code, tc.payload), ContainsSequence)
+		if err != nil {
+			t.Fatal(err)
+		}
+		serverErr := parseServerError(msg)
+		if got := serverErr.Unwrap(); got != tc.want {
+			t.Errorf("code %d: kind %v, want %v", tc.code, got, tc.want)
+		}
+		if tc.want != nil && !errors.Is(serverErr, tc.want) {
+			t.Errorf("code %d: errors.Is(%v, %v) = false", tc.code, serverErr, tc.want)
+		}
+	}
+}
+
+func TestErrorHandler(t *testing.T) {
+	s := newFakeServer(t, scriptedDialog(func(c *fakeConn, sid string) {
+		c.send(serverError(codeQuotaExceeded, `{"error":"quota exceeded"}`))
+	}))
+	setupDialog(t, s)
+	var got []ServerError
+	WithErrorHandler(func(err ServerError) { got = append(got, err) })
+	t.Cleanup(func() { eventHandlers = EventHandlers{} })
+
+	if _, err := runFakeDialog(t); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("realTimeDialog() = %v, want ErrQuotaExceeded", err)
+	}
+	if len(got) != 1 || got[0].Code != codeQuotaExceeded || got[0].Message != "quota exceeded" {
+		t.Errorf("error handler got %+v, want the quota error", got)
+	}
+}
+
+// TestErrorMidTurnPolicy injects an Error frame between two audio frames of
+// a bot answer and checks what each policy plays and how the dialog ends.
+func TestErrorMidTurnPolicy(t *testing.T) {
+	const code = 55000001
+	for _, tc := range []struct {
+		policy    ErrorMidTurnPolicy
+		played    int
+		abandoned bool
+		errorCode int
+	}{
+		{ErrorMidTurnAbortTurn, 2400, true, 0},
+		{ErrorMidTurnContinue, 4800, false, 0},
+		{ErrorMidTurnEndDialog, 2400, false, code},
+	} {
+		t.Run(tc.policy.String(), func(t *testing.T) {
+			s := newFakeServer(t, scriptedDialog(func(c *fakeConn, sid string) {
+				c.userTurn(sid, "讲个故事")
+				c.send(serverFrame(350, sid, `{"tts_type":"default"}`))
+				c.send(serverAudio(sid, make([]float32, 2400)))
+				c.send(serverError(code, `{"error":"tts failed"}`))
+				c.send(serverAudio(sid, make([]float32, 2400)))
+				c.send(serverFrame(359, sid, `{}`))
+			}))
+			_, speaker := setupDialog(t, s)
+			WithErrorMidTurnPolicy(tc.policy)
+			var errs []ServerError
+			WithErrorHandler(func(err ServerError) { errs = append(errs, err) })
+			t.Cleanup(func() {
+				WithErrorMidTurnPolicy(ErrorMidTurnAbortTurn)
+				eventHandlers = EventHandlers{}
+			})
+
+			_, err := runFakeDialog(t)
+			var reason *ShutdownReason
+			if !errors.As(err, &reason) || reason.Kind != ShutdownServerClosed || reason.Code != tc.errorCode {
+				t.Errorf("realTimeDialog() = %v, want the server closing with code %d", err, tc.errorCode)
+			}
+			if len(errs) != 1 || errs[0].Code != code {
+				t.Errorf("error handler got %+v, want the code %d error", errs, code)
+			}
+			if got := speaker.played(); got != tc.played {
+				t.Errorf("played %d samples, want %d", got, tc.played)
+			}
+			if tc.policy == ErrorMidTurnEndDialog {
+				return
+			}
+			transcript := turns.Transcript()
+			if len(transcript) != 1 {
+				t.Fatalf("transcript has %d turns, want 1: %+v", len(transcript), transcript)
+			}
+			if got := transcript[0].Abandoned != ""; got != tc.abandoned {
+				t.Errorf("turn abandoned = %v, want %v", got, tc.abandoned)
+			}
+		})
+	}
+}
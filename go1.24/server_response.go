@@ -2,19 +2,17 @@ package main
 
 import (
 	"context"
-	"encoding/binary"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"math"
-	"math/rand"
 	"os"
 	"path/filepath"
-	"sync"
+	"strconv"
 	"sync/atomic"
 	"time"
 
 	"github.com/golang/glog"
-	"github.com/gordonklaus/portaudio"
 	"github.com/gorilla/websocket"
 )
 
@@ -27,52 +25,210 @@ const (
 
 var (
 	audio                []byte
-	bufferLock           sync.Mutex
-	buffer               = make([]float32, 0, sampleRate*bufferSeconds)
 	isSendingChatTTSText = atomic.Bool{}
 	isUserQuerying       = atomic.Bool{}
 )
 
-func realtimeAPIOutputAudio(ctx context.Context, conn *websocket.Conn) {
-	go startPlayer(ctx)
+// EventHandlers holds optional application callbacks for server events.
+type EventHandlers struct {
+	// OnProsody is called with the emotion/style tag attached to a TTS
+	// sentence. Sentences without a tag do not trigger it.
+	OnProsody func(tag string)
+	// OnError is called with every Error frame received from the server.
+	OnError func(err ServerError)
+	// OnIdleTimeout is called when nobody spoke for the bot response timeout,
+	// whatever the timeout behavior.
+	OnIdleTimeout func()
+	// OnFormatWarning is called when audio in the first seconds of a session
+	// does not look like the configured sample format.
+	OnFormatWarning func(w FormatWarning)
+	// OnAuditRejected is called with the user text when the server rejects
+	// the query in its audit.
+	OnAuditRejected func(userText string)
+	// OnNegotiationFallback is called when the server rejected the
+	// compression of the session setup and it is retried without.
+	OnNegotiationFallback func(from, to CompressionBits)
+	// OnResponseTimeout is called with the turn ID when the bot did not
+	// start answering a user query within the first response timeout.
+	OnResponseTimeout func(turnID int)
+	// OnUnknownEvent is called with the event number, in decimal, and the raw
+	// JSON payload of a server event this client does not know, e.g. one
+	// added to the service after this release.
+	OnUnknownEvent func(eventType string, raw json.RawMessage)
+	// OnQualityDegraded is called when the network quality score drops
+	// below the threshold set with WithQualityThreshold.
+	OnQualityDegraded func(q NetworkQuality)
+}
+
+var eventHandlers EventHandlers
+
+// knownServerEvents lists the events of the JSON messages the server sends
+// that this client knows, whether it acts on them or not.
+var knownServerEvents = map[int32]string{
+	50:  "ConnectionStarted",
+	51:  "ConnectionFailed",
+	52:  "ConnectionFinished",
+	150: "SessionStarted",
+	152: "SessionFinished",
+	153: "SessionFailed",
+	154: "UsageResponse",
+	350: "TTSSentenceStart",
+	351: "TTSSentenceEnd",
+	352: "TTSResponse",
+	359: "TTSEnded",
+	450: "ASRInfo",
+	451: "ASRResponse",
+	459: "ASREnded",
+	550: "ChatResponse",
+	559: "ChatEnded",
+	599: "DialogCommonError",
+}
+
+// handleUnknownEvent hands msg to EventHandlers.OnUnknownEvent if its event is
+// not in knownServerEvents.
+func handleUnknownEvent(msg *Message) {
+	if _, ok := knownServerEvents[msg.Event]; ok {
+		return
+	}
+	glog.V(1).Infof("Receive unknown event %d (session_id=%s): %s", msg.Event, msg.SessionID, msg.Payload)
+	if eventHandlers.OnUnknownEvent != nil {
+		eventHandlers.OnUnknownEvent(strconv.Itoa(int(msg.Event)), json.RawMessage(msg.Payload))
+	}
+}
+
+// prosodyKeys lists the payload fields that may carry a TTS emotion or style
+// tag, in order of preference.
+var prosodyKeys = []string{"emotion", "style", "prosody"}
+
+// prosodyTag returns the emotion/style tag of a TTSSentenceStart payload, or an
+// empty string if the server did not send one.
+func prosodyTag(jsonData map[string]interface{}) string {
+	for _, key := range prosodyKeys {
+		if tag, ok := jsonData[key].(string); ok && tag != "" {
+			return tag
+		}
+	}
+	return ""
+}
+
+// realtimeAPIOutputAudio runs the receive loop until the session ends. It
+// returns why the server ended the dialog, or nil if it ended because ctx was
+// done.
+func realtimeAPIOutputAudio(ctx context.Context, conn *websocket.Conn) *ShutdownReason {
+	defer saveAudioToPCMFile(recordingFile)
+	defer responseWait.stop()
 	for {
 		glog.Infof("Waiting for message...")
 		msg, err := receiveMessage(conn)
 		if err != nil {
+			if ctx.Err() != nil && isTimeout(err) {
+				glog.Warningf("No SessionFinished within the finish grace period of %s, closing.", finishGracePeriod)
+				return nil
+			}
 			glog.Errorf("Receive message error: %v", err)
-			return
+			if ctx.Err() != nil {
+				return nil
+			}
+			return shutdownFor(err)
 		}
 		switch msg.Type {
 		case MsgTypeFullServer:
 			glog.Infof("Receive text message (event=%d, session_id=%s): %s", msg.Event, msg.SessionID, msg.Payload)
+			// 未识别的事件原样交给上层，便于在客户端更新前使用服务端的新功能
+			handleUnknownEvent(msg)
 			// session finished event
-			if msg.Event == 152 || msg.Event == 153 {
-				return
+			if msg.Event == 152 {
+				sessionState.Set(StateSessionFinished, nil)
+				if ctx.Err() != nil {
+					return nil
+				}
+				return &ShutdownReason{Kind: ShutdownServerClosed, Err: errors.New("session finished by the server")}
+			}
+			if msg.Event == 153 {
+				err := fmt.Errorf("session failed: %s", msg.Payload)
+				sessionState.Set(StateFailed, err)
+				return &ShutdownReason{Kind: ShutdownServerClosed, Err: err}
 			}
 			// asr info event, clear audio buffer
 			if msg.Event == 450 {
 				// 清空本地音频缓存，等待接收下一轮的音频
-				audio = audio[:0]
-				buffer = buffer[:0]
+				resetRecording()
+				flushAudioSink()
+				captions.botEnded()
 				// 用户说话了，不需要触发连续SayHello引导用户交互了
-				queryChan <- struct{}{}
+				signalActivity()
+				responseWait.stop()
 				isUserQuerying.Store(true)
+				sessionExport.userStarted()
+				// 用户打断了上一轮回复
+				if turn, ok := turns.userStarted(); ok {
+					logTurn(turn)
+					answerTurnFinished(turn)
+				}
+			}
+			// asr response event, record the recognized user text
+			if msg.Event == 451 {
+				text, final := asrText(msg.Payload)
+				if final {
+					turns.userText(text)
+				}
+				captions.userText(text, final)
 			}
-			// 发送ChatTTSText请求事件之后，收到tts_type为chat_tts_text的事件，清空本地缓存的S2S模型闲聊音频数据
-			if msg.Event == 350 && isSendingChatTTSText.Load() {
+			if msg.Event == 350 {
+				formatCheck.sentenceStarted()
+				responseWait.stop()
+				// 半双工模式下机器人开口后关闭麦克风输入
+				mic.mute()
 				var jsonData map[string]interface{}
 				_ = json.Unmarshal(msg.Payload, &jsonData)
-				if jsonData["tts_type"] == "chat_tts_text" {
-					audio = audio[:0]
-					buffer = buffer[:0]
+				// 审核拦截的回复按 -fail-on-audit 处理，可能不播放直接结束本轮或会话
+				if jsonData["tts_type"] == auditRiskyTTSType {
+					if reason := handleAuditRejected(conn, msg.SessionID); reason != nil {
+						return reason
+					}
+				}
+				if n := turns.sentenceStarted(); *maxBotSentences > 0 && n > *maxBotSentences {
+					truncateTurn(conn, msg.SessionID, fmt.Sprintf("%d sentences", *maxBotSentences))
+				}
+				// 服务端下发了情感/风格标签时通知上层，便于 UI 随本句语音做出反馈
+				if tag := prosodyTag(jsonData); tag != "" {
+					glog.Infof("Receive TTS prosody tag (session_id=%s, reply_id=%v): %s", msg.SessionID, jsonData["reply_id"], tag)
+					if eventHandlers.OnProsody != nil {
+						eventHandlers.OnProsody(tag)
+					}
+				}
+				// 发送ChatTTSText请求事件之后，收到tts_type为chat_tts_text的事件，清空本地缓存的S2S模型闲聊音频数据
+				if isSendingChatTTSText.Load() && jsonData["tts_type"] == "chat_tts_text" {
+					resetRecording()
+					flushAudioSink()
 					isSendingChatTTSText.Store(false)
+					turns.resumeAudio()
+				}
+			}
+			if msg.Event == 351 {
+				formatCheck.sentenceEnded(msg.Payload)
+			}
+			// chat response event, record the bot text
+			if msg.Event == 550 {
+				var jsonData map[string]interface{}
+				_ = json.Unmarshal(msg.Payload, &jsonData)
+				if content, ok := jsonData["content"].(string); ok {
+					turns.botText(content)
+					if !turns.droppingAudio() {
+						captions.botText(content)
+					}
 				}
 			}
 			if msg.Event == 459 {
 				isUserQuerying.Store(false)
+				// 首字节延迟从用户说完开始计时
+				firstByte.userEnded(latencyClock())
+				sessionExport.userEnded(turns.currentID())
+				// 用户说完后开始计时，机器人迟迟不开始回答时按 -response-timeout-action 处理
+				responseWait.queryEnded(conn, msg.SessionID)
 			}
 			// 概率触发发送ChatTTSText请求
-			if msg.Event == 459 && rand.Intn(2) == 0 {
+			if msg.Event == 459 && randIntn(2) == 0 {
 				go func() {
 					isSendingChatTTSText.Store(true)
 					glog.Infof("hit ChatTTSText event, start sending...")
@@ -100,19 +256,54 @@ func realtimeAPIOutputAudio(ctx context.Context, conn *websocket.Conn) {
 				}()
 			}
 		case MsgTypeAudioOnlyServer:
-			glog.Infof("Receive audio message (event=%d): session_id=%s", msg.Event, msg.SessionID)
+			glog.V(1).Infof("Receive audio message (event=%d): session_id=%s", msg.Event, msg.SessionID)
+			formatCheck.checkDownlink(msg.Payload)
+			// 按收到的音频时长（而不是播放进度）统计，避免播放缓冲抖动导致误截断
+			received := time.Duration(len(msg.Payload)/4) * time.Second / sampleRate
+			if total := turns.botAudio(received); *maxBotSpeech > 0 && total > *maxBotSpeech {
+				truncateTurn(conn, msg.SessionID, maxBotSpeech.String())
+			}
+			responseWait.stop()
 			handleIncomingAudio(msg.Payload)
-			audio = append(audio, msg.Payload...)
+			recordAudio(msg.Payload)
 		case MsgTypeError:
-			glog.Exitf("Receive Error message (code=%d): %s", msg.ErrorCode, string(msg.Payload))
-			return
+			serverErr := handleServerError(msg)
+			if !turns.botAnswering() {
+				return shutdownFor(serverErr)
+			}
+			// 回答过程中的错误按 -error-mid-turn 处理
+			switch errorMidTurnPolicy {
+			case ErrorMidTurnAbortTurn:
+				AbandonTurn(conn, msg.SessionID, serverErr.Error())
+			case ErrorMidTurnContinue:
+				glog.Warningf("Error frame amid the bot answer, playing on: %v", serverErr)
+			default:
+				return shutdownFor(serverErr)
+			}
 		default:
-			glog.Exitf("Received unexpected message type: %s", msg.Type)
-			return
+			glog.Errorf("Received unexpected message type: %s", msg.Type)
+			return &ShutdownReason{Kind: ShutdownError, Err: fmt.Errorf("unexpected message type: %s", msg.Type)}
+		}
+		// 默认以 tts ended 事件判定机器人说完本轮，可用 WithTurnDetector 替换
+		if turnDetector.TurnComplete(msg) {
+			botTurnComplete()
 		}
 	}
 }
 
+// botTurnComplete finishes the turn the bot just completed.
+func botTurnComplete() {
+	// 延迟 -post-turn-mic-delay 后再打开麦克风，避免录入尾音与回声
+	mic.turnComplete(time.Now())
+	captions.botEnded()
+	// 机器人回答完毕，重新开始空闲计时
+	signalActivity()
+	if turn, ok := turns.finish(); ok {
+		logTurn(turn)
+		answerTurnFinished(turn)
+	}
+}
+
 /**
  * 结合api接入文档对二进制协议进行理解，上下行统一理解
  * - header(4bytes)
@@ -133,20 +324,25 @@ func realtimeAPIOutputAudio(ctx context.Context, conn *websocket.Conn) {
  *     - data
  */
 func receiveMessage(conn *websocket.Conn) (*Message, error) {
-	mt, frame, err := conn.ReadMessage()
+	mt, data, err := conn.ReadMessage()
 	if err != nil {
 		return nil, err
 	}
 	if mt != websocket.BinaryMessage && mt != websocket.TextMessage {
 		return nil, fmt.Errorf("unexpected Websocket message type: %d", mt)
 	}
-
-	framePrefix := frame
-	if len(frame) > 100 {
-		framePrefix = frame[:100]
+	counters.framesReceived.Add(1)
+	counters.bytesReceived.Add(uint64(len(data)))
+	metrics.ObserveMessageSize(DirectionInbound, len(data))
+	frame := data
+	if mt == websocket.TextMessage && wsMessageType == websocket.TextMessage {
+		if frame, err = base64.StdEncoding.DecodeString(string(data)); err != nil {
+			return nil, fmt.Errorf("decode base64 text message: %w", err)
+		}
 	}
-	glog.Infof("Receive frame prefix: %v", framePrefix)
-	msg, _, err := Unmarshal(frame, ContainsSequence)
+	readTap.tap(frame)
+
+	msg, prot, err := Unmarshal(frame, ContainsSequence)
 	if err != nil {
 		if len(frame) > 500 {
 			frame = frame[:500]
@@ -154,75 +350,141 @@ func receiveMessage(conn *websocket.Conn) (*Message, error) {
 		glog.Infof("Data response: %s", frame)
 		return nil, fmt.Errorf("unmarshal response message: %w", err)
 	}
+	// 音频帧每秒有数十个，逐帧打印的开销不可忽略，仅在 -v=1 时输出
+	if msg.Type != MsgTypeAudioOnlyServer || glog.V(1) {
+		framePrefix := frame
+		if len(frame) > 100 {
+			framePrefix = frame[:100]
+		}
+		glog.Infof("Receive frame prefix: %v", framePrefix)
+	}
+	bandwidth.observe(DirectionInbound, msg, len(data))
+	serverVersion.Store(int32(prot.Version()))
+	if msg.Payload, err = decompressPayload(prot.Compression(), msg.Payload); err != nil {
+		return nil, fmt.Errorf("decompress response payload: %w", err)
+	}
+	auditLog.log(DirectionInbound, msg)
+	sessionManager.observe(conn, msg)
+	journal.Record(JournalEventReceived, msg.Event, msg.SessionID, msg.Type.String())
+	debugFrame("received", msg)
 	return msg, nil
 }
 
-func startPlayer(ctx context.Context) {
-	outputDevice, err := portaudio.DefaultOutputDevice()
-	if err != nil {
-		glog.Errorf("Failed to get default output device: %v", err)
+// handleServerError parses an Error frame, logs it and hands it to the
+// application error handler.
+func handleServerError(msg *Message) ServerError {
+	serverErr := parseServerError(msg)
+	counters.serverErrors.Add(1)
+	glog.Errorf("Receive Error message: code=%d session_id=%s kind=%v message=%q",
+		serverErr.Code, serverErr.SessionID, serverErr.Unwrap(), serverErr.Message)
+	if eventHandlers.OnError != nil {
+		eventHandlers.OnError(serverErr)
+	}
+	return serverErr
+}
+
+// asrText returns the recognized text of an ASRResponse payload and whether it
+// is final rather than interim.
+func asrText(payload []byte) (string, bool) {
+	var resp struct {
+		Results []struct {
+			Text      string `json:"text"`
+			IsInterim bool   `json:"is_interim"`
+		} `json:"results"`
+	}
+	if err := json.Unmarshal(payload, &resp); err != nil || len(resp.Results) == 0 {
+		return "", false
+	}
+	return resp.Results[0].Text, !resp.Results[0].IsInterim
+}
+
+func logTurn(turn Turn) {
+	glog.Infof("Turn %d finished: sentences=%d, bot_audio=%s, first_byte_latency=%s, truncated=%v, abandoned=%q, user=%q, bot=%q",
+		turn.ID, turn.Sentences, turn.BotAudio, turn.FirstByteLatency, turn.Truncated, turn.Abandoned, turn.UserText, turn.BotText)
+}
+
+// truncateTurn cuts the current bot answer short: it interrupts the server,
+// drops the queued TTS audio and optionally speaks the wrap-up line.
+func truncateTurn(conn *websocket.Conn, sessionID, limit string) {
+	if !turns.truncate() {
 		return
 	}
-	outputParameters := portaudio.StreamParameters{
-		Output: portaudio.StreamDeviceParameters{
-			Device:   outputDevice,
-			Channels: channels,
-			Latency:  10 * time.Millisecond,
-		},
-		SampleRate:      float64(sampleRate),
-		FramesPerBuffer: framesPerBuffer,
-	}
-	outputStream, err := portaudio.OpenStream(outputParameters, func(out []float32) {
-		bufferLock.Lock()
-		defer bufferLock.Unlock()
-		if len(buffer) < len(out) {
-			copy(out, buffer)
-			for i := len(buffer); i < len(out); i++ {
-				out[i] = 0
-			}
-			buffer = buffer[:0]
-		} else {
-			copy(out, buffer)
-			buffer = buffer[len(out):]
-		}
-	})
-	if err != nil {
-		glog.Errorf("Failed to open PortAudio output stream: %v", err)
+	glog.Warningf("Bot answer exceeds %s, truncating turn.", limit)
+	resetRecording()
+	flushAudioSink()
+	if err := clientInterrupt(conn, sessionID); err != nil {
+		glog.Errorf("Failed to interrupt bot answer: %v", err)
+	}
+	if *wrapUpText == "" {
 		return
 	}
-	defer outputStream.Close()
+	isSendingChatTTSText.Store(true)
+	_ = chatTTSText(conn, sessionID, &ChatTTSTextPayload{Start: true, Content: *wrapUpText})
+	_ = chatTTSText(conn, sessionID, &ChatTTSTextPayload{End: true})
+}
 
-	if err := outputStream.Start(); err != nil {
-		glog.Errorf("Failed to start PortAudio output stream: %v", err)
+// AbandonTurn gives up the turn in progress without finishing the session,
+// e.g. because the user walked away: the bot answer is interrupted and its
+// queued audio dropped, a pending wrap-up line is discarded, a pending AskTurn
+// returns the abandoned turn, and the turn is recorded with reason. The
+// dialog then waits for the user again. It is safe to call at any time;
+// without a turn in progress it does nothing.
+func AbandonTurn(conn *websocket.Conn, sessionID, reason string) {
+	turn, ok := turns.abandon(reason)
+	if !ok {
 		return
 	}
-	glog.Info("PortAudio output stream started for playback.")
-	<-ctx.Done()
-	saveAudioToPCMFile("output.pcm")
-	glog.Info("PortAudio output stream stopped.")
+	glog.Warningf("Turn %d abandoned: %s", turn.ID, reason)
+	journal.Record(JournalCommand, 0, sessionID, "turn abandoned: "+reason)
+	isSendingChatTTSText.Store(false)
+	isUserQuerying.Store(false)
+	flushAudioSink()
+	if err := clientInterrupt(conn, sessionID); err != nil {
+		glog.Errorf("Failed to interrupt abandoned turn: %v", err)
+	}
+	mic.turnComplete(time.Now())
+	logTurn(turn)
+	answerTurnFinished(turn)
 }
 
 func handleIncomingAudio(data []byte) {
-	if isSendingChatTTSText.Load() {
+	if isSendingChatTTSText.Load() || turns.droppingAudio() {
 		return
 	}
-	glog.Infof("Received audio byte len: %d, float32 len: %d", len(data), len(data)/4)
-	sampleCount := len(data) / 4
-	samples := make([]float32, sampleCount)
-	for i := 0; i < sampleCount; i++ {
-		bits := binary.LittleEndian.Uint32(data[i*4 : (i+1)*4])
-		samples[i] = math.Float32frombits(bits)
+	glog.V(1).Infof("Received audio byte len: %d, float32 len: %d", len(data), len(data)/4)
+	samples := pcmFloat32ToSamples(data)
+	firstByte.audioReceived(latencyClock())
+	captions.audioQueued(time.Duration(len(samples)) * time.Second / sampleRate)
+	answerAudio(samples)
+	duplex.botAudio(samples)
+	// 将音频写入播放端
+	if err := audioSink.WriteFrame(samples); err != nil {
+		glog.Errorf("Failed to write audio output: %v", err)
 	}
-	// 将音频加载到缓冲区
-	bufferLock.Lock()
-	defer bufferLock.Unlock()
-	buffer = append(buffer, samples...)
-	if len(buffer) > sampleRate*bufferSeconds {
-		buffer = buffer[len(buffer)-(sampleRate*bufferSeconds):]
+}
+
+// flushAudioSink 丢弃播放端尚未播放的音频
+func flushAudioSink() {
+	captions.flush()
+	duplex.botFlushed()
+	if err := audioSink.Flush(); err != nil {
+		glog.Errorf("Failed to flush audio output: %v", err)
 	}
 }
 
 func saveAudioToPCMFile(s string) {
+	// 超出音频内存上限时录音已部分写入文件，这里只需追加剩余部分
+	if recordingSpill != nil {
+		_, err := recordingSpill.Write(audio)
+		if closeErr := recordingSpill.Close(); err == nil {
+			err = closeErr
+		}
+		recordingSpill = nil
+		if err != nil {
+			glog.Exitf("Save pcm file: %v", err)
+		}
+		return
+	}
 	if len(audio) == 0 {
 		glog.Info("No audio data to save.")
 		return
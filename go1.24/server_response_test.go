@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+)
+
+func TestProsodyCallback(t *testing.T) {
+	s := newFakeServer(t, scriptedDialog(func(c *fakeConn, sid string) {
+		c.send(serverFrame(350, sid, `{"tts_type":"default","emotion":"happy"}`))
+		c.send(serverFrame(350, sid, `{"tts_type":"default"}`))
+		c.send(serverFrame(359, sid, `{}`))
+	}))
+	setupDialog(t, s)
+	var tags []string
+	eventHandlers.OnProsody = func(tag string) { tags = append(tags, tag) }
+	t.Cleanup(func() { eventHandlers = EventHandlers{} })
+
+	if _, err := runFakeDialog(t); err == nil {
+		t.Fatal("realTimeDialog() = nil, want the server closing the session")
+	}
+	if want := []string{"happy"}; !slices.Equal(tags, want) {
+		t.Errorf("OnProsody got %q, want %q", tags, want)
+	}
+}
+
+// TestUnknownEvent checks that an event the client does not know reaches
+// OnUnknownEvent with its raw payload, and the known ones do not.
+func TestUnknownEvent(t *testing.T) {
+	const payload = `{"feature":"new","args":[1,2]}`
+	s := newFakeServer(t, scriptedDialog(func(c *fakeConn, sid string) {
+		c.send(serverFrame(777, sid, payload))
+		c.answer(sid, "你好", 2400)
+	}))
+	setupDialog(t, s)
+	var got []string
+	eventHandlers.OnUnknownEvent = func(eventType string, raw json.RawMessage) {
+		got = append(got, eventType+" "+string(raw))
+	}
+	t.Cleanup(func() { eventHandlers = EventHandlers{} })
+
+	if _, err := runFakeDialog(t); err == nil {
+		t.Fatal("realTimeDialog() = nil, want the server closing the session")
+	}
+	if want := []string{"777 " + payload}; !slices.Equal(got, want) {
+		t.Errorf("OnUnknownEvent got %q, want %q", got, want)
+	}
+}
+
+// BenchmarkAudioFrameHotPath decodes a downlink audio frame and its samples,
+// which the receive loop does for every frame of a TTS stream.
+func BenchmarkAudioFrameHotPath(b *testing.B) {
+	frame := serverAudio("session-1", make([]float32, sampleRate/25))
+	b.ReportAllocs()
+	b.SetBytes(int64(len(frame)))
+	for b.Loop() {
+		msg, _, err := Unmarshal(frame, ContainsSequence)
+		if err != nil {
+			b.Fatal(err)
+		}
+		pcmFloat32ToSamples(msg.Payload)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+var errInvalidSessionPayload = errors.New("invalid StartSession payload")
+
+// Validate checks the fields of p the service would reject or the client
+// could not play.
+func (p *StartSessionPayload) Validate() error {
+	switch {
+	case p.TTS.AudioConfig.Format == "":
+		return fmt.Errorf("%w: empty TTS audio format", errInvalidSessionPayload)
+	case p.TTS.AudioConfig.SampleRate <= 0:
+		return fmt.Errorf("%w: TTS sample rate %d is not positive", errInvalidSessionPayload, p.TTS.AudioConfig.SampleRate)
+	case p.TTS.AudioConfig.Channel != 1:
+		return fmt.Errorf("%w: %d TTS channels, the client plays mono only", errInvalidSessionPayload, p.TTS.AudioConfig.Channel)
+	case p.TTS.SpeakingRate != 0 && (p.TTS.SpeakingRate < minSpeakingRate || p.TTS.SpeakingRate > maxSpeakingRate):
+		return fmt.Errorf("%w: %v is outside [%v, %v]", errInvalidSpeakingRate, p.TTS.SpeakingRate, minSpeakingRate, maxSpeakingRate)
+	case p.Dialog.BotName == "":
+		return fmt.Errorf("%w: empty bot name", errInvalidSessionPayload)
+	}
+	return nil
+}
+
+// StartSessionPayloadBuilder builds a StartSession payload from the defaults
+// of the dialog, for callers that only change a few fields:
+//
+//	p, err := NewStartSessionPayloadBuilder().WithBotName("小助手").WithSampleRate(16000).Build()
+type StartSessionPayloadBuilder struct {
+	p StartSessionPayload
+}
+
+// NewStartSessionPayloadBuilder returns a builder starting from the payload
+// the dialog sends by default.
+func NewStartSessionPayloadBuilder() *StartSessionPayloadBuilder {
+	return &StartSessionPayloadBuilder{p: *newStartSessionPayload()}
+}
+
+// WithTTSFormat sets the audio format of the bot speech, e.g. "pcm".
+func (b *StartSessionPayloadBuilder) WithTTSFormat(format string) *StartSessionPayloadBuilder {
+	b.p.TTS.AudioConfig.Format = format
+	return b
+}
+
+// WithSampleRate sets the sample rate of the bot speech.
+func (b *StartSessionPayloadBuilder) WithSampleRate(n int) *StartSessionPayloadBuilder {
+	b.p.TTS.AudioConfig.SampleRate = n
+	return b
+}
+
+// WithChannel sets the channel count of the bot speech.
+func (b *StartSessionPayloadBuilder) WithChannel(c int) *StartSessionPayloadBuilder {
+	b.p.TTS.AudioConfig.Channel = c
+	return b
+}
+
+// WithBotName sets the name of the bot.
+func (b *StartSessionPayloadBuilder) WithBotName(name string) *StartSessionPayloadBuilder {
+	b.p.Dialog.BotName = name
+	return b
+}
+
+// WithSystemRole sets the role the bot plays.
+func (b *StartSessionPayloadBuilder) WithSystemRole(role string) *StartSessionPayloadBuilder {
+	b.p.Dialog.SystemRole = role
+	return b
+}
+
+// Build validates the payload and returns it.
+func (b *StartSessionPayloadBuilder) Build() (StartSessionPayload, error) {
+	if err := b.p.Validate(); err != nil {
+		return StartSessionPayload{}, err
+	}
+	return b.p, nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// exportPreroll is how much audio before the server noticed the user speaking
+// is kept at the start of an exported user turn.
+const exportPreroll = 500 * time.Millisecond
+
+// exportTranscript is the file of the session export holding the transcript.
+const exportTranscript = "transcript.json"
+
+// sessionExporter keeps the user audio of each turn, from shortly before
+// ASRInfo to ASREnded, and writes it with the transcript when the dialog
+// ends. The export is what scriptgen turns into a conversation script.
+type sessionExporter struct {
+	dir string
+
+	lock      sync.Mutex
+	preroll   []int16 // the last exportPreroll of input while nobody speaks
+	capturing bool
+	current   []int16
+	segments  map[int][]int16 // by turn ID
+}
+
+// sessionExport exports the session if WithSessionExport is set.
+var sessionExport *sessionExporter
+
+// WithSessionExport writes the transcript of the dialog and the user audio of
+// every turn to dir when the dialog ends: transcript.json with the turns and
+// turn-<id>.wav for each turn the user spoke.
+func WithSessionExport(dir string) {
+	sessionExport = &sessionExporter{dir: dir, segments: map[int][]int16{}}
+}
+
+// userAudio records samples just sent.
+func (e *sessionExporter) userAudio(samples []int16) {
+	if e == nil {
+		return
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.capturing {
+		e.current = append(e.current, samples...)
+		return
+	}
+	e.preroll = append(e.preroll, samples...)
+	if keep := int(exportPreroll.Seconds() * inputSampleRate); len(e.preroll) > keep {
+		e.preroll = append(e.preroll[:0], e.preroll[len(e.preroll)-keep:]...)
+	}
+}
+
+// userStarted starts a user turn with the pre-roll.
+func (e *sessionExporter) userStarted() {
+	if e == nil {
+		return
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.capturing = true
+	e.current = append([]int16(nil), e.preroll...)
+	e.preroll = e.preroll[:0]
+}
+
+// userEnded ends the user turn, which is the turn with turnID.
+func (e *sessionExporter) userEnded(turnID int) {
+	if e == nil {
+		return
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if !e.capturing {
+		return
+	}
+	e.capturing = false
+	if turnID != 0 {
+		e.segments[turnID] = e.current
+	}
+	e.current = nil
+}
+
+// save writes the export to e.dir.
+func (e *sessionExporter) save() {
+	if e == nil {
+		return
+	}
+	if err := e.write(turns.Transcript()); err != nil {
+		glog.Errorf("Failed to export session: %v", err)
+		return
+	}
+	glog.Infof("Session exported to %s", e.dir)
+}
+
+func (e *sessionExporter) write(transcript []Turn) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if err := os.MkdirAll(e.dir, 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(transcript, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(e.dir, exportTranscript), data, 0644); err != nil {
+		return err
+	}
+	for id, samples := range e.segments {
+		if err := writeWAV(exportSegmentPath(e.dir, id), samples, inputSampleRate, 1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exportSegmentPath returns the path of the user audio of turn id.
+func exportSegmentPath(dir string, id int) string {
+	return filepath.Join(dir, fmt.Sprintf("turn-%d.wav", id))
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestSessionExportScriptgen exports a session of a spoken turn and a text
+// turn and checks that scriptgen turns it into a script -script accepts.
+func TestSessionExportScriptgen(t *testing.T) {
+	dir := t.TempDir()
+	e := &sessionExporter{dir: dir, segments: map[int][]int16{}}
+	preroll := int(exportPreroll.Seconds() * inputSampleRate)
+	e.userAudio(make([]int16, 2*preroll)) // silence before the user speaks
+	e.userStarted()
+	e.userAudio(make([]int16, 1600))
+	e.userEnded(2)
+	e.userAudio(make([]int16, 1600)) // the bot answering
+	if got := len(e.segments[2]); got != preroll+1600 {
+		t.Errorf("turn 2 has %d samples, want the pre-roll and the speech, %d", got, preroll+1600)
+	}
+
+	transcript := []Turn{
+		{ID: 1, BotText: "你好，有什么可以帮你"},
+		{ID: 2, UserText: "今天天气怎么样", BotText: "今天北京晴，气温二十度", FirstByteLatency: 800 * time.Millisecond},
+		{ID: 3, UserText: "谢谢, 再见", BotText: "再见"},
+	}
+	if err := e.write(transcript); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "turn-2.wav")); err != nil {
+		t.Errorf("user audio of turn 2 not exported: %v", err)
+	}
+
+	var out strings.Builder
+	if err := runScriptgen(&out, dir); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"audio: " + filepath.Join(dir, "turn-2.wav") + " => audio, contains=今天北京, max-latency=1.2s",
+		"text: 谢谢  再见 => audio, contains=再见",
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 || strings.Join(lines[1:], "\n") != strings.Join(want, "\n") {
+		t.Errorf("scriptgen wrote\n%s\nwant a comment and\n%s", out.String(), strings.Join(want, "\n"))
+	}
+	steps, err := parseScript(strings.NewReader(out.String()))
+	if err != nil {
+		t.Fatalf("parseScript(scriptgen output) = %v", err)
+	}
+	if len(steps) != 2 || steps[0].Audio == "" || steps[1].Text != "谢谢  再见" {
+		t.Errorf("parsed steps = %+v, want the spoken and the text turn", steps)
+	}
+}
+
+func TestScriptgenMissingExport(t *testing.T) {
+	if err := runScriptgen(&strings.Builder{}, t.TempDir()); err == nil {
+		t.Error("runScriptgen() on an empty directory = nil, want an error")
+	}
+}
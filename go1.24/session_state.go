@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var errSessionFinished = errors.New("session finished before becoming ready")
+
+// SessionState is the lifecycle state of the dialog session.
+type SessionState int32
+
+// Values that a SessionState variable can take.
+const (
+	StateIdle SessionState = iota
+	StateConnected
+	StateSessionStarted
+	StateSessionFinished
+	StateFailed
+)
+
+func (s SessionState) String() string {
+	switch s {
+	case StateIdle:
+		return "Idle"
+	case StateConnected:
+		return "Connected"
+	case StateSessionStarted:
+		return "SessionStarted"
+	case StateSessionFinished:
+		return "SessionFinished"
+	case StateFailed:
+		return "Failed"
+	default:
+		return fmt.Sprintf("invalid session state: %d", s)
+	}
+}
+
+// sessionStateMachine tracks the session lifecycle and lets goroutines wait
+// for transitions. It is safe for concurrent use.
+type sessionStateMachine struct {
+	lock    sync.Mutex
+	state   SessionState
+	err     error
+	changed chan struct{} // closed on every transition
+}
+
+func newSessionStateMachine() *sessionStateMachine {
+	return &sessionStateMachine{changed: make(chan struct{})}
+}
+
+var sessionState = newSessionStateMachine()
+
+// Set moves the machine to state. err is the cause of a StateFailed transition.
+func (m *sessionStateMachine) Set(state SessionState, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.state == state {
+		return
+	}
+	detail := fmt.Sprintf("%s -> %s", m.state, state)
+	if err != nil {
+		detail += ": " + err.Error()
+	}
+	journal.Record(JournalStateChange, 0, "", detail)
+	m.state, m.err = state, err
+	close(m.changed)
+	m.changed = make(chan struct{})
+}
+
+// State returns the current state.
+func (m *sessionStateMachine) State() SessionState {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.state
+}
+
+// WaitReady blocks until the server has confirmed the session start. It
+// returns an error if the session fails or finishes first, or ctx is done.
+func (m *sessionStateMachine) WaitReady(ctx context.Context) error {
+	for {
+		m.lock.Lock()
+		state, err, changed := m.state, m.err, m.changed
+		m.lock.Unlock()
+
+		switch state {
+		case StateSessionStarted:
+			return nil
+		case StateFailed:
+			return fmt.Errorf("session failed: %w", err)
+		case StateSessionFinished:
+			return errSessionFinished
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+	}
+}
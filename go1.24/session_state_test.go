@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// TestWaitReady checks that WaitReady returns only once the server confirmed
+// the session with SessionStarted.
+func TestWaitReady(t *testing.T) {
+	release := make(chan struct{})
+	s := newFakeServer(t, func(c *fakeConn) {
+		if c.expect(1) == nil {
+			return
+		}
+		c.send(serverFrame(50, "conn-1", `{}`))
+		msg := c.expect(100)
+		if msg == nil {
+			return
+		}
+		<-release
+		c.send(serverFrame(150, msg.SessionID, `{"dialog_id":"dialog-1"}`))
+		c.read() // until the client hangs up
+	})
+	setupDialog(t, s)
+	conn := dialFake(t)
+	ctx := context.Background()
+	if err := startConnection(ctx, conn); err != nil {
+		t.Fatal(err)
+	}
+
+	started := make(chan error, 1)
+	go func() { started <- startSession(ctx, conn, "session-1", product.NewSessionPayload()) }()
+	ready := make(chan error, 1)
+	go func() { ready <- sessionState.WaitReady(ctx) }()
+	select {
+	case err := <-ready:
+		t.Fatalf("WaitReady() = %v before SessionStarted", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	if err := <-started; err != nil {
+		t.Fatalf("startSession() = %v", err)
+	}
+	select {
+	case err := <-ready:
+		if err != nil {
+			t.Errorf("WaitReady() = %v, want nil after SessionStarted", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("WaitReady() did not return after SessionStarted")
+	}
+}
+
+func TestWaitReadyFailed(t *testing.T) {
+	m := newSessionStateMachine()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	go m.Set(StateFailed, context.DeadlineExceeded)
+	if err := m.WaitReady(ctx); err == nil {
+		t.Error("WaitReady() = nil for a failed session")
+	}
+
+	m = newSessionStateMachine()
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if err := m.WaitReady(ctx); err != context.Canceled {
+		t.Errorf("WaitReady() = %v, want context.Canceled", err)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/gorilla/websocket"
+)
+
+// ErrSessionIDInUse is returned by StartSession for a session ID still active
+// on the connection.
+var ErrSessionIDInUse = errors.New("session ID is still active on this connection")
+
+// SessionManager tracks the active sessions of each connection: a session is
+// active from its StartSession until SessionFinished or SessionFailed. Reusing
+// an active session ID mixes up two conversations on the server, so
+// startSession rejects it with ErrSessionIDInUse, and a message for a session
+// that is not active is reported rather than routed to some session. It is
+// safe for concurrent use.
+type SessionManager struct {
+	lock  sync.Mutex
+	conns map[*websocket.Conn]map[string]bool
+}
+
+// NewSessionManager returns a SessionManager without active sessions.
+func NewSessionManager() *SessionManager {
+	return &SessionManager{conns: map[*websocket.Conn]map[string]bool{}}
+}
+
+var sessionManager = NewSessionManager()
+
+// acquire marks sessionID active on conn, failing with ErrSessionIDInUse if
+// it already is.
+func (m *SessionManager) acquire(conn *websocket.Conn, sessionID string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	sessions := m.conns[conn]
+	if sessions[sessionID] {
+		return fmt.Errorf("%w: %s", ErrSessionIDInUse, sessionID)
+	}
+	if sessions == nil {
+		sessions = map[string]bool{}
+		m.conns[conn] = sessions
+	}
+	sessions[sessionID] = true
+	return nil
+}
+
+// release marks sessionID no longer active on conn.
+func (m *SessionManager) release(conn *websocket.Conn, sessionID string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.conns[conn], sessionID)
+	if len(m.conns[conn]) == 0 {
+		delete(m.conns, conn)
+	}
+}
+
+// Active reports whether sessionID is active on conn.
+func (m *SessionManager) Active(conn *websocket.Conn, sessionID string) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.conns[conn][sessionID]
+}
+
+// Sessions returns the IDs of the sessions active on conn, sorted.
+func (m *SessionManager) Sessions(conn *websocket.Conn) []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	ids := make([]string, 0, len(m.conns[conn]))
+	for id := range m.conns[conn] {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+// forget drops the sessions of a closed connection.
+func (m *SessionManager) forget(conn *websocket.Conn) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.conns, conn)
+}
+
+// observe checks an inbound message against the active sessions of conn. A
+// message for a session that is not active is logged as a warning, since it
+// is not clear which conversation it belongs to; the end of a session
+// releases its ID.
+func (m *SessionManager) observe(conn *websocket.Conn, msg *Message) {
+	if msg.SessionID == "" {
+		return
+	}
+	if !m.Active(conn, msg.SessionID) {
+		glog.Warningf("Received %s (event=%d) for unknown session %s", msg.Type, msg.Event, msg.SessionID)
+		journal.Record(JournalDiagnostic, msg.Event, msg.SessionID, "message for unknown session")
+		return
+	}
+	if msg.Event == 152 || msg.Event == 153 { // SessionFinished, SessionFailed
+		m.release(conn, msg.SessionID)
+	}
+}
+
+// dialogHistory records the dialog IDs the server assigned to each session ID.
+// A session started again with the same ID, e.g. on a new connection after
+// the old one broke, gets a new dialog ID; the history correlates their logs.
+type dialogHistory struct {
+	lock sync.Mutex
+	ids  map[string][]string
+}
+
+var dialogIDs = &dialogHistory{ids: map[string][]string{}}
+
+// record notes that the server assigned dialogID to sessionID.
+func (h *dialogHistory) record(sessionID, dialogID string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	ids := h.ids[sessionID]
+	if len(ids) > 0 {
+		last := ids[len(ids)-1]
+		if last == dialogID {
+			return
+		}
+		glog.Infof("reconnected: old dialogID=%s new dialogID=%s", last, dialogID)
+	}
+	h.ids[sessionID] = append(ids, dialogID)
+}
+
+// PreviousDialogIDs returns every dialog ID the server assigned to sessionID,
+// oldest first; the last one is the current dialog ID.
+func PreviousDialogIDs(sessionID string) []string {
+	dialogIDs.lock.Lock()
+	defer dialogIDs.lock.Unlock()
+	return append([]string(nil), dialogIDs.ids[sessionID]...)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+)
+
+// TestSessionIDReuse starts a session, checks that its ID cannot be started
+// again while it is active, and can once the server finished it.
+func TestSessionIDReuse(t *testing.T) {
+	finished := make(chan struct{})
+	s := newFakeServer(t, func(c *fakeConn) {
+		sid := c.handshake("dialog-1")
+		<-finished
+		c.send(serverFrame(152, sid, `{}`))
+		if msg := c.expect(100); msg != nil {
+			c.send(serverFrame(150, msg.SessionID, `{"dialog_id":"dialog-2"}`))
+		}
+		for c.read() != nil {
+		}
+	})
+	setupDialog(t, s)
+	conn := dialFake(t)
+	ctx := context.Background()
+	if err := startConnection(ctx, conn); err != nil {
+		t.Fatal(err)
+	}
+	if err := startSession(ctx, conn, "session-1", product.NewSessionPayload()); err != nil {
+		t.Fatal(err)
+	}
+	if got := sessionManager.Sessions(conn); !slices.Equal(got, []string{"session-1"}) {
+		t.Errorf("Sessions() = %v, want [session-1]", got)
+	}
+	if err := startSession(ctx, conn, "session-1", product.NewSessionPayload()); !errors.Is(err, ErrSessionIDInUse) {
+		t.Fatalf("startSession() with an active ID = %v, want ErrSessionIDInUse", err)
+	}
+
+	close(finished)
+	if msg, err := receiveMessage(conn); err != nil || msg.Event != 152 {
+		t.Fatalf("receiveMessage() = %v, %v, want SessionFinished", msg, err)
+	}
+	if sessionManager.Active(conn, "session-1") {
+		t.Error("session-1 still active after SessionFinished")
+	}
+	if err := startSession(ctx, conn, "session-1", product.NewSessionPayload()); err != nil {
+		t.Errorf("startSession() after SessionFinished = %v, want nil", err)
+	}
+	if got := PreviousDialogIDs("session-1"); !slices.Equal(got, []string{"dialog-1", "dialog-2"}) {
+		t.Errorf("PreviousDialogIDs() = %v, want both dialogs", got)
+	}
+}
+
+// TestUnknownSessionWarning checks that a message for a session that is not
+// active is reported in the journal, and not taken for the active one.
+func TestUnknownSessionWarning(t *testing.T) {
+	s := newFakeServer(t, func(c *fakeConn) {
+		c.handshake("dialog-1")
+		c.send(serverFrame(550, "session-9", `{"content":"串话"}`))
+		for c.read() != nil {
+		}
+	})
+	setupDialog(t, s)
+	conn := dialFake(t)
+	ctx := context.Background()
+	if err := startConnection(ctx, conn); err != nil {
+		t.Fatal(err)
+	}
+	if err := startSession(ctx, conn, "session-1", product.NewSessionPayload()); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := receiveMessage(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.SessionID != "session-9" {
+		t.Errorf("message of session %q, want session-9 as sent", msg.SessionID)
+	}
+	var warned bool
+	for _, e := range journal.Entries() {
+		if e.Kind == JournalDiagnostic && e.SessionID == "session-9" && e.Detail == "message for unknown session" {
+			warned = true
+		}
+	}
+	if !warned {
+		t.Errorf("journal = %+v, want a diagnostic about session-9", journal.Entries())
+	}
+	if got := sessionManager.Sessions(conn); !slices.Equal(got, []string{"session-1"}) {
+		t.Errorf("Sessions() = %v, want only session-1", got)
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/gorilla/websocket"
+)
+
+// ShutdownKind classifies why a dialog ended.
+type ShutdownKind int
+
+// Values that a ShutdownKind variable can take.
+const (
+	// ShutdownUserRequested means the user quit, e.g. with Ctrl-C, or the
+	// audio input file ended and the bot answered its last turn.
+	ShutdownUserRequested ShutdownKind = iota
+	// ShutdownContextCanceled means the context of the dialog was canceled.
+	ShutdownContextCanceled
+	// ShutdownServerClosed means the server closed the connection, ended the
+	// session or sent an Error frame.
+	ShutdownServerClosed
+	// ShutdownAuthFailure means the credentials were rejected.
+	ShutdownAuthFailure
+	// ShutdownAudioFatal means the audio input or output failed.
+	ShutdownAudioFatal
+	// ShutdownIdleTimeout means -idle-behavior terminate ended the session.
+	ShutdownIdleTimeout
+	// ShutdownError is any other failure, e.g. a protocol error.
+	ShutdownError
+	// ShutdownAuditRejected means the server rejected a user query in its
+	// audit and WithFailOnAudit(AuditFailSession) is set.
+	ShutdownAuditRejected
+)
+
+func (k ShutdownKind) String() string {
+	switch k {
+	case ShutdownUserRequested:
+		return "UserRequested"
+	case ShutdownContextCanceled:
+		return "ContextCanceled"
+	case ShutdownServerClosed:
+		return "ServerClosed"
+	case ShutdownAuthFailure:
+		return "AuthFailure"
+	case ShutdownAudioFatal:
+		return "AudioFatal"
+	case ShutdownIdleTimeout:
+		return "IdleTimeout"
+	case ShutdownError:
+		return "Error"
+	case ShutdownAuditRejected:
+		return "AuditRejected"
+	default:
+		return fmt.Sprintf("invalid shutdown kind: %d", k)
+	}
+}
+
+// shutdownExitCodes maps each kind to the exit code of the command. Failures
+// get codes from 10 up, apart from 1, which glog.Exitf exits with, and 2, the
+// exit code of invalid flags.
+var shutdownExitCodes = map[ShutdownKind]int{
+	ShutdownUserRequested:   0,
+	ShutdownContextCanceled: 0,
+	ShutdownServerClosed:    10,
+	ShutdownAuthFailure:     11,
+	ShutdownAudioFatal:      12,
+	ShutdownIdleTimeout:     13,
+	ShutdownAuditRejected:   14,
+	ShutdownError:           15,
+}
+
+// exitCodesHelp documents the exit codes in the -help output.
+const exitCodesHelp = `
+Exit codes:
+  0   quit by the user
+  1   failed to start, e.g. an unreadable file, or a -script turn failed
+  2   invalid flags
+Exit codes of a dialog:
+  10  closed by the server
+  11  credentials rejected
+  12  audio input or output failed
+  13  ended by -idle-behavior terminate
+  14  query rejected by the audit with -fail-on-audit session
+  15  other error
+Exit codes of -ask -once:
+  20  connecting failed
+  21  starting the session failed
+  22  no response
+  23  the answer did not complete
+  24  other error
+`
+
+// ShutdownReason tells why a dialog ended. Code is the websocket close code or
+// the server error code with ShutdownServerClosed, Err the underlying failure.
+type ShutdownReason struct {
+	Kind ShutdownKind
+	Code int
+	Err  error
+}
+
+func (r *ShutdownReason) Error() string {
+	s := r.Kind.String()
+	if r.Code != 0 {
+		s += fmt.Sprintf("{code=%d}", r.Code)
+	}
+	if r.Err != nil {
+		s += ": " + r.Err.Error()
+	}
+	return s
+}
+
+func (r *ShutdownReason) Unwrap() error {
+	return r.Err
+}
+
+// ExitCode returns the exit code of the command for r.
+func (r *ShutdownReason) ExitCode() int {
+	return shutdownExitCodes[r.Kind]
+}
+
+// ShutdownMetrics is implemented by a Metrics set with WithMetrics that also
+// counts how dialogs ended. The session statistics count them regardless.
+type ShutdownMetrics interface {
+	ObserveShutdown(kind ShutdownKind)
+}
+
+// shutdownFor classifies err, which ended the dialog.
+func shutdownFor(err error) *ShutdownReason {
+	var reason *ShutdownReason
+	var credErr *CredentialError
+	var closeErr *websocket.CloseError
+	var serverErr ServerError
+	switch {
+	case errors.As(err, &reason):
+		return reason
+	case errors.As(err, &credErr):
+		return &ShutdownReason{Kind: ShutdownAuthFailure, Code: credErr.Code, Err: err}
+	case errors.As(err, &closeErr):
+		return &ShutdownReason{Kind: ShutdownServerClosed, Code: closeErr.Code, Err: err}
+	case errors.As(err, &serverErr):
+		return &ShutdownReason{Kind: ShutdownServerClosed, Code: serverErr.Code, Err: err}
+	default:
+		return &ShutdownReason{Kind: ShutdownError, Err: err}
+	}
+}
+
+// shutdownCause returns why ctx was canceled: the ShutdownReason it was
+// canceled with, or ShutdownContextCanceled.
+func shutdownCause(ctx context.Context) *ShutdownReason {
+	var reason *ShutdownReason
+	if errors.As(context.Cause(ctx), &reason) {
+		return reason
+	}
+	return &ShutdownReason{Kind: ShutdownContextCanceled, Err: context.Cause(ctx)}
+}
+
+// recordShutdown logs why the dialog ended, counts it in the metrics, hands
+// the final session statistics to the stats reporters and returns the summary
+// of the dialog, which it also keeps for SessionSummary.
+func recordShutdown(sessionID string, reason *ShutdownReason) DialogSummary {
+	glog.Infof("Dialog ended: %v", reason)
+	journal.Record(JournalCommand, 0, sessionID, "shutdown: "+reason.Error())
+	shutdownCounts.ObserveShutdown(reason.Kind)
+	if m, ok := metrics.(ShutdownMetrics); ok {
+		m.ObserveShutdown(reason.Kind)
+	}
+	stats := collectStats(sessionID)
+	stats.Shutdown = reason.Error()
+	for _, sr := range registeredReporters() {
+		sr.reporter.Report(stats)
+	}
+	summary := summarize(stats)
+	setSessionSummary(summary)
+	return summary
+}
+
+// gracefulShutdownTimeout bounds how long the process waits for the dialogs
+// to stop before it closes the audio devices anyway.
+const gracefulShutdownTimeout = 5 * time.Second
+
+var errShutdownTimeout = errors.New("dialogs did not stop in time")
+
+// ShutdownManager tracks the running dialogs and their goroutines, so that
+// shared resources such as the audio devices are only released once every
+// dialog stopped using them.
+type ShutdownManager struct {
+	lock     sync.Mutex
+	sessions map[string]context.CancelCauseFunc
+	wg       sync.WaitGroup
+}
+
+var shutdownManager = &ShutdownManager{sessions: map[string]context.CancelCauseFunc{}}
+
+// register adds the dialog of sessionID, which stop ends. The returned func
+// removes it again.
+func (m *ShutdownManager) register(sessionID string, stop context.CancelCauseFunc) func() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.sessions[sessionID] = stop
+	return func() {
+		m.lock.Lock()
+		defer m.lock.Unlock()
+		delete(m.sessions, sessionID)
+	}
+}
+
+// Go runs f in a goroutine GracefulShutdown waits for.
+func (m *ShutdownManager) Go(f func()) {
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		f()
+	}()
+}
+
+// GracefulShutdown ends every registered dialog and waits until all goroutines
+// started with Go returned, or fails with errShutdownTimeout after timeout.
+func (m *ShutdownManager) GracefulShutdown(timeout time.Duration) error {
+	m.lock.Lock()
+	for _, stop := range m.sessions {
+		stop(&ShutdownReason{Kind: ShutdownContextCanceled})
+	}
+	m.lock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		m.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("%w after %s", errShutdownTimeout, timeout)
+	}
+}
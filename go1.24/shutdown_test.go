@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// recordingShutdowns is a Metrics recording the shutdowns it observes.
+type recordingShutdowns struct {
+	*MessageSizeHistogram
+	kinds []ShutdownKind
+}
+
+func (m *recordingShutdowns) ObserveShutdown(kind ShutdownKind) {
+	m.kinds = append(m.kinds, kind)
+}
+
+// TestShutdownServerClosed checks that a session ended by the server is
+// reported as ShutdownServerClosed, with its exit code, in the summary and in
+// the metrics.
+func TestShutdownServerClosed(t *testing.T) {
+	s := newFakeServer(t, scriptedDialog(func(c *fakeConn, sid string) {}))
+	setupDialog(t, s)
+	m := &recordingShutdowns{MessageSizeHistogram: NewMessageSizeHistogram()}
+	WithMetrics(m)
+	t.Cleanup(func() { WithMetrics(messageSizes) })
+
+	summary, err := runFakeDialog(t)
+	var reason *ShutdownReason
+	if !errors.As(err, &reason) || reason.Kind != ShutdownServerClosed {
+		t.Fatalf("realTimeDialog() = %v, want ShutdownServerClosed", err)
+	}
+	if code := reason.ExitCode(); code != 10 {
+		t.Errorf("ExitCode() = %d, want 10", code)
+	}
+	if summary.DisconnectReason != reason.Error() {
+		t.Errorf("summary.DisconnectReason = %q, want %q", summary.DisconnectReason, reason.Error())
+	}
+	if len(m.kinds) != 1 || m.kinds[0] != ShutdownServerClosed {
+		t.Errorf("ShutdownMetrics observed %v, want [ServerClosed]", m.kinds)
+	}
+	if got := collectStats("session-1").Shutdowns; len(got) != 1 || got["ServerClosed"] != 1 {
+		t.Errorf("stats.Shutdowns = %v, want one ServerClosed", got)
+	}
+}
+
+// TestShutdownContextCanceled cancels the context of a running dialog.
+func TestShutdownContextCanceled(t *testing.T) {
+	s := newFakeServer(t, func(c *fakeConn) {
+		c.handshake("dialog-1")
+		for c.read() != nil {
+		}
+	})
+	setupDialog(t, s)
+	conn := dialFake(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	ended := make(chan *ShutdownReason, 1)
+	go func() { ended <- runDialog(ctx, conn, "session-1") }()
+	if err := sessionState.WaitReady(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	reason := <-ended
+	if reason.Kind != ShutdownContextCanceled {
+		t.Errorf("runDialog() = %v, want ShutdownContextCanceled", reason)
+	}
+	if code := reason.ExitCode(); code != 0 {
+		t.Errorf("ExitCode() = %d, want 0", code)
+	}
+	if err := shutdownManager.GracefulShutdown(time.Second); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestShutdownAuthFailure rejects StartConnection with a client error code.
+func TestShutdownAuthFailure(t *testing.T) {
+	s := newFakeServer(t, func(c *fakeConn) {
+		if c.expect(1) != nil {
+			c.send(serverError(45000003, `{"error":"invalid access token"}`))
+		}
+	})
+	setupDialog(t, s)
+
+	summary, err := runFakeDialog(t)
+	var reason *ShutdownReason
+	if !errors.As(err, &reason) || reason.Kind != ShutdownAuthFailure || reason.Code != 45000003 {
+		t.Fatalf("realTimeDialog() = %v, want ShutdownAuthFailure with code 45000003", err)
+	}
+	if code := reason.ExitCode(); code != 11 {
+		t.Errorf("ExitCode() = %d, want 11", code)
+	}
+	if summary.DisconnectReason != reason.Error() {
+		t.Errorf("summary.DisconnectReason = %q, want %q", summary.DisconnectReason, reason.Error())
+	}
+}
+
+// TestExitCodesDistinct checks that no dialog failure exits like glog.Exitf,
+// invalid flags or a failed -ask -once.
+func TestExitCodesDistinct(t *testing.T) {
+	reserved := map[int]string{1: "glog.Exitf", 2: "invalid flags"}
+	for _, code := range []int{exitAskConnect, exitAskSession, exitAskResponse, exitAskAnswer, exitAskFailed} {
+		reserved[code] = "-ask -once"
+	}
+	for kind, code := range shutdownExitCodes {
+		if code == 0 {
+			continue
+		}
+		if other, ok := reserved[code]; ok {
+			t.Errorf("%v exits with %d, like %s", kind, code, other)
+		}
+		reserved[code] = kind.String()
+	}
+}
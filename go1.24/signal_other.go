@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// There is no user signal to dump the session journal on; it is written on
+// exit only.
+var journalDumpSignal os.Signal
@@ -0,0 +1,12 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// journalDumpSignal makes the client dump the session journal. SIGQUIT is
+// left to the Go runtime, which dumps the goroutines on it.
+var journalDumpSignal os.Signal = syscall.SIGUSR1
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// switchSource is the uplink source of the dialog. The source it reads from
+// can be replaced between two frames, so that the session and its sequence
+// numbering simply continue on the new source. It never ends: once its input
+// is exhausted it sends silence until the next source is set.
+type switchSource struct {
+	lock    sync.Mutex
+	current AudioSource
+	name    string
+	// revert is the source a temporary source started with PlaySource hands
+	// back to at EOF; it stays open meanwhile.
+	revert     AudioSource
+	revertName string
+	// reading is the source ReadFrame is blocked on, outside of lock. A
+	// source replaced while it is read is only closed once the read
+	// returned: it is kept in retired until then, and retiredDone is closed
+	// after closing it.
+	reading     AudioSource
+	retired     []namedSource
+	retiredDone chan struct{}
+}
+
+type namedSource struct {
+	src  AudioSource
+	name string
+}
+
+// newSwitchSource returns a switchSource starting on src.
+func newSwitchSource(src AudioSource, name string) *switchSource {
+	turns.sourceChanged(name)
+	return &switchSource{current: src, name: name}
+}
+
+// SetSource replaces the uplink source of the dialog with src at the next
+// frame boundary; the previous source is closed. It fails unless the dialog
+// reads its input through a switchable source.
+func SetSource(src AudioSource, name string) error {
+	s, ok := audioSource.(*switchSource)
+	if !ok {
+		return errors.New("audio input is not switchable")
+	}
+	s.set(src, name, false)
+	return nil
+}
+
+// PlaySource is like SetSource, but src is temporary: at its EOF the dialog
+// goes back to the source it replaced.
+func PlaySource(src AudioSource, name string) error {
+	s, ok := audioSource.(*switchSource)
+	if !ok {
+		return errors.New("audio input is not switchable")
+	}
+	s.set(src, name, true)
+	return nil
+}
+
+// switchToMic makes the microphone the uplink source. The sources in use are
+// closed before the microphone is opened, so that two input streams are never
+// open on the device at once; the dialog sends silence in between.
+func switchToMic(ctx context.Context) error {
+	s, ok := audioSource.(*switchSource)
+	if !ok {
+		return errors.New("audio input is not switchable")
+	}
+	select {
+	case <-s.set(silenceSource{}, "silence", false):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	src, err := newAudioSource("mic")
+	if err != nil {
+		return err
+	}
+	s.set(src, "mic", false)
+	return nil
+}
+
+// set swaps in src without waiting for the frame being read. The returned
+// channel is closed once the sources it replaced are closed.
+func (s *switchSource) set(src AudioSource, name string, temporary bool) <-chan struct{} {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if temporary && s.revert == nil {
+		// 保留被替换的输入，临时输入读完后切回
+		s.revert, s.revertName = s.current, s.name
+		s.switchTo(src, name)
+		return closedChan
+	}
+	if !temporary && s.revert != nil {
+		s.retire(s.revert, s.revertName)
+		s.revert, s.revertName = nil, ""
+	}
+	done := s.retire(s.current, s.name)
+	s.switchTo(src, name)
+	return done
+}
+
+// closedChan is a closed channel, for sources closed right away.
+var closedChan = func() chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}()
+
+// retire closes src, which was replaced, or leaves it to ReadFrame if it is
+// being read. s.lock must be held.
+func (s *switchSource) retire(src AudioSource, name string) <-chan struct{} {
+	if src != s.reading {
+		s.closeSource(src, name)
+		return closedChan
+	}
+	s.retired = append(s.retired, namedSource{src, name})
+	if s.retiredDone == nil {
+		s.retiredDone = make(chan struct{})
+	}
+	return s.retiredDone
+}
+
+// switchTo makes src the current source and notes the change in the log, the
+// journal and the transcript. s.lock must be held.
+func (s *switchSource) switchTo(src AudioSource, name string) {
+	glog.Infof("Audio input switched from %s to %s.", s.name, name)
+	journal.Record(JournalCommand, 0, "", fmt.Sprintf("audio input switched from %s to %s", s.name, name))
+	turns.sourceChanged(name)
+	s.current, s.name = src, name
+}
+
+func (s *switchSource) closeSource(src AudioSource, name string) {
+	if err := src.Close(); err != nil {
+		glog.Errorf("Failed to close audio input %s: %v", name, err)
+	}
+}
+
+// ReadFrame reads a frame of the current source. The read happens outside of
+// s.lock, so that switching never waits for a frame to arrive; a frame read
+// from a source replaced meanwhile is still sent.
+func (s *switchSource) ReadFrame(ctx context.Context) ([]int16, error) {
+	for {
+		s.lock.Lock()
+		src := s.current
+		s.reading = src
+		s.lock.Unlock()
+
+		samples, err := src.ReadFrame(ctx)
+
+		s.lock.Lock()
+		s.reading = nil
+		replaced := s.closeRetired()
+		if replaced || !errors.Is(err, io.EOF) {
+			s.lock.Unlock()
+			if replaced && err != nil {
+				// 被替换的输入读完或出错，改读新的输入
+				continue
+			}
+			return samples, err
+		}
+		switch {
+		case src != s.current:
+			// 读取期间 /play 把它留作临时输入读完后切回的输入
+			s.closeSource(s.revert, s.revertName)
+			s.revert, s.revertName = nil, ""
+		case s.revert == nil:
+			s.closeSource(s.current, s.name)
+			// 输入读完后以静音继续会话，/play 仍然可以播放新的录音
+			s.switchTo(silenceSource{}, "silence")
+		default:
+			s.closeSource(s.current, s.name)
+			s.switchTo(s.revert, s.revertName)
+			s.revert, s.revertName = nil, ""
+		}
+		s.lock.Unlock()
+	}
+}
+
+// closeRetired closes the sources replaced during a read and reports whether
+// there were any. s.lock must be held.
+func (s *switchSource) closeRetired() bool {
+	if len(s.retired) == 0 {
+		return false
+	}
+	for _, r := range s.retired {
+		s.closeSource(r.src, r.name)
+	}
+	s.retired = nil
+	close(s.retiredDone)
+	s.retiredDone = nil
+	return true
+}
+
+func (s *switchSource) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.revert != nil {
+		s.closeSource(s.revert, s.revertName)
+		s.revert = nil
+	}
+	if s.current == s.reading {
+		// 正在读取的输入由 ReadFrame 在读取返回后关闭
+		s.retire(s.current, s.name)
+		return nil
+	}
+	return s.current.Close()
+}
+
+// runCommands reads input commands from r, one per line, until r ends or ctx
+// is done:
+//
+//	/play <file>  speak the PCM/WAV file, then go back to the current input
+//	/mic          switch to the microphone
+//	/output <dev> play on the output device called dev
+//	/debug on|off turn the frame logging of WithDebugMode on or off
+func runCommands(ctx context.Context, r io.Reader) {
+	sc := bufio.NewScanner(r)
+	for ctx.Err() == nil && sc.Scan() {
+		command, arg, _ := strings.Cut(strings.TrimSpace(sc.Text()), " ")
+		arg = strings.TrimSpace(arg)
+		var err error
+		switch command {
+		case "":
+			continue
+		case "/play":
+			var src AudioSource
+			if src, err = NewFileSource(arg); err == nil {
+				err = PlaySource(src, arg)
+			}
+		case "/mic":
+			err = switchToMic(ctx)
+		case "/output":
+			err = SwitchOutputDevice(arg)
+		case "/debug":
+			switch arg {
+			case "on", "off":
+				SetDebugMode(arg == "on")
+			default:
+				err = fmt.Errorf("want /debug on or /debug off, got %q", arg)
+			}
+		default:
+			err = fmt.Errorf("unknown command %q, want /play <file>, /mic, /output <device> or /debug on|off", command)
+		}
+		if err != nil {
+			glog.Errorf("Command %s: %v", command, err)
+		}
+	}
+}
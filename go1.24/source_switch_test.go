@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// gatedSource is an AudioSource whose reads block until a frame is released.
+type gatedSource struct {
+	reading chan struct{}
+	frames  chan []int16
+	lock    sync.Mutex
+	closed  bool
+}
+
+func newGatedSource() *gatedSource {
+	return &gatedSource{reading: make(chan struct{}, 1), frames: make(chan []int16)}
+}
+
+func (g *gatedSource) ReadFrame(ctx context.Context) ([]int16, error) {
+	g.reading <- struct{}{}
+	select {
+	case f := <-g.frames:
+		return f, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (g *gatedSource) Close() error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.closed = true
+	return nil
+}
+
+func (g *gatedSource) isClosed() bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.closed
+}
+
+// TestSwitchSourceDuringRead switches the source while a frame is being read
+// and checks that the switch does not wait for it, that the frame is still
+// returned and that the old source is closed only after the read.
+func TestSwitchSourceDuringRead(t *testing.T) {
+	setupDialog(t, nil)
+	old := newGatedSource()
+	s := newSwitchSource(old, "old")
+	read := make(chan []int16)
+	go func() {
+		samples, err := s.ReadFrame(context.Background())
+		if err != nil {
+			t.Errorf("ReadFrame() = %v", err)
+		}
+		read <- samples
+	}()
+	<-old.reading
+
+	switched := make(chan struct{})
+	go func() {
+		s.set(&MemorySource{Frames: [][]int16{{2}}}, "new", false)
+		close(switched)
+	}()
+	select {
+	case <-switched:
+	case <-time.After(5 * time.Second):
+		t.Fatal("switching the source waited for the frame being read")
+	}
+	if old.isClosed() {
+		t.Error("the source being read was closed during the read")
+	}
+
+	old.frames <- []int16{1}
+	if got := <-read; len(got) != 1 || got[0] != 1 {
+		t.Errorf("ReadFrame() = %v, want the frame of the old source", got)
+	}
+	if !old.isClosed() {
+		t.Error("the old source was not closed after its read")
+	}
+	if got, err := s.ReadFrame(context.Background()); err != nil || len(got) != 1 || got[0] != 2 {
+		t.Errorf("ReadFrame() = %v, %v, want the frame of the new source", got, err)
+	}
+}
+
+// exclusiveMicBackend fails to open a mic while another one is open, like an
+// input device taking a single stream.
+type exclusiveMicBackend struct {
+	fakeBackend
+	lock sync.Mutex
+	open int
+}
+
+func (b *exclusiveMicBackend) NewSource() (AudioSource, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.open > 0 {
+		return nil, errors.New("device busy")
+	}
+	b.open++
+	return &exclusiveMic{fakeMic: newFakeMic(), b: b}, nil
+}
+
+type exclusiveMic struct {
+	*fakeMic
+	b    *exclusiveMicBackend
+	once sync.Once
+}
+
+func (m *exclusiveMic) Close() error {
+	m.once.Do(func() {
+		m.b.lock.Lock()
+		m.b.open--
+		m.b.lock.Unlock()
+	})
+	return m.fakeMic.Close()
+}
+
+// TestSwitchToMic switches to the mic while the mic is being read and checks
+// that the old stream is closed before the new one is opened.
+func TestSwitchToMic(t *testing.T) {
+	setupDialog(t, nil)
+	b := &exclusiveMicBackend{}
+	WithAudioBackend(b)
+	t.Cleanup(func() { WithAudioBackend(defaultAudioBackend) })
+	mic, err := newAudioSource("mic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newSwitchSource(mic, "mic")
+	audioSource = s
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for ctx.Err() == nil {
+			_, _ = s.ReadFrame(ctx)
+		}
+	}()
+	err = switchToMic(ctx)
+	cancel()
+	wg.Wait()
+	if err != nil {
+		t.Fatalf("switchToMic() = %v", err)
+	}
+	if s.current == mic || s.name != "mic" {
+		t.Errorf("input is %s, want a new mic", s.name)
+	}
+	if b.open != 1 {
+		t.Errorf("%d mics open, want 1", b.open)
+	}
+}
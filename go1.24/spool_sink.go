@@ -0,0 +1,321 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// spoolPattern names spool files; the * is replaced by os.CreateTemp.
+	spoolPattern = "realtimedialog-spool-*.pcm"
+	// spoolChunkHeader is the size of a chunk header in the spool file: the
+	// receive time in Unix nanoseconds and the number of samples.
+	spoolChunkHeader = 12
+	// spoolRetryInterval is how often a spooling sink checks whether the
+	// consumer is back while no new audio arrives.
+	spoolRetryInterval = 500 * time.Millisecond
+)
+
+// SpoolConfig configures NewSpoolSink. Zero fields take the defaults.
+type SpoolConfig struct {
+	// MemorySamples is how much audio is held in memory while the consumer
+	// is away before spilling to disk. Default 5s.
+	MemorySamples int
+	// Dir is where spool files are created. Default os.TempDir().
+	Dir string
+	// MaxBytes caps the spool file; audio beyond it is discarded. Default
+	// 64 MiB, about 20 minutes.
+	MaxBytes int64
+	// MaxAge is how old queued audio may get before it is discarded instead
+	// of replayed. Spool files left behind by a dead process are removed
+	// once they are this old. Default 2m.
+	MaxAge time.Duration
+}
+
+func (c *SpoolConfig) setDefaults() {
+	if c.MemorySamples <= 0 {
+		c.MemorySamples = 5 * sampleRate
+	}
+	if c.Dir == "" {
+		c.Dir = os.TempDir()
+	}
+	if c.MaxBytes <= 0 {
+		c.MaxBytes = 64 << 20
+	}
+	if c.MaxAge <= 0 {
+		c.MaxAge = 2 * time.Minute
+	}
+}
+
+type spoolChunk struct {
+	at      time.Time
+	samples []int16
+}
+
+// spoolSink queues the audio its consumer fails to take, first in memory and
+// then in a spool file, and replays it in order once the consumer accepts
+// writes again.
+type spoolSink struct {
+	next AudioSink
+	cfg  SpoolConfig
+	stop chan struct{}
+
+	lock          sync.Mutex
+	memory        []spoolChunk // the oldest queued audio
+	memorySamples int
+	file          *os.File // newer queued audio, nil if none
+	readOff       int64
+	writeOff      int64
+	fileSamples   int
+	gap           time.Duration // discarded audio not logged yet
+	gapReason     string
+	spooling      bool
+	closed        bool
+}
+
+// NewSpoolSink wraps next so that audio is not lost while next fails, e.g.
+// because the consumer of a relay disconnected for a moment: failed writes
+// are queued and replayed in order once next works again. Queued audio that
+// exceeds cfg.MaxBytes or cfg.MaxAge is discarded and logged as a gap. Stale
+// spool files of earlier processes in cfg.Dir are removed.
+func NewSpoolSink(next AudioSink, cfg SpoolConfig) AudioSink {
+	cfg.setDefaults()
+	removeStaleSpools(cfg.Dir, cfg.MaxAge)
+	s := &spoolSink{next: next, cfg: cfg, stop: make(chan struct{})}
+	go s.retry()
+	return s
+}
+
+// removeStaleSpools removes the spool files in dir not written to for maxAge,
+// which hold only audio too old to replay.
+func removeStaleSpools(dir string, maxAge time.Duration) {
+	paths, _ := filepath.Glob(filepath.Join(dir, spoolPattern))
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil || time.Since(info.ModTime()) < maxAge {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			glog.Warningf("Failed to remove stale spool %s: %v", path, err)
+			continue
+		}
+		glog.Infof("Removed stale spool %s", path)
+	}
+}
+
+func (s *spoolSink) WriteFrame(samples []int16) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return errors.New("spool sink closed")
+	}
+	if s.drain() {
+		err := s.next.WriteFrame(samples)
+		if err == nil {
+			return nil
+		}
+		if !s.spooling {
+			glog.Warningf("Audio output failed, spooling: %v", err)
+			s.spooling = true
+		}
+	}
+	s.enqueue(spoolChunk{at: time.Now(), samples: append([]int16(nil), samples...)})
+	return nil
+}
+
+// Flush drops the queued audio along with the audio queued in next.
+func (s *spoolSink) Flush() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.dropMemory()
+	s.removeFile()
+	return s.next.Flush()
+}
+
+// Close discards the audio still queued, removes the spool file and closes
+// next.
+func (s *spoolSink) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	close(s.stop)
+	if queued := s.memorySamples + s.fileSamples; queued > 0 {
+		s.discard(samplesDuration(queued), "output closed")
+	}
+	s.logGap()
+	s.dropMemory()
+	s.removeFile()
+	return s.next.Close()
+}
+
+// retry replays queued audio while no new audio arrives to trigger it.
+func (s *spoolSink) retry() {
+	ticker := time.NewTicker(spoolRetryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.lock.Lock()
+			if !s.closed {
+				s.drain()
+			}
+			s.lock.Unlock()
+		}
+	}
+}
+
+// drain writes the queued audio to next in order. It reports whether the
+// queue is empty. s.lock must be held.
+func (s *spoolSink) drain() bool {
+	for len(s.memory) > 0 {
+		c := s.memory[0]
+		if !s.replay(c) {
+			return false
+		}
+		s.memory = s.memory[1:]
+		s.memorySamples -= len(c.samples)
+		releaseAudioMemory(int64(2 * len(c.samples)))
+	}
+	for s.file != nil && s.readOff < s.writeOff {
+		c, size, err := s.readChunk()
+		if err != nil {
+			glog.Errorf("Read spool: %v", err)
+			s.discard(samplesDuration(s.fileSamples), "spool unreadable")
+			s.removeFile()
+			break
+		}
+		if !s.replay(c) {
+			return false
+		}
+		s.readOff += size
+		s.fileSamples -= len(c.samples)
+	}
+	if s.file != nil {
+		s.removeFile()
+	}
+	s.logGap()
+	if s.spooling {
+		glog.Info("Audio output is back, spooled audio replayed.")
+		s.spooling = false
+	}
+	return true
+}
+
+// replay writes a queued chunk to next, or discards it if it is too old. It
+// reports false if next failed. s.lock must be held.
+func (s *spoolSink) replay(c spoolChunk) bool {
+	if time.Since(c.at) > s.cfg.MaxAge {
+		s.discard(samplesDuration(len(c.samples)), fmt.Sprintf("older than %s", s.cfg.MaxAge))
+		return true
+	}
+	s.logGap()
+	return s.next.WriteFrame(c.samples) == nil
+}
+
+// enqueue queues c in memory or, once that is full, the audio memory limit is
+// reached or spilling has begun, in the spool file. s.lock must be held.
+func (s *spoolSink) enqueue(c spoolChunk) {
+	if s.file == nil && s.memorySamples+len(c.samples) <= s.cfg.MemorySamples && reserveAudioMemory(int64(2*len(c.samples))) {
+		s.memory = append(s.memory, c)
+		s.memorySamples += len(c.samples)
+		return
+	}
+	size := int64(spoolChunkHeader + 2*len(c.samples))
+	if s.writeOff+size > s.cfg.MaxBytes {
+		s.discard(samplesDuration(len(c.samples)), fmt.Sprintf("spool exceeds %d bytes", s.cfg.MaxBytes))
+		return
+	}
+	if s.file == nil {
+		f, err := os.CreateTemp(s.cfg.Dir, spoolPattern)
+		if err != nil {
+			glog.Errorf("Create spool: %v", err)
+			s.discard(samplesDuration(len(c.samples)), "spool unavailable")
+			return
+		}
+		glog.Infof("Spooling audio output to %s", f.Name())
+		s.file, s.readOff, s.writeOff = f, 0, 0
+	}
+	buf := make([]byte, size)
+	binary.LittleEndian.PutUint64(buf, uint64(c.at.UnixNano()))
+	binary.LittleEndian.PutUint32(buf[8:], uint32(len(c.samples)))
+	copy(buf[spoolChunkHeader:], samplesToBytes(c.samples))
+	if _, err := s.file.WriteAt(buf, s.writeOff); err != nil {
+		glog.Errorf("Write spool: %v", err)
+		s.discard(samplesDuration(len(c.samples)), "spool unwritable")
+		return
+	}
+	s.writeOff += size
+	s.fileSamples += len(c.samples)
+}
+
+// readChunk reads the chunk at s.readOff and returns it with its size in the
+// file. s.lock must be held.
+func (s *spoolSink) readChunk() (spoolChunk, int64, error) {
+	header := make([]byte, spoolChunkHeader)
+	if _, err := s.file.ReadAt(header, s.readOff); err != nil {
+		return spoolChunk{}, 0, err
+	}
+	n := int64(binary.LittleEndian.Uint32(header[8:]))
+	data := make([]byte, 2*n)
+	if _, err := s.file.ReadAt(data, s.readOff+spoolChunkHeader); err != nil && !errors.Is(err, io.EOF) {
+		return spoolChunk{}, 0, err
+	}
+	at := time.Unix(0, int64(binary.LittleEndian.Uint64(header)))
+	return spoolChunk{at: at, samples: bytesToSamples(data)}, spoolChunkHeader + 2*n, nil
+}
+
+// dropMemory drops the audio queued in memory. s.lock must be held.
+func (s *spoolSink) dropMemory() {
+	releaseAudioMemory(int64(2 * s.memorySamples))
+	s.memory, s.memorySamples = nil, 0
+}
+
+// removeFile closes and deletes the spool file. s.lock must be held.
+func (s *spoolSink) removeFile() {
+	if s.file == nil {
+		return
+	}
+	_ = s.file.Close()
+	if err := os.Remove(s.file.Name()); err != nil {
+		glog.Warningf("Failed to remove spool: %v", err)
+	}
+	s.file, s.readOff, s.writeOff, s.fileSamples = nil, 0, 0, 0
+}
+
+// discard accounts for d of audio dropped for reason; consecutive drops are
+// logged as one gap. s.lock must be held.
+func (s *spoolSink) discard(d time.Duration, reason string) {
+	if s.gap > 0 && reason != s.gapReason {
+		s.logGap()
+	}
+	s.gap += d
+	s.gapReason = reason
+}
+
+// logGap logs the gap of discarded audio, if any, in the output and the
+// journal. s.lock must be held.
+func (s *spoolSink) logGap() {
+	if s.gap == 0 {
+		return
+	}
+	glog.Warningf("--- audio output gap: discarded %s (%s) ---", s.gap, s.gapReason)
+	journal.Record(JournalCommand, 0, "", fmt.Sprintf("audio output gap of %s: %s", s.gap, s.gapReason))
+	s.gap, s.gapReason = 0, ""
+}
+
+func samplesDuration(n int) time.Duration {
+	return time.Duration(n) * time.Second / sampleRate
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// ConnStats counts the frames and bytes exchanged over the websocket and holds
+// the quality of the connection.
+type ConnStats struct {
+	FramesSent     uint64 `json:"frames_sent"`
+	BytesSent      uint64 `json:"bytes_sent"`
+	FramesReceived uint64 `json:"frames_received"`
+	BytesReceived  uint64 `json:"bytes_received"`
+	NetworkQuality
+}
+
+// SessionStats is a snapshot of the session handed to a StatsReporter.
+// Shutdown, why the dialog ended, is only set in the final report. Shutdowns
+// counts the dialogs ended so far by ShutdownKind name.
+type SessionStats struct {
+	SessionID      string            `json:"session_id"`
+	DialogID       string            `json:"dialog_id"`
+	State          string            `json:"state"`
+	Shutdown       string            `json:"shutdown,omitempty"`
+	Shutdowns      map[string]uint64 `json:"shutdowns,omitempty"`
+	Uptime         time.Duration     `json:"uptime"`
+	Turns          int               `json:"turns"`
+	TruncatedTurns int               `json:"truncated_turns"`
+	AbandonedTurns int               `json:"abandoned_turns"`
+	UserAudio      time.Duration     `json:"user_audio"`
+	BotAudio       time.Duration     `json:"bot_audio"`
+	ServerErrors   uint64            `json:"server_errors"`
+	AudioMemory    int64             `json:"audio_memory_bytes"`
+	DroppedSignals uint64            `json:"dropped_activity_signals"`
+	ConnStats
+	InboundSizes  HistogramSnapshot `json:"inbound_message_sizes"`
+	OutboundSizes HistogramSnapshot `json:"outbound_message_sizes"`
+	FrameSizes    HistogramSnapshot `json:"audio_frame_sizes"`
+	Bandwidth     []BandwidthStats  `json:"bandwidth"`
+}
+
+// sessionCounters holds the counters updated on the hot paths.
+type sessionCounters struct {
+	start          time.Time
+	framesSent     atomic.Uint64
+	bytesSent      atomic.Uint64
+	framesReceived atomic.Uint64
+	bytesReceived  atomic.Uint64
+	serverErrors   atomic.Uint64
+	// userSamples counts the input audio samples sent.
+	userSamples atomic.Uint64
+	// auditRejections counts the user queries the server rejected in its
+	// audit.
+	auditRejections atomic.Uint64
+}
+
+var counters = &sessionCounters{start: time.Now()}
+
+// collectStats takes a snapshot of the session statistics.
+func collectStats(sessionID string) SessionStats {
+	stats := SessionStats{
+		SessionID:    sessionID,
+		DialogID:     dialogID,
+		State:        sessionState.State().String(),
+		Uptime:       time.Since(counters.start),
+		UserAudio:    time.Duration(counters.userSamples.Load()) * time.Second / inputSampleRate,
+		ServerErrors: counters.serverErrors.Load(),
+		AudioMemory:  AudioMemoryUsage(),
+		ConnStats: ConnStats{
+			FramesSent:     counters.framesSent.Load(),
+			BytesSent:      counters.bytesSent.Load(),
+			FramesReceived: counters.framesReceived.Load(),
+			BytesReceived:  counters.bytesReceived.Load(),
+		},
+		InboundSizes:  messageSizes.Snapshot(DirectionInbound),
+		OutboundSizes: messageSizes.Snapshot(DirectionOutbound),
+		FrameSizes:    audioFrameSizes.snapshot(),
+		Bandwidth:     bandwidth.Snapshot(),
+		Shutdowns:     shutdownCounts.Snapshot(),
+	}
+	stats.DroppedSignals = queryChan.Dropped()
+	stats.NetworkQuality = netQuality.snapshot()
+	for _, turn := range turns.Transcript() {
+		stats.Turns++
+		stats.BotAudio += turn.BotAudio
+		if turn.Truncated {
+			stats.TruncatedTurns++
+		}
+		if turn.Abandoned != "" {
+			stats.AbandonedTurns++
+		}
+	}
+	return stats
+}
+
+// StatsReporter receives periodic session statistics.
+type StatsReporter interface {
+	Report(stats SessionStats)
+}
+
+// LogStatsReporter writes the statistics to the log.
+type LogStatsReporter struct{}
+
+// Report implements StatsReporter.
+func (LogStatsReporter) Report(stats SessionStats) {
+	glog.Infof("Session stats: session_id=%s dialog_id=%s state=%s uptime=%s turns=%d truncated_turns=%d abandoned_turns=%d bot_audio=%s server_errors=%d audio_memory=%d frames_sent=%d bytes_sent=%d frames_received=%d bytes_received=%d",
+		stats.SessionID, stats.DialogID, stats.State, stats.Uptime.Round(time.Millisecond), stats.Turns, stats.TruncatedTurns, stats.AbandonedTurns,
+		stats.BotAudio, stats.ServerErrors, stats.AudioMemory, stats.FramesSent, stats.BytesSent, stats.FramesReceived, stats.BytesReceived)
+	glog.Infof("Message sizes: inbound %v; outbound %v; audio frames %v", stats.InboundSizes, stats.OutboundSizes, stats.FrameSizes)
+}
+
+type jsonStatsReporter struct {
+	lock sync.Mutex
+	enc  *json.Encoder
+}
+
+// JSONStatsReporter returns a reporter writing each report to w as one JSON
+// line.
+func JSONStatsReporter(w io.Writer) StatsReporter {
+	return &jsonStatsReporter{enc: json.NewEncoder(w)}
+}
+
+func (r *jsonStatsReporter) Report(stats SessionStats) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if err := r.enc.Encode(stats); err != nil {
+		glog.Errorf("Failed to write JSON stats: %v", err)
+	}
+}
+
+type scheduledReporter struct {
+	reporter StatsReporter
+	interval time.Duration
+}
+
+var (
+	statsLock      sync.Mutex
+	statsReporters []scheduledReporter
+	// statsRescheduled is closed, and replaced, when SetStatsInterval changes
+	// the intervals.
+	statsRescheduled = make(chan struct{})
+)
+
+// WithStatsReporter registers r to receive the session statistics every
+// interval while the dialog runs.
+func WithStatsReporter(r StatsReporter, interval time.Duration) {
+	statsLock.Lock()
+	defer statsLock.Unlock()
+	statsReporters = append(statsReporters, scheduledReporter{reporter: r, interval: interval})
+}
+
+// SetStatsInterval changes the interval of every registered reporter, also
+// while the dialog runs; 0 stops the periodic reports.
+func SetStatsInterval(interval time.Duration) {
+	statsLock.Lock()
+	defer statsLock.Unlock()
+	for i := range statsReporters {
+		statsReporters[i].interval = interval
+	}
+	close(statsRescheduled)
+	statsRescheduled = make(chan struct{})
+}
+
+// registeredReporters returns the registered reporters.
+func registeredReporters() []scheduledReporter {
+	statsLock.Lock()
+	defer statsLock.Unlock()
+	return append([]scheduledReporter(nil), statsReporters...)
+}
+
+// statsSchedule returns the interval of reporter i and a channel closed when
+// it changes.
+func statsSchedule(i int) (time.Duration, <-chan struct{}) {
+	statsLock.Lock()
+	defer statsLock.Unlock()
+	return statsReporters[i].interval, statsRescheduled
+}
+
+// runStatsReporters reports to every registered reporter on its interval until
+// ctx is done.
+func runStatsReporters(ctx context.Context, sessionID string) {
+	for i, sr := range registeredReporters() {
+		go func(i int, r StatsReporter) {
+			ticker := time.NewTicker(time.Hour)
+			defer ticker.Stop()
+			for {
+				interval, rescheduled := statsSchedule(i)
+				if interval > 0 {
+					ticker.Reset(interval)
+				} else {
+					ticker.Stop()
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case <-rescheduled:
+				case <-ticker.C:
+					r.Report(collectStats(sessionID))
+				}
+			}
+		}(i, sr.reporter)
+	}
+}
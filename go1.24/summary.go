@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// DialogSummary totals a dialog for a quick post-mortem of the run.
+type DialogSummary struct {
+	SessionID string `json:"session_id"`
+	DialogID  string `json:"dialog_id"`
+	LogID     string `json:"logid"`
+	// DisconnectReason is why the dialog ended.
+	DisconnectReason string        `json:"disconnect_reason"`
+	Duration         time.Duration `json:"duration"`
+	TotalTurns       int           `json:"total_turns"`
+	BytesSent        uint64        `json:"bytes_sent"`
+	// BytesReceived, UserAudio and BotAudio count what went over the
+	// websocket, whether it was played or not.
+	BytesReceived uint64        `json:"bytes_received"`
+	UserAudio     time.Duration `json:"user_audio"`
+	BotAudio      time.Duration `json:"bot_audio"`
+	// DialogIDChanges counts the times the server assigned the session a new
+	// dialog ID, e.g. when it was started again on a new connection.
+	DialogIDChanges int    `json:"dialog_id_changes"`
+	ServerErrors    uint64 `json:"server_errors"`
+	AuditRejections uint64 `json:"audit_rejections"`
+}
+
+var (
+	// connLogID is the X-Tt-Logid of the connection the dialog runs on.
+	connLogID string
+
+	summaryLock sync.Mutex
+	lastSummary *DialogSummary
+)
+
+// summarize totals the final statistics of the dialog.
+func summarize(stats SessionStats) DialogSummary {
+	s := DialogSummary{
+		SessionID:        stats.SessionID,
+		DialogID:         stats.DialogID,
+		LogID:            connLogID,
+		DisconnectReason: stats.Shutdown,
+		Duration:         stats.Uptime,
+		TotalTurns:       stats.Turns,
+		BytesSent:        stats.BytesSent,
+		BytesReceived:    stats.BytesReceived,
+		UserAudio:        stats.UserAudio,
+		BotAudio:         stats.BotAudio,
+		ServerErrors:     stats.ServerErrors,
+		AuditRejections:  counters.auditRejections.Load(),
+	}
+	if ids := PreviousDialogIDs(stats.SessionID); len(ids) > 1 {
+		s.DialogIDChanges = len(ids) - 1
+	}
+	return s
+}
+
+// SessionSummary returns the summary of the last dialog that ended, or false
+// while none has.
+func SessionSummary() (DialogSummary, bool) {
+	summaryLock.Lock()
+	defer summaryLock.Unlock()
+	if lastSummary == nil {
+		return DialogSummary{}, false
+	}
+	return *lastSummary, true
+}
+
+// setSessionSummary keeps s as the summary of the last dialog.
+func setSessionSummary(s DialogSummary) {
+	summaryLock.Lock()
+	defer summaryLock.Unlock()
+	lastSummary = &s
+}
+
+// writeSessionSummary prints s as a small table.
+func writeSessionSummary(w io.Writer, s DialogSummary) error {
+	_, err := fmt.Fprintf(w, `Session summary:
+  session ID        %s
+  dialog ID         %s
+  logid             %s
+  ended             %s
+  duration          %s
+  turns             %d
+  bytes sent        %d
+  bytes received    %d
+  user audio sent   %s
+  bot audio         %s
+  dialog ID changes %d
+  server errors     %d
+  audit rejections  %d
+`, s.SessionID, s.DialogID, s.LogID, s.DisconnectReason, s.Duration.Round(time.Millisecond), s.TotalTurns, s.BytesSent, s.BytesReceived,
+		s.UserAudio.Round(time.Millisecond), s.BotAudio.Round(time.Millisecond), s.DialogIDChanges, s.ServerErrors, s.AuditRejections)
+	return err
+}
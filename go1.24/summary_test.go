@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestSessionSummary runs a scripted dialog on a file input and checks that
+// its summary totals what happened: the turns, the audio sent and received
+// and the bytes over the websocket.
+func TestSessionSummary(t *testing.T) {
+	const frames = 3
+	received := make(chan int, 1)
+	s := newFakeServer(t, func(c *fakeConn) {
+		var samples int
+		defer func() { received <- samples }()
+		sid := c.handshake("dialog-1")
+		if c.expect(300) == nil {
+			return
+		}
+		c.answer(sid, "你好", 2400)
+		for {
+			msg := c.read()
+			if msg == nil {
+				return
+			}
+			if msg.Type == MsgTypeAudioOnlyClient {
+				samples += len(msg.Payload) / 2
+			}
+			if msg.TypeFlag()&msgTypeFlagSequenceMask == MsgTypeFlagLastNoSeq {
+				break
+			}
+		}
+		c.userTurn(sid, "今天天气怎么样")
+		c.answer(sid, "晴天", 4800)
+		c.finish(sid)
+	})
+	setupDialog(t, s)
+	src := &MemorySource{}
+	for i := range frames {
+		src.Frames = append(src.Frames, toneSamples(inputFramesPerBuffer, int16(1000*(i+1))))
+	}
+	WithAudioSource(src)
+
+	summary, err := runFakeDialog(t)
+	if err != nil {
+		t.Fatalf("realTimeDialog() = %v, want nil once the input ended", err)
+	}
+	if got, ok := SessionSummary(); !ok || got != *summary {
+		t.Errorf("SessionSummary() = %+v, %v, want what realTimeDialog returned", got, ok)
+	}
+	if summary.SessionID != "session-1" || summary.DialogID != "dialog-1" || summary.TotalTurns != 2 || summary.DialogIDChanges != 0 {
+		t.Errorf("summary = %+v, want 2 turns of session-1 on dialog-1", summary)
+	}
+	if want := time.Duration(<-received) * time.Second / inputSampleRate; summary.UserAudio != want || want == 0 {
+		t.Errorf("summary.UserAudio = %v, want the %v the server received", summary.UserAudio, want)
+	}
+	if want := samplesDuration(2400 + 4800); summary.BotAudio != want {
+		t.Errorf("summary.BotAudio = %v, want %v", summary.BotAudio, want)
+	}
+	if summary.BytesSent == 0 || summary.BytesReceived == 0 || summary.Duration <= 0 {
+		t.Errorf("summary = %+v, want the bytes and the duration of the dialog", summary)
+	}
+
+	var out bytes.Buffer
+	if err := writeSessionSummary(&out, *summary); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"dialog ID         dialog-1", "turns             2", "dialog ID changes 0"} {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("summary table lacks %q:\n%s", line, out.String())
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"io"
+	"os"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// wireTap copies frames to a writer for protocol debugging. A failing writer
+// is reported once and then left alone, so a tap can never break the dialog.
+type wireTap struct {
+	lock   sync.Mutex
+	w      io.Writer
+	failed bool
+}
+
+var (
+	writeTap = &wireTap{}
+	readTap  = &wireTap{}
+)
+
+// WithWriteTap copies every binary protocol frame written to the websocket,
+// headers included, to w. The frames are concatenated as sent and can be
+// decoded again with an IncrementalDecoder.
+func WithWriteTap(w io.Writer) {
+	writeTap.set(w)
+}
+
+// WithReadTap copies every binary protocol frame read from the websocket,
+// headers included, to w.
+func WithReadTap(w io.Writer) {
+	readTap.set(w)
+}
+
+func (t *wireTap) set(w io.Writer) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.w = w
+	t.failed = false
+}
+
+func (t *wireTap) tap(frame []byte) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.w == nil || t.failed {
+		return
+	}
+	if _, err := t.w.Write(frame); err != nil {
+		glog.Errorf("Wire tap write failed, tap disabled: %v", err)
+		t.failed = true
+	}
+}
+
+// createTapFile creates the file a -write-tap or -read-tap copies frames to.
+func createTapFile(path string) *os.File {
+	f, err := os.Create(path)
+	if err != nil {
+		glog.Exitf("Create tap file: %v", err)
+	}
+	return f
+}
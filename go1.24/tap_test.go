@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+// TestWireTaps checks that the taps see exactly the bytes of the websocket
+// messages exchanged.
+func TestWireTaps(t *testing.T) {
+	serverFrames := [][]byte{
+		serverFrame(50, "conn-1", `{}`),
+		serverAudio("session-1", []float32{0.5, -0.5}),
+	}
+	sent := make(chan []byte, 2)
+	s := newFakeServer(t, func(c *fakeConn) {
+		for _, frame := range serverFrames {
+			_, data, err := c.conn.ReadMessage()
+			if err != nil {
+				c.t.Errorf("fake server: read: %v", err)
+				return
+			}
+			sent <- data
+			c.send(frame)
+		}
+	})
+	setupDialog(t, s)
+	var writeCopy, readCopy bytes.Buffer
+	WithWriteTap(&writeCopy)
+	WithReadTap(&readCopy)
+	t.Cleanup(func() {
+		WithWriteTap(nil)
+		WithReadTap(nil)
+	})
+
+	conn := dialFake(t)
+	if err := startConnection(context.Background(), conn); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendAudioFrame(conn, "session-1", []int16{1, 2, 3}, MsgTypeFlagWithEvent); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := receiveMessage(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := append(<-sent, <-sent...); !bytes.Equal(writeCopy.Bytes(), want) {
+		t.Errorf("write tap = % x\nwant the bytes sent % x", writeCopy.Bytes(), want)
+	}
+	if want := bytes.Join(serverFrames, nil); !bytes.Equal(readCopy.Bytes(), want) {
+		t.Errorf("read tap = % x\nwant the bytes received % x", readCopy.Bytes(), want)
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import "time"
+
+// recordTrimHangover is how much of a trailing silence is kept, so that quiet
+// speech endings below the threshold are not cut off.
+const recordTrimHangover = 300 * time.Millisecond
+
+// recordTrimThreshold is the amplitude at or below which trailing audio of a
+// recording counts as silence; 0 disables trimming.
+var recordTrimThreshold int16
+
+// WithRecordTrimTrailingSilence trims the trailing silence of recorded bot
+// answers, i.e. the file output and the saved -ask answer, down to
+// recordTrimHangover. Samples with an amplitude at or below threshold count
+// as silence. Live playback is never trimmed. 0 disables trimming.
+func WithRecordTrimTrailingSilence(threshold int16) {
+	recordTrimThreshold = threshold
+}
+
+// loudEnd returns the index after the last sample of samples louder than
+// threshold, or 0 if there is none.
+func loudEnd(samples []int16, threshold int16) int {
+	for i := len(samples) - 1; i >= 0; i-- {
+		if v := int(samples[i]); v > int(threshold) || -v > int(threshold) {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// trimTrailingSilence returns samples without the trailing silence beyond
+// recordTrimHangover.
+func trimTrailingSilence(samples []int16, threshold int16) []int16 {
+	end := loudEnd(samples, threshold) + int(recordTrimHangover.Seconds()*sampleRate)
+	return samples[:min(len(samples), end)]
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// toneSamples returns n samples alternating between amplitude and -amplitude.
+func toneSamples(n int, amplitude int16) []int16 {
+	samples := make([]int16, n)
+	for i := range samples {
+		samples[i] = amplitude
+		if i%2 == 1 {
+			samples[i] = -amplitude
+		}
+	}
+	return samples
+}
+
+func TestTrimTrailingSilence(t *testing.T) {
+	hangover := int(recordTrimHangover.Seconds() * sampleRate)
+	for _, tc := range []struct {
+		name    string
+		samples []int16
+		want    int
+	}{
+		{"tone then silence", append(toneSamples(1000, 8000), make([]int16, 2*hangover)...), 1000 + hangover},
+		{"quiet ending", append(append(toneSamples(1000, 8000), toneSamples(500, 200)...), make([]int16, 2*hangover)...), 1500 + hangover},
+		{"short silence", append(toneSamples(1000, 8000), make([]int16, hangover/2)...), 1000 + hangover/2},
+		{"silence only", make([]int16, 2*hangover), hangover},
+	} {
+		got := trimTrailingSilence(tc.samples, 100)
+		if len(got) != tc.want {
+			t.Errorf("%s: trimmed to %d samples, want %d", tc.name, len(got), tc.want)
+		}
+	}
+}
+
+// TestFileSinkTrim checks that a file sink trims the silence ending each
+// answer, but not the silence within it, and that a pipe sink trims nothing.
+func TestFileSinkTrim(t *testing.T) {
+	WithRecordTrimTrailingSilence(100)
+	t.Cleanup(func() { WithRecordTrimTrailingSilence(0) })
+	hangover := int(recordTrimHangover.Seconds() * sampleRate)
+	answer := [][]int16{toneSamples(1000, 8000), make([]int16, 2*hangover), toneSamples(1000, 8000), make([]int16, 2*hangover)}
+
+	path := filepath.Join(t.TempDir(), "out.pcm")
+	sink, err := NewFileSink(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 2 {
+		for _, frame := range answer {
+			if err := sink.WriteFrame(frame); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := sink.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(data)/2, 2*(1000+2*hangover+1000+hangover); got != want {
+		t.Errorf("file sink wrote %d samples, want %d", got, want)
+	}
+
+	var pipe bytes.Buffer
+	sink = NewPipeSink(&pipe)
+	for _, frame := range answer {
+		if err := sink.WriteFrame(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := pipe.Len()/2, 2*(1000+2*hangover); got != want {
+		t.Errorf("pipe sink wrote %d samples, want all %d", got, want)
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Turn records one exchange of the dialog: what the user said and how the bot
+// answered.
+type Turn struct {
+	ID        int           `json:"id"`
+	UserText  string        `json:"user_text,omitempty"`
+	BotText   string        `json:"bot_text,omitempty"`
+	Sentences int           `json:"sentences"`
+	BotAudio  time.Duration `json:"bot_audio"`
+	// Truncated reports that the client cut the bot's answer short.
+	Truncated bool `json:"truncated,omitempty"`
+	// Abandoned is the reason given to AbandonTurn, if the turn was abandoned.
+	Abandoned string `json:"abandoned,omitempty"`
+	// FirstByteLatency is the time from the end of the user's speech
+	// (ASREnded) to the first bot audio after it, if both happened.
+	FirstByteLatency time.Duration `json:"first_byte_latency,omitempty"`
+	// Source is the audio input the turn started on, when it can be switched
+	// with -commands.
+	Source string `json:"source,omitempty"`
+}
+
+// turnTracker accumulates the current turn from server events and keeps the
+// transcript of finished turns. It is safe for concurrent use.
+type turnTracker struct {
+	lock      sync.Mutex
+	current   *Turn
+	dropAudio bool
+	// abandoned is set from AbandonTurn until the abandoned answer ends or
+	// the user speaks again; bot events in between are ignored.
+	abandoned bool
+	done      []Turn
+	nextID    int
+	source    string
+	// answered is closed when the next turn with user text finishes.
+	answered chan struct{}
+}
+
+var turns = &turnTracker{}
+
+// turn returns the current turn, starting one if needed. t.lock must be held.
+func (t *turnTracker) turn() *Turn {
+	if t.current == nil {
+		t.nextID++
+		t.current = &Turn{ID: t.nextID, Source: t.source}
+	}
+	return t.current
+}
+
+// finishLocked moves the current turn to the transcript. t.lock must be held.
+func (t *turnTracker) finishLocked() (Turn, bool) {
+	if t.current == nil {
+		return Turn{}, false
+	}
+	turn := *t.current
+	turn.FirstByteLatency, _ = firstByte.endTurn()
+	t.done = append(t.done, turn)
+	t.current = nil
+	t.dropAudio = false
+	if t.answered != nil && turn.UserText != "" {
+		close(t.answered)
+		t.answered = nil
+	}
+	return turn, true
+}
+
+// userStarted is called when the user starts speaking. A turn the bot already
+// answered (the user barged in) is finished first.
+func (t *turnTracker) userStarted() (Turn, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.abandoned = false
+	if t.current != nil && (t.current.Sentences > 0 || t.current.BotAudio > 0) {
+		return t.finishLocked()
+	}
+	return Turn{}, false
+}
+
+// begin finishes the turn in progress, if any, and starts a new turn with
+// userText, returning the finished turn and the ID of the new one. It is used
+// when the client starts a turn itself, e.g. with AskTurn.
+func (t *turnTracker) begin(userText string) (finished Turn, ok bool, id int) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	finished, ok = t.finishLocked()
+	t.abandoned = false
+	turn := t.turn()
+	turn.UserText = userText
+	return finished, ok, turn.ID
+}
+
+// userText sets the recognized user text of the current turn.
+func (t *turnTracker) userText(text string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.turn().UserText = text
+}
+
+// botText appends text of the bot answer to the current turn.
+func (t *turnTracker) botText(text string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.abandoned {
+		return
+	}
+	t.turn().BotText += text
+}
+
+// sentenceStarted counts a TTS sentence and returns the sentences so far.
+func (t *turnTracker) sentenceStarted() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.abandoned {
+		return 0
+	}
+	turn := t.turn()
+	turn.Sentences++
+	return turn.Sentences
+}
+
+// botAudio adds d of received TTS audio to the current turn and returns the
+// total. Audio received after the turn was truncated is not counted.
+func (t *turnTracker) botAudio(d time.Duration) time.Duration {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.abandoned {
+		return 0
+	}
+	turn := t.turn()
+	if !turn.Truncated {
+		turn.BotAudio += d
+	}
+	return turn.BotAudio
+}
+
+// truncate marks the current turn as truncated and starts dropping its audio.
+// It reports false if the turn was already truncated.
+func (t *turnTracker) truncate() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	turn := t.turn()
+	if turn.Truncated {
+		return false
+	}
+	turn.Truncated = true
+	t.dropAudio = true
+	return true
+}
+
+// droppingAudio reports whether audio of the current turn should be discarded.
+func (t *turnTracker) droppingAudio() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.dropAudio || t.abandoned
+}
+
+// botAnswering reports whether the bot is in the middle of an answer: the
+// current turn has bot sentences or audio and has not ended.
+func (t *turnTracker) botAnswering() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.current != nil && !t.abandoned && (t.current.Sentences > 0 || t.current.BotAudio > 0)
+}
+
+// currentUserText returns the recognized user text of the current turn.
+func (t *turnTracker) currentUserText() string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.current == nil {
+		return ""
+	}
+	return t.current.UserText
+}
+
+// currentID returns the ID of the current turn, or 0 if none is in progress.
+func (t *turnTracker) currentID() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.current == nil {
+		return 0
+	}
+	return t.current.ID
+}
+
+// answeringTurn returns the ID of the current turn once the bot started a
+// sentence in it, or 0.
+func (t *turnTracker) answeringTurn() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.current == nil || t.current.Sentences == 0 {
+		return 0
+	}
+	return t.current.ID
+}
+
+// nextAnswer returns a channel closed when the next turn with user text
+// finishes and whether such a turn is in progress.
+func (t *turnTracker) nextAnswer() (<-chan struct{}, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.answered == nil {
+		t.answered = make(chan struct{})
+	}
+	return t.answered, t.current != nil && t.current.UserText != ""
+}
+
+// resumeAudio stops discarding audio, e.g. to play a wrap-up line.
+func (t *turnTracker) resumeAudio() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.dropAudio = false
+}
+
+// finish ends the current turn and returns it. The end of an abandoned
+// answer only stops ignoring bot events, the turn is already in the
+// transcript.
+func (t *turnTracker) finish() (Turn, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.abandoned {
+		t.abandoned = false
+		return Turn{}, false
+	}
+	return t.finishLocked()
+}
+
+// abandon finishes the turn in progress as abandoned for reason and ignores
+// the rest of its answer. It reports false if no turn is in progress.
+func (t *turnTracker) abandon(reason string) (Turn, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.current == nil {
+		return Turn{}, false
+	}
+	t.current.Abandoned = reason
+	turn, ok := t.finishLocked()
+	t.abandoned = true
+	return turn, ok
+}
+
+// sourceChanged notes that the audio input switched to source; turns started
+// from now on record it.
+func (t *turnTracker) sourceChanged(source string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.source = source
+}
+
+// Transcript returns the finished turns in order.
+func (t *turnTracker) Transcript() []Turn {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return append([]Turn(nil), t.done...)
+}
@@ -0,0 +1,27 @@
+package main
+
+// TurnDetector decides from the server messages when the bot finished its
+// turn, so that the turn logic does not depend on the shape of one event.
+// The receive loop calls it with every message it receives, in order.
+type TurnDetector interface {
+	TurnComplete(msg *Message) bool
+}
+
+// EventTurnDetector completes the turn on a server event, by default
+// TTSEnded (359) as documented.
+type EventTurnDetector struct {
+	Event int32
+}
+
+// TurnComplete implements TurnDetector.
+func (d EventTurnDetector) TurnComplete(msg *Message) bool {
+	return msg.Type == MsgTypeFullServer && msg.Event == d.Event
+}
+
+var turnDetector TurnDetector = EventTurnDetector{Event: 359}
+
+// WithTurnDetector makes d decide when the bot finished a turn, in the dialog
+// and in one-shot answers.
+func WithTurnDetector(d TurnDetector) {
+	turnDetector = d
+}
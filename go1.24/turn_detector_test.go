@@ -0,0 +1,62 @@
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+// sentenceTurnDetector completes the turn on TTSSentenceEnd, as a server
+// without TTSEnded would need, and records the events it was given.
+type sentenceTurnDetector struct {
+	lock   sync.Mutex
+	events []int32
+}
+
+func (d *sentenceTurnDetector) TurnComplete(msg *Message) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.events = append(d.events, msg.Event)
+	return msg.Type == MsgTypeFullServer && msg.Event == 351
+}
+
+// TestWithTurnDetector swaps in a detector completing the turns on an event
+// the default one ignores and checks that the turns finish on it.
+func TestWithTurnDetector(t *testing.T) {
+	s := newFakeServer(t, scriptedDialog(func(c *fakeConn, sid string) {
+		for _, text := range []string{"你好", "晴天"} {
+			c.send(serverFrame(350, sid, `{"tts_type":"default"}`))
+			c.send(serverFrame(550, sid, `{"content":"`+text+`"}`))
+			c.send(serverAudio(sid, make([]float32, 2400)))
+			c.send(serverFrame(351, sid, `{}`))
+			if text == "你好" {
+				c.userTurn(sid, "今天天气怎么样")
+			}
+		}
+	}))
+	setupDialog(t, s)
+	d := &sentenceTurnDetector{}
+	WithTurnDetector(d)
+	t.Cleanup(func() { WithTurnDetector(EventTurnDetector{Event: 359}) })
+
+	if _, err := runFakeDialog(t); err == nil {
+		t.Error("realTimeDialog() = nil, want the server ending the session")
+	}
+	transcript := turns.Transcript()
+	if len(transcript) != 2 {
+		t.Fatalf("transcript has %d turns, want 2: %+v", len(transcript), transcript)
+	}
+	if got := transcript[1]; got.UserText != "今天天气怎么样" || got.BotText != "晴天" {
+		t.Errorf("second turn = %+v, want 今天天气怎么样 answered with 晴天", got)
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	var sentenceEnds int
+	for _, event := range d.events {
+		if event == 351 {
+			sentenceEnds++
+		}
+	}
+	if sentenceEnds != 2 {
+		t.Errorf("detector saw %d TTSSentenceEnd events, want 2: %v", sentenceEnds, d.events)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	// utteranceRMSThreshold is the frame RMS above which input counts as
+	// speech for the minimum utterance check.
+	utteranceRMSThreshold = 500
+	// utteranceHangover is how long the input must stay quiet to end an
+	// utterance, so that short pauses between words do not split it.
+	utteranceHangover = 200 * time.Millisecond
+)
+
+// minUtteranceDuration is the shortest speech sent to the server; 0 disables
+// the check.
+var minUtteranceDuration time.Duration
+
+// WithMinUtteranceDuration discards speech shorter than d, e.g. key clicks or
+// coughs, by sending silence in its place so the server does not start a turn
+// for it. Input is delayed by up to d while an utterance is being confirmed.
+func WithMinUtteranceDuration(d time.Duration) {
+	minUtteranceDuration = d
+}
+
+type utteranceState int
+
+const (
+	utteranceIdle utteranceState = iota
+	utteranceCandidate
+	utteranceSpeech
+)
+
+// utteranceGate holds back frames that may start an utterance until it lasted
+// the minimum duration. The held frames are the pre-roll released once the
+// utterance is confirmed, or replaced by silence if it ends earlier. Every
+// frame pushed is eventually returned, so the uplink stream stays continuous.
+type utteranceGate struct {
+	min   time.Duration
+	state utteranceState
+	held  [][]int16
+	// speech is the loud audio of the candidate, quiet the trailing silence.
+	speech, quiet time.Duration
+}
+
+func newUtteranceGate(min time.Duration) *utteranceGate {
+	return &utteranceGate{min: min}
+}
+
+// push adds a frame and returns the frames ready to be sent.
+func (g *utteranceGate) push(samples []int16) [][]int16 {
+	if g.min <= 0 {
+		return [][]int16{samples}
+	}
+	d := time.Duration(len(samples)) * time.Second / inputSampleRate
+	loud := frameRMS(samples) >= utteranceRMSThreshold
+	if loud {
+		g.quiet = 0
+	} else {
+		g.quiet += d
+	}
+
+	switch g.state {
+	case utteranceIdle:
+		if !loud {
+			return [][]int16{samples}
+		}
+		g.state = utteranceCandidate
+		g.held = [][]int16{samples}
+		g.speech = d
+		return nil
+	case utteranceCandidate:
+		g.held = append(g.held, samples)
+		if loud {
+			g.speech += d
+		}
+		if g.speech >= g.min {
+			g.state = utteranceSpeech
+			return g.release(false)
+		}
+		if g.quiet >= utteranceHangover {
+			g.state = utteranceIdle
+			return g.release(true)
+		}
+		return nil
+	default:
+		if g.quiet >= utteranceHangover {
+			g.state = utteranceIdle
+		}
+		return [][]int16{samples}
+	}
+}
+
+// flush returns the held frames, silenced unless the utterance was
+// confirmed, e.g. when the input ends.
+func (g *utteranceGate) flush() [][]int16 {
+	silence := g.state == utteranceCandidate
+	g.state = utteranceIdle
+	return g.release(silence)
+}
+
+func (g *utteranceGate) release(silence bool) [][]int16 {
+	frames := g.held
+	g.held = nil
+	if silence {
+		for _, frame := range frames {
+			clear(frame)
+		}
+	}
+	return frames
+}
+
+// frameRMS returns the root mean square amplitude of samples.
+func frameRMS(samples []int16) float64 {
+	if len(samples) == 0 {
+		return 0
+	}
+	var sum float64
+	for _, s := range samples {
+		sum += float64(s) * float64(s)
+	}
+	return math.Sqrt(sum / float64(len(samples)))
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// tone returns a loud frame of inputFramesPerBuffer samples.
+func tone() []int16 {
+	frame := make([]int16, inputFramesPerBuffer)
+	for i := range frame {
+		frame[i] = 8000
+		if i%2 == 1 {
+			frame[i] = -8000
+		}
+	}
+	return frame
+}
+
+// pushAll pushes frames through g and returns the frames sent.
+func pushAll(g *utteranceGate, frames ...[]int16) [][]int16 {
+	var sent [][]int16
+	for _, f := range frames {
+		sent = append(sent, g.push(f)...)
+	}
+	return sent
+}
+
+func loudFrames(sent [][]int16) int {
+	n := 0
+	for _, f := range sent {
+		if frameRMS(f) >= utteranceRMSThreshold {
+			n++
+		}
+	}
+	return n
+}
+
+// silentFrames returns n silent frames.
+func silentFrames(n int) [][]int16 {
+	frames := make([][]int16, n)
+	for i := range frames {
+		frames[i] = make([]int16, inputFramesPerBuffer)
+	}
+	return frames
+}
+
+func TestUtteranceGateDropsShortSounds(t *testing.T) {
+	g := newUtteranceGate(250 * time.Millisecond)
+	// a 50ms click, then enough silence to end it
+	frames := [][]int16{tone(), tone(), tone(), tone(), tone()}
+	frames = append(frames, silentFrames(int(utteranceHangover/(10*time.Millisecond))+1)...)
+	sent := pushAll(g, frames...)
+	if len(sent) != len(frames) {
+		t.Errorf("sent %d frames, want all %d", len(sent), len(frames))
+	}
+	if n := loudFrames(sent); n != 0 {
+		t.Errorf("%d loud frames sent for a 50ms click, want 0", n)
+	}
+}
+
+func TestUtteranceGateSendsSpeech(t *testing.T) {
+	g := newUtteranceGate(100 * time.Millisecond)
+	var frames [][]int16
+	for range 30 { // 300ms of speech
+		frames = append(frames, tone())
+	}
+	sent := pushAll(g, frames...)
+	sent = append(sent, g.flush()...)
+	if n := loudFrames(sent); n != len(frames) {
+		t.Errorf("%d loud frames sent, want all %d including the pre-roll", n, len(frames))
+	}
+}
+
+func TestUtteranceGateDisabled(t *testing.T) {
+	g := newUtteranceGate(0)
+	if sent := pushAll(g, tone()); len(sent) != 1 || loudFrames(sent) != 1 {
+		t.Error("disabled gate held back a frame")
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// warmPingInterval is how often a warmed connection waiting for its
+	// session is pinged, so that proxies and the server do not close it as
+	// idle.
+	warmPingInterval = 15 * time.Second
+	// warmPingTimeout bounds writing one ping.
+	warmPingTimeout = 5 * time.Second
+)
+
+var errAlreadyWarm = errors.New("a warmed connection is already waiting")
+
+// warmConn is a connection dialed and started ahead of its session.
+type warmConn struct {
+	conn *websocket.Conn
+	resp *http.Response
+	stop chan struct{}
+	done chan struct{}
+}
+
+var (
+	warmLock sync.Mutex
+	warm     *warmConn
+	// cancelWarming aborts the Warmup in progress, nil if there is none.
+	cancelWarming context.CancelFunc
+)
+
+// Warmup dials the service and performs StartConnection ahead of the session,
+// so that the next dialog skips the dial, TLS and handshake cost and only
+// starts its session. The warmed connection is pinged until it is taken, and
+// closed by closeWarmConn if it never is.
+func Warmup(ctx context.Context) error {
+	warmLock.Lock()
+	if warm != nil || cancelWarming != nil {
+		warmLock.Unlock()
+		return errAlreadyWarm
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	cancelWarming = cancel
+	warmLock.Unlock()
+
+	// 拨号与握手期间不持有 warmLock，closeWarmConn 取消后无需等待拨号超时
+	start := time.Now()
+	conn, resp, err := dial(ctx)
+	if err == nil {
+		if err = startConnection(ctx, conn); err != nil {
+			_ = closeConn(conn)
+		}
+	}
+
+	warmLock.Lock()
+	defer warmLock.Unlock()
+	cancelWarming = nil
+	if err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		// 握手完成时 closeWarmConn 已被调用，连接不会再被取走
+		_ = closeConn(conn)
+		return err
+	}
+	glog.Infof("Connection warmed up in %s.", time.Since(start).Round(time.Millisecond))
+	warm = &warmConn{conn: conn, resp: resp, stop: make(chan struct{}), done: make(chan struct{})}
+	go warm.keepAlive()
+	return nil
+}
+
+// keepAlive pings c.conn until c.stop is closed.
+func (c *warmConn) keepAlive() {
+	defer close(c.done)
+	ticker := time.NewTicker(warmPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(warmPingTimeout)); err != nil {
+				glog.Warningf("Failed to ping warmed connection: %v", err)
+			}
+		}
+	}
+}
+
+// takeWarmConn hands over the connection of the last Warmup, on which
+// StartConnection already succeeded, or reports false if there is none.
+func takeWarmConn() (*websocket.Conn, *http.Response, bool) {
+	warmLock.Lock()
+	defer warmLock.Unlock()
+	if warm == nil {
+		return nil, nil, false
+	}
+	c := warm
+	warm = nil
+	close(c.stop)
+	<-c.done
+	return c.conn, c.resp, true
+}
+
+// closeWarmConn finishes and closes a warmed connection that was never taken,
+// and aborts a Warmup still in progress.
+func closeWarmConn() {
+	warmLock.Lock()
+	if cancelWarming != nil {
+		cancelWarming()
+	}
+	warmLock.Unlock()
+	conn, _, ok := takeWarmConn()
+	if !ok {
+		return
+	}
+	if err := finishConnection(conn); err != nil {
+		glog.Errorf("Failed to finish warmed connection: %v", err)
+	}
+	_ = closeConn(conn)
+}
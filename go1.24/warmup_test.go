@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+// TestWarmup checks that a session started after Warmup runs on the warmed
+// connection without dialing again.
+func TestWarmup(t *testing.T) {
+	events := make(chan []int32, 1)
+	s := newFakeServer(t, func(c *fakeConn) {
+		defer func() { events <- c.events }()
+		c.handshake("dialog-1")
+		for c.read() != nil {
+		}
+	})
+	setupDialog(t, nil)
+	d := s.Dialer()
+	WithDialer(d)
+	t.Cleanup(func() { WithDialer(nil) })
+
+	if err := Warmup(context.Background()); err != nil {
+		t.Fatalf("Warmup() = %v", err)
+	}
+	if err := Warmup(context.Background()); !errors.Is(err, errAlreadyWarm) {
+		t.Errorf("second Warmup() = %v, want errAlreadyWarm", err)
+	}
+	conn, _, started := takeWarmConn()
+	if !started {
+		t.Fatal("takeWarmConn() found no warmed connection")
+	}
+	if !connStarted(conn) {
+		t.Error("connStarted() = false for the warmed connection, want true")
+	}
+	if err := startSession(context.Background(), conn, "session-1", newStartSessionPayload()); err != nil {
+		t.Fatalf("startSession() on the warmed connection = %v", err)
+	}
+	_ = closeConn(conn)
+	if got := d.Dials.Load(); got != 1 {
+		t.Errorf("dialed %d times, want only the warmup dial", got)
+	}
+	if got, want := <-events, []int32{1, 100}; !slices.Equal(got, want) {
+		t.Errorf("server got events %v, want %v", got, want)
+	}
+}
+
+// TestCloseWarmConnDuringWarmup checks that closeWarmConn does not wait for a
+// Warmup stuck on a server that never answers StartConnection.
+func TestCloseWarmConnDuringWarmup(t *testing.T) {
+	dialed := make(chan struct{})
+	s := newFakeServer(t, func(c *fakeConn) {
+		close(dialed)
+		for c.read() != nil {
+		}
+	})
+	setupDialog(t, s)
+
+	warmed := make(chan error, 1)
+	go func() { warmed <- Warmup(context.Background()) }()
+	<-dialed
+	closed := make(chan struct{})
+	go func() {
+		closeWarmConn()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("closeWarmConn() waited for the warmup handshake")
+	}
+	if err := <-warmed; !errors.Is(err, context.Canceled) {
+		t.Errorf("Warmup() = %v, want context.Canceled", err)
+	}
+	if _, _, ok := takeWarmConn(); ok {
+		t.Error("the aborted warmup left a warmed connection")
+	}
+}
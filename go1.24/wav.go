@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+var errUnsupportedWAV = errors.New("unsupported WAV file")
+
+// writeWAV writes interleaved 16-bit PCM samples to path as a WAV file.
+func writeWAV(path string, samples []int16, sampleRate, channels int) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("create WAV file: %w", err)
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	if err := writeWAVHeader(w, len(samples), sampleRate, channels); err != nil {
+		return err
+	}
+	if _, err := w.Write(samplesToBytes(samples)); err != nil {
+		return fmt.Errorf("write WAV data: %w", err)
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("write WAV data: %w", err)
+	}
+	return f.Close()
+}
+
+// writeWAVHeader writes the header of a 16-bit PCM WAV file whose data of
+// samples samples, channels interleaved, follows.
+func writeWAVHeader(w io.Writer, samples, sampleRate, channels int) error {
+	dataSize := uint32(samples * 2)
+	header := []interface{}{
+		[4]byte{'R', 'I', 'F', 'F'},
+		36 + dataSize,
+		[4]byte{'W', 'A', 'V', 'E'},
+		[4]byte{'f', 'm', 't', ' '},
+		uint32(16),                        // fmt chunk size
+		uint16(1),                         // PCM
+		uint16(channels),                  // channels
+		uint32(sampleRate),                // sample rate
+		uint32(sampleRate * channels * 2), // byte rate
+		uint16(channels * 2),              // block align
+		uint16(16),                        // bits per sample
+		[4]byte{'d', 'a', 't', 'a'},
+		dataSize,
+	}
+	for _, v := range header {
+		if err := binary.Write(w, binary.LittleEndian, v); err != nil {
+			return fmt.Errorf("write WAV header: %w", err)
+		}
+	}
+	return nil
+}
+
+// readWAVHeader reads the chunks of a WAV file from r up to its audio data,
+// which must be 16-bit PCM with channels channels at sampleRate. Chunks other
+// than fmt and data, e.g. LIST, are skipped.
+func readWAVHeader(r io.Reader, sampleRate, channels int) error {
+	var riff struct {
+		ID   [4]byte
+		Size uint32
+		Type [4]byte
+	}
+	if err := binary.Read(r, binary.LittleEndian, &riff); err != nil {
+		return fmt.Errorf("read RIFF header: %w", err)
+	}
+	if string(riff.ID[:]) != "RIFF" || string(riff.Type[:]) != "WAVE" {
+		return fmt.Errorf("%w: not a RIFF WAVE file", errUnsupportedWAV)
+	}
+	var format bool
+	for {
+		var chunk struct {
+			ID   [4]byte
+			Size uint32
+		}
+		if err := binary.Read(r, binary.LittleEndian, &chunk); err != nil {
+			return fmt.Errorf("read WAV chunk header: %w", err)
+		}
+		switch string(chunk.ID[:]) {
+		case "fmt ":
+			var fmtChunk struct {
+				Format        uint16
+				Channels      uint16
+				SampleRate    uint32
+				ByteRate      uint32
+				BlockAlign    uint16
+				BitsPerSample uint16
+			}
+			if chunk.Size < 16 {
+				return fmt.Errorf("%w: fmt chunk of %d bytes", errUnsupportedWAV, chunk.Size)
+			}
+			if err := binary.Read(r, binary.LittleEndian, &fmtChunk); err != nil {
+				return fmt.Errorf("read WAV fmt chunk: %w", err)
+			}
+			if fmtChunk.Format != 1 || fmtChunk.BitsPerSample != 16 {
+				return fmt.Errorf("%w: format %d with %d bits per sample, want 16-bit PCM", errUnsupportedWAV, fmtChunk.Format, fmtChunk.BitsPerSample)
+			}
+			if int(fmtChunk.SampleRate) != sampleRate || int(fmtChunk.Channels) != channels {
+				return fmt.Errorf("%w: %dHz with %d channels, want %dHz with %d", errUnsupportedWAV, fmtChunk.SampleRate, fmtChunk.Channels, sampleRate, channels)
+			}
+			if err := skipChunk(r, chunk.Size-16); err != nil {
+				return err
+			}
+			format = true
+		case "data":
+			if !format {
+				return fmt.Errorf("%w: data chunk before the fmt chunk", errUnsupportedWAV)
+			}
+			return nil
+		default:
+			if err := skipChunk(r, chunk.Size); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// skipChunk skips the rest of a chunk of size bytes, which is padded to an
+// even size.
+func skipChunk(r io.Reader, size uint32) error {
+	if _, err := io.CopyN(io.Discard, r, int64(size)+int64(size%2)); err != nil {
+		return fmt.Errorf("skip WAV chunk: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+)
+
+// wavFile returns a WAV file of 16-bit PCM with the given rate and channels,
+// a LIST chunk before the data and data as audio.
+func wavFile(sampleRate, channels int, data []byte) []byte {
+	var b bytes.Buffer
+	b.WriteString("RIFF")
+	_ = binary.Write(&b, binary.LittleEndian, uint32(0))
+	b.WriteString("WAVEfmt ")
+	for _, v := range []any{
+		uint32(16), uint16(1), uint16(channels), uint32(sampleRate),
+		uint32(sampleRate * channels * 2), uint16(channels * 2), uint16(16),
+	} {
+		_ = binary.Write(&b, binary.LittleEndian, v)
+	}
+	b.WriteString("LIST")
+	_ = binary.Write(&b, binary.LittleEndian, uint32(3))
+	b.WriteString("abc\x00") // padded to an even size
+	b.WriteString("data")
+	_ = binary.Write(&b, binary.LittleEndian, uint32(len(data)))
+	b.Write(data)
+	return b.Bytes()
+}
+
+func TestReadWAVHeader(t *testing.T) {
+	r := bytes.NewReader(wavFile(inputSampleRate, 1, []byte{1, 2}))
+	if err := readWAVHeader(r, inputSampleRate, 1); err != nil {
+		t.Fatalf("readWAVHeader() = %v", err)
+	}
+	if rest, _ := io.ReadAll(r); !bytes.Equal(rest, []byte{1, 2}) {
+		t.Errorf("audio after the header = % x, want 01 02", rest)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		rate     int
+		channels int
+	}{
+		{"rate", 44100, 1},
+		{"channels", inputSampleRate, 2},
+	} {
+		err := readWAVHeader(bytes.NewReader(wavFile(tc.rate, tc.channels, nil)), inputSampleRate, 1)
+		if !errors.Is(err, errUnsupportedWAV) {
+			t.Errorf("readWAVHeader() of a file with other %s = %v, want errUnsupportedWAV", tc.name, err)
+		}
+	}
+}